@@ -54,6 +54,12 @@ type Header struct {
 	MixDigest   *common.Hash      `json:"mixHash"`
 	Nonce       *types.BlockNonce `json:"nonce"`
 	BaseFee     *hexutil.Big      `json:"baseFeePerGas" rlp:"optional"`
+	// The fields added by Shanghai and Cancun, they need to be set together with ParentBeaconRoot
+	// (EIP-4788) for the RLP of the header.
+	WithdrawalsHash  *common.Hash    `json:"withdrawalsRoot"`
+	BlobGasUsed      *hexutil.Uint64 `json:"blobGasUsed"`
+	ExcessBlobGas    *hexutil.Uint64 `json:"excessBlobGas"`
+	ParentBeaconRoot *common.Hash    `json:"parentBeaconBlockRoot"`
 	// transactions
 	Transactions []SendTxArgs `json:"transactions"`
 }
@@ -82,6 +88,16 @@ func (dec *Header) ToHeader() types.Header {
 	if dec.BaseFee != nil {
 		h.BaseFee = (*big.Int)(dec.BaseFee)
 	}
+	h.WithdrawalsHash = dec.WithdrawalsHash
+	if dec.BlobGasUsed != nil {
+		blobGasUsed := uint64(*dec.BlobGasUsed)
+		h.BlobGasUsed = &blobGasUsed
+	}
+	if dec.ExcessBlobGas != nil {
+		excessBlobGas := uint64(*dec.ExcessBlobGas)
+		h.ExcessBlobGas = &excessBlobGas
+	}
+	h.ParentBeaconRoot = dec.ParentBeaconRoot
 	return h
 }
 
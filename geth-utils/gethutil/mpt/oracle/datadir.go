@@ -0,0 +1,228 @@
+package oracle
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// localDb is the chain database of a geth datadir, see SetDatadir. When it is set, the blocks,
+// proofs and code are read from it instead of being fetched from NodeUrl.
+var localDb ethdb.Database
+
+// SetDatadir makes the oracle read from the geth datadir at path (the key-value store in
+// geth/chaindata together with its ancient store) instead of sending JSON-RPC requests to NodeUrl.
+// The proofs are built from the trie nodes stored by their hashes, the node thus needs to keep
+// the state with the hash-based scheme (and to be an archive node for the older blocks).
+// An empty path closes the datadir and switches back to JSON-RPC.
+func SetDatadir(path string) error {
+	if localDb != nil {
+		if err := localDb.Close(); err != nil {
+			return err
+		}
+		localDb = nil
+	}
+	if path == "" {
+		return nil
+	}
+
+	chaindata := filepath.Join(path, "geth", "chaindata")
+	db, err := rawdb.Open(rawdb.OpenOptions{
+		Directory:         chaindata,
+		AncientsDirectory: filepath.Join(chaindata, "ancient"),
+		Cache:             16,
+		Handles:           16,
+		ReadOnly:          true,
+	})
+	if err != nil {
+		return fmt.Errorf("opening datadir %s: %w", path, err)
+	}
+	localDb = db
+
+	return nil
+}
+
+// readLocalHeader returns the header of the canonical block with the given number.
+func readLocalHeader(blockNumber *big.Int) (*types.Header, error) {
+	n := blockNumber.Uint64()
+	hash := rawdb.ReadCanonicalHash(localDb, n)
+	if hash == (common.Hash{}) {
+		return nil, fmt.Errorf("block %d not found in datadir", n)
+	}
+	header := rawdb.ReadHeader(localDb, hash, n)
+	if header == nil {
+		return nil, fmt.Errorf("header of block %d not found in datadir", n)
+	}
+
+	return header, nil
+}
+
+// readLocalBlock returns the header and the transactions of the canonical block with the given number.
+func readLocalBlock(blockNumber *big.Int) (types.Header, []*types.Transaction) {
+	header, err := readLocalHeader(blockNumber)
+	checkFetch(err)
+	var txs []*types.Transaction
+	if body := rawdb.ReadBody(localDb, header.Hash(), header.Number.Uint64()); body != nil {
+		txs = body.Transactions
+	}
+
+	return *header, txs
+}
+
+// getLocalProofAccount is getProofAccount reading the trie nodes from the datadir. The proof has the same
+// format as the eth_getProof response: the hex encoded nodes on the path to the key that are referenced
+// by their hashes (the nodes inlined in their parent are not proof elements).
+func getLocalProofAccount(blockNumber *big.Int, addr common.Address, skey common.Hash, storage bool) []string {
+	header, err := readLocalHeader(blockNumber)
+	checkFetch(err)
+
+	accountProof, leaf, err := walkProof(header.Root, crypto.Keccak256(addr.Bytes()), readLocalNode)
+	checkFetch(err)
+	if !storage {
+		return accountProof
+	}
+	if leaf == nil {
+		// No account, no storage.
+		return []string{}
+	}
+
+	var account Account
+	checkFetch(rlp.DecodeBytes(leaf, &account))
+	storageProof, _, err := walkProof(account.Root, crypto.Keccak256(skey.Bytes()), readLocalNode)
+	checkFetch(err)
+
+	return storageProof
+}
+
+// getLocalCode returns the code of the account with the given address hash.
+func getLocalCode(blockNumber *big.Int, addrHash common.Hash) []byte {
+	header, err := readLocalHeader(blockNumber)
+	checkFetch(err)
+	_, leaf, err := walkProof(header.Root, addrHash.Bytes(), readLocalNode)
+	checkFetch(err)
+	if leaf == nil {
+		return nil
+	}
+
+	var account Account
+	checkFetch(rlp.DecodeBytes(leaf, &account))
+
+	return rawdb.ReadCode(localDb, common.BytesToHash(account.CodeHash))
+}
+
+// readLocalNode returns the trie node with the given hash from the datadir.
+func readLocalNode(hash common.Hash) []byte {
+	return rawdb.ReadLegacyTrieNode(localDb, hash)
+}
+
+// walkProof walks the trie with the given root to the key and returns the proof and the value
+// of the leaf (nil when there is no leaf with this key). The nodes referenced by their hashes
+// are obtained by readNode.
+func walkProof(root common.Hash, key []byte, readNode func(hash common.Hash) []byte) ([]string, []byte, error) {
+	var proof []string
+	if root == types.EmptyRootHash {
+		return proof, nil, nil
+	}
+
+	nibbles := make([]byte, 2*len(key))
+	for i, b := range key {
+		nibbles[2*i], nibbles[2*i+1] = b/16, b%16
+	}
+
+	ref, isHash := root.Bytes(), true
+	for {
+		node := ref
+		if isHash {
+			node = readNode(common.BytesToHash(ref))
+			if node == nil {
+				return nil, nil, fmt.Errorf("trie node %x not found", ref)
+			}
+			proof = append(proof, hexutil.Encode(node))
+		}
+
+		elems, _, err := rlp.SplitList(node)
+		if err != nil {
+			return nil, nil, err
+		}
+		count, err := rlp.CountValues(elems)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var child []byte
+		switch count {
+		case 17:
+			if len(nibbles) == 0 {
+				return proof, nil, nil
+			}
+			rest := elems
+			for i := byte(0); i <= nibbles[0]; i++ {
+				_, _, rest, err = rlp.Split(rest)
+				if err != nil {
+					return nil, nil, err
+				}
+				child = elems[:len(elems)-len(rest)]
+				elems = rest
+			}
+			nibbles = nibbles[1:]
+		case 2:
+			compact, rest, err := rlp.SplitString(elems)
+			if err != nil {
+				return nil, nil, err
+			}
+			path, isLeaf := compactToNibbles(compact)
+			if !bytes.HasPrefix(nibbles, path) || isLeaf && len(path) != len(nibbles) {
+				// The trie does not contain the key.
+				return proof, nil, nil
+			}
+			if isLeaf {
+				value, _, err := rlp.SplitString(rest)
+				return proof, value, err
+			}
+			nibbles = nibbles[len(path):]
+			child = rest
+		default:
+			return nil, nil, errors.New("invalid number of trie node elements")
+		}
+
+		kind, content, _, err := rlp.Split(child)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case kind == rlp.List: // node inlined in its parent
+			ref, isHash = child, false
+		case len(content) == common.HashLength:
+			ref, isHash = content, true
+		default: // empty child
+			return proof, nil, nil
+		}
+	}
+}
+
+// compactToNibbles decodes the compact (hex-prefix) encoded path of a leaf or extension node.
+func compactToNibbles(compact []byte) ([]byte, bool) {
+	if len(compact) == 0 {
+		return nil, false
+	}
+	isLeaf := compact[0]>>4 >= 2
+	var nibbles []byte
+	if compact[0]>>4&1 == 1 { // odd number of nibbles, the first one is in the flag byte
+		nibbles = append(nibbles, compact[0]&0x0f)
+	}
+	for _, b := range compact[1:] {
+		nibbles = append(nibbles, b>>4, b&0x0f)
+	}
+
+	return nibbles, isLeaf
+}
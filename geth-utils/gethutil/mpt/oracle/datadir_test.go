@@ -0,0 +1,128 @@
+package oracle
+
+import (
+	"bytes"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// datadirFixture is the content of the datadir created by writeDatadirFixture: the state trie
+// and the storage trie consist of a single leaf.
+type datadirFixture struct {
+	dir                      string
+	stateRoot                common.Hash
+	accountLeaf, storageLeaf []byte
+	code                     []byte
+}
+
+// shortLeaf returns the RLP of the leaf with the whole (hashed) key in the leaf.
+func shortLeaf(t *testing.T, hashedKey, value []byte) []byte {
+	leaf, err := rlp.EncodeToBytes([][]byte{append([]byte{0x20}, hashedKey...), value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+// writeDatadirFixture creates a geth datadir (key-value store and an empty ancient store) with
+// blocks 0 and 1 having the state with the account at addr which has value stored at key.
+func writeDatadirFixture(t *testing.T, addr common.Address, key, value common.Hash) datadirFixture {
+	f := datadirFixture{dir: t.TempDir(), code: []byte{0x60, 0x00, 0x60, 0x00, 0xf3}}
+	chaindata := filepath.Join(f.dir, "geth", "chaindata")
+	db, err := rawdb.Open(rawdb.OpenOptions{
+		Directory:         chaindata,
+		AncientsDirectory: filepath.Join(chaindata, "ancient"),
+		Cache:             16,
+		Handles:           16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storageValue, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(value.Bytes()))
+	f.storageLeaf = shortLeaf(t, crypto.Keccak256(key.Bytes()), storageValue)
+	storageRoot := crypto.Keccak256Hash(f.storageLeaf)
+	rawdb.WriteLegacyTrieNode(db, storageRoot, f.storageLeaf)
+
+	codeHash := crypto.Keccak256Hash(f.code)
+	rawdb.WriteCode(db, codeHash, f.code)
+
+	account, _ := rlp.EncodeToBytes(Account{
+		Nonce:    1,
+		Balance:  big.NewInt(7),
+		Root:     storageRoot,
+		CodeHash: codeHash.Bytes(),
+	})
+	f.accountLeaf = shortLeaf(t, crypto.Keccak256(addr.Bytes()), account)
+	f.stateRoot = crypto.Keccak256Hash(f.accountLeaf)
+	rawdb.WriteLegacyTrieNode(db, f.stateRoot, f.accountLeaf)
+
+	for n := uint64(0); n < 2; n++ {
+		header := &types.Header{Number: new(big.Int).SetUint64(n), Root: f.stateRoot, Difficulty: big.NewInt(0)}
+		rawdb.WriteHeader(db, header)
+		rawdb.WriteCanonicalHash(db, header.Hash(), n)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestSetDatadir(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	f := writeDatadirFixture(t, addr, key, common.HexToHash("0x17"))
+
+	if err := SetDatadir(f.dir); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDatadir("")
+	calls := APICalls()
+
+	blockNumber := big.NewInt(1)
+	header := PrefetchBlock(blockNumber, true, nil)
+	if header.Root != f.stateRoot {
+		t.Fatalf("state root: got %x, want %x", header.Root, f.stateRoot)
+	}
+
+	accountProof := PrefetchAccount(blockNumber, addr, nil)
+	if len(accountProof) != 1 || accountProof[0] != hexutil.Encode(f.accountLeaf) {
+		t.Fatalf("wrong account proof %v", accountProof)
+	}
+	if node, _ := Preimage(f.stateRoot); !bytes.Equal(node, f.accountLeaf) {
+		t.Fatal("account leaf not stored as preimage")
+	}
+
+	storageProof := PrefetchStorage(blockNumber, addr, key, nil)
+	if len(storageProof) != 1 || storageProof[0] != hexutil.Encode(f.storageLeaf) {
+		t.Fatalf("wrong storage proof %v", storageProof)
+	}
+
+	PrefetchCode(blockNumber, crypto.Keccak256Hash(addr.Bytes()))
+	if code, _ := Preimage(crypto.Keccak256Hash(f.code)); !bytes.Equal(code, f.code) {
+		t.Fatalf("wrong code %x", code)
+	}
+
+	// The proof of an account that does not exist ends with the leaf of the other account:
+	other := common.HexToAddress("0x1")
+	if proof := PrefetchAccount(blockNumber, other, nil); len(proof) != 1 || proof[0] != hexutil.Encode(f.accountLeaf) {
+		t.Fatalf("wrong non-existing account proof %v", proof)
+	}
+	if proof := PrefetchStorage(blockNumber, other, key, nil); len(proof) != 0 {
+		t.Fatalf("storage proof of a non-existing account: %v", proof)
+	}
+
+	if APICalls() != calls {
+		t.Fatal("the node has been queried")
+	}
+}
@@ -0,0 +1,176 @@
+package oracle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Fixture is what the provider served during a recording (see StartRecording): the block headers
+// and the trie nodes (the proof elements and the preimages). The fixture is replayed by the
+// MemoryProvider returned by Provider, without network. The code is not part of the fixture
+// (PrefetchCode does not go through the provider).
+type Fixture struct {
+	Block   uint64
+	Headers []types.Header
+	Nodes   [][]byte
+}
+
+// fixtureJSON is the file format of Fixture, the headers are RLP encoded.
+type fixtureJSON struct {
+	Block   uint64          `json:"block"`
+	Headers []hexutil.Bytes `json:"headers"`
+	Nodes   []hexutil.Bytes `json:"nodes"`
+}
+
+// Save writes the fixture to the file at path.
+func (f Fixture) Save(path string) error {
+	data := fixtureJSON{Block: f.Block}
+	for _, header := range f.Headers {
+		enc, err := rlp.EncodeToBytes(&header)
+		if err != nil {
+			return fmt.Errorf("header %d: %w", header.Number, err)
+		}
+		data.Headers = append(data.Headers, enc)
+	}
+	for _, node := range f.Nodes {
+		data.Nodes = append(data.Nodes, node)
+	}
+	enc, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, enc, 0644)
+}
+
+// LoadFixture reads the fixture saved by Fixture.Save.
+func LoadFixture(path string) (Fixture, error) {
+	enc, err := os.ReadFile(path)
+	if err != nil {
+		return Fixture{}, err
+	}
+	var data fixtureJSON
+	if err := json.Unmarshal(enc, &data); err != nil {
+		return Fixture{}, fmt.Errorf("fixture %s: %w", path, err)
+	}
+	f := Fixture{Block: data.Block}
+	for i, enc := range data.Headers {
+		var header types.Header
+		if err := rlp.DecodeBytes(enc, &header); err != nil {
+			return Fixture{}, fmt.Errorf("fixture %s, header %d: %w", path, i, err)
+		}
+		f.Headers = append(f.Headers, header)
+	}
+	for _, node := range data.Nodes {
+		f.Nodes = append(f.Nodes, node)
+	}
+
+	return f, nil
+}
+
+// Provider returns the MemoryProvider serving the fixture.
+func (f Fixture) Provider() *MemoryProvider {
+	p := NewMemoryProvider()
+	for _, header := range f.Headers {
+		p.AddHeader(header)
+	}
+	p.AddNodes(f.Nodes...)
+
+	return p
+}
+
+// Recorder is the Provider that passes the calls to the provider set before StartRecording
+// and captures what it serves.
+type Recorder struct {
+	inner   Provider
+	headers map[uint64]types.Header
+	nodes   map[common.Hash][]byte
+}
+
+// StartRecording sets the Recorder wrapping the current provider as the provider, Stop restores
+// the current provider.
+func StartRecording() *Recorder {
+	r := &Recorder{
+		inner:   provider,
+		headers: make(map[uint64]types.Header),
+		nodes:   make(map[common.Hash][]byte),
+	}
+	provider = r
+
+	return r
+}
+
+// Stop restores the provider wrapped by the recorder and returns the fixture of the recorded block.
+func (r *Recorder) Stop(block uint64) Fixture {
+	provider = r.inner
+
+	f := Fixture{Block: block}
+	for _, header := range r.headers {
+		f.Headers = append(f.Headers, header)
+	}
+	sort.Slice(f.Headers, func(i, j int) bool { return f.Headers[i].Number.Cmp(f.Headers[j].Number) < 0 })
+	for _, node := range r.nodes {
+		f.Nodes = append(f.Nodes, node)
+	}
+	sort.Slice(f.Nodes, func(i, j int) bool { return bytes.Compare(f.Nodes[i], f.Nodes[j]) < 0 })
+
+	return f
+}
+
+func (r *Recorder) addNode(node []byte) {
+	r.nodes[crypto.Keccak256Hash(node)] = common.CopyBytes(node)
+}
+
+// record returns postProcess which also records the nodes (after postProcess added its nodes).
+func (r *Recorder) record(postProcess func(map[common.Hash][]byte)) func(map[common.Hash][]byte) {
+	return func(newPreimages map[common.Hash][]byte) {
+		if postProcess != nil {
+			postProcess(newPreimages)
+		}
+		for _, node := range newPreimages {
+			r.addNode(node)
+		}
+	}
+}
+
+func (r *Recorder) PrefetchBlock(blockNumber *big.Int, startBlock bool, hasher types.TrieHasher) types.Header {
+	header := r.inner.PrefetchBlock(blockNumber, startBlock, hasher)
+	r.headers[header.Number.Uint64()] = header
+	return header
+}
+
+func (r *Recorder) PrefetchAccount(blockNumber *big.Int, addr common.Address, postProcess func(map[common.Hash][]byte)) []string {
+	proof := r.inner.PrefetchAccount(blockNumber, addr, r.record(postProcess))
+	// The header of the block might not be prefetched (the next block is not), the fixture needs
+	// its state root, which is the hash of the first proof element:
+	if _, ok := r.headers[blockNumber.Uint64()]; !ok && len(proof) != 0 {
+		r.headers[blockNumber.Uint64()] = types.Header{
+			Number:     new(big.Int).Set(blockNumber),
+			Root:       crypto.Keccak256Hash(hexutil.MustDecode(proof[0])),
+			Difficulty: big.NewInt(0),
+		}
+	}
+	return proof
+}
+
+func (r *Recorder) PrefetchStorage(blockNumber *big.Int, addr common.Address, skey common.Hash, postProcess func(map[common.Hash][]byte)) []string {
+	return r.inner.PrefetchStorage(blockNumber, addr, skey, r.record(postProcess))
+}
+
+func (r *Recorder) Preimage(hash common.Hash) ([]byte, error) {
+	node, err := r.inner.Preimage(hash)
+	if err == nil {
+		r.addNode(node)
+	}
+	return node, err
+}
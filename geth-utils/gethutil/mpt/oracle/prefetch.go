@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/big"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -30,6 +32,7 @@ type jsonresp struct {
 	Jsonrpc string        `json:"jsonrpc"`
 	Id      uint64        `json:"id"`
 	Result  AccountResult `json:"result"`
+	Error   *RPCError     `json:"error"`
 }
 
 type jsonresps struct {
@@ -50,6 +53,14 @@ type jsonrespt struct {
 	Result  Header `json:"result"`
 }
 
+type jsonrespn struct {
+	Jsonrpc string `json:"jsonrpc"`
+	Id      uint64 `json:"id"`
+	Result  *struct {
+		Number *hexutil.Big `json:"number"`
+	} `json:"result"`
+}
+
 // Result structs for GetProof
 type AccountResult struct {
 	Address      common.Address  `json:"address"`
@@ -104,28 +115,203 @@ func cacheWrite(key string, value []byte) {
 	os.WriteFile(toFilename(key), value, 0644)
 }
 
-func getAPI(jsonData []byte) io.Reader {
-	key := hexutil.Encode(crypto.Keccak256(jsonData))
+// fallbackUrls are the endpoints that are queried (in order) when NodeUrl cannot be reached.
+var fallbackUrls []string
+
+// SetNodeURLs sets the endpoints the oracle queries. The first one becomes NodeUrl, the others
+// are used as fallbacks when the node cannot be reached: a transport error or an HTTP status
+// other than 2xx (for example, 503 or 429 when the node is overloaded or rate limited).
+// A valid response - even if it is a JSON-RPC error, for example the node does not have the state
+// of the block - does not trigger the failover, the error of the first node is returned as is.
+func SetNodeURLs(urls []string) {
+	if len(urls) == 0 {
+		panic("at least one node URL is needed")
+	}
+	NodeUrl = urls[0]
+	fallbackUrls = urls[1:]
+}
+
+// retryBackoff is the wait before the first retry of a request, it doubles with each retry.
+var retryBackoff = time.Second
+
+// isRetryableStatus returns whether the request that failed with the HTTP status might succeed
+// when retried: the node is rate limiting or (temporarily) failing.
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// postWithRetries posts jsonData to url, it retries a couple of times in case of a transport error
+// or a retryable HTTP status (see isRetryableStatus).
+func postWithRetries(url string, jsonData []byte) (*http.Response, error) {
 	var (
 		err     error
 		resp    *http.Response
 		retries int = 3
+		backoff     = retryBackoff
 	)
-	for retries > 0 {
-		resp, err = http.Post(NodeUrl, "application/json", bytes.NewBuffer(jsonData))
-		if err != nil {
-			retries -= 1
-			time.Sleep(1000)
-		} else {
+	for {
+		resp, err = http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+		if err == nil && !isRetryableStatus(resp.StatusCode) {
+			break
+		}
+		retries -= 1
+		if retries == 0 {
 			break
 		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return resp, err
+}
+
+// apiCalls counts the requests sent to the node.
+var apiCalls int
+
+// APICalls returns the number of requests that have been sent to the node so far.
+func APICalls() int {
+	return apiCalls
+}
+
+// fetchTime is the time spent waiting for the node responses.
+var fetchTime time.Duration
+
+// FetchTime returns the total time spent in the requests to the node so far.
+func FetchTime() time.Duration {
+	return fetchTime
+}
+
+// FetchError is the panic value when a request to the node fails (or the data cannot be read
+// from the datadir), so that the callers can tell it apart from the other failures.
+type FetchError struct {
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return "fetch: " + e.Err.Error()
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// RPCError is the error object of the JSON-RPC response.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// ErrHTTPStatus is the fetch failure when the node responds with an HTTP status other than 2xx.
+var ErrHTTPStatus = errors.New("unexpected HTTP status")
+
+var (
+	// ErrStatePruned is the fetch failure when the node does not have the state of the block
+	// (any more), an archive node is needed for the block.
+	ErrStatePruned = errors.New("state of the block pruned")
+	// ErrIncompleteSnapState is the fetch failure when the node has been snap-synced and lacks
+	// the trie nodes of the state (the sync or the generation of the snapshot has not completed),
+	// the proofs of the block might be available once it has.
+	ErrIncompleteSnapState = errors.New("snap-synced state incomplete")
+)
+
+// snapStateMessages and prunedStateMessages are the parts of the (lowercase) RPC error messages
+// by which geth (v1.13) reports the state that is not available:
+//   - "waiting for sync": the path-based trie database before the initial state sync completes
+//     (errDatabaseWaitSync in triedb/pathdb/errors.go),
+//   - "not covered yet": the snapshot that has not been generated up to the key
+//     (ErrNotCoveredYet in core/state/snapshot/snapshot.go),
+//   - "missing trie node": the trie node that is not in the database (MissingNodeError in trie/errors.go),
+//   - "is not available": the state root that is not in the database ("state %#x is not available"
+//     of the readers in triedb/hashdb/database.go and triedb/pathdb/database.go),
+//   - "historical state": the state that cannot be regenerated ("historical state not available in
+//     path scheme yet" and "required historical state unavailable" in eth/state_accessor.go).
+//
+// The snap sync messages are checked first, a node in the middle of the sync reports the missing
+// trie nodes too.
+var (
+	snapStateMessages   = []string{"waiting for sync", "not covered yet"}
+	prunedStateMessages = []string{"missing trie node", "is not available", "historical state"}
+)
+
+// checkRPCError panics with FetchError when the response has an error, the error wraps
+// ErrIncompleteSnapState or ErrStatePruned when the message tells that the state is not available.
+// The classification is best-effort: it relies on the messages (the JSON-RPC error code is -32000
+// for all of them), and geth reports the trie node that the snap sync has not downloaded yet as
+// missing, the same as the pruned one. Such a failure is thus classified as ErrStatePruned.
+func checkRPCError(e *RPCError) {
+	if e == nil {
+		return
+	}
+	message := strings.ToLower(e.Message)
+	for _, kind := range []struct {
+		err      error
+		messages []string
+	}{{ErrIncompleteSnapState, snapStateMessages}, {ErrStatePruned, prunedStateMessages}} {
+		for _, m := range kind.messages {
+			if strings.Contains(message, m) {
+				checkFetch(fmt.Errorf("%w: %w", kind.err, e))
+			}
+		}
+	}
+	checkFetch(e)
+}
+
+// checkFetch panics with FetchError when err is not nil.
+func checkFetch(err error) {
+	if err != nil {
+		panic(&FetchError{Err: err})
+	}
+}
+
+func getAPI(jsonData []byte) io.Reader {
+	apiCalls++
+	start := time.Now()
+	defer func() { fetchTime += time.Since(start) }()
+	key := hexutil.Encode(crypto.Keccak256(jsonData))
+	urls := []string{NodeUrl}
+	for _, url := range fallbackUrls {
+		if url != NodeUrl {
+			urls = append(urls, url)
+		}
+	}
+
+	var ret []byte
+	for i, url := range urls {
+		var err error
+		ret, err = post(url, jsonData)
+		if err == nil {
+			break
+		}
+		if i == len(urls)-1 {
+			checkFetch(err)
+		}
+		log.Printf("node %s not reachable (%v), failing over to %s", url, err, urls[i+1])
 	}
-	defer resp.Body.Close()
-	ret, _ := io.ReadAll(resp.Body)
 	cacheWrite(key, ret)
 	return bytes.NewReader(ret)
 }
 
+// post posts jsonData to url and returns the response body.
+func post(url string, jsonData []byte) ([]byte, error) {
+	resp, err := postWithRetries(url, jsonData)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// The body of the failed request is not the JSON-RPC response, it is not returned (nor cached):
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%w: %s", ErrHTTPStatus, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
 var unhashMap = make(map[common.Hash]common.Address)
 
 func unhash(addrHash common.Hash) common.Address {
@@ -134,23 +320,30 @@ func unhash(addrHash common.Hash) common.Address {
 
 var cached = make(map[string]bool)
 
-func PrefetchStorage(blockNumber *big.Int, addr common.Address, skey common.Hash, postProcess func(map[common.Hash][]byte)) []string {
+// ResetCache drops what has been fetched so far: the record of the fetched proofs, the preimages
+// and the storage caches. The proofs are requested from the provider again afterwards.
+func ResetCache() {
+	cached = make(map[string]bool)
+	preimages = make(map[common.Hash][]byte)
+	storageCaches = make(map[string]*storageCache)
+}
+
+func (rpcProvider) PrefetchStorage(blockNumber *big.Int, addr common.Address, skey common.Hash, postProcess func(map[common.Hash][]byte)) []string {
 	key := fmt.Sprintf("proof_%d_%s_%s", blockNumber, addr, skey)
 	// TODO: should return proof anyway
 	if cached[key] {
 		return nil
 	}
-	cached[key] = true
 
-	ap := getProofAccount(blockNumber, addr, skey, true)
-	//fmt.Println("PrefetchStorage", blockNumber, addr, skey, len(ap))
-	newPreimages := make(map[common.Hash][]byte)
-	for _, s := range ap {
-		ret, _ := hex.DecodeString(s[2:])
-		hash := crypto.Keccak256Hash(ret)
-		//fmt.Println("   ", i, hash)
-		newPreimages[hash] = ret
+	storage := blockStorageCache(blockNumber)
+	ap, ok := storage.proof(addr, skey)
+	if !ok {
+		ap = getProofAccount(blockNumber, addr, skey, true)
 	}
+	// Marked only once the proof is fetched: a failed fetch is requested again on retry.
+	cached[key] = true
+	//fmt.Println("PrefetchStorage", blockNumber, addr, skey, len(ap))
+	newPreimages := storage.add(addr, ap)
 
 	if postProcess != nil {
 		postProcess(newPreimages)
@@ -163,14 +356,108 @@ func PrefetchStorage(blockNumber *big.Int, addr common.Address, skey common.Hash
 	return ap
 }
 
-func PrefetchAccount(blockNumber *big.Int, addr common.Address, postProcess func(map[common.Hash][]byte)) []string {
+// PrefetchStorageBatch prefetches the storage proofs of many slots of one account (for example,
+// the storage keys of an access list entry). The default provider fetches the slots that have not
+// been fetched yet in a single eth_getProof request (the method takes the list of the storage keys),
+// the other providers and the datadir prefetch the slots one by one.
+func PrefetchStorageBatch(blockNumber *big.Int, addr common.Address, keys []common.Hash) {
+	if _, ok := provider.(rpcProvider); !ok || localDb != nil {
+		for _, skey := range keys {
+			PrefetchStorage(blockNumber, addr, skey, nil)
+		}
+		return
+	}
+	countCall()
+
+	var missing []common.Hash
+	for _, skey := range keys {
+		key := fmt.Sprintf("proof_%d_%s_%s", blockNumber, addr, skey)
+		if !cached[key] {
+			missing = append(missing, skey)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	storage := blockStorageCache(blockNumber)
+	for _, proof := range getStorageProofs(blockNumber, addr, missing) {
+		for hash, val := range storage.add(addr, proof) {
+			preimages[hash] = val
+		}
+	}
+	for _, skey := range missing {
+		cached[fmt.Sprintf("proof_%d_%s_%s", blockNumber, addr, skey)] = true
+	}
+}
+
+// storageCache holds the storage proof nodes fetched in a block and the storage roots of
+// the accounts (the first elements of their storage proofs), see storageCache.proof.
+type storageCache struct {
+	roots map[common.Address]common.Hash
+	nodes map[common.Hash][]byte
+}
+
+// storageCaches holds the storage cache of each block (by the block number), the nodes fetched
+// in one block are not used for the proofs of another one.
+var storageCaches = make(map[string]*storageCache)
+
+// blockStorageCache returns the storage cache of the block.
+func blockStorageCache(blockNumber *big.Int) *storageCache {
+	c, ok := storageCaches[blockNumber.String()]
+	if !ok {
+		c = &storageCache{roots: make(map[common.Address]common.Hash), nodes: make(map[common.Hash][]byte)}
+		storageCaches[blockNumber.String()] = c
+	}
+
+	return c
+}
+
+// add adds the nodes of the storage proof of the account to the cache, it returns them by their hashes.
+func (c *storageCache) add(addr common.Address, proof []string) map[common.Hash][]byte {
+	nodes := make(map[common.Hash][]byte)
+	for i, s := range proof {
+		ret, _ := hex.DecodeString(s[2:])
+		hash := crypto.Keccak256Hash(ret)
+		nodes[hash] = ret
+		c.nodes[hash] = ret
+		if i == 0 {
+			c.roots[addr] = hash
+		}
+	}
+
+	return nodes
+}
+
+// proof returns the proof of skey in the storage trie of the account when all the nodes on the path
+// have been fetched in the block. The storage proofs of an account share the nodes at the top of
+// the trie, so this is the case for the keys that end in a branch or a leaf fetched before (the keys
+// that are not in the trie, for example). The key is hashed as in the secure trie (unless
+// PreventHashingInSecureTrie is set). It returns false when the proof needs to be fetched.
+func (c *storageCache) proof(addr common.Address, skey common.Hash) ([]string, bool) {
+	root, ok := c.roots[addr]
+	if !ok {
+		return nil, false
+	}
+	key := skey.Bytes()
+	if !PreventHashingInSecureTrie {
+		key = crypto.Keccak256(key)
+	}
+	proof, _, err := walkProof(root, key, func(hash common.Hash) []byte {
+		return c.nodes[hash]
+	})
+
+	return proof, err == nil
+}
+
+func (rpcProvider) PrefetchAccount(blockNumber *big.Int, addr common.Address, postProcess func(map[common.Hash][]byte)) []string {
 	key := fmt.Sprintf("proof_%d_%s", blockNumber, addr)
 	if cached[key] {
 		return nil
 	}
-	cached[key] = true
 
 	ap := getProofAccount(blockNumber, addr, common.Hash{}, false)
+	cached[key] = true
 	newPreimages := make(map[common.Hash][]byte)
 	for _, s := range ap {
 		ret, _ := hex.DecodeString(s[2:])
@@ -210,8 +497,8 @@ func PrefetchCode(blockNumber *big.Int, addrHash common.Hash) {
 	if cached[key] {
 		return
 	}
-	cached[key] = true
 	ret := getProvedCodeBytes(blockNumber, addrHash)
+	cached[key] = true
 	hash := crypto.Keccak256Hash(ret)
 	preimages[hash] = ret
 }
@@ -234,13 +521,12 @@ func Output(output common.Hash) {
 	}
 }
 
-func check(err error) {
-	if err != nil {
-		log.Fatal(err)
+// fetchBlock returns the header and the transactions of the block with the given number.
+func fetchBlock(blockNumber *big.Int) (types.Header, []*types.Transaction) {
+	if localDb != nil {
+		return readLocalBlock(blockNumber)
 	}
-}
 
-func PrefetchBlock(blockNumber *big.Int, startBlock bool, hasher types.TrieHasher) types.Header {
 	r := jsonreq{Jsonrpc: "2.0", Method: "eth_getBlockByNumber", Id: 1}
 	r.Params = make([]interface{}, 2)
 	r.Params[0] = fmt.Sprintf("0x%x", blockNumber.Int64())
@@ -248,8 +534,18 @@ func PrefetchBlock(blockNumber *big.Int, startBlock bool, hasher types.TrieHashe
 	jsonData, _ := json.Marshal(r)
 
 	jr := jsonrespt{}
-	check(json.NewDecoder(getAPI(jsonData)).Decode(&jr))
-	blockHeader := jr.Result.ToHeader()
+	checkFetch(json.NewDecoder(getAPI(jsonData)).Decode(&jr))
+
+	txs := make([]*types.Transaction, len(jr.Result.Transactions))
+	for i := 0; i < len(jr.Result.Transactions); i++ {
+		txs[i] = jr.Result.Transactions[i].ToTransaction()
+	}
+
+	return jr.Result.ToHeader(), txs
+}
+
+func (rpcProvider) PrefetchBlock(blockNumber *big.Int, startBlock bool, hasher types.TrieHasher) types.Header {
+	blockHeader, txs := fetchBlock(blockNumber)
 
 	// put in the start block header
 	if startBlock {
@@ -283,10 +579,6 @@ func PrefetchBlock(blockNumber *big.Int, startBlock bool, hasher types.TrieHashe
 	os.WriteFile(key, saveinput, 0644)
 
 	// save the txs
-	txs := make([]*types.Transaction, len(jr.Result.Transactions))
-	for i := 0; i < len(jr.Result.Transactions); i++ {
-		txs[i] = jr.Result.Transactions[i].ToTransaction()
-	}
 	fmt.Println(txs[0].To())
 	testTxHash := types.DeriveSha(types.Transactions(txs), hasher)
 	if testTxHash != blockHeader.TxHash {
@@ -297,10 +589,45 @@ func PrefetchBlock(blockNumber *big.Int, startBlock bool, hasher types.TrieHashe
 	return blockHeader
 }
 
+// blockTags are the special block identifiers accepted by ResolveBlockTag.
+var blockTags = map[string]bool{
+	"latest":    true,
+	"pending":   true,
+	"finalized": true,
+}
+
+// ResolveBlockTag asks the node for the block behind a special tag ("latest", "pending",
+// "finalized") and returns its number, so that the rest of the prefetching can work
+// with a concrete block.
+func ResolveBlockTag(tag string) (*big.Int, error) {
+	if !blockTags[tag] {
+		return nil, fmt.Errorf("unsupported block tag: %s", tag)
+	}
+	r := jsonreq{Jsonrpc: "2.0", Method: "eth_getBlockByNumber", Id: 1}
+	r.Params = make([]interface{}, 2)
+	r.Params[0] = tag
+	r.Params[1] = false
+	jsonData, _ := json.Marshal(r)
+
+	jr := jsonrespn{}
+	if err := json.NewDecoder(getAPI(jsonData)).Decode(&jr); err != nil {
+		return nil, err
+	}
+	if jr.Result == nil || jr.Result.Number == nil {
+		return nil, fmt.Errorf("block not found for tag: %s", tag)
+	}
+
+	return jr.Result.Number.ToInt(), nil
+}
+
 func getProofAccount(blockNumber *big.Int, addr common.Address, skey common.Hash, storage bool) []string {
 	addrHash := crypto.Keccak256Hash(addr[:])
 	unhashMap[addrHash] = addr
 
+	if localDb != nil {
+		return getLocalProofAccount(blockNumber, addr, skey, storage)
+	}
+
 	r := jsonreq{Jsonrpc: "2.0", Method: "eth_getProof", Id: 1}
 	r.Params = make([]interface{}, 3)
 	r.Params[0] = addr
@@ -309,6 +636,7 @@ func getProofAccount(blockNumber *big.Int, addr common.Address, skey common.Hash
 	jsonData, _ := json.Marshal(r)
 	jr := jsonresp{}
 	json.NewDecoder(getAPI(jsonData)).Decode(&jr)
+	checkRPCError(jr.Error)
 
 	if storage {
 		if len(jr.Result.StorageProof) != 0 {
@@ -321,7 +649,33 @@ func getProofAccount(blockNumber *big.Int, addr common.Address, skey common.Hash
 	}
 }
 
+// getStorageProofs fetches the storage proofs of the keys in one eth_getProof request.
+func getStorageProofs(blockNumber *big.Int, addr common.Address, keys []common.Hash) [][]string {
+	addrHash := crypto.Keccak256Hash(addr[:])
+	unhashMap[addrHash] = addr
+
+	r := jsonreq{Jsonrpc: "2.0", Method: "eth_getProof", Id: 1}
+	r.Params = make([]interface{}, 3)
+	r.Params[0] = addr
+	r.Params[1] = keys
+	r.Params[2] = fmt.Sprintf("0x%x", blockNumber.Int64())
+	jsonData, _ := json.Marshal(r)
+	jr := jsonresp{}
+	json.NewDecoder(getAPI(jsonData)).Decode(&jr)
+	checkRPCError(jr.Error)
+
+	proofs := make([][]string, len(jr.Result.StorageProof))
+	for i, sp := range jr.Result.StorageProof {
+		proofs[i] = sp.Proof
+	}
+	return proofs
+}
+
 func getProvedCodeBytes(blockNumber *big.Int, addrHash common.Hash) []byte {
+	if localDb != nil {
+		return getLocalCode(blockNumber, addrHash)
+	}
+
 	addr := unhash(addrHash)
 
 	r := jsonreq{Jsonrpc: "2.0", Method: "eth_getCode", Id: 1}
@@ -0,0 +1,468 @@
+package oracle
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// mockNode starts a JSON-RPC server which answers every request with the given result
+// (or the error, when the result is *RPCError).
+func mockNode(t testing.TB, handle func(req jsonreq) interface{}) func() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req jsonreq
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatal(err)
+		}
+		resp := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      req.Id,
+		}
+		result := handle(req)
+		if _, ok := result.(*RPCError); ok {
+			resp["error"] = result
+		} else {
+			resp["result"] = result
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+
+	prevUrl := NodeUrl
+	NodeUrl = server.URL
+
+	return func() {
+		NodeUrl = prevUrl
+		server.Close()
+	}
+}
+
+func TestResolveBlockTag(t *testing.T) {
+	closeNode := mockNode(t, func(req jsonreq) interface{} {
+		if req.Method != "eth_getBlockByNumber" {
+			t.Fatalf("unexpected method %s", req.Method)
+		}
+		if req.Params[0] != "latest" {
+			t.Fatalf("unexpected tag %v", req.Params[0])
+		}
+		return map[string]string{"number": "0xcab4d5"}
+	})
+	defer closeNode()
+
+	blockNumber, err := ResolveBlockTag("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockNumber.Int64() != 13284565 {
+		t.Fatalf("wrong block number %d", blockNumber)
+	}
+}
+
+func TestResolveBlockTagUnsupported(t *testing.T) {
+	if _, err := ResolveBlockTag("0x10"); err == nil {
+		t.Fatal("expected error for unsupported tag")
+	}
+}
+
+func TestFailoverToSecondNode(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	proof := []string{"0xe2a0390decd9548b62a8d60345a988386fc84ba6bc95484008f6362f93160ef3e56301"}
+	closeNode := mockNode(t, func(req jsonreq) interface{} {
+		return map[string]interface{}{"accountProof": proof}
+	})
+	defer closeNode()
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadUrl := dead.URL
+	dead.Close()
+
+	workingUrl := NodeUrl
+	SetNodeURLs([]string{deadUrl, workingUrl})
+	defer SetNodeURLs([]string{workingUrl})
+
+	addr := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	ap := PrefetchAccount(big.NewInt(1056), addr, nil)
+	if len(ap) != 1 || ap[0] != proof[0] {
+		t.Fatalf("unexpected proof %v", ap)
+	}
+}
+
+// The node that responds with an HTTP error status is retried and then failed over, its response
+// is not used.
+func TestFailoverOnHTTPStatus(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	proof := []string{"0xe2a0390decd9548b62a8d60345a988386fc84ba6bc95484008f6362f93160ef3e56301"}
+	closeNode := mockNode(t, func(req jsonreq) interface{} {
+		return map[string]interface{}{"accountProof": proof}
+	})
+	defer closeNode()
+	workingUrl := NodeUrl
+
+	requests := 0
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"accountProof":[]}}`))
+	}))
+	defer unavailable.Close()
+
+	SetNodeURLs([]string{unavailable.URL, workingUrl})
+	defer SetNodeURLs([]string{workingUrl})
+
+	addr := common.HexToAddress("0x1000000000000000000000000000000000000003")
+	ap := PrefetchAccount(big.NewInt(1056), addr, nil)
+	if len(ap) != 1 || ap[0] != proof[0] {
+		t.Fatalf("unexpected proof %v", ap)
+	}
+	if requests != 3 {
+		t.Fatalf("expected 3 requests to the unavailable node, got %d", requests)
+	}
+
+	// Without a fallback the status is the fetch error:
+	SetNodeURLs([]string{unavailable.URL})
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = r.(error)
+			}
+		}()
+		PrefetchAccount(big.NewInt(1057), addr, nil)
+		return nil
+	}()
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) || !errors.Is(err, ErrHTTPStatus) {
+		t.Fatalf("expected ErrHTTPStatus, got %v", err)
+	}
+}
+
+// The rate limited request is retried after the backoff.
+func TestRetryRateLimited(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	proof := []string{"0xe2a0390decd9548b62a8d60345a988386fc84ba6bc95484008f6362f93160ef3e56301"}
+	limited := true
+	closeNode := mockNode(t, func(req jsonreq) interface{} {
+		return map[string]interface{}{"accountProof": proof}
+	})
+	defer closeNode()
+	nodeUrl := NodeUrl
+	rateLimiter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limited {
+			limited = false
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		// The node behind the rate limiter:
+		resp, err := http.Post(nodeUrl, "application/json", r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	}))
+	defer rateLimiter.Close()
+	SetNodeURLs([]string{rateLimiter.URL})
+	defer SetNodeURLs([]string{nodeUrl})
+
+	addr := common.HexToAddress("0x1000000000000000000000000000000000000004")
+	ap := PrefetchAccount(big.NewInt(1056), addr, nil)
+	if len(ap) != 1 || ap[0] != proof[0] {
+		t.Fatalf("unexpected proof %v", ap)
+	}
+	if limited {
+		t.Fatal("the rate limiter was not contacted")
+	}
+}
+
+// The node without the state of the block responds with a JSON-RPC error, the error is returned
+// to the caller and the next node is not contacted.
+func TestNoFailoverOnRPCError(t *testing.T) {
+	fallbackContacted := false
+	closeNode := mockNode(t, func(req jsonreq) interface{} {
+		fallbackContacted = true
+		return map[string]interface{}{"accountProof": []string{}}
+	})
+	defer closeNode()
+	fallbackUrl := NodeUrl
+	closePruned := mockNode(t, func(req jsonreq) interface{} {
+		return &RPCError{Code: -32000, Message: "missing trie node"}
+	})
+	defer closePruned()
+
+	SetNodeURLs([]string{NodeUrl, fallbackUrl})
+	defer SetNodeURLs([]string{fallbackUrl})
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = r.(error)
+			}
+		}()
+		addr := common.HexToAddress("0x1000000000000000000000000000000000000002")
+		PrefetchAccount(big.NewInt(1056), addr, nil)
+		return nil
+	}()
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -32000 || !errors.Is(err, ErrStatePruned) {
+		t.Fatalf("expected the RPC error of the first node, got %v", err)
+	}
+	if fallbackContacted {
+		t.Fatal("the fallback node was contacted")
+	}
+}
+
+// branchStorageTrie returns the root and the nodes of the storage trie with n slots, each in a leaf
+// below the root branch, and n slots that are not in the trie (their first nibble is not used).
+func branchStorageTrie(tb testing.TB, n int) (common.Hash, map[common.Hash][]byte, []common.Hash, []common.Hash) {
+	children := make([][]byte, 17)
+	var slots, absent []common.Hash
+	for i := int64(0); len(slots) < n || len(absent) < n; i++ {
+		slot := common.BigToHash(big.NewInt(i))
+		hashedKey := crypto.Keccak256(slot.Bytes())
+		nibble := hashedKey[0] / 16
+		if children[nibble] == nil && len(slots) < n {
+			value, _ := rlp.EncodeToBytes([]byte{byte(i + 1)})
+			// The leaf holds the remaining (odd number of) nibbles of the key:
+			leaf, err := rlp.EncodeToBytes([][]byte{append([]byte{0x30 | hashedKey[0]&0x0f}, hashedKey[1:]...), value})
+			if err != nil {
+				tb.Fatal(err)
+			}
+			children[nibble] = leaf
+			slots = append(slots, slot)
+		} else if children[nibble] == nil && len(slots) == n && len(absent) < n {
+			absent = append(absent, slot)
+		}
+	}
+
+	nodes := make(map[common.Hash][]byte)
+	refs := make([][]byte, 17)
+	for i, child := range children {
+		if child != nil {
+			hash := crypto.Keccak256Hash(child)
+			nodes[hash] = child
+			refs[i] = hash.Bytes()
+		}
+	}
+	branch, err := rlp.EncodeToBytes(refs)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	root := crypto.Keccak256Hash(branch)
+	nodes[root] = branch
+
+	return root, nodes, slots, absent
+}
+
+// mockStorageNode starts the node answering eth_getProof with the storage proofs of the trie,
+// it counts the storage proof requests.
+func mockStorageNode(tb testing.TB, root common.Hash, nodes map[common.Hash][]byte, requests *int) func() {
+	return mockNode(tb, func(req jsonreq) interface{} {
+		*requests++
+		skey := common.HexToHash(req.Params[1].([]interface{})[0].(string))
+		proof, _, err := walkProof(root, crypto.Keccak256(skey.Bytes()), func(hash common.Hash) []byte {
+			return nodes[hash]
+		})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return map[string]interface{}{"storageProof": []map[string]interface{}{{"key": skey, "proof": proof}}}
+	})
+}
+
+// The proofs of the slots that are not in the trie end in the root branch, which is known from the
+// proofs fetched before: these proofs are not fetched.
+func TestPrefetchStorageCachedRoot(t *testing.T) {
+	root, nodes, slots, absent := branchStorageTrie(t, 5)
+	requests := 0
+	closeNode := mockStorageNode(t, root, nodes, &requests)
+	defer closeNode()
+
+	blockNumber := big.NewInt(2114)
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	for i, slot := range append(slots, absent...) {
+		proof := PrefetchStorage(blockNumber, addr, slot, nil)
+		expected, _, _ := walkProof(root, crypto.Keccak256(slot.Bytes()), func(hash common.Hash) []byte {
+			return nodes[hash]
+		})
+		if len(proof) != len(expected) {
+			t.Fatalf("slot %d: got %d proof elements, want %d", i, len(proof), len(expected))
+		}
+		for j := range proof {
+			if proof[j] != expected[j] {
+				t.Fatalf("slot %d: proof element %d is %s, want %s", i, j, proof[j], expected[j])
+			}
+		}
+		if node, _ := Preimage(root); node == nil || hexutil.Encode(node) != proof[0] {
+			t.Fatalf("slot %d: the root is not stored as preimage", i)
+		}
+	}
+	if requests != len(slots) {
+		t.Fatalf("expected %d storage proof requests, got %d", len(slots), requests)
+	}
+
+	// The storage root is not shared between the blocks:
+	PrefetchStorage(big.NewInt(2115), addr, absent[0], nil)
+	if requests != len(slots)+1 {
+		t.Fatal("the proof of another block has not been fetched")
+	}
+}
+
+func BenchmarkPrefetchStorageSameAccount(b *testing.B) {
+	root, nodes, slots, absent := branchStorageTrie(b, 5)
+	requests := 0
+	closeNode := mockStorageNode(b, root, nodes, &requests)
+	defer closeNode()
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		// A new block for each iteration, nothing is cached from the previous one:
+		blockNumber := big.NewInt(int64(3_000_000 + i))
+		for _, slot := range append(slots, absent...) {
+			PrefetchStorage(blockNumber, addr, slot, nil)
+		}
+	}
+	b.ReportMetric(float64(requests)/float64(b.N), "requests/op")
+}
+
+// The storage cache walks the trie by the key as the secure trie does: by the hashed key, or by
+// the key itself when PreventHashingInSecureTrie is set.
+func TestStorageCacheKeyHashing(t *testing.T) {
+	root, nodes, slots, _ := branchStorageTrie(t, 5)
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	c := &storageCache{roots: map[common.Address]common.Hash{addr: root}, nodes: nodes}
+
+	hashedSlot := common.BytesToHash(crypto.Keccak256(slots[0].Bytes()))
+	proof, ok := c.proof(addr, slots[0])
+	if !ok {
+		t.Fatal("no proof of the slot")
+	}
+	if hashedProof, _ := c.proof(addr, hashedSlot); reflect.DeepEqual(hashedProof, proof) {
+		t.Fatal("the hashed slot is not hashed again")
+	}
+
+	PreventHashingInSecureTrie = true
+	defer func() { PreventHashingInSecureTrie = false }()
+	if hashedProof, _ := c.proof(addr, hashedSlot); !reflect.DeepEqual(hashedProof, proof) {
+		t.Fatal("the key is hashed when the hashing is prevented")
+	}
+}
+
+// The proofs of all the slots are fetched in one request, PrefetchStorage does not fetch them again.
+func TestPrefetchStorageBatch(t *testing.T) {
+	root, nodes, slots, _ := branchStorageTrie(t, 5)
+	requests := 0
+	closeNode := mockNode(t, func(req jsonreq) interface{} {
+		requests++
+		var storageProof []map[string]interface{}
+		for _, key := range req.Params[1].([]interface{}) {
+			skey := common.HexToHash(key.(string))
+			proof, _, err := walkProof(root, crypto.Keccak256(skey.Bytes()), func(hash common.Hash) []byte {
+				return nodes[hash]
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			storageProof = append(storageProof, map[string]interface{}{"key": skey, "proof": proof})
+		}
+		return map[string]interface{}{"storageProof": storageProof}
+	})
+	defer closeNode()
+
+	blockNumber := big.NewInt(2140)
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	PrefetchStorageBatch(blockNumber, addr, slots)
+	if requests != 1 {
+		t.Fatalf("expected one request, got %d", requests)
+	}
+	for i, slot := range slots {
+		if _, ok := blockStorageCache(blockNumber).proof(addr, slot); !ok {
+			t.Fatalf("slot %d: the proof is not among the nodes fetched in the block", i)
+		}
+		PrefetchStorage(blockNumber, addr, slot, nil)
+	}
+	if requests != 1 {
+		t.Fatalf("the prefetched slots have been fetched again, %d requests", requests)
+	}
+
+	// Only the slots that have not been fetched yet are requested:
+	PrefetchStorageBatch(blockNumber, addr, slots)
+	if requests != 1 {
+		t.Fatal("the batch of prefetched slots has been fetched again")
+	}
+}
+
+// The error of the snap-synced node lacking the trie nodes is told apart from the pruned state.
+func TestPrefetchAccountStateNotAvailable(t *testing.T) {
+	message := ""
+	closeNode := mockNode(t, func(req jsonreq) interface{} {
+		return &RPCError{Code: -32000, Message: message}
+	})
+	defer closeNode()
+
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	fetch := func(blockNumber int64) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = r.(error)
+			}
+		}()
+		PrefetchAccount(big.NewInt(blockNumber), addr, nil)
+		return nil
+	}
+
+	tests := []struct {
+		message  string
+		expected error
+		other    error
+	}{
+		// The messages of geth v1.13, see snapStateMessages and prunedStateMessages:
+		// errDatabaseWaitSync (triedb/pathdb/errors.go)
+		{"waiting for sync", ErrIncompleteSnapState, ErrStatePruned},
+		// ErrNotCoveredYet (core/state/snapshot/snapshot.go)
+		{"not covered yet", ErrIncompleteSnapState, ErrStatePruned},
+		// MissingNodeError (trie/errors.go) wrapping the error of the reader (triedb/hashdb/database.go)
+		{"missing trie node 5e2f (path ) state 0x12 is not available, not found", ErrStatePruned, ErrIncompleteSnapState},
+		// The reader of the path-based trie database (triedb/pathdb/database.go)
+		{"state 0x5e2f is not available", ErrStatePruned, ErrIncompleteSnapState},
+		// eth/state_accessor.go
+		{"historical state not available in path scheme yet", ErrStatePruned, ErrIncompleteSnapState},
+		{"required historical state unavailable (reexec=128)", ErrStatePruned, ErrIncompleteSnapState},
+	}
+	for i, test := range tests {
+		message = test.message
+		err := fetch(int64(2144 + i))
+		var fetchErr *FetchError
+		if !errors.As(err, &fetchErr) || !errors.Is(err, test.expected) || errors.Is(err, test.other) {
+			t.Fatalf("%q: expected %v, got %v", test.message, test.expected, err)
+		}
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) || rpcErr.Code != -32000 {
+			t.Fatalf("%q: the RPC error is not wrapped: %v", test.message, err)
+		}
+	}
+
+	// The other errors are not classified:
+	message = "invalid argument 0"
+	err := fetch(2150)
+	if err == nil || errors.Is(err, ErrStatePruned) || errors.Is(err, ErrIncompleteSnapState) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -10,7 +10,7 @@ import (
 
 var preimages = make(map[common.Hash][]byte)
 
-func Preimage(hash common.Hash) ([]byte, error) {
+func (rpcProvider) Preimage(hash common.Hash) ([]byte, error) {
 	val, ok := preimages[hash]
 	if !ok {
 		return nil, errors.New("can't find preimage")
@@ -0,0 +1,197 @@
+package oracle
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Provider is the source of the blocks, the proofs and the trie node preimages the oracle
+// serves to the state. The default provider sends JSON-RPC requests to NodeUrl (or reads
+// the datadir set by SetDatadir), SetProvider replaces it, for example with MemoryProvider
+// in the tests that are not to depend on a node.
+type Provider interface {
+	PrefetchBlock(blockNumber *big.Int, startBlock bool, hasher types.TrieHasher) types.Header
+	PrefetchAccount(blockNumber *big.Int, addr common.Address, postProcess func(map[common.Hash][]byte)) []string
+	PrefetchStorage(blockNumber *big.Int, addr common.Address, skey common.Hash, postProcess func(map[common.Hash][]byte)) []string
+	Preimage(hash common.Hash) ([]byte, error)
+}
+
+// rpcProvider is the default Provider, it fetches from NodeUrl.
+type rpcProvider struct{}
+
+var provider Provider = rpcProvider{}
+
+// SetProvider sets the provider used by PrefetchBlock, PrefetchAccount, PrefetchStorage and Preimage,
+// nil restores the default JSON-RPC provider.
+func SetProvider(p Provider) {
+	if p == nil {
+		p = rpcProvider{}
+	}
+	provider = p
+}
+
+// ErrCallBudgetExceeded is the panic value of the provider call that crosses the budget set by
+// SetCallBudget.
+var ErrCallBudgetExceeded = errors.New("oracle call budget exceeded")
+
+// providerCalls counts the calls of PrefetchBlock, PrefetchAccount, PrefetchStorage and Preimage,
+// whichever the provider (APICalls counts only the requests actually sent to the node).
+var providerCalls int
+
+// callBudget is the number of calls allowed by SetCallBudget, callLimit is the value of providerCalls
+// above which the calls panic (0 when there is no budget).
+var callBudget, callLimit int
+
+// ProviderCalls returns the number of calls served by the provider so far.
+func ProviderCalls() int {
+	return providerCalls
+}
+
+// SetCallBudget allows n more provider calls, the call after them panics with ErrCallBudgetExceeded.
+// n <= 0 removes the budget.
+func SetCallBudget(n int) {
+	callBudget, callLimit = n, 0
+	if n > 0 {
+		callLimit = providerCalls + n
+	}
+}
+
+// countCall counts the provider call and panics when it crosses the budget.
+func countCall() {
+	providerCalls++
+	if callLimit > 0 && providerCalls > callLimit {
+		panic(fmt.Errorf("%w: more than %d calls", ErrCallBudgetExceeded, callBudget))
+	}
+}
+
+func PrefetchBlock(blockNumber *big.Int, startBlock bool, hasher types.TrieHasher) types.Header {
+	countCall()
+	return provider.PrefetchBlock(blockNumber, startBlock, hasher)
+}
+
+func PrefetchAccount(blockNumber *big.Int, addr common.Address, postProcess func(map[common.Hash][]byte)) []string {
+	countCall()
+	return provider.PrefetchAccount(blockNumber, addr, postProcess)
+}
+
+func PrefetchStorage(blockNumber *big.Int, addr common.Address, skey common.Hash, postProcess func(map[common.Hash][]byte)) []string {
+	countCall()
+	return provider.PrefetchStorage(blockNumber, addr, skey, postProcess)
+}
+
+func Preimage(hash common.Hash) ([]byte, error) {
+	countCall()
+	return provider.Preimage(hash)
+}
+
+// MemoryProvider is the Provider serving the headers and the trie nodes it has been seeded with.
+// The proofs are built by walking the seeded tries, the nodes given to the postProcess callbacks
+// are added to the seeded nodes. Only the seeded nodes are served as the preimages.
+// As the JSON-RPC provider, it returns each proof only on the first fetch (the state loads the fetched
+// account only once, the modifications applied to it since are kept).
+type MemoryProvider struct {
+	headers map[uint64]types.Header
+	nodes   map[common.Hash][]byte
+	fetched map[string]bool
+}
+
+func NewMemoryProvider() *MemoryProvider {
+	return &MemoryProvider{
+		headers: make(map[uint64]types.Header),
+		nodes:   make(map[common.Hash][]byte),
+		fetched: make(map[string]bool),
+	}
+}
+
+// AddHeader seeds the header of the block with the number header.Number.
+func (p *MemoryProvider) AddHeader(header types.Header) {
+	p.headers[header.Number.Uint64()] = header
+}
+
+// AddNodes seeds the trie nodes (for example, the elements of a proof), each is stored by its hash.
+func (p *MemoryProvider) AddNodes(nodes ...[]byte) {
+	for _, node := range nodes {
+		p.nodes[crypto.Keccak256Hash(node)] = common.CopyBytes(node)
+	}
+}
+
+func (p *MemoryProvider) header(blockNumber *big.Int) types.Header {
+	header, ok := p.headers[blockNumber.Uint64()]
+	if !ok {
+		checkFetch(fmt.Errorf("block %d not in the memory provider", blockNumber))
+	}
+	return header
+}
+
+func (p *MemoryProvider) readNode(hash common.Hash) []byte {
+	return p.nodes[hash]
+}
+
+// firstFetch returns whether the proof of key is fetched for the first time (see rpcProvider.PrefetchAccount).
+func (p *MemoryProvider) firstFetch(key string) bool {
+	if p.fetched[key] {
+		return false
+	}
+	p.fetched[key] = true
+	return true
+}
+
+// proof walks the seeded trie with the given root and runs postProcess on the proof nodes.
+func (p *MemoryProvider) proof(root common.Hash, key []byte, postProcess func(map[common.Hash][]byte)) ([]string, []byte) {
+	proof, leaf, err := walkProof(root, key, p.readNode)
+	checkFetch(err)
+	if postProcess != nil {
+		newPreimages := make(map[common.Hash][]byte)
+		for _, s := range proof {
+			node := hexutil.MustDecode(s)
+			newPreimages[crypto.Keccak256Hash(node)] = node
+		}
+		postProcess(newPreimages)
+		for hash, val := range newPreimages {
+			p.nodes[hash] = val
+		}
+	}
+
+	return proof, leaf
+}
+
+func (p *MemoryProvider) PrefetchBlock(blockNumber *big.Int, startBlock bool, hasher types.TrieHasher) types.Header {
+	return p.header(blockNumber)
+}
+
+func (p *MemoryProvider) PrefetchAccount(blockNumber *big.Int, addr common.Address, postProcess func(map[common.Hash][]byte)) []string {
+	if !p.firstFetch(fmt.Sprintf("proof_%d_%s", blockNumber, addr)) {
+		return nil
+	}
+	proof, _ := p.proof(p.header(blockNumber).Root, crypto.Keccak256(addr.Bytes()), postProcess)
+	return proof
+}
+
+func (p *MemoryProvider) PrefetchStorage(blockNumber *big.Int, addr common.Address, skey common.Hash, postProcess func(map[common.Hash][]byte)) []string {
+	if !p.firstFetch(fmt.Sprintf("proof_%d_%s_%s", blockNumber, addr, skey)) {
+		return nil
+	}
+	_, leaf := p.proof(p.header(blockNumber).Root, crypto.Keccak256(addr.Bytes()), nil)
+	if leaf == nil {
+		return []string{}
+	}
+	var account Account
+	checkFetch(rlp.DecodeBytes(leaf, &account))
+	proof, _ := p.proof(account.Root, crypto.Keccak256(skey.Bytes()), postProcess)
+
+	return proof
+}
+
+func (p *MemoryProvider) Preimage(hash common.Hash) ([]byte, error) {
+	if node, ok := p.nodes[hash]; ok {
+		return node, nil
+	}
+	return nil, errors.New("can't find preimage")
+}
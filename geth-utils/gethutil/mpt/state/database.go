@@ -97,6 +97,8 @@ type Trie interface {
 
 	Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) ([]byte, [][]byte, bool, bool, error)
 
+	ProveEach(key []byte, fn func(level int, proofEl []byte) error) error
+
 	GetNodeByNibbles(key []byte) ([]byte, error)
 
 	GetRoot() trie.Node
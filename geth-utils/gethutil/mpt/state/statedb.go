@@ -324,6 +324,37 @@ func (s *StateDB) GetStorageProof(a common.Address, key common.Hash) ([][]byte,
 	return proof, neighbourNode, extNibbles, isLastLeaf, isNeighbourNodeHashed, err
 }
 
+// GetStorageProofByHash returns the Merkle proof for the storage slot with the given hashed key
+// (the key is not hashed, whatever oracle.PreventHashingInSecureTrie).
+func (s *StateDB) GetStorageProofByHash(a common.Address, keyHash common.Hash) ([][]byte, []byte, [][]byte, bool, bool, error) {
+	var proof proofList
+	trie := s.StorageTrie(a)
+	if trie == nil {
+		return proof, nil, nil, false, false, errors.New("storage trie for requested address does not exist")
+	}
+	neighbourNode, extNibbles, isLastLeaf, isNeighbourNodeHashed, err := trie.Prove(keyHash[:], 0, &proof)
+	return proof, neighbourNode, extNibbles, isLastLeaf, isNeighbourNodeHashed, err
+}
+
+// GetStorageProofEach walks the Merkle proof for given storage slot and calls fn with each
+// proof element, starting with the storage root. Contrary to GetStorageProof, the proof elements
+// are not collected into a list, see Trie.ProveEach. It is meant for the consumers which need
+// one proof element at a time (as EstimateWitness), not for the witness conversion. The trie nodes
+// of the proof stay in memory (in the storage trie and the oracle) either way.
+func (s *StateDB) GetStorageProofEach(a common.Address, key common.Hash, fn func(level int, proofEl []byte) error) error {
+	trie := s.StorageTrie(a)
+	if trie == nil {
+		return errors.New("storage trie for requested address does not exist")
+	}
+	var newKey []byte
+	if !oracle.PreventHashingInSecureTrie {
+		newKey = crypto.Keccak256(key.Bytes())
+	} else {
+		newKey = key.Bytes()
+	}
+	return trie.ProveEach(newKey, fn)
+}
+
 func (s *StateDB) GetNodeByNibbles(a common.Address, key []byte) ([]byte, error) {
 	trie := s.StorageTrie(a)
 	return trie.GetNodeByNibbles(key)
@@ -440,8 +471,10 @@ func (s *StateDB) SetStorage(addr common.Address, storage map[common.Hash]common
 // creating a new account in GetOrNewStateObject (called from example from SetBalance).
 // The reason the new account is created without this call is that the local statedb.stateObjects
 // is populated only with the objects that are created locally.
+// The account already in statedb.stateObjects is not retrieved again (the modifications applied
+// to it are kept).
 func (s *StateDB) SetStateObjectIfExists(addr common.Address) {
-	if s.loadRemoteAccountsIntoStateObjects {
+	if s.loadRemoteAccountsIntoStateObjects && s.stateObjects[addr] == nil {
 		ap := oracle.PrefetchAccount(s.Db.BlockNumber, addr, nil)
 		if len(ap) > 0 {
 			ret, _ := hex.DecodeString(ap[len(ap)-1][2:])
@@ -505,12 +538,16 @@ func (s *StateDB) Suicide(addr common.Address) bool {
 }
 
 // Added for MPT generator:
+// DeleteAccount removes the account from the trie. The state object is marked as deleted, so
+// the account (including its storage) does not resurface in the subsequent modifications - when
+// the account is created again, it starts with the empty storage trie (like after SELFDESTRUCT).
 func (s *StateDB) DeleteAccount(addr common.Address) bool {
 	stateObject := s.GetStateObject(addr)
 	if stateObject == nil {
 		return false
 	}
 	s.deleteStateObject(stateObject)
+	stateObject.deleted = true
 
 	return true
 }
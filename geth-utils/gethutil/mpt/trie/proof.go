@@ -131,6 +131,9 @@ func (t *Trie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) (
 		// }
 	}
 
+	// Only the neighbour that has not been resolved is a hash reference. The neighbour shorter
+	// than 32 bytes is inlined in the branch (it is never a HashNode), neighbourNodeRLP is then
+	// the node itself.
 	isNeighbourNodeHashed := false
 	if _, ok := neighbourNode.(HashNode); ok {
 		isNeighbourNodeHashed = true
@@ -145,6 +148,62 @@ func (t *Trie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) (
 	return neighbourNodeRLP, extNibbles, isLastLeaf, isNeighbourNodeHashed, nil
 }
 
+// ProveEach walks the path to key and calls fn with the RLP of each proof element, starting
+// with the root. Contrary to Prove, the proof elements are not collected into a list, fn gets each
+// element as it is encoded (and can stop the walk by returning an error). The trie nodes on the
+// path are resolved (and kept in the trie) as in Prove, only the list of the encoded elements is
+// saved. The neighbour node and extension nibbles that Prove returns for the witness generation are
+// not computed here. The witness conversion does not use ProveEach: it compares the lengths of the
+// S and C proofs and looks at their last elements before converting the first one, it needs the
+// whole proofs. ProveEach thus does not lower the memory of the witness generation.
+func (t *Trie) ProveEach(key []byte, fn func(level int, proofEl []byte) error) error {
+	key = KeybytesToHex(key)
+	hasher := NewHasher(false)
+	defer returnHasherToPool(hasher)
+
+	tn := t.root
+	level := 0
+	for len(key) > 0 && tn != nil {
+		var proofNode Node
+		switch n := tn.(type) {
+		case *ShortNode:
+			proofNode = n
+			if len(key) < len(n.Key) || !bytes.Equal(n.Key, key[:len(n.Key)]) {
+				// The trie doesn't contain the key.
+				tn = nil
+			} else {
+				tn = n.Val
+				key = key[len(n.Key):]
+			}
+		case *FullNode:
+			proofNode = n
+			tn = n.Children[key[0]]
+			key = key[1:]
+		case HashNode:
+			var err error
+			tn, err = t.resolveHash(n, nil)
+			if err != nil {
+				return err
+			}
+			continue
+		default:
+			panic(fmt.Sprintf("%T: invalid node: %v", tn, tn))
+		}
+
+		hashed, _ := hasher.ProofHash(proofNode)
+		enc, err := rlp.EncodeToBytes(hashed)
+		if err != nil {
+			return err
+		}
+		if err := fn(level, enc); err != nil {
+			return err
+		}
+		level++
+	}
+
+	return nil
+}
+
 func (t *Trie) GetNodeByNibbles(key []byte) ([]byte, error) {
 	tn := t.root
 	// var node Node
@@ -194,6 +253,11 @@ func (t *SecureTrie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWri
 	return t.trie.Prove(key, fromLevel, proofDb)
 }
 
+// ProveEach calls fn with each proof element on the path to key, see Trie.ProveEach.
+func (t *SecureTrie) ProveEach(key []byte, fn func(level int, proofEl []byte) error) error {
+	return t.trie.ProveEach(key, fn)
+}
+
 func (t *SecureTrie) GetNodeByNibbles(key []byte) ([]byte, error) {
 	return t.trie.GetNodeByNibbles(key)
 }
@@ -0,0 +1,149 @@
+package trie
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+type proofList [][]byte
+
+func (n *proofList) Put(key []byte, value []byte) error {
+	*n = append(*n, value)
+	return nil
+}
+
+func (n *proofList) Delete(key []byte) error {
+	panic("not supported")
+}
+
+// makeDeepTrie returns an in-memory trie with n hashed keys (as in a storage trie) and
+// the key that is the deepest in the trie.
+func makeDeepTrie(tb testing.TB, n int) (*Trie, []byte) {
+	trie, err := New(common.Hash{}, &Database{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keys := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		var slot [32]byte
+		binary.BigEndian.PutUint64(slot[24:], uint64(i))
+		keys[i] = crypto.Keccak256(slot[:])
+		trie.Update(keys[i], bytes.Repeat([]byte{1}, 32))
+	}
+	// Cache the node hashes, the proofs below do not hash the whole trie then:
+	trie.Hash()
+
+	var deepest []byte
+	depth := 0
+	for _, key := range keys {
+		var proof proofList
+		if _, _, _, _, err := trie.Prove(key, 0, &proof); err != nil {
+			tb.Fatal(err)
+		}
+		if len(proof) > depth {
+			depth = len(proof)
+			deepest = key
+		}
+	}
+
+	return trie, deepest
+}
+
+func TestProveEachMatchesProve(t *testing.T) {
+	trie, key := makeDeepTrie(t, 1000)
+
+	var proof proofList
+	if _, _, _, _, err := trie.Prove(key, 0, &proof); err != nil {
+		t.Fatal(err)
+	}
+
+	var levels int
+	err := trie.ProveEach(key, func(level int, proofEl []byte) error {
+		if level != levels {
+			t.Errorf("level: got %d, want %d", level, levels)
+		}
+		if !bytes.Equal(proofEl, proof[level]) {
+			t.Errorf("proof element %d differs:\n%x\n%x", level, proofEl, proof[level])
+		}
+		levels++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if levels != len(proof) {
+		t.Errorf("number of proof elements: got %d, want %d", levels, len(proof))
+	}
+}
+
+// liveHeap returns the bytes of the live heap objects (after a garbage collection).
+func liveHeap() int64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
+
+// The benchmarks below compare Prove, which collects the proof elements into a list, and ProveEach,
+// which hands each element to the callback. Next to the allocations, they report the live heap of
+// the walk above the heap of the trie, measured once when the consumer handles the last proof
+// element. The difference is the list of the encoded elements only: the trie nodes on the path
+// are resolved before the walk (makeDeepTrie hashes the trie), they are in the base heap of both.
+
+func BenchmarkProve(b *testing.B) {
+	trie, key := makeDeepTrie(b, 10000)
+	base := liveHeap()
+	var proof proofList
+	if _, _, _, _, err := trie.Prove(key, 0, &proof); err != nil {
+		b.Fatal(err)
+	}
+	peak := liveHeap() - base
+	runtime.KeepAlive(proof)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var proof proofList
+		if _, _, _, _, err := trie.Prove(key, 0, &proof); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(peak), "peak-live-B")
+}
+
+func BenchmarkProveEach(b *testing.B) {
+	trie, key := makeDeepTrie(b, 10000)
+	var depth int
+	trie.ProveEach(key, func(level int, proofEl []byte) error {
+		depth = level + 1
+		return nil
+	})
+	base := liveHeap()
+	var peak int64
+	err := trie.ProveEach(key, func(level int, proofEl []byte) error {
+		if level == depth-1 {
+			peak = liveHeap() - base
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := trie.ProveEach(key, func(level int, proofEl []byte) error {
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(peak), "peak-live-B")
+}
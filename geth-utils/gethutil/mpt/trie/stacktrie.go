@@ -657,34 +657,10 @@ func (st *StackTrie) UpdateAndGetProofs(db ethdb.KeyValueReader, list types.Deri
 
 	// StackTrie requires values to be inserted in increasing hash order, which is not the
 	// order that `list` provides hashes in. This insertion sequence ensures that the
-	// order is correct.
-	var indexBuf []byte
-	for i := 1; i < list.Len() && i <= 0x7f; i++ {
-		indexBuf = rlp.AppendUint64(indexBuf[:0], uint64(i))
+	// order is correct (index 0 is encoded as [128] by rlp.AppendUint64, see types.IndexKey).
+	for _, i := range types.DeriveOrder(list.Len()) {
 		value := types.EncodeForDerive(list, i, valueBuf)
-		proof, err := st.UpdateAndGetProof(db, indexBuf, value)
-		if err != nil {
-			return nil, err
-		}
-		proofs = append(proofs, proof)
-	}
-
-	// special case when index is 0
-	// rlp.AppendUint64() encodes index 0 to [128]
-	if list.Len() > 0 {
-		indexBuf = rlp.AppendUint64(indexBuf[:0], 0)
-		value := types.EncodeForDerive(list, 0, valueBuf)
-		proof, err := st.UpdateAndGetProof(db, indexBuf, value)
-		if err != nil {
-			return nil, err
-		}
-		proofs = append(proofs, proof)
-	}
-
-	for i := 0x80; i < list.Len(); i++ {
-		indexBuf = rlp.AppendUint64(indexBuf[:0], uint64(i))
-		value := types.EncodeForDerive(list, i, valueBuf)
-		proof, err := st.UpdateAndGetProof(db, indexBuf, value)
+		proof, err := st.UpdateAndGetProof(db, types.IndexKey(i), value)
 		if err != nil {
 			return nil, err
 		}
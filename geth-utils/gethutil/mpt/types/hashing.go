@@ -88,6 +88,31 @@ func DeriveSha(list DerivableList, hasher TrieHasher) common.Hash {
 	return UpdateStackTrie(list, hasher).Hash()
 }
 
+// IndexKey returns the key of the list element at index i in the trie built by DeriveSha
+// (the transactions, the receipts, the withdrawals): the RLP encoding of the index, so that
+// the index 0 is 0x80 and the indices from 0x80 on take two or more bytes.
+func IndexKey(i int) []byte {
+	return rlp.AppendUint64(nil, uint64(i))
+}
+
+// DeriveOrder returns the indices of the list of n elements in the increasing order of their keys
+// (see IndexKey), which is the order StackTrie requires the values to be inserted in: the indices
+// 1 to 0x7f (single byte keys), then 0 (0x80) and then the indices from 0x80 on.
+func DeriveOrder(n int) []int {
+	order := make([]int, 0, n)
+	for i := 1; i < n && i <= 0x7f; i++ {
+		order = append(order, i)
+	}
+	if n > 0 {
+		order = append(order, 0)
+	}
+	for i := 0x80; i < n; i++ {
+		order = append(order, i)
+	}
+
+	return order
+}
+
 func UpdateStackTrie(list DerivableList, hasher TrieHasher) TrieHasher {
 	hasher.Reset()
 
@@ -97,21 +122,9 @@ func UpdateStackTrie(list DerivableList, hasher TrieHasher) TrieHasher {
 	// StackTrie requires values to be inserted in increasing hash order, which is not the
 	// order that `list` provides hashes in. This insertion sequence ensures that the
 	// order is correct.
-	var indexBuf []byte
-	for i := 1; i < list.Len() && i <= 0x7f; i++ {
-		indexBuf = rlp.AppendUint64(indexBuf[:0], uint64(i))
-		value := EncodeForDerive(list, i, valueBuf)
-		hasher.Update(indexBuf, value)
-	}
-	if list.Len() > 0 {
-		indexBuf = rlp.AppendUint64(indexBuf[:0], 0)
-		value := EncodeForDerive(list, 0, valueBuf)
-		hasher.Update(indexBuf, value)
-	}
-	for i := 0x80; i < list.Len(); i++ {
-		indexBuf = rlp.AppendUint64(indexBuf[:0], uint64(i))
+	for _, i := range DeriveOrder(list.Len()) {
 		value := EncodeForDerive(list, i, valueBuf)
-		hasher.Update(indexBuf, value)
+		hasher.Update(IndexKey(i), value)
 	}
 
 	return hasher
@@ -0,0 +1,122 @@
+package witness
+
+import (
+	"main/gethutil/mpt/oracle"
+	"main/gethutil/mpt/state"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AccessListEntry is an address with the storage keys accessed at this address.
+type AccessListEntry struct {
+	Address     common.Address
+	StorageKeys []common.Hash
+}
+
+// GetAccessListWitness returns the witness proving the current state of all the accounts and storage
+// slots in the access list. No state is changed: each witness has the same S and C proofs.
+// A slot that is not set is proved by the storage non-existence proof, an account that does
+// not exist by the account non-existence proof.
+func GetAccessListWitness(nodeUrl string, blockNum int, entries []AccessListEntry) ([]Node, error) {
+	oracle.NodeUrl = nodeUrl
+	statedb, err := openStateDB(blockNum)
+	if err != nil {
+		return nil, err
+	}
+
+	trieModifications, err := accessListModifications(statedb, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []Node
+	keys := newKeyCache()
+	for i, tMod := range trieModifications {
+		modNodes, err := witnessOfModification(i, tMod, statedb, nil, keys)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, modNodes...)
+	}
+
+	return nodes, nil
+}
+
+// groupAccessList merges the entries with the same address (the account is then fetched only once)
+// and removes the duplicate storage keys. The order of the first appearance is kept.
+func groupAccessList(entries []AccessListEntry) []AccessListEntry {
+	var grouped []AccessListEntry
+	index := make(map[common.Address]int)
+	seen := make(map[common.Address]map[common.Hash]bool)
+	for _, entry := range entries {
+		i, ok := index[entry.Address]
+		if !ok {
+			i = len(grouped)
+			index[entry.Address] = i
+			seen[entry.Address] = make(map[common.Hash]bool)
+			grouped = append(grouped, AccessListEntry{Address: entry.Address})
+		}
+		for _, key := range entry.StorageKeys {
+			if seen[entry.Address][key] {
+				continue
+			}
+			seen[entry.Address][key] = true
+			grouped[i].StorageKeys = append(grouped[i].StorageKeys, key)
+		}
+	}
+
+	return grouped
+}
+
+// accessListModifications returns the modifications that do not change the state, but prove
+// the current values of the access list entries.
+func accessListModifications(statedb *state.StateDB, entries []AccessListEntry) (trieModifications []TrieModification, err error) {
+	defer recoverWitnessError(-1, common.Address{}, &err)
+
+	for _, entry := range groupAccessList(entries) {
+		addr := entry.Address
+		oracle.PrefetchAccount(statedb.Db.BlockNumber, addr, nil)
+		if !statedb.Exist(addr) {
+			// The storage slots of the account that does not exist are proved not to exist
+			// by the account non-existence proof.
+			trieModifications = append(trieModifications, TrieModification{
+				Type:    AccountDoesNotExist,
+				Address: addr,
+			})
+			continue
+		}
+
+		if len(entry.StorageKeys) == 0 {
+			// Setting the nonce to its current value gives the account proof with S = C.
+			trieModifications = append(trieModifications, TrieModification{
+				Type:    NonceChanged,
+				Nonce:   statedb.GetNonce(addr),
+				Address: addr,
+			})
+			continue
+		}
+
+		// The slots of the entry are fetched in one request:
+		oracle.PrefetchStorageBatch(statedb.Db.BlockNumber, addr, entry.StorageKeys)
+		for _, key := range entry.StorageKeys {
+			value := statedb.GetState(addr, key)
+			if value == (common.Hash{}) {
+				trieModifications = append(trieModifications, TrieModification{
+					Type:    StorageDoesNotExist,
+					Key:     key,
+					Address: addr,
+				})
+				continue
+			}
+			// Setting the slot to its current value gives the storage proof with S = C.
+			trieModifications = append(trieModifications, TrieModification{
+				Type:    StorageChanged,
+				Key:     key,
+				Value:   value,
+				Address: addr,
+			})
+		}
+	}
+
+	return trieModifications, nil
+}
@@ -0,0 +1,29 @@
+package witness
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestGroupAccessList(t *testing.T) {
+	addr1 := common.HexToAddress("0x1")
+	addr2 := common.HexToAddress("0x2")
+	key1 := common.HexToHash("0x11")
+	key2 := common.HexToHash("0x12")
+
+	grouped := groupAccessList([]AccessListEntry{
+		{Address: addr1, StorageKeys: []common.Hash{key1}},
+		{Address: addr2},
+		{Address: addr1, StorageKeys: []common.Hash{key2, key1}},
+	})
+
+	expected := []AccessListEntry{
+		{Address: addr1, StorageKeys: []common.Hash{key1, key2}},
+		{Address: addr2},
+	}
+	if !reflect.DeepEqual(grouped, expected) {
+		t.Fatalf("got %v, want %v", grouped, expected)
+	}
+}
@@ -0,0 +1,105 @@
+package witness
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AccountPairWitness is the read-only witness of two accounts with the state trie branches shared by
+// their proofs present once. Nodes holds the start node, the shared branches (the last one is
+// the branch in which the paths of the accounts diverge, as in the witness of the first account),
+// the nodes of the first account below it, the nodes of the second account below it and the end node.
+// Expand returns the witnesses of the two accounts.
+type AccountPairWitness struct {
+	Nodes     []Node
+	Addresses [2]common.Address
+	// Shared is the number of the shared branches in Nodes (after the start node).
+	Shared int
+	// Positions are the nibbles of the two accounts in the last shared branch: the positions of
+	// the children of the branch on the paths of the accounts.
+	Positions [2]int
+	// Below is the number of the nodes of each account below the shared branches (the last one is
+	// the account leaf).
+	Below [2]int
+}
+
+// GetAccountPairWitness returns the read-only witness of the accounts a and b which shows both account
+// leaves and the positions of the accounts in the branch where their paths diverge (see
+// AccountPairWitness). Both accounts need to exist.
+func GetAccountPairWitness(nodeUrl string, blockNum int, a, b common.Address) (AccountPairWitness, error) {
+	if a == b {
+		return AccountPairWitness{}, fmt.Errorf("the same account %s twice", a)
+	}
+	result, err := GetWitnessResult(nodeUrl, blockNum, []TrieModification{NewAccountRead(a), NewAccountRead(b)})
+	if err != nil {
+		return AccountPairWitness{}, err
+	}
+
+	return combineAccountWitnesses(result.Nodes, [2]common.Address{a, b})
+}
+
+// combineAccountWitnesses combines the witnesses of two account reads: the branches that are the same
+// trie nodes at the same depth are present once.
+func combineAccountWitnesses(nodes []Node, addrs [2]common.Address) (AccountPairWitness, error) {
+	segments, err := SplitByModification(nodes)
+	if err != nil {
+		return AccountPairWitness{}, err
+	}
+	if len(segments) != 2 {
+		return AccountPairWitness{}, fmt.Errorf("%d modifications, expected 2", len(segments))
+	}
+	var bodies [2][]Node
+	for i, segment := range segments {
+		bodies[i] = segment[1 : len(segment)-1]
+		if len(bodies[i]) == 0 || bodies[i][len(bodies[i])-1].Account == nil {
+			return AccountPairWitness{}, fmt.Errorf("modification %d does not end with the account leaf", i)
+		}
+	}
+
+	pair := AccountPairWitness{Addresses: addrs}
+	for pair.Shared < len(bodies[0])-1 && pair.Shared < len(bodies[1])-1 &&
+		isSameBranch(bodies[0][pair.Shared], bodies[1][pair.Shared]) {
+		pair.Shared++
+	}
+	if pair.Shared == 0 {
+		return AccountPairWitness{}, fmt.Errorf("accounts %s and %s do not share a branch", addrs[0], addrs[1])
+	}
+	for i := range bodies {
+		pair.Positions[i] = bodies[i][pair.Shared-1].ExtensionBranch.Branch.ModifiedIndex
+		pair.Below[i] = len(bodies[i]) - pair.Shared
+	}
+
+	pair.Nodes = append(pair.Nodes, segments[0][0])
+	pair.Nodes = append(pair.Nodes, bodies[0]...)
+	pair.Nodes = append(pair.Nodes, bodies[1][pair.Shared:]...)
+	pair.Nodes = append(pair.Nodes, segments[0][len(segments[0])-1])
+
+	return pair, nil
+}
+
+// Expand returns the witnesses of the two accounts, one after another.
+func (w AccountPairWitness) Expand() []Node {
+	if len(w.Nodes) == 0 {
+		return nil
+	}
+	start, end := w.Nodes[0], w.Nodes[len(w.Nodes)-1]
+	shared := w.Nodes[1 : 1+w.Shared]
+	first := w.Nodes[1+w.Shared : 1+w.Shared+w.Below[0]]
+	second := w.Nodes[1+w.Shared+w.Below[0] : len(w.Nodes)-1]
+
+	var nodes []Node
+	nodes = append(nodes, start)
+	nodes = append(nodes, shared...)
+	nodes = append(nodes, first...)
+	nodes = append(nodes, end)
+
+	// The paths are the same above the last shared branch:
+	nodes = append(nodes, start)
+	nodes = append(nodes, shared[:len(shared)-1]...)
+	nodes = append(nodes, withModifiedIndex(shared[len(shared)-1], w.Positions[1]))
+	nodes = append(nodes, second...)
+	nodes = append(nodes, end)
+
+	return nodes
+}
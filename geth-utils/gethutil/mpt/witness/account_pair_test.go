@@ -0,0 +1,46 @@
+package witness
+
+import (
+	"testing"
+
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The two accounts of the example state are in the same branch, at the first nibble in which
+// their hashed addresses differ.
+func TestAccountPairWitness(t *testing.T) {
+	root, nodes := exampleState()
+	setMemoryState(t, root, nodes...)
+
+	pair, err := GetAccountPairWitness("", 1, exampleEOA, exampleContract)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths [2][]byte
+	for i, addr := range pair.Addresses {
+		paths[i] = trie.KeybytesToHex(crypto.Keccak256(addr.Bytes()))
+	}
+	d := 0
+	for paths[0][d] == paths[1][d] {
+		d++
+	}
+	if pair.Shared < 1 || pair.Positions[0] != int(paths[0][d]) || pair.Positions[1] != int(paths[1][d]) {
+		t.Fatalf("%d shared branches, positions %v, expected %d and %d", pair.Shared, pair.Positions, paths[0][d], paths[1][d])
+	}
+	first := pair.Nodes[pair.Shared+pair.Below[0]]
+	second := pair.Nodes[len(pair.Nodes)-2]
+	if first.Account == nil || second.Account == nil {
+		t.Fatal("expected both account leaves")
+	}
+
+	separate, err := GetWitnessResult("", 1, []TrieModification{NewAccountRead(exampleEOA), NewAccountRead(exampleContract)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := DiffNodes(pair.Expand(), separate.Nodes); len(diffs) != 0 {
+		t.Fatalf("expanded witness differs from the separate witnesses: %v", diffs)
+	}
+}
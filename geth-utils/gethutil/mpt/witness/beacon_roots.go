@@ -0,0 +1,61 @@
+package witness
+
+import (
+	"fmt"
+	"math/big"
+
+	"main/gethutil/mpt/oracle"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// BeaconRootsAddress is the address of the beacon block roots contract (EIP-4788).
+var BeaconRootsAddress = common.HexToAddress("0x000F3df6D732807Ef1319fB7B8bB8522d0Beac02")
+
+// beaconRootsBufferLength is the length of the ring buffers of the beacon block roots contract
+// (HISTORY_BUFFER_LENGTH).
+const beaconRootsBufferLength = 8191
+
+// BeaconRootsModifications returns the two storage writes of the beacon block roots contract
+// at the beginning of the block with the given timestamp: the timestamp is stored at the slot
+// timestamp % 8191 of the first ring buffer and the parent beacon block root at the same position
+// of the second ring buffer (the slot timestamp % 8191 + 8191).
+func BeaconRootsModifications(timestamp uint64, parentBeaconRoot common.Hash) []TrieModification {
+	timestampIndex := timestamp % beaconRootsBufferLength
+	timestampSlot := common.BigToHash(new(big.Int).SetUint64(timestampIndex))
+	rootSlot := common.BigToHash(new(big.Int).SetUint64(timestampIndex + beaconRootsBufferLength))
+
+	return []TrieModification{
+		NewStorageChange(BeaconRootsAddress, timestampSlot, common.BigToHash(new(big.Int).SetUint64(timestamp))),
+		NewStorageChange(BeaconRootsAddress, rootSlot, parentBeaconRoot),
+	}
+}
+
+// GetBeaconRootsWitness returns the witness of the beacon block roots contract writes of the block
+// blockNum (see BeaconRootsModifications), they are applied to the state after the block blockNum-1.
+// The block needs to be a Cancun block (with the parent beacon block root in the header).
+func GetBeaconRootsWitness(nodeUrl string, blockNum int, opts ...WitnessOption) ([]Node, error) {
+	oracle.NodeUrl = nodeUrl
+	header, err := fetchHeader(blockNum)
+	if err != nil {
+		return nil, err
+	}
+	if header.ParentBeaconRoot == nil {
+		return nil, fmt.Errorf("block %d has no parent beacon block root", blockNum)
+	}
+
+	result, err := GetWitnessResult(nodeUrl, blockNum-1, BeaconRootsModifications(header.Time, *header.ParentBeaconRoot), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Nodes, nil
+}
+
+// fetchHeader returns the header of the block, the fetch failure is returned as *WitnessError.
+func fetchHeader(blockNum int) (header types.Header, err error) {
+	defer recoverWitnessError(-1, common.Address{}, &err)
+
+	return oracle.PrefetchBlock(big.NewInt(int64(blockNum)), true, nil), nil
+}
@@ -0,0 +1,67 @@
+package witness
+
+import (
+	"math/big"
+	"testing"
+
+	"main/gethutil/mpt/oracle"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The first Cancun block on mainnet (19426587) has the timestamp 1710338135, which is at the
+// position 8189 of the ring buffers.
+func TestBeaconRootsModifications(t *testing.T) {
+	root := common.HexToHash("0x2a")
+	mods := BeaconRootsModifications(1710338135, root)
+	if len(mods) != 2 {
+		t.Fatalf("expected 2 modifications, got %d", len(mods))
+	}
+	expected := []TrieModification{
+		{Type: StorageChanged, Address: BeaconRootsAddress, Key: common.BigToHash(big.NewInt(8189)), Value: common.BigToHash(big.NewInt(1710338135))},
+		{Type: StorageChanged, Address: BeaconRootsAddress, Key: common.BigToHash(big.NewInt(16380)), Value: root},
+	}
+	for i, mod := range mods {
+		if mod.Type != expected[i].Type || mod.Address != expected[i].Address || mod.Key != expected[i].Key || mod.Value != expected[i].Value {
+			t.Fatalf("modification %d: expected %+v, got %+v", i, expected[i], mod)
+		}
+	}
+}
+
+func TestGetBeaconRootsWitness(t *testing.T) {
+	timestamp := uint64(1710338135)
+	timestampSlot := common.BigToHash(big.NewInt(8189))
+	// The contract stores the timestamp of the previous write at the slot already:
+	accountLeaf, storageLeaf := singleSlotState(BeaconRootsAddress, timestampSlot, common.BigToHash(big.NewInt(int64(timestamp-8191*12))))
+	stateRoot := crypto.Keccak256Hash(accountLeaf)
+
+	parentBeaconRoot := common.HexToHash("0x2a")
+	provider := oracle.NewMemoryProvider()
+	provider.AddNodes(accountLeaf, storageLeaf)
+	provider.AddHeader(types.Header{Number: big.NewInt(1), Root: stateRoot, Difficulty: big.NewInt(0)})
+	provider.AddHeader(types.Header{Number: big.NewInt(2), Root: stateRoot, Difficulty: big.NewInt(0),
+		Time: timestamp, ParentBeaconRoot: &parentBeaconRoot})
+	oracle.SetProvider(provider)
+	t.Cleanup(func() { oracle.SetProvider(nil) })
+
+	nodes, err := GetBeaconRootsWitness("", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := 0
+	for _, node := range nodes {
+		if node.Start != nil && node.Start.ProofType == "StorageChanged" {
+			changes++
+		}
+	}
+	if changes != 2 {
+		t.Fatalf("expected 2 storage changes, got %d", changes)
+	}
+
+	// Block 1 has no parent beacon block root:
+	if _, err := GetBeaconRootsWitness("", 1); err == nil {
+		t.Fatal("expected an error for a block without the parent beacon block root")
+	}
+}
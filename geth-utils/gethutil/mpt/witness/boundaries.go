@@ -0,0 +1,57 @@
+package witness
+
+import "bytes"
+
+// isEndNode returns whether the node is the end node of a modification (see GetEndNode).
+func isEndNode(node Node) bool {
+	return node.Start != nil && node.Start.ProofType == "Disabled"
+}
+
+// trimRedundantBoundaries omits the start nodes that follow an end node and have the same flags as
+// the previous start node and the start root equal to the previous end root. The roots of the omitted
+// start node are moved into the end node before it (the end node has zero roots otherwise), the
+// chaining can thus still be verified: the S root in the end node is the C root of the previous
+// modification. The nodes are not modified, ExpandBoundaries restores them.
+func trimRedundantBoundaries(nodes []Node) []Node {
+	trimmed := make([]Node, 0, len(nodes))
+	var prev *StartNode
+	var prevCRoot []byte
+	for _, node := range nodes {
+		if node.Start == nil || isEndNode(node) {
+			trimmed = append(trimmed, node)
+			continue
+		}
+		last := len(trimmed) - 1
+		if prev != nil && *node.Start == *prev && last >= 0 && isEndNode(trimmed[last]) &&
+			bytes.Equal(node.Values[0], prevCRoot) {
+			trimmed[last].Values = node.Values
+		} else {
+			trimmed = append(trimmed, node)
+		}
+		prev, prevCRoot = node.Start, node.Values[1]
+	}
+
+	return trimmed
+}
+
+// ExpandBoundaries reconstructs the start nodes omitted by WithoutRedundantBoundaries, the witness
+// is then the same as generated without the option.
+func ExpandBoundaries(nodes []Node) []Node {
+	expanded := make([]Node, 0, len(nodes))
+	var prev *StartNode
+	for i, node := range nodes {
+		if node.Start != nil && !isEndNode(node) {
+			prev = node.Start
+		}
+		// The end node followed by a node that is not a start node carries the roots of the omitted
+		// start node.
+		if prev != nil && isEndNode(node) && i+1 < len(nodes) && nodes[i+1].Start == nil {
+			start := *prev
+			expanded = append(expanded, GetEndNode(), Node{Start: &start, Values: node.Values})
+			continue
+		}
+		expanded = append(expanded, node)
+	}
+
+	return expanded
+}
@@ -0,0 +1,69 @@
+package witness
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestWithoutRedundantBoundaries(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	addrh := crypto.Keccak256(addr.Bytes())
+	roots := []common.Hash{common.HexToHash("0x01"), common.HexToHash("0x02"), common.HexToHash("0x03"), common.HexToHash("0x04")}
+
+	// Three chained nonce modifications:
+	var nodes []Node
+	for i := 0; i < 3; i++ {
+		leafS := makeAccountLeaf(t, addrh, 0, uint64(i), big.NewInt(5))
+		leafC := makeAccountLeaf(t, addrh, 0, uint64(i+1), big.NewInt(5))
+		nodes = append(nodes,
+			GetStartNode("NonceChanged", roots[i], roots[i+1], 0),
+			prepareAccountLeafNode(addr, addrh, leafS, leafC, nil, trie.KeybytesToHex(addrh), false, false, false, AccountLayoutCurrent),
+			GetEndNode())
+	}
+	original := append([]Node(nil), nodes...)
+
+	trimmed := trimRedundantBoundaries(nodes)
+	boundaries := 0
+	for _, node := range trimmed {
+		if node.Start != nil {
+			boundaries++
+		}
+	}
+	if boundaries != 4 {
+		t.Fatalf("expected 4 boundary nodes, got %d", boundaries)
+	}
+	if diffs := DiffNodes(nodes, original); len(diffs) != 0 {
+		t.Fatalf("original nodes modified: %v", diffs)
+	}
+
+	// The chaining: the S root in the end node is the C root of the previous modification.
+	cRoot := trimmed[0].Values[1]
+	for _, node := range trimmed[1:] {
+		if !isEndNode(node) || bytes.Equal(node.Values[1], GetEndNode().Values[1]) {
+			continue
+		}
+		if !bytes.Equal(node.Values[0], cRoot) {
+			t.Fatalf("end node root %x does not chain to %x", node.Values[0], cRoot)
+		}
+		cRoot = node.Values[1]
+	}
+	if !bytes.Equal(cRoot[1:33], roots[3].Bytes()) {
+		t.Fatalf("wrong final root %x", cRoot)
+	}
+
+	if diffs := DiffNodes(ExpandBoundaries(trimmed), original); len(diffs) != 0 {
+		t.Fatalf("expanded witness differs from the original: %v", diffs)
+	}
+
+	// The start nodes of a different proof type than the previous one are kept:
+	nodes[3] = GetStartNode("BalanceChanged", roots[1], roots[2], 0)
+	if got := len(trimRedundantBoundaries(nodes)); got != len(nodes) {
+		t.Fatalf("expected no start node omitted, got %d of %d nodes", got, len(nodes))
+	}
+}
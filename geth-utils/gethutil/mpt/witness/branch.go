@@ -1,21 +1,17 @@
 package witness
 
 import (
-	"log"
-
-	"github.com/ethereum/go-ethereum/rlp"
+	"bytes"
+	"fmt"
 )
 
+// emptyBranch is the branch without children. It is the placeholder branch when there is no
+// branch in the proofs to take as the placeholder.
+var emptyBranch = append([]byte{192 + 17}, bytes.Repeat([]byte{128}, 17)...)
+
 // isBranch takes GetProof element and returns whether the element is a branch.
 func isBranch(proofEl []byte) bool {
-	elems, _, err := rlp.SplitList(proofEl)
-	check(err)
-	c, err1 := rlp.CountValues(elems)
-	check(err1)
-	if c != 2 && c != 17 {
-		log.Fatal("Proof element is neither leaf or branch")
-	}
-	return c == 17
+	return checkNodeRLP(proofEl, 0, "proof element") == 17
 }
 
 // prepareBranchWitness takes the rows that are to be filled with branch data and it takes
@@ -24,17 +20,17 @@ func isBranch(proofEl []byte) bool {
 // node when it applies). The parameter branchStart depends on whether it is S or C branch -
 // S occupies the first 34 columns, C occupies the next 34 columns.
 // The branch children are positioned each in its own row.
-func prepareBranchWitness(rows [][]byte, branch []byte, branchStart int, branchRLPOffset int) {
+// The RLP of the 17th branch element (the value slot) is returned. The value slot is always
+// empty (128) in the state and storage tries as all keys are of the same length, but a branch
+// can hold a value in a general MPT.
+func prepareBranchWitness(rows [][]byte, branch []byte, branchStart int, branchRLPOffset int) []byte {
 	branchNodeRLPLen := 2 // we have two positions for RLP meta data
 	rowInd := 1
 	colInd := branchNodeRLPLen - 1
 
 	i := 0
 	insideInd := -1
-	for {
-		if branchRLPOffset+i == len(branch)-1 { // -1 because of the last 128 (branch value)
-			break
-		}
+	for rowInd < 17 { // rows 1 to 16 are for the 16 children, the value slot follows them
 		b := branch[branchRLPOffset+i]
 		if insideInd == -1 && b == 128 {
 			rows[rowInd][branchStart] = b
@@ -63,45 +59,39 @@ func prepareBranchWitness(rows [][]byte, branch []byte, branchStart int, branchR
 
 		i++
 	}
+
+	return branch[branchRLPOffset+i:]
+}
+
+// listPrefix returns the copy of the RLP prefix of the list node: a single byte when the list
+// content is at most 55 bytes long (for example a branch with only one hashed child), otherwise
+// the byte 247 + n followed by the n bytes of the content length.
+func listPrefix(node []byte) []byte {
+	n := 1
+	if node[0] > 247 {
+		n += int(node[0] - 247)
+	}
+
+	return append([]byte{}, node[:n]...)
 }
 
 func prepareBranchNode(branch1, branch2, extNode1, extNode2, extListRlpBytes []byte, extValues [][]byte, key, driftedInd byte,
 	isBranchSPlaceholder, isBranchCPlaceholder, isExtension bool) Node {
+	checkNodeRLP(branch1, 17, "S branch")
+	checkNodeRLP(branch2, 17, "C branch")
+	if isExtension {
+		checkNodeRLP(extNode1, 2, "S extension node")
+		checkNodeRLP(extNode2, 2, "C extension node")
+	}
 	extensionNode := ExtensionNode{
 		ListRlpBytes: extListRlpBytes,
 	}
 
 	var listRlpBytes [2][]byte
-	branch1RLPOffset := 1
-	branch2RLPOffset := 1
-	listRlpBytes1 := []byte{branch1[0]}
-	listRlpBytes2 := []byte{branch2[0]}
-
-	if branch1[0] == 248 { // two RLP bytes
-		branch1RLPOffset = 2
-	} else if branch1[0] == 249 { // three RLP bytes
-		branch1RLPOffset = 3
-	}
-
-	if branch2[0] == 248 { // two RLP bytes
-		branch2RLPOffset = 2
-	} else if branch2[0] == 249 { // three RLP bytes
-		branch2RLPOffset = 3
-	}
-
-	if branch1[0] == 248 || branch1[0] == 249 {
-		listRlpBytes1 = append(listRlpBytes1, branch1[1])
-	}
-	if branch2[0] == 248 || branch2[0] == 249 {
-		listRlpBytes2 = append(listRlpBytes2, branch2[1])
-	}
-
-	if branch1[0] == 249 {
-		listRlpBytes1 = append(listRlpBytes1, branch1[2])
-	}
-	if branch2[0] == 249 {
-		listRlpBytes2 = append(listRlpBytes2, branch2[2])
-	}
+	listRlpBytes1 := listPrefix(branch1)
+	listRlpBytes2 := listPrefix(branch2)
+	branch1RLPOffset := len(listRlpBytes1)
+	branch2RLPOffset := len(listRlpBytes2)
 
 	listRlpBytes[0] = listRlpBytes1
 	listRlpBytes[1] = listRlpBytes2
@@ -119,18 +109,12 @@ func prepareBranchNode(branch1, branch2, extNode1, extNode2, extListRlpBytes []b
 		Branch:        branchNode,
 	}
 
-	values := make([][]byte, 17)
-	for i := 0; i < len(values); i++ {
-		values[i] = make([]byte, valueLen)
-	}
-	prepareBranchWitness(values, branch1, 0, branch1RLPOffset)
+	values := makeRows(17, len(extValues))
+	extensionBranch.Branch.ValueRlp[0] = prepareBranchWitness(values, branch1, 0, branch1RLPOffset)
 
 	// Just to get the modified child:
-	rows := make([][]byte, 17)
-	for i := 0; i < len(rows); i++ {
-		rows[i] = make([]byte, valueLen)
-	}
-	prepareBranchWitness(rows, branch2, 0, branch2RLPOffset)
+	rows := makeRows(17, 0)
+	extensionBranch.Branch.ValueRlp[1] = prepareBranchWitness(rows, branch2, 0, branch2RLPOffset)
 	values[0] = rows[1+key]
 
 	values = append(values, extValues...)
@@ -149,45 +133,54 @@ func prepareBranchNode(branch1, branch2, extNode1, extNode2, extListRlpBytes []b
 	return node
 }
 
-// getDriftedPosition returns the position in branch to which the leaf drifted because another
-// leaf has been added to the same slot. This information is stored into a branch init row.
-func getDriftedPosition(leafKeyRow []byte, numberOfNibbles int) byte {
-	var nibbles []byte
-	if leafKeyRow[0] != 248 {
-		keyLen := int(leafKeyRow[1] - 128)
-		if (leafKeyRow[2] != 32) && (leafKeyRow[2] != 0) { // second term is for extension node
-			if leafKeyRow[2] < 32 { // extension node
-				nibbles = append(nibbles, leafKeyRow[2]-16)
-			} else { // leaf
-				nibbles = append(nibbles, leafKeyRow[2]-48)
-			}
-		}
-		for i := 0; i < keyLen-1; i++ { // -1 because the first byte doesn't have any nibbles
-			b := leafKeyRow[3+i]
-			n1 := b / 16
-			n2 := b - n1*16
-			nibbles = append(nibbles, n1)
-			nibbles = append(nibbles, n2)
-		}
+// getKeyRowNibbles returns the nibbles stored in the key of a leaf or an extension node.
+// The first key byte holds the hex-prefix flags; if the number of nibbles is odd,
+// it holds the first nibble too.
+func getKeyRowNibbles(keyRow []byte) []byte {
+	start := 1
+	if keyRow[0] > 247 {
+		start = 1 + int(keyRow[0]-247)
+	}
+	var keyBytes []byte
+	if keyRow[start] < 128 {
+		// Only one byte for the key, for example [194,48,1] or [226,16,160,...]
+		keyBytes = keyRow[start : start+1]
 	} else {
-		keyLen := int(leafKeyRow[2] - 128)
-		if (leafKeyRow[3] != 32) && (leafKeyRow[3] != 0) { // second term is for extension node
-			if leafKeyRow[3] < 32 { // extension node
-				nibbles = append(nibbles, leafKeyRow[3]-16)
-			} else { // leaf
-				nibbles = append(nibbles, leafKeyRow[3]-48)
-			}
+		keyLen := int(keyRow[start] - 128)
+		keyBytes = keyRow[start+1 : start+1+keyLen]
+	}
+
+	var nibbles []byte
+	if keyBytes[0]&16 != 0 { // odd number of nibbles
+		nibbles = append(nibbles, keyBytes[0]%16)
+	}
+	for _, b := range keyBytes[1:] {
+		nibbles = append(nibbles, b/16)
+		nibbles = append(nibbles, b%16)
+	}
+
+	return nibbles
+}
+
+// driftedNibble returns the position in the newly added branch to which the leaf drifted because
+// another leaf has been added to the same slot (or, for deletion, the position from which it drifted
+// back). The drifted node (leafRow0) resides at keyIndex of key. The nibbles that the drifted node
+// and key have in common form the extension node above the new branch (if any); the first nibble
+// in which they differ is the drifted position. The same holds when the drifted node is
+// an extension node (modified extension node case).
+// The number of the common nibbles is returned too: the new branch is at keyIndex plus this number.
+func driftedNibble(leafRow0 []byte, key []byte, keyIndex int) (byte, int, error) {
+	nibbles := getKeyRowNibbles(leafRow0)
+	for i, n := range nibbles {
+		if keyIndex+i >= len(key) {
+			break
 		}
-		for i := 0; i < keyLen-1; i++ { // -1 because the first byte doesn't have any nibbles
-			b := leafKeyRow[4+i]
-			n1 := b / 16
-			n2 := b - n1*16
-			nibbles = append(nibbles, n1)
-			nibbles = append(nibbles, n2)
+		if n != key[keyIndex+i] {
+			return n, i, nil
 		}
 	}
 
-	return nibbles[numberOfNibbles]
+	return 0, 0, fmt.Errorf("drifted node key does not diverge from the key at index %d", keyIndex)
 }
 
 // addBranchAndPlaceholder adds to the rows a branch and its placeholder counterpart
@@ -205,10 +198,7 @@ func addBranchAndPlaceholder(proof1, proof2,
 
 	numberOfNibbles := 0
 	var extListRlpBytes []byte
-	var extValues [][]byte
-	for i := 0; i < 4; i++ {
-		extValues = append(extValues, make([]byte, valueLen))
-	}
+	extValues := makeRows(4, 0)
 
 	isExtension := (len1 == len2+2) || (len2 == len1+2)
 	if isExtension {
@@ -265,26 +255,28 @@ func addBranchAndPlaceholder(proof1, proof2,
 	// Note that isModifiedExtNode happens also when we have a branch instead of shortExtNode
 	isModifiedExtNode := !isBranch(longExtNode) && !isShorterProofLastLeaf
 
-	if len1 > len2 {
-		// We now get the first nibble of the leaf that was turned into branch.
-		// This first nibble presents the position of the leaf once it moved
-		// into the new branch.
-		driftedInd := getDriftedPosition(leafRow0, numberOfNibbles)
+	// We now get the nibble of the leaf that was turned into branch.
+	// This nibble presents the position of the leaf once it moved
+	// into the new branch.
+	driftedInd, commonNibbles, err := driftedNibble(leafRow0, key, keyIndex)
+	check(err)
 
-		node = prepareBranchNode(proof1[len1-2], proof1[len1-2], extNode, extNode, extListRlpBytes, extValues,
-			key[keyIndex+numberOfNibbles], driftedInd, false, true, isExtension)
+	// The nibbles the drifted node shares with the key are the nibbles of the extension node above
+	// the new branch. When the shorter proof ends in an extension node, this extension node is split:
+	// the part before the divergence becomes the new extension node, so its nibbles need to be
+	// the same as the ones in the longer proof.
+	if commonNibbles != numberOfNibbles {
+		panic(unsupportedShape("extension node above the placeholder branch has %d nibbles, the drifted node shares %d nibbles with the key",
+			numberOfNibbles, commonNibbles))
+	}
+	modifiedInd := key[keyIndex+commonNibbles]
 
-		// We now get the first nibble of the leaf that was turned into branch.
-		// This first nibble presents the position of the leaf once it moved
-		// into the new branch.
+	if len1 > len2 {
+		node = prepareBranchNode(proof1[len1-2], proof1[len1-2], extNode, extNode, extListRlpBytes, extValues,
+			modifiedInd, driftedInd, false, true, isExtension)
 	} else {
-		// We now get the first nibble of the leaf that was turned into branch.
-		// This first nibble presents the position of the leaf once it moved
-		// into the new branch.
-		driftedInd := getDriftedPosition(leafRow0, numberOfNibbles)
-
 		node = prepareBranchNode(proof2[len2-2], proof2[len2-2], extNode, extNode, extListRlpBytes, extValues,
-			key[keyIndex+numberOfNibbles], driftedInd, true, false, isExtension)
+			modifiedInd, driftedInd, true, false, isExtension)
 	}
 
 	return isModifiedExtNode, isExtension, numberOfNibbles, node
@@ -0,0 +1,330 @@
+package witness
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// makeKeyRow returns the RLP of a node with the given nibbles as key (with the terminator
+// appended for leaves) and val as value.
+func makeKeyRow(t *testing.T, nibbles []byte, isLeaf bool, val []byte) []byte {
+	hex := append([]byte{}, nibbles...)
+	if isLeaf {
+		hex = append(hex, 16)
+	}
+	row, err := rlp.EncodeToBytes([][]byte{trie.HexToCompact(hex), val})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return row
+}
+
+func TestDriftedNibblePlainBranch(t *testing.T) {
+	key := trie.KeybytesToHex(common.HexToHash("0x3c5a").Bytes())
+	keyIndex := 2
+	// The existing leaf differs from key in the first nibble after keyIndex,
+	// so the new branch is placed directly at keyIndex.
+	leafNibbles := append([]byte{}, key[keyIndex:64]...)
+	leafNibbles[0] = 7
+	leaf := makeKeyRow(t, leafNibbles, true, common.HexToHash("0x1").Bytes())
+
+	n, _, err := driftedNibble(leaf, key, keyIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Fatalf("wrong drifted nibble %d", n)
+	}
+}
+
+func TestDriftedNibbleExtensionThenBranch(t *testing.T) {
+	key := trie.KeybytesToHex(common.HexToHash("0xab12").Bytes())
+	keyIndex := 1
+	// The existing leaf shares three nibbles with key (these become an extension node),
+	// the new branch is placed after them.
+	leafNibbles := append([]byte{}, key[keyIndex:64]...)
+	leafNibbles[3] = (key[keyIndex+3] + 1) % 16
+	leaf := makeKeyRow(t, leafNibbles, true, []byte{1})
+
+	n, shared, err := driftedNibble(leaf, key, keyIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != leafNibbles[3] {
+		t.Fatalf("wrong drifted nibble %d, expected %d", n, leafNibbles[3])
+	}
+	if shared != 3 {
+		t.Fatalf("wrong number of common nibbles %d", shared)
+	}
+}
+
+func TestDriftedNibbleModifiedExtension(t *testing.T) {
+	key := trie.KeybytesToHex(common.HexToHash("0xab12").Bytes())
+	keyIndex := 4
+	// Extension node with nibbles n5 n6 n7 where the key continues with n5 m1:
+	extNibbles := []byte{key[keyIndex], (key[keyIndex+1] + 3) % 16, 9}
+	ext := makeKeyRow(t, extNibbles, false, common.HexToHash("0xff").Bytes())
+
+	n, _, err := driftedNibble(ext, key, keyIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != extNibbles[1] {
+		t.Fatalf("wrong drifted nibble %d, expected %d", n, extNibbles[1])
+	}
+
+	// Extension node with only one nibble (key stored in a single byte):
+	ext = makeKeyRow(t, []byte{(key[keyIndex] + 1) % 16}, false, common.HexToHash("0xff").Bytes())
+	n, _, err = driftedNibble(ext, key, keyIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != (key[keyIndex]+1)%16 {
+		t.Fatalf("wrong drifted nibble %d", n)
+	}
+}
+
+func TestDriftedNibbleSameKey(t *testing.T) {
+	key := trie.KeybytesToHex(common.HexToHash("0xab12").Bytes())
+	leaf := makeKeyRow(t, key[10:64], true, []byte{1})
+
+	if _, _, err := driftedNibble(leaf, key, 10); err == nil {
+		t.Fatal("expected error for a leaf at the queried key")
+	}
+}
+
+type testProofList [][]byte
+
+func (n *testProofList) Put(key []byte, value []byte) error {
+	*n = append(*n, value)
+	return nil
+}
+
+func (n *testProofList) Delete(key []byte) error {
+	panic("not supported")
+}
+
+func proveKey(t *testing.T, tr *trie.Trie, key []byte) ([][]byte, [][]byte) {
+	var proof testProofList
+	_, extNibbles, _, _, err := tr.Prove(key, 0, &proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return proof, extNibbles
+}
+
+// The shorter (S) proof ends in an extension node: the added key diverges from the extension
+// nibbles, the extension node is split and the new branch is placed below the part of
+// the extension that the key shares with it.
+func TestAddBranchAndPlaceholderShorterProofEndsInExtension(t *testing.T) {
+	value := common.HexToHash("0x1234").Bytes()
+	for _, tc := range []struct {
+		name          string
+		newKeyPrefix  []byte
+		commonNibbles int
+		modifiedInd   byte
+		driftedInd    byte
+	}{
+		// Extension nibbles a b 1, the key diverges at the first nibble after a:
+		{"one common nibble", []byte{0xac}, 1, 0xc, 0xb},
+		// The key diverges at the last extension nibble:
+		{"two common nibbles", []byte{0xab, 0x20}, 2, 0x2, 0x1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr, err := trie.New(common.Hash{}, &trie.Database{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			key1 := common.RightPadBytes([]byte{0xab, 0x12}, 32)
+			key2 := common.RightPadBytes([]byte{0xab, 0x13}, 32)
+			tr.Update(key1, value)
+			tr.Update(key2, value)
+
+			newKey := common.RightPadBytes(tc.newKeyPrefix, 32)
+			proof1, extNibblesS := proveKey(t, tr, newKey)
+			tr.Update(newKey, value)
+			proof2, extNibblesC := proveKey(t, tr, newKey)
+
+			if len(proof1) != 1 || isBranch(proof1[0]) {
+				t.Fatalf("S proof should consist of the extension node only: %v", proof1)
+			}
+			if len(proof2) != 3 {
+				t.Fatalf("C proof should have new extension node, branch and leaf: %v", proof2)
+			}
+
+			var toBeHashed [][]byte
+			key := trie.KeybytesToHex(newKey)
+			isModifiedExtNode, isExtension, numberOfNibbles, node := addBranchAndPlaceholder(proof1, proof2,
+				extNibblesS, extNibblesC, proof1[0], key, nil, 0, 0, true, false, false, false, &toBeHashed)
+
+			if !isModifiedExtNode || !isExtension {
+				t.Fatalf("expected modified extension node above an extension node: %t %t", isModifiedExtNode, isExtension)
+			}
+			if numberOfNibbles != tc.commonNibbles {
+				t.Fatalf("wrong number of extension nibbles %d", numberOfNibbles)
+			}
+			branch := node.ExtensionBranch.Branch
+			if byte(branch.ModifiedIndex) != tc.modifiedInd || byte(branch.DriftedIndex) != tc.driftedInd {
+				t.Fatalf("wrong placeholder branch positions: modified %d, drifted %d", branch.ModifiedIndex, branch.DriftedIndex)
+			}
+		})
+	}
+}
+
+// makeBranch17 returns the RLP of a branch with hashed children at the given positions
+// and val in the value slot.
+func makeBranch17(t *testing.T, children []int, val []byte) []byte {
+	elems := make([][]byte, 17)
+	for _, c := range children {
+		elems[c] = common.HexToHash(fmt.Sprintf("0x%x", c+1)).Bytes()
+	}
+	elems[16] = val
+	branch, err := rlp.EncodeToBytes(elems)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return branch
+}
+
+func TestPrepareBranchNodeValueSlot(t *testing.T) {
+	branchS := makeBranch17(t, []int{3, 11}, nil)
+	branchC := makeBranch17(t, []int{3, 11}, []byte("abc"))
+
+	node := prepareBranchNode(branchS, branchC, nil, nil, nil, makeRows(4, 0), 3, 3, false, false, false)
+
+	branch := node.ExtensionBranch.Branch
+	if !bytes.Equal(branch.ValueRlp[0], []byte{128}) {
+		t.Fatalf("empty value slot: %v", branch.ValueRlp[0])
+	}
+	if !bytes.Equal(branch.ValueRlp[1], []byte{131, 'a', 'b', 'c'}) {
+		t.Fatalf("value slot: %v", branch.ValueRlp[1])
+	}
+	// The children rows are not affected by the value:
+	for _, c := range []int{3, 11} {
+		row := node.Values[1+c]
+		if row[0] != 160 || !bytes.Equal(row[1:33], common.HexToHash(fmt.Sprintf("0x%x", c+1)).Bytes()) {
+			t.Fatalf("wrong child %d row: %v", c, row)
+		}
+	}
+	if node.Values[1+5][0] != 128 {
+		t.Fatalf("wrong empty child row: %v", node.Values[1+5])
+	}
+	// Modified child is taken from the C branch:
+	if !bytes.Equal(node.Values[0], node.Values[1+3]) {
+		t.Fatalf("wrong modified child row: %v", node.Values[0])
+	}
+}
+
+// The branch with the hashed child at 3 and the inline child at 9 of the given encoded length.
+func makeInlineChildBranch(t *testing.T, inlineLen int) []byte {
+	inline, err := rlp.EncodeToBytes([][]byte{{0x3a}, bytes.Repeat([]byte{1}, inlineLen-3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	elems := make([]interface{}, 17)
+	for i := range elems {
+		elems[i] = []byte{}
+	}
+	elems[3] = common.HexToHash("0x4").Bytes()
+	elems[9] = rlp.RawValue(inline)
+	branch, err := rlp.EncodeToBytes(elems)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return branch
+}
+
+// The S branch content is 55 bytes long (short list), the C branch content is 56 bytes long
+// (long list with one length byte): the children are parsed after the prefix of each branch.
+func TestPrepareBranchNodeLongListBoundary(t *testing.T) {
+	branchS := makeInlineChildBranch(t, 7)
+	branchC := makeInlineChildBranch(t, 8)
+	if branchS[0] != 192+55 || branchC[0] != 248 || branchC[1] != 56 {
+		t.Fatalf("wrong test branches: %v, %v", branchS[:2], branchC[:2])
+	}
+
+	node := prepareBranchNode(branchS, branchC, nil, nil, nil, makeRows(4, 0), 9, 9, false, false, false)
+
+	branch := node.ExtensionBranch.Branch
+	if !bytes.Equal(branch.ListRlpBytes[0], []byte{192 + 55}) || !bytes.Equal(branch.ListRlpBytes[1], []byte{248, 56}) {
+		t.Fatalf("wrong list RLP bytes: %v", branch.ListRlpBytes)
+	}
+	if !bytes.Equal(branch.ValueRlp[0], []byte{128}) || !bytes.Equal(branch.ValueRlp[1], []byte{128}) {
+		t.Fatalf("wrong value slots: %v", branch.ValueRlp)
+	}
+	row := node.Values[1+3]
+	if row[0] != 160 || !bytes.Equal(row[1:33], common.HexToHash("0x4").Bytes()) {
+		t.Fatalf("wrong hashed child row: %v", row)
+	}
+	// The inline child row in S, the modified child row is taken from C:
+	if !bytes.Equal(node.Values[1+9][:7], branchS[1+41:1+41+7]) {
+		t.Fatalf("wrong S inline child row: %v", node.Values[1+9])
+	}
+	if !bytes.Equal(node.Values[0][:8], branchC[2+41:2+41+8]) {
+		t.Fatalf("wrong modified child row: %v", node.Values[0])
+	}
+}
+
+// The proof ends with the extension node, the branch and the leaf: the extension nibbles,
+// the branch position and the leaf nibbles give the whole key.
+func TestConvertProofExtensionBranchLeaf(t *testing.T) {
+	tr, err := trie.New(common.Hash{}, &trie.Database{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key1 := common.RightPadBytes([]byte{0xab, 0x12}, 32)
+	key2 := common.RightPadBytes([]byte{0xab, 0x13}, 32)
+	tr.Update(key1, []byte{1})
+	tr.Update(key2, []byte{2})
+	proof1, extNibblesS := proveKey(t, tr, key1)
+	tr.Update(key1, []byte{3})
+	proof2, extNibblesC := proveKey(t, tr, key1)
+	if len(proof1) != 3 || isBranch(proof1[0]) || !isBranch(proof1[1]) {
+		t.Fatalf("expected the extension node, the branch and the leaf: %d elements", len(proof1))
+	}
+
+	key := trie.KeybytesToHex(key1)
+	nodes := convertProofToWitness(nil, common.Address{}, nil, proof1, proof2, extNibblesS, extNibblesC,
+		common.BytesToHash(key1), key, nil, false, false, false, false, AccountLayoutCurrent)
+	if len(nodes) != 2 || nodes[0].ExtensionBranch == nil || !nodes[0].ExtensionBranch.IsExtension || nodes[1].Storage == nil {
+		t.Fatalf("expected the extension branch node and the leaf, got %d nodes", len(nodes))
+	}
+	var nibbles []byte
+	nibbles = append(nibbles, extNibblesS[0]...)
+	nibbles = append(nibbles, byte(nodes[0].ExtensionBranch.Branch.ModifiedIndex))
+	nibbles = append(nibbles, getKeyRowNibbles(nodes[1].KeccakData[1])...)
+	if !bytes.Equal(nibbles, key[:64]) {
+		t.Fatalf("key %x reconstructed as %x", key[:64], nibbles)
+	}
+}
+
+// The proof with the extension node directly above the leaf is rejected, the witness has no rows
+// for this shape.
+func TestConvertProofExtensionLeaf(t *testing.T) {
+	key := trie.KeybytesToHex(common.RightPadBytes([]byte{0xab, 0x12}, 32))
+	leaf := makeKeyRow(t, key[3:64], true, []byte{1})
+	ext := makeKeyRow(t, key[:3], false, crypto.Keccak256(leaf))
+	proof := [][]byte{ext, leaf}
+
+	err := func() (err error) {
+		defer recoverWitnessError(0, common.Address{}, &err)
+		convertProofToWitness(nil, common.Address{}, nil, proof, proof, [][]byte{key[:3]}, [][]byte{key[:3]},
+			common.Hash{}, key, nil, false, false, false, false, AccountLayoutCurrent)
+		return nil
+	}()
+	if !errors.Is(err, ErrUnsupportedShape) {
+		t.Fatalf("expected ErrUnsupportedShape, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package witness
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// COnlyProof is the C side of the witness of a modification (see WithCOnly): the account proof
+// and the storage proof (for the storage modifications) after the modification. SRoot and CRoot
+// are the state roots before and after the modification, the roots of the start node.
+type COnlyProof struct {
+	Index        int            `json:"index"`
+	Address      common.Address `json:"address"`
+	Key          common.Hash    `json:"key"`
+	SRoot        common.Hash    `json:"s_root"`
+	CRoot        common.Hash    `json:"c_root"`
+	AccountProof [][]byte       `json:"account_proof"`
+	StorageProof [][]byte       `json:"storage_proof,omitempty"`
+}
+
+// cOnlyProofs returns the C sides of the witnesses of the modification index (nodes), proofs are
+// the raw proofs of the witnesses (one per witness).
+func cOnlyProofs(index int, nodes []Node, proofs []RawProof) ([]COnlyProof, error) {
+	segments, err := SplitByModification(nodes)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) != len(proofs) {
+		return nil, fmt.Errorf("modification %d: %d witnesses and %d proofs", index, len(segments), len(proofs))
+	}
+
+	cOnly := make([]COnlyProof, len(segments))
+	for i, segment := range segments {
+		cOnly[i] = COnlyProof{
+			Index:        index,
+			Address:      proofs[i].Address,
+			Key:          proofs[i].Key,
+			SRoot:        common.BytesToHash(segment[0].Values[0][1:33]),
+			CRoot:        common.BytesToHash(segment[0].Values[1][1:33]),
+			AccountProof: proofs[i].AccountProofC,
+			StorageProof: proofs[i].StorageProofC,
+		}
+	}
+
+	return cOnly, nil
+}
@@ -0,0 +1,98 @@
+package witness
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+
+	"main/gethutil/mpt/state"
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// verifyCOnlyProof returns the value under key in the trie of the root, proven by proof.
+func verifyCOnlyProof(t *testing.T, root common.Hash, key []byte, proof [][]byte) []byte {
+	t.Helper()
+	proofDb := memorydb.New()
+	for _, proofEl := range proof {
+		proofDb.Put(crypto.Keccak256(proofEl), proofEl)
+	}
+	value, err := trie.VerifyProof(root, crypto.Keccak256(key), proofDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+// The C proofs prove the modified values in the state after each modification, the C root of
+// a modification is the S root of the next one and the last one is the post-state root.
+func TestWithCOnly(t *testing.T) {
+	root, nodes := exampleState()
+	setMemoryState(t, root, nodes...)
+	slot := common.BigToHash(big.NewInt(1))
+
+	result, err := GetWitnessResult("", 1, []TrieModification{
+		NewStorageChange(exampleContract, slot, common.HexToHash("0x2a")),
+		NewNonceChange(exampleEOA, 5),
+		NewBalanceChange(exampleEOA, big.NewInt(100)),
+	}, WithCOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Nodes != nil || result.RawProofs != nil {
+		t.Fatal("nodes or raw proofs attached with WithCOnly")
+	}
+	if len(result.COnly) != 3 {
+		t.Fatalf("got %d C proofs, want 3", len(result.COnly))
+	}
+
+	prevC := root
+	for i, proof := range result.COnly {
+		if proof.Index != i || proof.SRoot != prevC {
+			t.Fatalf("C proof %d: index %d, S root %s, the previous C root %s", i, proof.Index, proof.SRoot, prevC)
+		}
+		prevC = proof.CRoot
+
+		var account state.Account
+		if err := rlp.DecodeBytes(verifyCOnlyProof(t, proof.CRoot, proof.Address.Bytes(), proof.AccountProof), &account); err != nil {
+			t.Fatal(err)
+		}
+		switch i {
+		case 0:
+			value := verifyCOnlyProof(t, account.Root, proof.Key.Bytes(), proof.StorageProof)
+			if expected, _ := rlp.EncodeToBytes(big.NewInt(0x2a)); !bytes.Equal(value, expected) {
+				t.Fatalf("slot value %x, want %x", value, expected)
+			}
+		case 1:
+			if account.Nonce != 5 {
+				t.Fatalf("nonce %d, want 5", account.Nonce)
+			}
+		case 2:
+			if account.Balance.Cmp(big.NewInt(100)) != 0 || account.Nonce != 5 {
+				t.Fatalf("balance %s and nonce %d, want 100 and 5", account.Balance, account.Nonce)
+			}
+		}
+	}
+	if postRoot := result.IntermediateRoots[len(result.IntermediateRoots)-1]; prevC != postRoot {
+		t.Fatalf("last C root %s, post-state root %s", prevC, postRoot)
+	}
+}
+
+// The options operating on the witness nodes are rejected alongside WithCOnly, the nodes are not
+// in the result.
+func TestWithCOnlyIncompatibleOptions(t *testing.T) {
+	root, nodes := exampleState()
+	for _, opt := range []WitnessOption{WithoutLeaf(), WithSharedNodeDedup(), WithoutRedundantBoundaries(), WithRowIndices()} {
+		setMemoryState(t, root, nodes...)
+		_, err := GetWitnessResult("", 1, []TrieModification{NewNonceChange(exampleEOA, 5)}, WithCOnly(), opt)
+		if !errors.Is(err, ErrIncompatibleOptions) {
+			t.Fatalf("expected ErrIncompatibleOptions, got %v", err)
+		}
+	}
+}
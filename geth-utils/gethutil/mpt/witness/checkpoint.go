@@ -0,0 +1,159 @@
+package witness
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+
+	"main/gethutil/mpt/oracle"
+	"main/gethutil/mpt/state"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// checkpoint is the progress of GetWitnessResumable: the witness of the modifications
+// before NextModification.
+type checkpoint struct {
+	BlockNum         int
+	NextModification int
+	Nodes            []Node
+}
+
+// saveCheckpoint writes the checkpoint to a temporary file first and then renames it, so that
+// an interruption while writing does not destroy the previous checkpoint.
+func saveCheckpoint(path string, c checkpoint) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(c); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// loadCheckpoint returns the checkpoint stored at path, ok is false when there is no checkpoint.
+func loadCheckpoint(path string) (c checkpoint, ok bool, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, false, nil
+	}
+	if err != nil {
+		return c, false, err
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&c)
+
+	return c, err == nil, err
+}
+
+// lastCRoot returns the root after the last modification in the witness (the C root
+// in the start node of the last modification).
+func lastCRoot(nodes []Node) (common.Hash, bool) {
+	for i := len(nodes) - 1; i >= 0; i-- {
+		start := nodes[i].Start
+		if start != nil && start.ProofType != "Disabled" {
+			return common.BytesToHash(nodes[i].Values[1][1:33]), true
+		}
+	}
+
+	return common.Hash{}, false
+}
+
+// GetWitnessResumable is like GetWitness, but it persists the witness to checkpointPath after every
+// `every` modifications. When the checkpoint exists (the previous run has been interrupted), the
+// modifications that have already been processed are skipped. Only their changes are replayed on
+// the state (no proofs are taken and no witness is generated for them) and the resulting root is
+// checked against the last C root in the checkpoint, so that the witness continues from the correct
+// start root.
+// The checkpoint is removed once the whole witness is generated.
+func GetWitnessResumable(nodeUrl string, blockNum int, trieModifications []TrieModification, checkpointPath string, every int) ([]Node, error) {
+	if every < 1 {
+		every = 1
+	}
+
+	c, ok, err := loadCheckpoint(checkpointPath)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		c = checkpoint{BlockNum: blockNum}
+	}
+	if c.BlockNum != blockNum || c.NextModification > len(trieModifications) {
+		return nil, fmt.Errorf("checkpoint %s is for block %d with %d modifications processed", checkpointPath, c.BlockNum, c.NextModification)
+	}
+
+	if nodeUrl != "" {
+		oracle.NodeUrl = nodeUrl
+	}
+	statedb, err := openStateDB(blockNum)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := newKeyCache()
+	if c.NextModification > 0 {
+		for i, tMod := range trieModifications[:c.NextModification] {
+			if err := replayModification(i, tMod, statedb); err != nil {
+				return nil, err
+			}
+		}
+		root := statedb.GetTrie().Hash()
+		expected, _ := lastCRoot(c.Nodes)
+		if root != expected {
+			return nil, fmt.Errorf("state root %x after replaying %d modifications does not match the checkpoint root %x", root, c.NextModification, expected)
+		}
+	}
+
+	for i := c.NextModification; i < len(trieModifications); i++ {
+		nodes, err := witnessOfModification(i, trieModifications[i], statedb, nil, keys)
+		if err != nil {
+			return nil, err
+		}
+		c.Nodes = append(c.Nodes, nodes...)
+		c.NextModification = i + 1
+		if c.NextModification%every == 0 && c.NextModification < len(trieModifications) {
+			if err := saveCheckpoint(checkpointPath, c); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := os.Remove(checkpointPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return c.Nodes, nil
+}
+
+// replayModification applies the modification to the state as the witness generation does, but
+// without taking the proofs (the state fetches only what it needs to apply the change).
+func replayModification(index int, tMod TrieModification, statedb *state.StateDB) (err error) {
+	defer recoverWitnessError(index, tMod.Address, &err)
+
+	switch tMod.Type {
+	case AccountAndStorageChange:
+		for _, m := range splitAccountAndStorageChange(tMod) {
+			if err := replayModification(index, m, statedb); err != nil {
+				return err
+			}
+		}
+		return nil
+	case StorageChanged:
+		statedb.SetState(tMod.Address, tMod.Key, tMod.Value)
+	case StorageDoesNotExist:
+	default:
+		statedb.SetStateObjectIfExists(tMod.Address)
+		applyAccountModification(statedb, tMod)
+	}
+	statedb.IntermediateRoot(false)
+
+	return nil
+}
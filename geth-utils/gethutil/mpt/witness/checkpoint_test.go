@@ -0,0 +1,71 @@
+package witness
+
+import (
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"main/gethutil/mpt/oracle"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// The run resumed from the checkpoint gives the witness of the uninterrupted run. The modifications
+// in the checkpoint are only replayed on the state, the resumed run makes fewer oracle calls than
+// the uninterrupted one.
+func TestGetWitnessResumableReplaysState(t *testing.T) {
+	root, nodes := exampleState()
+	trieModifications := []TrieModification{
+		NewNonceChange(exampleEOA, 2),
+		NewStorageChange(exampleContract, common.BigToHash(big.NewInt(1)), common.HexToHash("0x2a")),
+		NewBalanceChange(exampleEOA, big.NewInt(100)),
+		NewStorageChange(exampleContract, common.BigToHash(big.NewInt(2)), common.HexToHash("0x2b")),
+	}
+
+	setMemoryState(t, root, nodes...)
+	calls := oracle.ProviderCalls()
+	result, err := GetWitnessResult("", 1, trieModifications)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullCalls := oracle.ProviderCalls() - calls
+	expected, err := json.Marshal(result.Nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate the run that has been interrupted after two modifications:
+	setMemoryState(t, root, nodes...)
+	interrupted, err := GetWitnessResult("", 1, trieModifications[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpointPath := filepath.Join(t.TempDir(), "witness.checkpoint")
+	err = saveCheckpoint(checkpointPath, checkpoint{BlockNum: 1, NextModification: 2, Nodes: interrupted.Nodes})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setMemoryState(t, root, nodes...)
+	calls = oracle.ProviderCalls()
+	resumedNodes, err := GetWitnessResumable("", 1, trieModifications, checkpointPath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumedCalls := oracle.ProviderCalls() - calls
+	resumed, err := json.Marshal(resumedNodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resumed) != string(expected) {
+		t.Fatal("resumed witness differs from the witness generated in one run")
+	}
+	if resumedCalls >= fullCalls {
+		t.Fatalf("resumed run made %d oracle calls, the uninterrupted run %d", resumedCalls, fullCalls)
+	}
+	if _, err := os.Stat(checkpointPath); !os.IsNotExist(err) {
+		t.Fatal("checkpoint not removed after the witness is generated")
+	}
+}
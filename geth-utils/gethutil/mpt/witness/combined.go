@@ -0,0 +1,163 @@
+package witness
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// CombinedStorageWitness is the read-only witness of several storage slots of one account in which
+// the storage trie branches shared by the proofs of the slots are present once. Nodes holds the start
+// node and the account trie nodes (the same for all the slots), then the storage trie nodes of each
+// slot without the branches it shares with the previous slot, and the end node. Expand returns
+// the witness of each slot in turn, as generated by GetAccessListWitness.
+type CombinedStorageWitness struct {
+	Nodes []Node
+	Slots []CombinedSlot
+}
+
+// CombinedSlot describes the storage trie nodes of a slot in CombinedStorageWitness.
+type CombinedSlot struct {
+	Key   common.Hash
+	Start StartNode
+	// Shared holds the modified index (the nibble of the key of this slot) of each branch the slot
+	// shares with the previous slot, from the storage root down. These branches are not repeated
+	// in Nodes.
+	Shared []int
+	// Nodes is the number of the storage trie nodes of the slot (below the shared branches) in Nodes.
+	Nodes int
+}
+
+// GetCombinedStorageWitness returns the combined read-only witness of the storage slots of the account
+// at addr (see CombinedStorageWitness). The account needs to exist and at least one key is needed.
+func GetCombinedStorageWitness(nodeUrl string, blockNum int, addr common.Address, keys []common.Hash) (CombinedStorageWitness, error) {
+	if len(keys) == 0 {
+		return CombinedStorageWitness{}, errors.New("no storage keys")
+	}
+	nodes, err := GetAccessListWitness(nodeUrl, blockNum, []AccessListEntry{{Address: addr, StorageKeys: keys}})
+	if err != nil {
+		return CombinedStorageWitness{}, err
+	}
+
+	return combineStorageWitnesses(nodes)
+}
+
+// accountNodesEnd returns the index after the account leaf in the nodes, -1 if there is none.
+func accountNodesEnd(nodes []Node) int {
+	for i, node := range nodes {
+		if node.Account != nil {
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+// combineStorageWitnesses combines the witnesses of the storage slots of one account: each storage
+// trie branch which is the same trie node as the branch at the same depth in the previous slot is
+// omitted (only the slot's modified index is kept).
+func combineStorageWitnesses(nodes []Node) (CombinedStorageWitness, error) {
+	segments, err := SplitByModification(nodes)
+	if err != nil {
+		return CombinedStorageWitness{}, err
+	}
+
+	var combined CombinedStorageWitness
+	var accountNodes, prev []Node
+	for i, segment := range segments {
+		body := segment[1 : len(segment)-1]
+		end := accountNodesEnd(body)
+		if end == -1 || end == len(body) {
+			return CombinedStorageWitness{}, fmt.Errorf("modification %d is not a storage modification", i)
+		}
+		if i == 0 {
+			accountNodes = body[:end]
+			combined.Nodes = append(combined.Nodes, segment[0])
+			combined.Nodes = append(combined.Nodes, accountNodes...)
+		} else if diffs := DiffNodes(body[:end], accountNodes); len(diffs) != 0 {
+			return CombinedStorageWitness{}, fmt.Errorf("modification %d: the account nodes differ: %v", i, diffs)
+		}
+
+		storage := body[end:]
+		leaf := storage[len(storage)-1]
+		if leaf.Storage == nil {
+			return CombinedStorageWitness{}, fmt.Errorf("modification %d does not end with the storage leaf", i)
+		}
+		slot := CombinedSlot{Key: leaf.Storage.Address, Start: *segment[0].Start}
+		for j := 0; j < len(storage)-1 && j < len(prev) && isSameBranch(storage[j], prev[j]); j++ {
+			slot.Shared = append(slot.Shared, storage[j].ExtensionBranch.Branch.ModifiedIndex)
+		}
+		slot.Nodes = len(storage) - len(slot.Shared)
+		combined.Nodes = append(combined.Nodes, storage[len(slot.Shared):]...)
+		combined.Slots = append(combined.Slots, slot)
+		prev = storage
+	}
+	if len(segments) != 0 {
+		combined.Nodes = append(combined.Nodes, nodes[len(nodes)-1])
+	}
+
+	return combined, nil
+}
+
+// isSameBranch returns whether both nodes are the extension branch nodes of the same S and C branch
+// (and extension node). The nodes can differ in the modified child only.
+func isSameBranch(a, b Node) bool {
+	if a.ExtensionBranch == nil || b.ExtensionBranch == nil || len(a.KeccakData) != len(b.KeccakData) {
+		return false
+	}
+	for i := range a.KeccakData {
+		if !bytes.Equal(a.KeccakData[i], b.KeccakData[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// withModifiedIndex returns the copy of the (read-only) extension branch node modified at ind:
+// the modified child row is the row of the child at ind.
+func withModifiedIndex(node Node, ind int) Node {
+	extensionBranch := *node.ExtensionBranch
+	extensionBranch.Branch.ModifiedIndex = ind
+	extensionBranch.Branch.DriftedIndex = ind
+	node.ExtensionBranch = &extensionBranch
+	values := make([][]byte, len(node.Values))
+	copy(values, node.Values)
+	values[0] = append([]byte(nil), node.Values[1+ind]...)
+	node.Values = values
+
+	return node
+}
+
+// Expand returns the witnesses of the slots, one after another.
+func (w CombinedStorageWitness) Expand() []Node {
+	if len(w.Nodes) == 0 {
+		return nil
+	}
+	end := accountNodesEnd(w.Nodes)
+	accountNodes := w.Nodes[1:end]
+	storage := w.Nodes[end : len(w.Nodes)-1]
+
+	var nodes, prev []Node
+	for _, slot := range w.Slots {
+		slotNodes := make([]Node, 0, len(slot.Shared)+slot.Nodes)
+		for j, ind := range slot.Shared {
+			slotNodes = append(slotNodes, withModifiedIndex(prev[j], ind))
+		}
+		slotNodes = append(slotNodes, storage[:slot.Nodes]...)
+		storage = storage[slot.Nodes:]
+
+		start := w.Nodes[0]
+		startNode := slot.Start
+		start.Start = &startNode
+		nodes = append(nodes, start)
+		nodes = append(nodes, accountNodes...)
+		nodes = append(nodes, slotNodes...)
+		nodes = append(nodes, w.Nodes[len(w.Nodes)-1])
+		prev = slotNodes
+	}
+
+	return nodes
+}
@@ -0,0 +1,87 @@
+package witness
+
+import (
+	"math/big"
+	"testing"
+
+	"main/gethutil/mpt/state"
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Three slots under the storage root branch: the branch is emitted once, the witness of each slot
+// is recovered by Expand.
+func TestCombinedStorageWitness(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+
+	// The keys with the hashes in different children of the root branch:
+	var keys []common.Hash
+	children := make(map[int]common.Hash)
+	var leaves [][]byte
+	for i := int64(1); len(keys) < 3; i++ {
+		key := common.BigToHash(big.NewInt(i))
+		keyh := crypto.Keccak256(key.Bytes())
+		if _, ok := children[int(keyh[0]/16)]; ok {
+			continue
+		}
+		value, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(key.Bytes()))
+		leaf, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(trie.KeybytesToHex(keyh)[1:]), value})
+		keys = append(keys, key)
+		leaves = append(leaves, leaf)
+		children[int(keyh[0]/16)] = crypto.Keccak256Hash(leaf)
+	}
+	storageRoot := makeBranch(t, children)
+	account, _ := rlp.EncodeToBytes(state.Account{
+		Nonce:    1,
+		Balance:  big.NewInt(7),
+		Root:     crypto.Keccak256Hash(storageRoot),
+		CodeHash: crypto.Keccak256(nil),
+	})
+	accountLeaf, _ := rlp.EncodeToBytes([][]byte{
+		trie.HexToCompact(trie.KeybytesToHex(crypto.Keccak256(addr.Bytes()))), account})
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), append([][]byte{accountLeaf, storageRoot}, leaves...)...)
+
+	combined, err := GetCombinedStorageWitness("", 1, addr, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Start node, account leaf, storage root branch, three storage leaves, end node:
+	if len(combined.Nodes) != 7 || len(combined.Slots) != 3 {
+		t.Fatalf("expected 7 nodes and 3 slots, got %d nodes and %d slots", len(combined.Nodes), len(combined.Slots))
+	}
+	branches := 0
+	for _, node := range combined.Nodes {
+		if node.ExtensionBranch != nil {
+			branches++
+		}
+	}
+	if branches != 1 {
+		t.Fatalf("expected the shared branch once, got %d branches", branches)
+	}
+	for i, slot := range combined.Slots {
+		if slot.Key != keys[i] {
+			t.Fatalf("slot %d has key %x", i, slot.Key)
+		}
+		shared := 1
+		if i == 0 {
+			shared = 0
+		}
+		if len(slot.Shared) != shared || slot.Nodes != 2-shared {
+			t.Fatalf("slot %d: %d shared branches, %d nodes", i, len(slot.Shared), slot.Nodes)
+		}
+		if shared == 1 && slot.Shared[0] != int(crypto.Keccak256(keys[i].Bytes())[0]/16) {
+			t.Fatalf("slot %d: wrong modified index %d", i, slot.Shared[0])
+		}
+	}
+
+	separate, err := GetAccessListWitness("", 1, []AccessListEntry{{Address: addr, StorageKeys: keys}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := DiffNodes(combined.Expand(), separate); len(diffs) != 0 {
+		t.Fatalf("expanded witness differs from the separate witnesses: %v", diffs)
+	}
+}
@@ -0,0 +1,128 @@
+package witness
+
+import (
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// ProofPair holds the proofs (as returned by eth_getProof: the RLP encoded nodes from the root
+// towards the leaf) of a single modification before (S) and after (C) the modification.
+// The proofs can come from any source, the account and storage proofs do not need to be
+// obtained from the same state.
+type ProofPair struct {
+	// ProofType is the proof type of the start node, for example "StorageChanged" or "NonceChanged".
+	ProofType string
+	Address   common.Address
+	// Key is the storage key, it is used only when there are storage proofs.
+	Key           common.Hash
+	AccountProofS [][]byte
+	AccountProofC [][]byte
+	StorageProofS [][]byte
+	StorageProofC [][]byte
+	// AccountNeighbourNode and StorageNeighbourNode are the RLP of the other (non-nil) child of
+	// the branch that is added (or deleted) by the modification. They are needed only when
+	// the S and C proofs are not of the same length.
+	AccountNeighbourNode []byte
+	StorageNeighbourNode []byte
+	// AccountLayout is the layout of the accounts in the account leaves, the layout of the fork
+	// the proofs are of (the zero value is AccountLayoutCurrent). The leaves of another layout
+	// fail with ErrUnsupportedShape. The witness of AccountLayoutExtended is for inspecting the
+	// proofs only, the circuit cannot verify it (see AccountLayoutExtended).
+	AccountLayout AccountLayout
+}
+
+// ConvertProofs converts the proofs into the witness of a single modification: the start node,
+// the account nodes, the storage nodes (when StorageProofS or StorageProofC is set) and the end node.
+// Unlike GetWitness, it does not use the oracle: the roots are the hashes of the first proof
+// elements and the extension node nibbles are taken from the proofs.
+//
+// Each proof needs to be in the order from the root towards the leaf (as checked by the hash
+// references), otherwise ErrProofOrder is returned. The proofs are not checked against each other,
+// it is up to the caller to provide the S and C proofs of the same key. The modification that
+// shortens (or elongates) an existing extension node needs the proof of the modified extension node
+// which is not in the proofs, it fails with ErrUnsupportedShape. The start node has IsNoOp set by
+// the same rule as in GetWitness. The failures are returned as *WitnessError (with Index 0).
+func ConvertProofs(p ProofPair) (nodes []Node, err error) {
+	defer recoverWitnessError(0, p.Address, &err)
+
+	checkProofOrder(p.AccountProofS, "account S proof")
+	checkProofOrder(p.AccountProofC, "account C proof")
+	checkProofOrder(p.StorageProofS, "storage S proof")
+	checkProofOrder(p.StorageProofC, "storage C proof")
+
+	addrh := keccak(p.Address.Bytes())
+	accountAddr := trie.KeybytesToHex(addrh)
+	sRoot, cRoot := proofRoot(p.AccountProofS), proofRoot(p.AccountProofC)
+
+	startNode := GetStartNode(p.ProofType, sRoot, cRoot, 0)
+	startNode.Start.IsNoOp = isNoOp(p.ProofType, sRoot, cRoot)
+	nodes = append(nodes, startNode)
+
+	nodesAccount := convertProofToWitness(nil, p.Address, addrh, p.AccountProofS, p.AccountProofC,
+		proofExtNibbles(p.AccountProofS), proofExtNibbles(p.AccountProofC), p.Key, accountAddr, p.AccountNeighbourNode,
+		true, p.ProofType == "AccountDoesNotExist", false, isShorterProofLastLeaf(p.AccountProofS, p.AccountProofC), p.AccountLayout)
+	if len(p.AccountProofS) == 0 && len(p.AccountProofC) == 1 {
+		// The first account in the empty trie (see obtainAccountProofAndConvertToWitness).
+		setAccountLeafSPlaceholder(&nodesAccount[len(nodesAccount)-1])
+	}
+	nodes = append(nodes, nodesAccount...)
+
+	if len(p.StorageProofS) != 0 || len(p.StorageProofC) != 0 {
+		keyHashed := trie.KeybytesToHex(hashStorageKey(p.Key))
+		nodesStorage := convertProofToWitness(nil, p.Address, addrh, p.StorageProofS, p.StorageProofC,
+			proofExtNibbles(p.StorageProofS), proofExtNibbles(p.StorageProofC), p.Key, keyHashed, p.StorageNeighbourNode,
+			false, false, p.ProofType == "StorageDoesNotExist", isShorterProofLastLeaf(p.StorageProofS, p.StorageProofC), AccountLayoutCurrent)
+		nodes = append(nodes, nodesStorage...)
+	}
+	nodes = append(nodes, GetEndNode())
+
+	return nodes, nil
+}
+
+// proofRoot returns the root of the trie of which proof is the proof (the empty root for
+// the empty proof).
+func proofRoot(proof [][]byte) common.Hash {
+	if len(proof) == 0 {
+		return types.EmptyRootHash
+	}
+	return common.BytesToHash(keccak(proof[0]))
+}
+
+// isLeafNode returns whether proofEl is a leaf (and not an extension node, both have two elements),
+// it is set in the hex-prefix flags of the key.
+func isLeafNode(proofEl []byte) bool {
+	if checkNodeRLP(proofEl, 0, "proof element") != 2 {
+		return false
+	}
+	content, _, _ := rlp.SplitList(proofEl)
+	key, _, err := rlp.SplitString(content)
+
+	return err == nil && len(key) > 0 && key[0]&32 != 0
+}
+
+// proofExtNibbles returns the nibbles of the extension nodes in the proof, as trie.Prove
+// returns them alongside the proof.
+func proofExtNibbles(proof [][]byte) [][]byte {
+	var extNibbles [][]byte
+	for _, proofEl := range proof {
+		if !isBranch(proofEl) && !isLeafNode(proofEl) {
+			extNibbles = append(extNibbles, getKeyRowNibbles(proofEl))
+		}
+	}
+
+	return extNibbles
+}
+
+// isShorterProofLastLeaf returns whether the last element of the S proof is a leaf or, for
+// the deletion (the S proof is longer), the last element of the C proof.
+func isShorterProofLastLeaf(proofS, proofC [][]byte) bool {
+	proof := proofS
+	if len(proofS) > len(proofC) {
+		proof = proofC
+	}
+
+	return len(proof) > 0 && isLeafNode(proof[len(proof)-1])
+}
@@ -0,0 +1,263 @@
+package witness
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// makeProofPair returns the proofs of a storage modification with a branch in the account trie
+// and a single slot storage trie. The account proofs (the nonce changes) and the storage proofs
+// are not from the same state.
+func makeProofPair(t *testing.T) ProofPair {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	addrh := crypto.Keccak256(addr.Bytes())
+	key := common.HexToHash("0x12")
+	other := common.HexToHash("0xcc")
+	nibble := int(trie.KeybytesToHex(addrh)[0])
+
+	leafS := makeAccountLeaf(t, addrh, 1, 1, big.NewInt(5))
+	leafC := makeAccountLeaf(t, addrh, 1, 2, big.NewInt(5))
+	branchS := makeBranch(t, map[int]common.Hash{nibble: crypto.Keccak256Hash(leafS), (nibble + 1) % 16: other})
+	branchC := makeBranch(t, map[int]common.Hash{nibble: crypto.Keccak256Hash(leafC), (nibble + 1) % 16: other})
+	valueS, _ := rlp.EncodeToBytes([]byte{1})
+	valueC, _ := rlp.EncodeToBytes([]byte{2})
+
+	return ProofPair{
+		ProofType:     "StorageChanged",
+		Address:       addr,
+		Key:           key,
+		AccountProofS: [][]byte{branchS, leafS},
+		AccountProofC: [][]byte{branchC, leafC},
+		StorageProofS: [][]byte{makeStorageLeaf(t, key, valueS)},
+		StorageProofC: [][]byte{makeStorageLeaf(t, key, valueC)},
+	}
+}
+
+func TestConvertProofs(t *testing.T) {
+	p := makeProofPair(t)
+	branchS, branchC := p.AccountProofS[0], p.AccountProofC[0]
+	leafS, leafC := p.AccountProofS[1], p.AccountProofC[1]
+
+	nodes, err := ConvertProofs(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nodes) != 5 || nodes[1].ExtensionBranch == nil || nodes[2].Account == nil || nodes[3].Storage == nil {
+		t.Fatalf("expected start, branch, account leaf, storage leaf and end node, got %d nodes", len(nodes))
+	}
+	if nodes[0].Start.ProofType != "StorageChanged" || nodes[0].Start.IsNoOp || nodes[4].Start.ProofType != "Disabled" {
+		t.Fatalf("wrong boundary nodes: %+v, %+v", nodes[0].Start, nodes[4].Start)
+	}
+	if !bytes.Equal(nodes[0].Values[0][1:33], crypto.Keccak256(branchS)) || !bytes.Equal(nodes[0].Values[1][1:33], crypto.Keccak256(branchC)) {
+		t.Fatal("roots are not the hashes of the proof roots")
+	}
+
+	_, err = ConvertProofs(ProofPair{
+		ProofType:     "NonceChanged",
+		Address:       p.Address,
+		AccountProofS: [][]byte{branchS[:len(branchS)-10], leafS},
+		AccountProofC: [][]byte{branchC, leafC},
+	})
+	var witnessErr *WitnessError
+	if !errors.As(err, &witnessErr) || !errors.Is(err, ErrMalformedNode) {
+		t.Fatalf("expected WitnessError with ErrMalformedNode, got %v", err)
+	}
+}
+
+func TestProofExtNibbles(t *testing.T) {
+	nibbles := []byte{3, 10, 5}
+	extNode, err := rlp.EncodeToBytes([][]byte{trie.HexToCompact(nibbles), common.HexToHash("0xaa").Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := common.HexToHash("0x12")
+	leaf := makeStorageLeaf(t, key, []byte{1})
+
+	extNibbles := proofExtNibbles([][]byte{extNode, makeBranch(t, map[int]common.Hash{1: key}), leaf})
+	if len(extNibbles) != 1 || !bytes.Equal(extNibbles[0], nibbles) {
+		t.Fatalf("expected extension nibbles %v, got %v", nibbles, extNibbles)
+	}
+	if !isShorterProofLastLeaf([][]byte{leaf}, [][]byte{extNode}) || isShorterProofLastLeaf([][]byte{extNode, leaf}, [][]byte{extNode}) {
+		t.Fatal("wrong last leaf of the shorter proof")
+	}
+}
+
+func TestConvertProofsDeepProof(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	addrh := crypto.Keccak256(addr.Bytes())
+	nibbles := trie.KeybytesToHex(addrh)
+	// The extension node with 42 nibbles (the RLP list is longer than 55 bytes) and 20 branches
+	// below it, the leaf is at the nibble 62:
+	extLen, depth := 42, 20
+
+	childS := makeAccountLeaf(t, addrh, extLen+depth, 1, big.NewInt(5))
+	childC := makeAccountLeaf(t, addrh, extLen+depth, 2, big.NewInt(5))
+	proofS, proofC := [][]byte{childS}, [][]byte{childC}
+	for i := extLen + depth - 1; i >= extLen; i-- {
+		neighbour := (int(nibbles[i]) + 1) % 16
+		childrenS := map[int]common.Hash{int(nibbles[i]): crypto.Keccak256Hash(childS), neighbour: common.HexToHash("0xcc")}
+		childrenC := map[int]common.Hash{int(nibbles[i]): crypto.Keccak256Hash(childC), neighbour: common.HexToHash("0xcc")}
+		childS, childC = makeBranch(t, childrenS), makeBranch(t, childrenC)
+		proofS, proofC = append([][]byte{childS}, proofS...), append([][]byte{childC}, proofC...)
+	}
+	extS, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(nibbles[:extLen]), crypto.Keccak256(childS)})
+	extC, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(nibbles[:extLen]), crypto.Keccak256(childC)})
+	proofS, proofC = append([][]byte{extS}, proofS...), append([][]byte{extC}, proofC...)
+
+	nodes, err := ConvertProofs(ProofPair{
+		ProofType:     "NonceChanged",
+		Address:       addr,
+		AccountProofS: proofS,
+		AccountProofC: proofC,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The start node, the branches (the first one with the extension node), the leaf and the end node:
+	if len(nodes) != depth+3 {
+		t.Fatalf("expected %d nodes, got %d", depth+3, len(nodes))
+	}
+	for i, node := range nodes[1 : depth+1] {
+		if node.ExtensionBranch == nil || node.ExtensionBranch.IsExtension != (i == 0) {
+			t.Fatalf("node %d is not the expected branch", i+1)
+		}
+		if node.ExtensionBranch.Branch.ModifiedIndex != int(nibbles[extLen+i]) {
+			t.Fatalf("branch %d modified at %d, expected %d", i, node.ExtensionBranch.Branch.ModifiedIndex, nibbles[extLen+i])
+		}
+	}
+	if nodes[depth+1].Account == nil {
+		t.Fatal("the leaf is not converted into the account node")
+	}
+}
+
+// The proof elements out of the root to leaf order are detected by the hash references.
+func TestConvertProofsOutOfOrder(t *testing.T) {
+	p := makeProofPair(t)
+	p.AccountProofC = [][]byte{p.AccountProofC[1], p.AccountProofC[0]}
+
+	_, err := ConvertProofs(p)
+	if !errors.Is(err, ErrProofOrder) || !errors.Is(err, ErrProofConvert) {
+		t.Fatalf("expected ErrProofOrder, got %v", err)
+	}
+
+	// The C branch does not reference the S leaf:
+	p = makeProofPair(t)
+	p.AccountProofC[1] = p.AccountProofS[1]
+	if _, err := ConvertProofs(p); !errors.Is(err, ErrProofOrder) {
+		t.Fatalf("expected ErrProofOrder, got %v", err)
+	}
+}
+
+// The accounts of the current layout are converted by default, the accounts with a field added
+// (as by a future fork) only when the proofs are of the extended layout.
+func TestConvertProofsAccountLayout(t *testing.T) {
+	p := makeProofPair(t)
+	p.StorageProofS, p.StorageProofC = nil, nil
+	p.ProofType = "NonceChanged"
+	nodes, err := ConvertProofs(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account := nodes[2].Account; nodes[2].Values[AccountNonceC][0] != 2 || account.StorageRootC != emptyStorageRoot {
+		t.Fatalf("wrong C account rows: nonce %v, storage root %s", nodes[2].Values[AccountNonceC], account.StorageRootC)
+	}
+
+	// The current fields followed by an added one:
+	addrh := crypto.Keccak256(p.Address.Bytes())
+	extendedLeaf := func(nonce uint64) []byte {
+		account, _ := rlp.EncodeToBytes([]interface{}{nonce, big.NewInt(5), emptyStorageRoot, crypto.Keccak256(nil), uint64(7)})
+		leaf, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(trie.KeybytesToHex(addrh)[1:]), account})
+		return leaf
+	}
+	nibble := int(trie.KeybytesToHex(addrh)[0])
+	other := common.HexToHash("0xcc")
+	leafS, leafC := extendedLeaf(1), extendedLeaf(2)
+	extended := ProofPair{
+		ProofType:     "NonceChanged",
+		Address:       p.Address,
+		AccountProofS: [][]byte{makeBranch(t, map[int]common.Hash{nibble: crypto.Keccak256Hash(leafS), (nibble + 1) % 16: other}), leafS},
+		AccountProofC: [][]byte{makeBranch(t, map[int]common.Hash{nibble: crypto.Keccak256Hash(leafC), (nibble + 1) % 16: other}), leafC},
+	}
+	if _, err := ConvertProofs(extended); !errors.Is(err, ErrUnsupportedShape) {
+		t.Fatalf("expected ErrUnsupportedShape for the extended account, got %v", err)
+	}
+
+	extended.AccountLayout = AccountLayoutExtended
+	nodes, err = ConvertProofs(extended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := nodes[2].Account
+	if nodes[2].Values[AccountNonceC][0] != 2 || account.StorageRootC != emptyStorageRoot || account.CodeHashC != crypto.Keccak256Hash(nil) {
+		t.Fatalf("wrong C account rows: nonce %v, storage root %s, code hash %s", nodes[2].Values[AccountNonceC], account.StorageRootC, account.CodeHashC)
+	}
+	if !bytes.Equal(nodes[2].KeccakData[1], leafC) {
+		t.Fatal("C leaf is not the extended leaf")
+	}
+
+	// The layout of one conversion does not leak into the others (as the concurrent ones):
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				_, errs[i] = ConvertProofs(extended)
+			} else {
+				current := extended
+				current.AccountLayout = AccountLayoutCurrent
+				if _, err := ConvertProofs(current); !errors.Is(err, ErrUnsupportedShape) {
+					errs[i] = fmt.Errorf("expected ErrUnsupportedShape, got %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("conversion %d: %v", i, err)
+		}
+	}
+}
+
+// The start node of the converted proofs is a no-op exactly when the one of GetWitness is: the
+// non-existence proofs are not no-ops even though their S and C roots are the same.
+func TestConvertProofsIsNoOp(t *testing.T) {
+	root, nodes := exampleState()
+	setMemoryState(t, root, nodes...)
+	for _, name := range []string{"NonceChanged", "AccountRead", "AccountDoesNotExist", "StorageChanged", "StorageChanged/NoOp", "StorageDoesNotExist"} {
+		result, err := GetWitnessResult("", 1, exampleModifications()[name], WithRawProofs())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		raw := result.RawProofs[0]
+		converted, err := ConvertProofs(ProofPair{
+			ProofType:     result.Nodes[0].Start.ProofType,
+			Address:       raw.Address,
+			Key:           raw.Key,
+			AccountProofS: raw.AccountProofS,
+			AccountProofC: raw.AccountProofC,
+			StorageProofS: raw.StorageProofS,
+			StorageProofC: raw.StorageProofC,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if converted[0].Start.IsNoOp != result.Nodes[0].Start.IsNoOp {
+			t.Errorf("%s: IsNoOp %v, GetWitness has %v", name, converted[0].Start.IsNoOp, result.Nodes[0].Start.IsNoOp)
+		}
+	}
+}
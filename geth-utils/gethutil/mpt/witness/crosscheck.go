@@ -0,0 +1,146 @@
+package witness
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// ErrProofMismatch is returned by CrossCheckWitness when a proof element is not in the witness.
+var ErrProofMismatch = errors.New("proof does not match the witness")
+
+// CrossCheckWitness checks that the witness of a single modification contains the account proof and
+// the storage proof (nil for the account modifications) as obtained independently, for example by
+// eth_getProof from another node. The proof needs to be the S or the C proof of the witness: each
+// trie node (extension node, branch or leaf) of the side in turn, the placeholder nodes excluded.
+// The proof can thus be either the proof before or after the modification, but not its part. The
+// account proof cannot be empty, the storage proof is empty only when the storage trie is.
+func CrossCheckWitness(nodes []Node, accountProof, storageProof [][]byte) error {
+	segments, err := SplitByModification(nodes)
+	if err != nil {
+		return err
+	}
+	if len(segments) != 1 {
+		return fmt.Errorf("expected the witness of a single modification, got %d modifications", len(segments))
+	}
+	if len(accountProof) == 0 {
+		return fmt.Errorf("account proof: %w: the proof is empty", ErrProofMismatch)
+	}
+
+	// The account trie nodes are the nodes up to the account leaf, the storage trie nodes follow:
+	start := segments[0][0]
+	segment := ExpandSharedNodes(segments[0][1 : len(segments[0])-1])
+	accountNodes := segment
+	var storageNodes []Node
+	var storageRoots [2]common.Hash
+	for i, node := range segment {
+		if node.Account != nil {
+			accountNodes, storageNodes = segment[:i+1], segment[i+1:]
+			storageRoots = [2]common.Hash{node.Account.StorageRootS, node.Account.StorageRootC}
+			break
+		}
+	}
+	accountRoots := [2]common.Hash{common.BytesToHash(start.Values[0][1:33]), common.BytesToHash(start.Values[1][1:33])}
+
+	if err := crossCheckProof(accountNodes, accountRoots, accountProof); err != nil {
+		return fmt.Errorf("account proof: %w", err)
+	}
+	if err := crossCheckProof(storageNodes, storageRoots, storageProof); err != nil {
+		return fmt.Errorf("storage proof: %w", err)
+	}
+
+	return nil
+}
+
+// crossCheckProof checks that the proof is the S or the C proof of the trie nodes (see proofOfSide),
+// roots are the S and C root of the trie.
+func crossCheckProof(nodes []Node, roots [2]common.Hash, proof [][]byte) error {
+	mismatch := 0
+	for side := 0; side < 2; side++ {
+		sideProof := proofOfSide(nodes, roots[side], side)
+		i := 0
+		for i < len(proof) && i < len(sideProof) && bytes.Equal(proof[i], sideProof[i]) {
+			i++
+		}
+		if i == len(proof) && i == len(sideProof) {
+			return nil
+		}
+		mismatch = max(mismatch, i)
+	}
+	if mismatch == len(proof) {
+		return fmt.Errorf("%w: the proof of %d elements is incomplete", ErrProofMismatch, len(proof))
+	}
+
+	return fmt.Errorf("%w: element %d (%x)", ErrProofMismatch, mismatch, proof[mismatch])
+}
+
+// proofOfSide returns the trie nodes of the side (0 for S, 1 for C) of the witness nodes: the branches
+// that are not placeholders and the extension nodes and the leaf that are in the trie with the root.
+// The extension node or the leaf of the witness node is a placeholder when the trie does not have it
+// at its position (it is then not referenced by the node above it), the drifted leaf might be in the
+// place of the leaf.
+func proofOfSide(nodes []Node, root common.Hash, side int) [][]byte {
+	var proof [][]byte
+	// inTrie returns whether the node is the root or the child of the last node of the proof:
+	inTrie := func(node []byte) bool {
+		if len(proof) == 0 {
+			return crypto.Keccak256Hash(node) == root
+		}
+		return isReferenced(proof[len(proof)-1], node)
+	}
+	for _, node := range nodes {
+		switch {
+		case node.ExtensionBranch != nil:
+			// The extension node of the placeholder branch is in the trie when the proof ends
+			// with it (the key diverges in the extension node):
+			if node.ExtensionBranch.IsExtension && len(node.KeccakData) > 2+side && inTrie(node.KeccakData[2+side]) {
+				proof = append(proof, node.KeccakData[2+side])
+			}
+			if !node.ExtensionBranch.IsPlaceholder[side] {
+				proof = append(proof, node.KeccakData[side])
+			}
+		case node.Account != nil || node.Storage != nil:
+			// The extension node modified by the modification (the long and the short one follow
+			// the leaf in KeccakData) ends the proof of the side that has it:
+			isModExtension := node.Account != nil && node.Account.IsModExtension != [2]bool{} ||
+				node.Storage != nil && node.Storage.IsModExtension != [2]bool{}
+			if l := len(node.KeccakData); isModExtension && l >= 2 {
+				for _, extNode := range node.KeccakData[l-2:] {
+					if inTrie(extNode) {
+						proof = append(proof, extNode)
+						break
+					}
+				}
+			}
+			leaves := [][]byte{node.KeccakData[side]}
+			if drifted, ok := DriftedLeaf(node); ok {
+				leaves = append(leaves, drifted)
+			}
+			for _, leaf := range leaves {
+				if inTrie(leaf) {
+					proof = append(proof, leaf)
+					break
+				}
+			}
+		}
+	}
+
+	return proof
+}
+
+// isReferenced returns whether the node is the child of the parent: the parent holds the hash
+// of the node or, when the node is shorter than 32 bytes, the node itself. The empty node (the
+// missing short extension node, for example) is never referenced.
+func isReferenced(parent, node []byte) bool {
+	if len(node) == 0 {
+		return false
+	}
+	if len(node) < 32 {
+		return bytes.Contains(parent, node)
+	}
+
+	return bytes.Contains(parent, crypto.Keccak256(node))
+}
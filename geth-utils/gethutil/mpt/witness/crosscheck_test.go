@@ -0,0 +1,89 @@
+package witness
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestCrossCheckWitness(t *testing.T) {
+	root, stateNodes := exampleStateWithSlots(40)
+	setMemoryState(t, root, stateNodes...)
+	result, err := GetWitnessResult("", 1, []TrieModification{
+		NewStorageChange(exampleContract, common.BigToHash(big.NewInt(7)), common.HexToHash("0x2a")),
+	}, WithRawProofs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, p := result.Nodes, result.RawProofs[0]
+	if len(p.AccountProofS) < 2 || len(p.StorageProofS) < 2 {
+		t.Fatalf("expected the proofs with branches, got %d and %d elements", len(p.AccountProofS), len(p.StorageProofS))
+	}
+
+	// The proofs before and after the modification both match:
+	if err := CrossCheckWitness(nodes, p.AccountProofS, p.StorageProofS); err != nil {
+		t.Fatalf("S proofs: %v", err)
+	}
+	if err := CrossCheckWitness(nodes, p.AccountProofC, p.StorageProofC); err != nil {
+		t.Fatalf("C proofs: %v", err)
+	}
+
+	last := len(p.AccountProofS) - 1
+	mismatches := []struct {
+		name                       string
+		accountProof, storageProof [][]byte
+	}{
+		// The leaf of another nonce:
+		{"account leaf", append(append([][]byte{}, p.AccountProofS[:last]...),
+			makeAccountLeaf(t, crypto.Keccak256(exampleContract.Bytes()), 1, 3, big.NewInt(5))), p.StorageProofS},
+		// The account proof as the storage proof:
+		{"storage proof", p.AccountProofS, p.AccountProofS},
+		// The proofs without the leaf:
+		{"truncated account proof", p.AccountProofS[:last], p.StorageProofS},
+		{"truncated storage proof", p.AccountProofS, p.StorageProofS[:len(p.StorageProofS)-1]},
+		// The proofs of the root only:
+		{"root of the storage proof", p.AccountProofS, p.StorageProofS[:1]},
+		// The S and C elements mixed:
+		{"mixed proof", p.AccountProofS, append(append([][]byte{}, p.StorageProofS[:len(p.StorageProofS)-1]...), p.StorageProofC[len(p.StorageProofC)-1])},
+		{"nil account proof", nil, p.StorageProofS},
+		{"nil storage proof", p.AccountProofS, nil},
+	}
+	for _, test := range mismatches {
+		if err := CrossCheckWitness(nodes, test.accountProof, test.storageProof); !errors.Is(err, ErrProofMismatch) {
+			t.Errorf("%s: expected ErrProofMismatch, got %v", test.name, err)
+		}
+	}
+
+	if err := CrossCheckWitness(append(nodes, nodes...), p.AccountProofS, nil); err == nil {
+		t.Fatal("expected an error for the witness of two modifications")
+	}
+}
+
+// The proofs of the examples (the account and storage modifications, the placeholder branches and
+// leaves, the non-existence proofs) match their witnesses.
+func TestCrossCheckExamples(t *testing.T) {
+	root, nodes := exampleState()
+	setMemoryState(t, root, nodes...)
+	for name, trieModifications := range exampleModifications() {
+		result, err := GetWitnessResult("", 1, trieModifications, WithRawProofs())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		segments, err := SplitByModification(result.Nodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// AccountAndStorageChange has the account and the storage witness, the proofs are the last ones:
+		segment := segments[len(segments)-1]
+		p := result.RawProofs[len(result.RawProofs)-1]
+		if err := CrossCheckWitness(segment, p.AccountProofS, p.StorageProofS); err != nil {
+			t.Errorf("%s: S proofs: %v", name, err)
+		}
+		if err := CrossCheckWitness(segment, p.AccountProofC, p.StorageProofC); err != nil {
+			t.Errorf("%s: C proofs: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package witness
+
+import "bytes"
+
+// isSharedBranch returns whether the S and C parts of the extension branch node are the same:
+// the S and C branch (and extension node) in KeccakData and the modified child row (which is
+// taken from the C branch) equal to the row of the same child in the S branch.
+// This is the case for the placeholder branches and for the modifications that do not change
+// the trie.
+func isSharedBranch(node Node) bool {
+	n := node.ExtensionBranch
+	if n == nil || n.IsShared {
+		return false
+	}
+	ind := n.Branch.ModifiedIndex
+	if ind < 0 || ind > 15 || len(node.Values) < 17 {
+		return false
+	}
+	if !bytes.Equal(node.Values[0], node.Values[1+ind]) {
+		return false
+	}
+	if len(node.KeccakData) < 2 || !bytes.Equal(node.KeccakData[0], node.KeccakData[1]) {
+		return false
+	}
+	if n.IsExtension {
+		if len(node.KeccakData) < 4 || !bytes.Equal(node.KeccakData[2], node.KeccakData[3]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dedupSharedNodes removes the C copies from the shared extension branch nodes (see isSharedBranch):
+// the modified child row (Values[0]) and the C branch and extension node in KeccakData. The branch
+// placeholder flags are kept, ExpandSharedNodes thus restores the placeholder rows as they were.
+func dedupSharedNodes(nodes []Node) {
+	for i, node := range nodes {
+		if !isSharedBranch(node) {
+			continue
+		}
+		extensionBranch := *node.ExtensionBranch
+		extensionBranch.IsShared = true
+		node.ExtensionBranch = &extensionBranch
+		node.Values = node.Values[1:]
+		keccakData := [][]byte{node.KeccakData[0]}
+		if extensionBranch.IsExtension {
+			keccakData = append(keccakData, node.KeccakData[2])
+		}
+		node.KeccakData = keccakData
+		nodes[i] = node
+	}
+}
+
+// ExpandSharedNodes reconstructs the nodes deduplicated by WithSharedNodeDedup, the witness
+// is then the same as generated without the option.
+func ExpandSharedNodes(nodes []Node) []Node {
+	expanded := make([]Node, len(nodes))
+	for i, node := range nodes {
+		if node.ExtensionBranch == nil || !node.ExtensionBranch.IsShared {
+			expanded[i] = node
+			continue
+		}
+		extensionBranch := *node.ExtensionBranch
+		extensionBranch.IsShared = false
+		node.ExtensionBranch = &extensionBranch
+
+		modifiedRow := append([]byte(nil), node.Values[extensionBranch.Branch.ModifiedIndex]...)
+		node.Values = append([][]byte{modifiedRow}, node.Values...)
+		keccakData := [][]byte{node.KeccakData[0], node.KeccakData[0]}
+		if extensionBranch.IsExtension {
+			keccakData = append(keccakData, node.KeccakData[1], node.KeccakData[1])
+		}
+		node.KeccakData = keccakData
+		expanded[i] = node
+	}
+
+	return expanded
+}
@@ -0,0 +1,61 @@
+package witness
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestSharedNodeDedup(t *testing.T) {
+	branchS := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xaa"), 10: common.HexToHash("0xcc")})
+	branchC := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xbb"), 10: common.HexToHash("0xcc")})
+	nodes := []Node{
+		GetStartNode("StorageChanged", common.HexToHash("0x01"), common.HexToHash("0x02"), 0),
+		prepareBranchNode(branchS, branchC, nil, nil, nil, makeRows(4, 0), 3, 3, false, false, false),
+		// Placeholder branch: the same branch on both sides.
+		prepareBranchNode(branchC, branchC, nil, nil, nil, makeRows(4, 0), 10, 3, true, false, false),
+		GetEndNode(),
+	}
+	original := append([]Node(nil), nodes...)
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dedupSharedNodes(nodes)
+	if nodes[1].ExtensionBranch.IsShared {
+		t.Fatal("changed branch marked as shared")
+	}
+	if !nodes[2].ExtensionBranch.IsShared || len(nodes[2].KeccakData) != 1 {
+		t.Fatal("placeholder branch not deduplicated")
+	}
+	if original[2].ExtensionBranch.IsShared {
+		t.Fatal("original node modified")
+	}
+	dedupJSON, err := json.Marshal(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dedupJSON) >= len(originalJSON) {
+		t.Fatalf("deduplicated witness not smaller: %d >= %d", len(dedupJSON), len(originalJSON))
+	}
+
+	// The consumer gets the deduplicated JSON:
+	var loaded []Node
+	if err := json.Unmarshal(dedupJSON, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	expanded := ExpandSharedNodes(loaded)
+	expandedJSON, err := json.Marshal(expanded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(expandedJSON) != string(originalJSON) {
+		t.Fatal("expanded witness differs from the original")
+	}
+	if !reflect.DeepEqual(ExpandSharedNodes(nodes)[2], original[2]) {
+		t.Fatal("expanded placeholder branch differs from the original")
+	}
+}
@@ -0,0 +1,100 @@
+package witness
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+// NodeDiff is a difference between two witnesses: the field (for example
+// "Account.StorageRootC" or "Values[3]") of the node at Index has the value Old in the first
+// witness and New in the second one. The byte fields are given in hex.
+type NodeDiff struct {
+	Index int
+	Field string
+	Old   string
+	New   string
+}
+
+func (d NodeDiff) String() string {
+	return fmt.Sprintf("[%d] %s: %s -> %s", d.Index, d.Field, d.Old, d.New)
+}
+
+// DiffNodes returns the differences between the witnesses a and b field by field, nil when they
+// are the same. A node that is only in one of the witnesses is reported with an empty Field.
+func DiffNodes(a, b []Node) []NodeDiff {
+	var diffs []NodeDiff
+	for i := 0; i < len(a) || i < len(b); i++ {
+		add := func(field, before, after string) {
+			diffs = append(diffs, NodeDiff{Index: i, Field: field, Old: before, New: after})
+		}
+		switch {
+		case i >= len(a):
+			add("", "<none>", "<node>")
+		case i >= len(b):
+			add("", "<node>", "<none>")
+		default:
+			diffValues("", reflect.ValueOf(a[i]), reflect.ValueOf(b[i]), add)
+		}
+	}
+
+	return diffs
+}
+
+func diffValues(path string, a, b reflect.Value, add func(field, before, after string)) {
+	field := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+
+	switch a.Kind() {
+	case reflect.Ptr:
+		switch {
+		case a.IsNil() && b.IsNil():
+		case a.IsNil():
+			add(path, "<nil>", "<set>")
+		case b.IsNil():
+			add(path, "<set>", "<nil>")
+		default:
+			diffValues(path, a.Elem(), b.Elem(), add)
+		}
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			diffValues(field(a.Type().Field(i).Name), a.Field(i), b.Field(i), add)
+		}
+	case reflect.Slice, reflect.Array:
+		if a.Type().Elem().Kind() == reflect.Uint8 {
+			if before, after := valueBytes(a), valueBytes(b); !bytes.Equal(before, after) {
+				add(path, fmt.Sprintf("0x%x", before), fmt.Sprintf("0x%x", after))
+			}
+			return
+		}
+		for i := 0; i < a.Len() || i < b.Len(); i++ {
+			elem := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= a.Len():
+				add(elem, "<none>", fmt.Sprint(b.Index(i)))
+			case i >= b.Len():
+				add(elem, fmt.Sprint(a.Index(i)), "<none>")
+			default:
+				diffValues(elem, a.Index(i), b.Index(i), add)
+			}
+		}
+	default:
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			add(path, fmt.Sprint(a), fmt.Sprint(b))
+		}
+	}
+}
+
+// valueBytes returns the bytes of a byte slice or array value.
+func valueBytes(v reflect.Value) []byte {
+	bs := make([]byte, v.Len())
+	for i := range bs {
+		bs[i] = byte(v.Index(i).Uint())
+	}
+
+	return bs
+}
@@ -0,0 +1,59 @@
+package witness
+
+import (
+	"math/big"
+	"testing"
+
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestDiffNodes(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	addrh := crypto.Keccak256(addr.Bytes())
+	branchS := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xaa"), 10: common.HexToHash("0xcc")})
+	branchC := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xbb"), 10: common.HexToHash("0xcc")})
+	witness := func() []Node {
+		leafS := makeAccountLeaf(t, addrh, 1, 1, big.NewInt(5))
+		leafC := makeAccountLeaf(t, addrh, 1, 2, big.NewInt(5))
+		return []Node{
+			GetStartNode("NonceChanged", common.HexToHash("0x01"), common.HexToHash("0x02"), 0),
+			prepareBranchNode(branchS, branchC, nil, nil, nil, makeRows(4, 0), 3, 3, false, false, false),
+			prepareAccountLeafNode(addr, addrh, leafS, leafC, nil, trie.KeybytesToHex(addrh), false, false, false, AccountLayoutCurrent),
+			GetEndNode(),
+		}
+	}
+
+	if diffs := DiffNodes(witness(), witness()); diffs != nil {
+		t.Fatalf("same witnesses differ: %v", diffs)
+	}
+
+	changed := witness()
+	oldRoot := changed[2].Account.StorageRootC
+	changed[2].Account.StorageRootC = common.HexToHash("0x1234")
+	diffs := DiffNodes(witness(), changed)
+	want := NodeDiff{
+		Index: 2,
+		Field: "Account.StorageRootC",
+		Old:   "0x" + common.Bytes2Hex(oldRoot.Bytes()),
+		New:   "0x" + common.Bytes2Hex(common.HexToHash("0x1234").Bytes()),
+	}
+	if len(diffs) != 1 || diffs[0] != want {
+		t.Fatalf("expected %v, got %v", want, diffs)
+	}
+
+	changed = witness()
+	changed[1].ExtensionBranch.Branch.DriftedIndex = 5
+	changed[1].Values[7][0] = 160
+	diffs = DiffNodes(witness(), changed)
+	if len(diffs) != 2 || diffs[0].String() != "[1] ExtensionBranch.Branch.DriftedIndex: 3 -> 5" || diffs[1].Field != "Values[7]" {
+		t.Fatalf("wrong diffs %v", diffs)
+	}
+
+	diffs = DiffNodes(witness(), witness()[:3])
+	if len(diffs) != 1 || diffs[0].Index != 3 || diffs[0].New != "<none>" {
+		t.Fatalf("missing node not reported: %v", diffs)
+	}
+}
@@ -0,0 +1,191 @@
+package witness
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// DumpNodes writes a human-readable representation of the witness to w. It is meant for
+// debugging malformed witnesses: it shows the boundaries of each modification (start and
+// end nodes), the children present in branches, the extension node nibbles, the key and
+// value lengths of leaves, and what differs between S and C.
+func DumpNodes(w io.Writer, nodes []Node) {
+	for i, node := range nodes {
+		switch {
+		case node.Start != nil:
+			dumpStartNode(w, i, node)
+		case node.ExtensionBranch != nil:
+			dumpExtensionBranchNode(w, i, node)
+		case node.Account != nil:
+			dumpAccountNode(w, i, node)
+		case node.Storage != nil:
+			dumpStorageNode(w, i, node)
+		case node.ModExtension != nil:
+			fmt.Fprintf(w, "[%d] modified extension\n", i)
+		default:
+			fmt.Fprintf(w, "[%d] unknown node\n", i)
+		}
+	}
+}
+
+func dumpStartNode(w io.Writer, i int, node Node) {
+	if node.Start.ProofType == "Disabled" {
+		fmt.Fprintf(w, "[%d] end\n", i)
+		return
+	}
+	fmt.Fprintf(w, "[%d] start %s", i, node.Start.ProofType)
+	if node.Start.IsNoOp {
+		fmt.Fprint(w, " (no-op)")
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "    S root: 0x%x\n", node.Values[0][1:33])
+	fmt.Fprintf(w, "    C root: 0x%x\n", node.Values[1][1:33])
+}
+
+func dumpExtensionBranchNode(w io.Writer, i int, node Node) {
+	eb := node.ExtensionBranch
+	fmt.Fprintf(w, "[%d] branch modified=%d drifted=%d", i, eb.Branch.ModifiedIndex, eb.Branch.DriftedIndex)
+	if eb.IsPlaceholder[0] {
+		fmt.Fprint(w, " placeholder=S")
+	} else if eb.IsPlaceholder[1] {
+		fmt.Fprint(w, " placeholder=C")
+	}
+	fmt.Fprintln(w)
+
+	if eb.IsExtension && len(node.KeccakData) > 2 {
+		var nibbles []string
+		for _, n := range getKeyRowNibbles(node.KeccakData[2]) {
+			nibbles = append(nibbles, fmt.Sprintf("%x", n))
+		}
+		fmt.Fprintf(w, "    extension nibbles: %s\n", strings.Join(nibbles, " "))
+	}
+
+	childrenS := branchChildren(node.KeccakData[0])
+	childrenC := branchChildren(node.KeccakData[1])
+	fmt.Fprintf(w, "    S children: %s\n", childrenPresence(childrenS))
+	fmt.Fprintf(w, "    C children: %s\n", childrenPresence(childrenC))
+
+	var changed []string
+	for j := 0; j < 16 && j < len(childrenS) && j < len(childrenC); j++ {
+		if !bytes.Equal(childrenS[j], childrenC[j]) {
+			changed = append(changed, fmt.Sprintf("%d", j))
+		}
+	}
+	if len(changed) > 0 {
+		fmt.Fprintf(w, "    changed children: %s\n", strings.Join(changed, " "))
+	}
+}
+
+func dumpAccountNode(w io.Writer, i int, node Node) {
+	fmt.Fprintf(w, "[%d] account 0x%x\n", i, node.Account.Address.Bytes())
+	dumpLeafLens(w, node.KeccakData[0], node.KeccakData[1])
+
+	fields := []struct {
+		name string
+		s, c AccountRowType
+	}{
+		{"nonce", AccountNonceS, AccountNonceC},
+		{"balance", AccountBalanceS, AccountBalanceC},
+		{"storage root", AccountStorageS, AccountStorageC},
+		{"code hash", AccountCodehashS, AccountCodehashC},
+	}
+	var changed []string
+	for _, f := range fields {
+		if !bytes.Equal(node.Values[f.s], node.Values[f.c]) {
+			changed = append(changed, f.name)
+		}
+	}
+	dumpChanged(w, changed)
+}
+
+func dumpStorageNode(w io.Writer, i int, node Node) {
+	fmt.Fprintf(w, "[%d] storage 0x%x\n", i, node.Storage.Address.Bytes())
+	dumpLeafLens(w, node.KeccakData[0], node.KeccakData[1])
+
+	var changed []string
+	if !bytes.Equal(node.Values[StorageValueS], node.Values[StorageValueC]) {
+		changed = append(changed, "value")
+	}
+	dumpChanged(w, changed)
+}
+
+func dumpLeafLens(w io.Writer, leafS, leafC []byte) {
+	for j, leaf := range [][]byte{leafS, leafC} {
+		sc := "S"
+		if j == 1 {
+			sc = "C"
+		}
+		keyLen, valueLen, err := leafLens(leaf)
+		if err != nil {
+			fmt.Fprintf(w, "    %s leaf: invalid RLP (%v)\n", sc, err)
+		} else {
+			fmt.Fprintf(w, "    %s leaf: key %d bytes, value %d bytes\n", sc, keyLen, valueLen)
+		}
+	}
+}
+
+func dumpChanged(w io.Writer, changed []string) {
+	if len(changed) == 0 {
+		fmt.Fprintln(w, "    changed: none")
+	} else {
+		fmt.Fprintf(w, "    changed: %s\n", strings.Join(changed, ", "))
+	}
+}
+
+// leafLens returns the length of the key and of the value stored in a leaf.
+func leafLens(leaf []byte) (int, int, error) {
+	elems, _, err := rlp.SplitList(leaf)
+	if err != nil {
+		return 0, 0, err
+	}
+	key, rest, err := rlp.SplitString(elems)
+	if err != nil {
+		return 0, 0, err
+	}
+	value, _, err := rlp.SplitString(rest)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return len(key), len(value), nil
+}
+
+// branchChildren returns the (raw) children of a branch, nil if the branch RLP cannot be parsed.
+func branchChildren(branch []byte) [][]byte {
+	elems, _, err := rlp.SplitList(branch)
+	if err != nil {
+		return nil
+	}
+	var children [][]byte
+	for len(elems) > 0 {
+		_, content, rest, err := rlp.Split(elems)
+		if err != nil {
+			return nil
+		}
+		children = append(children, content)
+		elems = rest
+	}
+
+	return children
+}
+
+// childrenPresence returns a 16-character string with `.` for a nil child, `h` for a hashed child,
+// and `e` for a child embedded in the branch.
+func childrenPresence(children [][]byte) string {
+	var sb strings.Builder
+	for j := 0; j < 16; j++ {
+		if j >= len(children) || len(children[j]) == 0 {
+			sb.WriteByte('.')
+		} else if len(children[j]) == 32 {
+			sb.WriteByte('h')
+		} else {
+			sb.WriteByte('e')
+		}
+	}
+
+	return sb.String()
+}
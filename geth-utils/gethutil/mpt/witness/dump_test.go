@@ -0,0 +1,73 @@
+package witness
+
+import (
+	"bytes"
+	"flag"
+	"math/big"
+	"os"
+	"testing"
+
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+// makeBranch returns the RLP of a branch with the given hashed children.
+func makeBranch(t *testing.T, children map[int]common.Hash) []byte {
+	elems := make([][]byte, 17)
+	for i := range elems {
+		elems[i] = []byte{}
+	}
+	for i, child := range children {
+		elems[i] = child.Bytes()
+	}
+	branch, err := rlp.EncodeToBytes(elems)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return branch
+}
+
+func TestDumpNodesNonceChanged(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	addrh := crypto.Keccak256(addr.Bytes())
+
+	branchS := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xaa"), 10: common.HexToHash("0xcc")})
+	branchC := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xbb"), 10: common.HexToHash("0xcc")})
+	extValues := make([][]byte, 4)
+	for i := range extValues {
+		extValues[i] = make([]byte, valueLen)
+	}
+
+	leafS := makeAccountLeaf(t, addrh, 1, 1, big.NewInt(5))
+	leafC := makeAccountLeaf(t, addrh, 1, 2, big.NewInt(5))
+
+	nodes := []Node{
+		GetStartNode("NonceChanged", common.HexToHash("0x01"), common.HexToHash("0x02"), 0),
+		prepareBranchNode(branchS, branchC, nil, nil, nil, extValues, 3, 3, false, false, false),
+		prepareAccountLeafNode(addr, addrh, leafS, leafC, nil, trie.KeybytesToHex(addrh), false, false, false, AccountLayoutCurrent),
+		GetEndNode(),
+	}
+
+	var buf bytes.Buffer
+	DumpNodes(&buf, nodes)
+
+	golden := "testdata/dump_nonce_changed.golden"
+	if *updateGolden {
+		if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("dump differs from %s:\n%s", golden, buf.String())
+	}
+}
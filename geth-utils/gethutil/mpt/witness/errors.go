@@ -0,0 +1,232 @@
+package witness
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+
+	"main/gethutil/mpt/oracle"
+	"main/gethutil/mpt/state"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var (
+	// ErrProofFetch is returned when the block or the proofs cannot be obtained from the node,
+	// the witness generation can be retried.
+	ErrProofFetch = errors.New("proof fetch failed")
+	// ErrProofConvert is returned when the proofs cannot be converted into the witness.
+	ErrProofConvert = errors.New("proof conversion failed")
+	// ErrUnsupportedShape is the conversion failure caused by a trie shape (or node encoding) that
+	// the witness does not support, errors.Is reports it also as ErrProofConvert.
+	ErrUnsupportedShape = fmt.Errorf("unsupported proof shape: %w", ErrProofConvert)
+	// ErrKeyMismatch is the conversion failure when the nibbles of the extension nodes and the leaf
+	// on the path do not match the key (errors.Is reports it also as ErrProofConvert).
+	ErrKeyMismatch = fmt.Errorf("key does not match the proof nibbles: %w", ErrProofConvert)
+	// ErrMalformedNode is the conversion failure when a proof element is not a valid RLP encoded
+	// trie node, for example when it is truncated (errors.Is reports it also as ErrProofConvert).
+	ErrMalformedNode = fmt.Errorf("malformed proof node: %w", ErrProofConvert)
+	// ErrMissingNeighbourPreimage is the conversion failure when a branch is added or deleted, but
+	// the other child of the branch (its preimage, when the branch holds the hash) is not available
+	// (errors.Is reports it also as ErrProofConvert).
+	ErrMissingNeighbourPreimage = fmt.Errorf("neighbour node preimage missing: %w", ErrProofConvert)
+	// ErrProofOrder is the conversion failure when the proof elements are not in the order from
+	// the root towards the leaf: an element is not referenced by the element before it (errors.Is
+	// reports it also as ErrProofConvert).
+	ErrProofOrder = fmt.Errorf("proof elements out of order: %w", ErrProofConvert)
+	// ErrStorageRootMismatch is the conversion failure when the root of the storage proof is not
+	// the storage root in the account leaf of the same (S or C) account proof, for example when
+	// the oracle serves the proofs of different states (errors.Is reports it also as ErrProofConvert).
+	ErrStorageRootMismatch = fmt.Errorf("storage proof root does not match the account storage root: %w", ErrProofConvert)
+	// ErrIncompleteSnapState is the cause of the ErrProofFetch failure when the node is snap-synced
+	// and lacks the trie nodes of the state, unlike ErrStatePruned when the state is not kept
+	// by the node (see oracle.ErrIncompleteSnapState).
+	ErrIncompleteSnapState = oracle.ErrIncompleteSnapState
+	// ErrStatePruned is the cause of the ErrProofFetch failure when the node has pruned the state
+	// of the block.
+	ErrStatePruned = oracle.ErrStatePruned
+	// ErrOracleBudgetExceeded is returned when the witness generation needs more oracle calls than
+	// allowed by WithMaxOracleCalls.
+	ErrOracleBudgetExceeded = oracle.ErrCallBudgetExceeded
+	// ErrInternal is returned when the witness generation fails with a runtime error (for example
+	// a nil pointer dereference or an index out of range): a bug in the witness generation or
+	// a malformed proof that is not caught by the checks.
+	ErrInternal = errors.New("internal witness generation error")
+)
+
+// WitnessError is the failure of the witness generation of a modification, Kind is one of
+// ErrProofFetch, ErrProofConvert, ErrUnsupportedShape, ErrOracleBudgetExceeded, ErrInternal and
+// Err is the underlying cause.
+// Index is -1 when the failure is not specific to a modification (for example, when fetching
+// the block).
+type WitnessError struct {
+	Kind    error
+	Index   int
+	Address common.Address
+	Err     error
+}
+
+func (e *WitnessError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("block: %v: %v", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("modification %d (%s): %v: %v", e.Index, e.Address, e.Kind, e.Err)
+}
+
+func (e *WitnessError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// unsupportedShape returns the panic value for the proofs the witness cannot represent.
+func unsupportedShape(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrUnsupportedShape, fmt.Sprintf(format, a...))
+}
+
+// recoverWitnessError turns the panic in the witness generation of the modification into *WitnessError
+// (stored in err). Fetch failures are reported by oracle as *oracle.FetchError.
+func recoverWitnessError(index int, addr common.Address, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	witnessErr := &WitnessError{Kind: ErrProofConvert, Index: index, Address: addr}
+	cause, ok := r.(error)
+	if !ok {
+		cause = fmt.Errorf("%v", r)
+	}
+	var fetchErr *oracle.FetchError
+	var runtimeErr runtime.Error
+	switch {
+	case errors.As(cause, &runtimeErr):
+		witnessErr.Kind = ErrInternal
+	case errors.As(cause, &fetchErr):
+		witnessErr.Kind = ErrProofFetch
+		cause = fetchErr.Err
+	case errors.Is(cause, ErrOracleBudgetExceeded):
+		witnessErr.Kind = ErrOracleBudgetExceeded
+	case errors.Is(cause, ErrUnsupportedShape):
+		witnessErr.Kind = ErrUnsupportedShape
+	}
+	witnessErr.Err = cause
+	*err = witnessErr
+}
+
+// openStateDB fetches the block and returns the state after it.
+func openStateDB(blockNum int) (statedb *state.StateDB, err error) {
+	defer recoverWitnessError(-1, common.Address{}, &err)
+
+	blockHeaderParent := oracle.PrefetchBlock(big.NewInt(int64(blockNum)), true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+
+	return state.New(blockHeaderParent.Root, database, nil)
+}
+
+// witnessOfModification returns the witness of the modification (applying the modification
+// to statedb), the failures are returned as *WitnessError. keys is shared by the modifications
+// of the same call.
+func witnessOfModification(index int, tMod TrieModification, statedb *state.StateDB, rawProofs *[]RawProof, keys *keyCache) (nodes []Node, err error) {
+	defer recoverWitnessError(index, tMod.Address, &err)
+
+	return obtainTwoProofsAndConvertToWitnessWithProofs([]TrieModification{tMod}, statedb, 0, rawProofs, keys), nil
+}
+
+// checkKeyNibbles panics with ErrKeyMismatch when the nibbles (of an extension node or a leaf, node
+// is used in the message) are not the n nibbles of the key from keyIndex on.
+func checkKeyNibbles(key []byte, keyIndex int, nibbles []byte, n int, node string) {
+	if !hasKeyNibbles(key, keyIndex, nibbles, n) {
+		panic(fmt.Errorf("%w: %s nibbles %x at position %d of key %x", ErrKeyMismatch, node, nibbles, keyIndex, key))
+	}
+}
+
+// hasKeyNibbles returns whether the nibbles are the n nibbles of the key from keyIndex on.
+func hasKeyNibbles(key []byte, keyIndex int, nibbles []byte, n int) bool {
+	return len(nibbles) == n && keyIndex+n <= len(key) && bytes.Equal(key[keyIndex:keyIndex+n], nibbles)
+}
+
+// checkKeyDiverges panics with ErrKeyMismatch when the nibbles (of the node at keyIndex) are a part
+// of the key: the node of a non-existing proof needs to diverge from the key.
+func checkKeyDiverges(key []byte, keyIndex int, nibbles []byte, node string) {
+	if keyIndex+len(nibbles) <= len(key) && bytes.Equal(key[keyIndex:keyIndex+len(nibbles)], nibbles) {
+		panic(fmt.Errorf("%w: %s nibbles %x at position %d match key %x of the non-existing proof", ErrKeyMismatch, node, nibbles, keyIndex, key))
+	}
+}
+
+// checkNodeRLP panics with ErrMalformedNode when the node (node is used in the message) is not
+// an RLP list of elems elements (a branch has 17 elements, a leaf and an extension node 2), elems = 0
+// accepts any of them. The bytes after the list are not checked.
+func checkNodeRLP(proofEl []byte, elems int, node string) int {
+	content, _, err := rlp.SplitList(proofEl)
+	c := 0
+	if err == nil {
+		c, err = rlp.CountValues(content)
+	}
+	if err == nil && (c != 2 && c != 17 || elems != 0 && c != elems) {
+		err = fmt.Errorf("%d elements", c)
+	}
+	if err != nil {
+		panic(fmt.Errorf("%w: %s of %d bytes: %v", ErrMalformedNode, node, len(proofEl), err))
+	}
+
+	return c
+}
+
+// checkProofOrder panics with ErrProofOrder when a proof element (of the proof named name in
+// the message) is not a child of the element before it. The child is referenced by its hash or,
+// when it is shorter than 32 bytes, inlined in the parent. The parents need to be valid nodes
+// (see checkNodeRLP).
+func checkProofOrder(proof [][]byte, name string) {
+	for i := 1; i < len(proof); i++ {
+		checkNodeRLP(proof[i-1], 0, fmt.Sprintf("%s element %d", name, i-1))
+		if !isChildNode(proof[i-1], proof[i]) {
+			panic(fmt.Errorf("%w: %s element %d is not referenced by element %d", ErrProofOrder, name, i, i-1))
+		}
+	}
+}
+
+// isChildNode returns whether child is referenced (by its hash or inlined) in the branch or
+// extension node parent.
+func isChildNode(parent, child []byte) bool {
+	content, _, err := rlp.SplitList(parent)
+	if err != nil {
+		return false
+	}
+	hash := keccak(child)
+	for len(content) > 0 {
+		kind, val, rest, err := rlp.Split(content)
+		if err != nil {
+			return false
+		}
+		if kind == rlp.String && bytes.Equal(val, hash) || kind == rlp.List && bytes.Equal(content[:len(content)-len(rest)], child) {
+			return true
+		}
+		content = rest
+	}
+
+	return false
+}
+
+// checkStorageRoot panics with ErrStorageRootMismatch when the root of the storage proof (the empty
+// root for the empty proof) is not the storage root in the account leaf, the last element of
+// the account proof. side ("S" or "C") is used in the message.
+func checkStorageRoot(accountProof, storageProof [][]byte, side string) {
+	if len(accountProof) == 0 {
+		panic(fmt.Errorf("%w: no account leaf in the %s proof", ErrStorageRootMismatch, side))
+	}
+	leaf := accountProof[len(accountProof)-1]
+	var elems [][]byte
+	if err := rlp.DecodeBytes(leaf, &elems); err != nil || len(elems) != 2 {
+		panic(fmt.Errorf("%w: %s account leaf of %d bytes", ErrMalformedNode, side, len(leaf)))
+	}
+	var account state.Account
+	if err := rlp.DecodeBytes(elems[1], &account); err != nil {
+		panic(fmt.Errorf("%w: %s account leaf value: %v", ErrMalformedNode, side, err))
+	}
+
+	if root := proofRoot(storageProof); root != account.Root {
+		panic(fmt.Errorf("%w: %s storage proof root %s, account storage root %s", ErrStorageRootMismatch, side, root, account.Root))
+	}
+}
@@ -0,0 +1,218 @@
+package witness
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"main/gethutil/mpt/oracle"
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestWitnessErrorClassification(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	generate := func(f func()) (err error) {
+		defer recoverWitnessError(3, addr, &err)
+		f()
+		return nil
+	}
+
+	fetchErr := generate(func() { panic(&oracle.FetchError{Err: io.ErrUnexpectedEOF}) })
+	if !errors.Is(fetchErr, ErrProofFetch) || !errors.Is(fetchErr, io.ErrUnexpectedEOF) {
+		t.Fatalf("fetch failure not classified: %v", fetchErr)
+	}
+	if errors.Is(fetchErr, ErrProofConvert) {
+		t.Fatalf("fetch failure classified as conversion failure: %v", fetchErr)
+	}
+
+	// The storage root of the account leaf needs to be 32 bytes long:
+	shapeErr := generate(func() { getStorageRootCodeHashValue(make([]byte, 70), 0) })
+	if !errors.Is(shapeErr, ErrUnsupportedShape) || !errors.Is(shapeErr, ErrProofConvert) {
+		t.Fatalf("unsupported shape not classified: %v", shapeErr)
+	}
+	if errors.Is(shapeErr, ErrProofFetch) {
+		t.Fatalf("unsupported shape classified as fetch failure: %v", shapeErr)
+	}
+
+	// The leaf is cut in the middle of its RLP:
+	convertErr := generate(func() { checkNodeRLP([]byte{0xe2, 0xa0, 0x39}, 2, "leaf") })
+	if !errors.Is(convertErr, ErrProofConvert) || errors.Is(convertErr, ErrUnsupportedShape) || errors.Is(convertErr, ErrProofFetch) {
+		t.Fatalf("conversion failure not classified: %v", convertErr)
+	}
+
+	// The runtime errors are not reported as conversion failures. The account leaf is cut after
+	// the storage root RLP byte (index out of range):
+	internalErr := generate(func() { getStorageRootCodeHashValue([]byte{160}, 0) })
+	var runtimeErr runtime.Error
+	if !errors.Is(internalErr, ErrInternal) || !errors.As(internalErr, &runtimeErr) || errors.Is(internalErr, ErrProofConvert) {
+		t.Fatalf("runtime error not classified: %v", internalErr)
+	}
+
+	// The errors of the state (for example of GetProof) do not exit the process:
+	stateErr := generate(func() { check(io.ErrShortBuffer) })
+	if !errors.Is(stateErr, ErrProofConvert) || !errors.Is(stateErr, io.ErrShortBuffer) || errors.Is(stateErr, ErrUnsupportedShape) {
+		t.Fatalf("state failure not classified: %v", stateErr)
+	}
+	checkedShapeErr := generate(func() { check(unsupportedShape("drifted node")) })
+	if !errors.Is(checkedShapeErr, ErrUnsupportedShape) {
+		t.Fatalf("unsupported shape passed to check not classified: %v", checkedShapeErr)
+	}
+
+	var witnessErr *WitnessError
+	if !errors.As(convertErr, &witnessErr) {
+		t.Fatalf("not a WitnessError: %T", convertErr)
+	}
+	if witnessErr.Index != 3 || witnessErr.Address != addr {
+		t.Fatalf("wrong context: modification %d, address %s", witnessErr.Index, witnessErr.Address)
+	}
+
+	if err := generate(func() {}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestMalformedNode(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	addrh := crypto.Keccak256(addr.Bytes())
+	key := common.HexToHash("0x12")
+	branch := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xaa"), 10: common.HexToHash("0xcc")})
+	accountLeaf := makeAccountLeaf(t, addrh, 1, 1, big.NewInt(5))
+	value, _ := rlp.EncodeToBytes([]byte{0x2a})
+	storageLeaf := makeStorageLeaf(t, key, value)
+	truncate := func(node []byte) []byte { return node[:len(node)-10] }
+
+	tests := []struct {
+		node string
+		f    func()
+	}{
+		{"proof element", func() { isBranch(truncate(branch)) }},
+		{"C branch", func() {
+			prepareBranchNode(branch, truncate(branch), nil, nil, nil, makeRows(4, 0), 3, 3, false, false, false)
+		}},
+		// A well-formed leaf where a branch is expected:
+		{"S branch", func() {
+			prepareBranchNode(storageLeaf, branch, nil, nil, nil, makeRows(4, 0), 3, 3, false, false, false)
+		}},
+		{"S account leaf", func() {
+			prepareAccountLeafNode(addr, addrh, truncate(accountLeaf), accountLeaf, nil, trie.KeybytesToHex(addrh), false, false, false, AccountLayoutCurrent)
+		}},
+		{"C storage leaf", func() {
+			prepareStorageLeafNode(storageLeaf, truncate(storageLeaf), nil, key, trie.KeybytesToHex(crypto.Keccak256(key.Bytes())), false, false, false, false, false)
+		}},
+	}
+	for _, test := range tests {
+		err := func() (err error) {
+			defer recoverWitnessError(0, addr, &err)
+			test.f()
+			return nil
+		}()
+		if !errors.Is(err, ErrMalformedNode) || !errors.Is(err, ErrProofConvert) {
+			t.Errorf("%s: expected ErrMalformedNode, got %v", test.node, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.node) {
+			t.Errorf("%s: node not named in %v", test.node, err)
+		}
+	}
+}
+
+// The storage proofs of a storage change match the storage roots of the account leaves, the account
+// leaf with the storage root of another storage trie does not.
+func TestStorageRootMismatch(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x17"))
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageLeaf)
+	if _, err := GetWitnessResult("", 1, []TrieModification{NewStorageChange(addr, key, common.HexToHash("0x2a"))}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(accountProof, storageProof [][]byte) (err error) {
+		defer recoverWitnessError(0, addr, &err)
+		checkStorageRoot(accountProof, storageProof, "C")
+		return nil
+	}
+	if err := check([][]byte{accountLeaf}, [][]byte{storageLeaf}); err != nil {
+		t.Fatal(err)
+	}
+	tampered, _ := singleSlotState(addr, key, common.HexToHash("0x18"))
+	err := check([][]byte{tampered}, [][]byte{storageLeaf})
+	if !errors.Is(err, ErrStorageRootMismatch) || !errors.Is(err, ErrProofConvert) {
+		t.Fatalf("expected ErrStorageRootMismatch, got %v", err)
+	}
+	// The empty storage proof is the proof of the empty storage trie:
+	if err := check([][]byte{accountLeaf}, nil); !errors.Is(err, ErrStorageRootMismatch) {
+		t.Fatalf("expected ErrStorageRootMismatch, got %v", err)
+	}
+}
+
+// A failed fetch is not recorded as fetched: the witness generation succeeds when retried
+// once the node answers again.
+func TestRetryAfterFetchError(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x17"))
+	stateRoot := crypto.Keccak256Hash(accountLeaf)
+
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Id     uint64        `json:"id"`
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.Id}
+		switch req.Method {
+		case "eth_getBlockByNumber":
+			number, _ := hexutil.DecodeBig(req.Params[0].(string))
+			header := types.Header{Number: number, Root: stateRoot, Difficulty: big.NewInt(0)}
+			block, _ := json.Marshal(&header)
+			var result map[string]interface{}
+			json.Unmarshal(block, &result)
+			result["transactions"] = []interface{}{}
+			resp["result"] = result
+		case "eth_getProof":
+			if failures > 0 {
+				failures--
+				resp["error"] = map[string]interface{}{"code": -32000, "message": "request timed out"}
+				break
+			}
+			resp["result"] = map[string]interface{}{
+				"accountProof": []string{hexutil.Encode(accountLeaf)},
+				"storageProof": []interface{}{map[string]interface{}{"proof": []string{hexutil.Encode(storageLeaf)}}},
+			}
+		default:
+			t.Errorf("unexpected method %s", req.Method)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+	prevUrl := oracle.NodeUrl
+	defer func() { oracle.NodeUrl = prevUrl }()
+	oracle.ResetCache()
+	defer oracle.ResetCache()
+
+	mods := []TrieModification{NewStorageChange(addr, key, common.HexToHash("0x2a"))}
+	if _, err := GetWitnessResult(server.URL, 1087, mods); !errors.Is(err, ErrProofFetch) {
+		t.Fatalf("expected ErrProofFetch, got %v", err)
+	}
+	if _, err := GetWitnessResult(server.URL, 1087, mods); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+}
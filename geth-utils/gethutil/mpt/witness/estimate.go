@@ -0,0 +1,144 @@
+package witness
+
+import (
+	"main/gethutil/mpt/oracle"
+	"main/gethutil/mpt/state"
+)
+
+// The number of rows (in Node.Values) for each kind of node (see GetStartNode, prepareBranchNode,
+// prepareAccountLeafNode and prepareStorageLeafNode):
+const (
+	startNodeRows   = 2
+	branchNodeRows  = 17 + 4 // branch children + extension node rows
+	accountLeafRows = int(AccountWrong) + 1 + modifiedExtensionNodeRowLen
+	storageLeafRows = int(StorageWrong) + 1 + modifiedExtensionNodeRowLen
+)
+
+// estimatedValueRowSize is the number of bytes a row takes in JSON: hex encoding,
+// quotes and comma.
+const estimatedValueRowSize = 2*valueLen + 3
+
+// estimatedNodeOverhead approximates the bytes taken by the JSON field names and
+// flags of one node.
+const estimatedNodeOverhead = 300
+
+// WitnessEstimate is the predicted size of the witness for a list of modifications.
+type WitnessEstimate struct {
+	// NodeCount is the number of witness nodes (including start and end nodes).
+	NodeCount int
+	// OracleCalls is the number of requests that have been sent to the node to obtain the proofs.
+	OracleCalls int
+	// ByteSize is the approximate size of the witness serialized with json.Marshal.
+	ByteSize int
+}
+
+// ExpectedNodeCount returns the number of witness nodes that are generated for a GetProof proof:
+// one node for each branch (the extension node above the branch is in the same node) and
+// one node for the leaf (a placeholder leaf is added when the proof does not end with a leaf).
+func ExpectedNodeCount(proof [][]byte) int {
+	count := 0
+	for _, el := range proof {
+		if isBranch(el) {
+			count++
+		}
+	}
+
+	return count + 1
+}
+
+// estimateProofSize returns the approximate number of bytes of the witness nodes for the proof.
+func estimateProofSize(proof [][]byte, leafRows int) int {
+	size := 0
+	for _, el := range proof {
+		size += estimateProofElSize(el)
+	}
+
+	return size + leafRows*estimatedValueRowSize + estimatedNodeOverhead
+}
+
+// estimateProofElSize returns the approximate number of bytes the proof element adds to the witness.
+func estimateProofElSize(proofEl []byte) int {
+	// Each proof element appears in the keccak data for both S and C proof.
+	size := 2 * (2*len(proofEl) + 3)
+	if isBranch(proofEl) {
+		size += branchNodeRows*estimatedValueRowSize + estimatedNodeOverhead
+	}
+
+	return size
+}
+
+// EstimateWitness predicts the size of the witness for the modifications without building it.
+// It fetches the proofs (which also warms the oracle cache for the subsequent build), but does
+// not apply the modifications. The estimate is thus less precise when the modifications change
+// the shape of the trie (for example, when an account is added). The failures are returned
+// as *WitnessError, as by GetWitnessResult.
+func EstimateWitness(nodeUrl string, blockNum int, trieModifications []TrieModification) (WitnessEstimate, error) {
+	var estimate WitnessEstimate
+
+	oracleCalls := oracle.ProviderCalls()
+	if nodeUrl != "" {
+		oracle.NodeUrl = nodeUrl
+	}
+	statedb, err := openStateDB(blockNum)
+	if err != nil {
+		return estimate, err
+	}
+
+	for i, tMod := range trieModifications {
+		nodeCount, byteSize, err := estimateModification(i, tMod, statedb)
+		if err != nil {
+			return estimate, err
+		}
+		estimate.NodeCount += nodeCount
+		estimate.ByteSize += byteSize
+	}
+	estimate.OracleCalls = oracle.ProviderCalls() - oracleCalls
+
+	return estimate, nil
+}
+
+// estimateModification returns the number of the witness nodes and their approximate size in bytes
+// for the modification, the failures are returned as *WitnessError.
+func estimateModification(index int, tMod TrieModification, statedb *state.StateDB) (nodeCount, byteSize int, err error) {
+	defer recoverWitnessError(index, tMod.Address, &err)
+
+	nodeCount += 2
+	byteSize += 2 * (startNodeRows*estimatedValueRowSize + estimatedNodeOverhead)
+
+	oracle.PrefetchAccount(statedb.Db.BlockNumber, tMod.Address, nil)
+	accountProof, _, _, _, _, err := statedb.GetProof(tMod.Address)
+	if err != nil {
+		return 0, 0, err
+	}
+	nodeCount += ExpectedNodeCount(accountProof)
+	byteSize += estimateProofSize(accountProof, accountLeafRows)
+	if tMod.Type == AccountAndStorageChange {
+		// The account witness precedes the storage witness:
+		nodeCount += 2 + ExpectedNodeCount(accountProof)
+		byteSize += 2*(startNodeRows*estimatedValueRowSize+estimatedNodeOverhead) + estimateProofSize(accountProof, accountLeafRows)
+	}
+
+	if tMod.Type == StorageChanged || tMod.Type == StorageDoesNotExist || tMod.Type == AccountAndStorageChange {
+		// The storage proof elements are only counted and sized, they are walked one by one
+		// instead of being collected into a list.
+		branches := 0
+		size := 0
+		if statedb.Exist(tMod.Address) {
+			oracle.PrefetchStorage(statedb.Db.BlockNumber, tMod.Address, tMod.Key, nil)
+			err = statedb.GetStorageProofEach(tMod.Address, tMod.Key, func(_ int, proofEl []byte) error {
+				if isBranch(proofEl) {
+					branches++
+				}
+				size += estimateProofElSize(proofEl)
+				return nil
+			})
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		nodeCount += branches + 1
+		byteSize += size + storageLeafRows*estimatedValueRowSize + estimatedNodeOverhead
+	}
+
+	return nodeCount, byteSize, nil
+}
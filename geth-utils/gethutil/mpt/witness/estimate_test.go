@@ -0,0 +1,75 @@
+package witness
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The estimate of the modifications that do not change the shape of the tries has the node count
+// of the witness and its size within a quarter of the JSON size.
+func TestEstimateWitnessMemoryProvider(t *testing.T) {
+	root, nodes := exampleStateWithSlots(40)
+	setMemoryState(t, root, nodes...)
+	slot := func(i int64) common.Hash { return common.BigToHash(big.NewInt(i)) }
+
+	tests := []struct {
+		name string
+		mods []TrieModification
+	}{
+		{"NonceChanged", []TrieModification{NewNonceChange(exampleEOA, 2)}},
+		{"StorageChanged", []TrieModification{NewStorageChange(exampleContract, slot(7), common.HexToHash("0x2a"))}},
+		{"AccountAndStorageChange", []TrieModification{NewAccountAndStorageChange(exampleContract, 2, nil, slot(9), common.HexToHash("0x2b"))}},
+		{"Mixed", []TrieModification{
+			NewBalanceChange(exampleEOA, big.NewInt(100)),
+			NewStorageChange(exampleContract, slot(1), common.HexToHash("0x2c")),
+			NewStorageNonExistence(exampleContract, slot(41)),
+		}},
+	}
+	for _, test := range tests {
+		estimate, err := EstimateWitness("", 1, test.mods)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		result, err := GetWitnessResult("", 1, test.mods)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		b, err := json.Marshal(result.Nodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if estimate.NodeCount != len(result.Nodes) {
+			t.Errorf("%s: estimated %d nodes, got %d", test.name, estimate.NodeCount, len(result.Nodes))
+		}
+		tolerance := len(b) / 4
+		if estimate.ByteSize < len(b)-tolerance || estimate.ByteSize > len(b)+tolerance {
+			t.Errorf("%s: estimated %d bytes, got %d", test.name, estimate.ByteSize, len(b))
+		}
+		if estimate.OracleCalls == 0 {
+			t.Errorf("%s: the provider calls are not counted", test.name)
+		}
+	}
+}
+
+// The failures of the estimate are returned as *WitnessError of the modification.
+func TestEstimateWitnessError(t *testing.T) {
+	accountLeaf, _ := singleSlotState(exampleContract, common.HexToHash("0x12"), common.HexToHash("0x17"))
+	// The storage trie is not served:
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf)
+
+	mods := []TrieModification{
+		NewNonceChange(exampleContract, 2),
+		NewStorageChange(exampleContract, common.HexToHash("0x12"), common.HexToHash("0x2a")),
+	}
+	_, err := EstimateWitness("", 1, mods)
+	var witnessErr *WitnessError
+	if !errors.As(err, &witnessErr) || witnessErr.Index != 1 {
+		t.Fatalf("expected the error of modification 1, got %v", err)
+	}
+}
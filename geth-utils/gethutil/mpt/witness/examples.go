@@ -0,0 +1,150 @@
+package witness
+
+import (
+	"fmt"
+	"math/big"
+
+	"main/gethutil/mpt/oracle"
+	"main/gethutil/mpt/state"
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// The accounts of the example state: the externally owned account, the contract with three
+// storage slots and the account that does not exist.
+var (
+	exampleEOA      = common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	exampleContract = common.HexToAddress("0x40efbf12580138bc2bbceeeaa111df4e42ab81ab")
+	exampleAbsent   = common.HexToAddress("0x68d5b2f6f1c0a4c8f3e7de1a23d6c0e4f1a2b3c4")
+)
+
+// proofTypeNames are the names of the proof types, the keys of GenerateExampleWitnesses.
+var proofTypeNames = map[ProofType]string{
+	NonceChanged:            "NonceChanged",
+	BalanceChanged:          "BalanceChanged",
+	CodeHashChanged:         "CodeHashChanged",
+	AccountDestructed:       "AccountDestructed",
+	AccountDoesNotExist:     "AccountDoesNotExist",
+	StorageChanged:          "StorageChanged",
+	StorageDoesNotExist:     "StorageDoesNotExist",
+	AccountCreate:           "AccountCreate",
+	CodeHashRead:            "CodeHashRead",
+	AccountRead:             "AccountRead",
+	AccountAndStorageChange: "AccountAndStorageChange",
+}
+
+// exampleModifications returns the modifications of the examples by name: one per proof type
+// (named as the proof type) and the structural edge cases (named proof type/case).
+func exampleModifications() map[string][]TrieModification {
+	slot := func(i int64) common.Hash { return common.BigToHash(big.NewInt(i)) }
+
+	return map[string][]TrieModification{
+		proofTypeNames[NonceChanged]:        {NewNonceChange(exampleEOA, 2)},
+		proofTypeNames[BalanceChanged]:      {NewBalanceChange(exampleEOA, big.NewInt(100))},
+		proofTypeNames[CodeHashChanged]:     {NewCodeHashChange(exampleEOA, crypto.Keccak256Hash([]byte{0x60, 0x00}))},
+		proofTypeNames[AccountDestructed]:   {NewAccountDestruct(exampleEOA)},
+		proofTypeNames[AccountDoesNotExist]: {NewAccountNonExistence(exampleAbsent)},
+		proofTypeNames[StorageChanged]:      {NewStorageChange(exampleContract, slot(1), common.HexToHash("0x2a"))},
+		proofTypeNames[StorageDoesNotExist]: {NewStorageNonExistence(exampleContract, slot(4))},
+		proofTypeNames[AccountCreate]:       {NewAccountCreate(exampleAbsent)},
+		proofTypeNames[CodeHashRead]:        {NewCodeHashRead(exampleContract)},
+		proofTypeNames[AccountRead]:         {NewAccountRead(exampleEOA)},
+		proofTypeNames[AccountAndStorageChange]: {
+			NewAccountAndStorageChange(exampleContract, 2, nil, slot(2), common.HexToHash("0x2b"))},
+		// The slot is added to the storage trie (a branch or a leaf is added):
+		proofTypeNames[StorageChanged] + "/AddSlot": {NewStorageChange(exampleContract, slot(4), common.HexToHash("0x2c"))},
+		// The slot is removed from the storage trie (the branch collapses into the drifted leaf):
+		proofTypeNames[StorageChanged] + "/DeleteSlot": {NewStorageChange(exampleContract, slot(3), common.Hash{})},
+		// The storage slot that does not change, the S and C proofs are the same:
+		proofTypeNames[StorageChanged] + "/NoOp": {NewStorageChange(exampleContract, slot(1), slot(1))},
+		// The storage of the account that does not exist, proven by the account non-existence:
+		proofTypeNames[StorageDoesNotExist] + "/NoAccount": {NewStorageNonExistence(exampleAbsent, slot(1))},
+	}
+}
+
+// exampleState returns the state root and the trie nodes of the example state: the externally
+// owned account and the contract with the slots 1, 2, 3 set to 1, 2, 3.
+func exampleState() (common.Hash, [][]byte) {
+	return exampleStateWithSlots(3)
+}
+
+// exampleStateWithSlots is exampleState with the slots 1, ..., n of the contract set to 1, ..., n.
+// The nodes are the proofs of all the accounts and the slots, which is the whole state.
+func exampleStateWithSlots(n int) (common.Hash, [][]byte) {
+	var nodes [][]byte
+	collect := func(tr *trie.Trie, key []byte) {
+		check(tr.ProveEach(key, func(level int, proofEl []byte) error {
+			nodes = append(nodes, common.CopyBytes(proofEl))
+			return nil
+		}))
+	}
+	newTrie := func() *trie.Trie {
+		tr, err := trie.New(common.Hash{}, &trie.Database{})
+		check(err)
+		return tr
+	}
+
+	storage := newTrie()
+	var storageKeys [][]byte
+	for i := int64(1); i <= int64(n); i++ {
+		key := crypto.Keccak256(common.BigToHash(big.NewInt(i)).Bytes())
+		value, err := rlp.EncodeToBytes(big.NewInt(i))
+		check(err)
+		check(storage.TryUpdate(key, value))
+		storageKeys = append(storageKeys, key)
+	}
+	for _, key := range storageKeys {
+		collect(storage, key)
+	}
+
+	accounts := newTrie()
+	var accountKeys [][]byte
+	for _, account := range []struct {
+		addr common.Address
+		data state.Account
+	}{
+		{exampleEOA, state.Account{Nonce: 1, Balance: big.NewInt(7), Root: types.EmptyRootHash, CodeHash: crypto.Keccak256(nil)}},
+		{exampleContract, state.Account{Nonce: 1, Balance: big.NewInt(0), Root: storage.Hash(), CodeHash: crypto.Keccak256(nil)}},
+	} {
+		key := crypto.Keccak256(account.addr.Bytes())
+		value, err := rlp.EncodeToBytes(&account.data)
+		check(err)
+		check(accounts.TryUpdate(key, value))
+		accountKeys = append(accountKeys, key)
+	}
+	for _, key := range accountKeys {
+		collect(accounts, key)
+	}
+
+	return accounts.Hash(), nodes
+}
+
+// GenerateExampleWitnesses returns the example witnesses for the circuit tests: one for each
+// proof type (keyed by the name of the proof type) and for the structural edge cases (keyed by
+// the name of the proof type, slash and the case). The examples are generated from the in-memory
+// state (see exampleState), the oracle provider is reset to the default one afterwards.
+func GenerateExampleWitnesses() map[string][]Node {
+	root, nodes := exampleState()
+	provider := oracle.NewMemoryProvider()
+	provider.AddNodes(nodes...)
+	for n := int64(1); n <= 2; n++ {
+		provider.AddHeader(types.Header{Number: big.NewInt(n), Root: root, Difficulty: big.NewInt(0)})
+	}
+	oracle.SetProvider(provider)
+	defer oracle.SetProvider(nil)
+
+	examples := make(map[string][]Node)
+	for name, trieModifications := range exampleModifications() {
+		result, err := GetWitnessResult("", 1, trieModifications)
+		if err != nil {
+			panic(fmt.Errorf("example %s: %w", name, err))
+		}
+		examples[name] = result.Nodes
+	}
+
+	return examples
+}
@@ -0,0 +1,43 @@
+package witness
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Every proof type has an example, each example is a chain of complete modification witnesses
+// (the C root of a modification is the S root of the next one) that can be flattened into rows.
+func TestGenerateExampleWitnesses(t *testing.T) {
+	examples := GenerateExampleWitnesses()
+	for proofType := NonceChanged; proofType <= AccountAndStorageChange; proofType++ {
+		name, ok := proofTypeNames[proofType]
+		if !ok {
+			t.Fatalf("proof type %d has no name", proofType)
+		}
+		if len(examples[name]) == 0 {
+			t.Fatalf("no example for %s", name)
+		}
+	}
+
+	for name, nodes := range examples {
+		segments, err := SplitByModification(nodes)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(segments) == 0 {
+			t.Fatalf("%s: no modification", name)
+		}
+		for i := 1; i < len(segments); i++ {
+			prevC := segments[i-1][0].Values[1][1:33]
+			if s := segments[i][0].Values[0][1:33]; !bytes.Equal(s, prevC) {
+				t.Fatalf("%s: modification %d starts at %x, the previous one ends at %x", name, i, s, prevC)
+			}
+		}
+		if _, err := FlattenNodes(nodes); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if segments, _ := SplitByModification(examples[proofTypeNames[AccountAndStorageChange]]); len(segments) != 2 {
+		t.Fatal("expected the account and the storage witness in the AccountAndStorageChange example")
+	}
+}
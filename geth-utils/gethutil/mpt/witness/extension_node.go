@@ -1,16 +1,21 @@
 package witness
 
+import (
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
 func prepareExtensions(extNibbles [][]byte, extensionNodeInd int, proofEl1, proofEl2 []byte) (byte, []byte, [][]byte) {
-	var values [][]byte
-	v1 := make([]byte, valueLen)
-	v2 := make([]byte, valueLen)
-	v3 := make([]byte, valueLen)
-	v4 := make([]byte, valueLen)
+	checkNodeRLP(proofEl1, 2, "S extension node")
+	checkNodeRLP(proofEl2, 2, "C extension node")
+	values := makeRows(4, 0)
+	v1, v2, v3, v4 := values[0], values[1], values[2], values[3]
 
 	listRlpBytes := prepareExtension(v1, v2, proofEl1, true)
 	prepareExtension(v3, v4, proofEl2, false)
 
-	evenNumberOfNibbles := proofEl1[2] == 0
+	evenNumberOfNibbles := isExtensionNodeEven(proofEl1)
 	keyLen := getExtensionNodeKeyLen(proofEl1)
 	numberOfNibbles := getExtensionNumberOfNibbles(proofEl1)
 
@@ -35,10 +40,6 @@ func prepareExtensions(extNibbles [][]byte, extensionNodeInd int, proofEl1, proo
 			extNibbles[extensionNodeInd][j]
 		ind++
 	}
-	values = append(values, v1)
-	values = append(values, v2)
-	values = append(values, v3)
-	values = append(values, v4)
 
 	return numberOfNibbles, listRlpBytes, values
 }
@@ -72,8 +73,17 @@ func getExtensionNodeKeyLen(proofEl []byte) byte {
 	}
 }
 
+// isExtensionNodeEven returns whether the extension node key has an even number of nibbles.
+// The first byte of the compact key is 0 in this case, otherwise it is `16 + first nibble`.
+// Note that the first byte of the compact key is at position 3 when the extension node
+// is longer than 55 bytes (two RLP list bytes).
+func isExtensionNodeEven(proofEl []byte) bool {
+	_, startKey := getExtensionLenStartKey(proofEl)
+	return proofEl[startKey] == 0
+}
+
 func getExtensionNumberOfNibbles(proofEl []byte) byte {
-	evenNumberOfNibbles := proofEl[2] == 0
+	evenNumberOfNibbles := isExtensionNodeEven(proofEl)
 	numberOfNibbles := byte(0)
 	keyLen := getExtensionNodeKeyLen(proofEl)
 	if keyLen == 1 {
@@ -147,17 +157,18 @@ func prepareExtension(v1, v2, proofEl []byte, setKey bool) []byte {
 	listRlpBytes = append(listRlpBytes, proofEl[0])
 
 	lenKey, startKey := getExtensionLenStartKey(proofEl)
+
+	// The list has two RLP bytes when it is longer than 55 bytes:
+	if startKey == 3 {
+		listRlpBytes = append(listRlpBytes, proofEl[1])
+	}
+
 	if lenKey != 1 {
 		// The descriptor now contains the key length RLP in value row:
 		startKey = startKey - 1
 		lenKey = lenKey + 1
 	}
 
-	// TODO
-	if startKey == 3 {
-		listRlpBytes = append(listRlpBytes, proofEl[1])
-	}
-
 	if setKey {
 		for j := 0; j < lenKey; j++ {
 			v1[j] = proofEl[startKey+j]
@@ -180,3 +191,14 @@ func prepareExtension(v1, v2, proofEl []byte, setKey bool) []byte {
 
 	return listRlpBytes
 }
+
+// extensionNodeWithNibbles returns the extension node with the same child as extNode, but with
+// the given nibbles. The RLP list is longer than 55 bytes (two list RLP bytes) when there are
+// many nibbles.
+func extensionNodeWithNibbles(extNode, nibbles []byte) []byte {
+	content, _, _ := rlp.SplitList(extNode)
+	_, child, _ := rlp.SplitString(content)
+	node, _ := rlp.EncodeToBytes([]interface{}{trie.HexToCompact(nibbles), rlp.RawValue(child)})
+
+	return node
+}
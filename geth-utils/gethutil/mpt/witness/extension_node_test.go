@@ -0,0 +1,208 @@
+package witness
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"main/gethutil/mpt/state"
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func makeNibbles(n int) []byte {
+	nibbles := make([]byte, n)
+	for i := range nibbles {
+		nibbles[i] = byte(i+1) % 16
+	}
+	return nibbles
+}
+
+func TestPrepareExtensions(t *testing.T) {
+	tests := []struct {
+		name            string
+		nibbles         []byte
+		numberOfNibbles byte
+		// the position of the first nibble stored in the C key row (every second nibble is stored)
+		startNibblePos int
+	}{
+		{"one nibble", []byte{7}, 1, 2},
+		{"two nibbles", []byte{5, 6}, 2, 1},
+		{"three nibbles", []byte{1, 2, 3}, 3, 2},
+		{"four nibbles", []byte{1, 2, 3, 4}, 4, 1},
+		{"long list even", makeNibbles(44), 44, 1},
+		{"long list odd", makeNibbles(45), 45, 2},
+		// The whole key (the node above the extension node is the root):
+		{"all nibbles", makeNibbles(64), 64, 1},
+	}
+
+	branchHash := common.HexToHash("0xabcdef")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compact := trie.HexToCompact(tt.nibbles)
+			ext, err := rlp.EncodeToBytes([][]byte{compact, branchHash.Bytes()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyRlp, _ := rlp.EncodeToBytes(compact)
+
+			numberOfNibbles, listRlpBytes, values := prepareExtensions([][]byte{tt.nibbles}, 0, ext, ext)
+
+			if numberOfNibbles != tt.numberOfNibbles {
+				t.Errorf("numberOfNibbles = %d, expected %d", numberOfNibbles, tt.numberOfNibbles)
+			}
+
+			expectedListRlpBytes := []byte{ext[0]}
+			if len(keyRlp)+33 > 55 {
+				expectedListRlpBytes = append(expectedListRlpBytes, ext[1])
+			}
+			if !bytes.Equal(listRlpBytes, expectedListRlpBytes) {
+				t.Errorf("listRlpBytes = %v, expected %v", listRlpBytes, expectedListRlpBytes)
+			}
+
+			if len(values) != 4 {
+				t.Fatalf("expected 4 rows, got %d", len(values))
+			}
+			if !bytes.Equal(values[0][:len(keyRlp)], keyRlp) {
+				t.Errorf("key row = %v, expected %v", values[0], keyRlp)
+			}
+			for _, row := range []int{1, 3} {
+				if values[row][0] != 160 || !bytes.Equal(values[row][1:33], branchHash.Bytes()) {
+					t.Errorf("branch hash row %d = %v", row, values[row])
+				}
+			}
+
+			expectedNibblesRow := make([]byte, valueLen)
+			ind := 0
+			for j := tt.startNibblePos; j < len(tt.nibbles); j += 2 {
+				expectedNibblesRow[2+ind] = tt.nibbles[j]
+				ind++
+			}
+			if !bytes.Equal(values[2], expectedNibblesRow) {
+				t.Errorf("nibbles row = %v, expected %v", values[2], expectedNibblesRow)
+			}
+		})
+	}
+}
+
+func TestGetExtensionNodeNibbles(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 44, 45} {
+		nibbles := makeNibbles(n)
+		ext, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(nibbles), common.HexToHash("0x1").Bytes()})
+		if got := getExtensionNodeNibbles(ext); !bytes.Equal(got, nibbles) {
+			t.Errorf("%d nibbles: got %v", n, got)
+		}
+	}
+}
+
+func TestExtensionNodeWithNibbles(t *testing.T) {
+	child := common.HexToHash("0xabcdef").Bytes()
+	long, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(makeNibbles(60)), child})
+	for _, n := range []int{1, 2, 30, 59} {
+		nibbles := makeNibbles(n)
+		expected, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(nibbles), child})
+		if got := extensionNodeWithNibbles(long, nibbles); !bytes.Equal(got, expected) {
+			t.Errorf("%d nibbles: got %v, expected %v", n, got, expected)
+		}
+	}
+}
+
+// The inserted slot shares the first nibble with the storage root extension node and diverges
+// at the second one: the extension node is replaced by the extension node of one nibble, the new
+// branch and the short extension node above the branch of the two existing slots. The short extension
+// node is obtained by the path of the long one (which is already hashed, like the storage key).
+func TestStorageInsertionModifiedExtensionNode(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	hashed := func(key common.Hash) []byte { return crypto.Keccak256(key.Bytes()) }
+
+	// Two slots sharing the first three nibbles of the hashed keys:
+	var keys []common.Hash
+	byPrefix := make(map[int]int)
+	for i := 0; len(keys) == 0; i++ {
+		h := hashed(slotKey(i))
+		prefix := int(h[0])<<4 | int(h[1]>>4)
+		if j, ok := byPrefix[prefix]; ok {
+			keys = append(keys, slotKey(j), slotKey(i))
+		}
+		byPrefix[prefix] = i
+	}
+	h0 := hashed(keys[0])
+	var newKey common.Hash
+	for i := 0; ; i++ {
+		h := hashed(slotKey(i))
+		if h[0]>>4 == h0[0]>>4 && h[0]&0xf != h0[0]&0xf {
+			newKey = slotKey(i)
+			break
+		}
+	}
+
+	value, _ := rlp.EncodeToBytes([]byte{0x17})
+	storage, err := trie.New(common.Hash{}, &trie.Database{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nodes [][]byte
+	collect := func(key common.Hash) [][]byte {
+		var proof [][]byte
+		if err := storage.ProveEach(hashed(key), func(level int, proofEl []byte) error {
+			proof = append(proof, common.CopyBytes(proofEl))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return proof
+	}
+	for _, key := range keys {
+		if err := storage.TryUpdate(hashed(key), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys {
+		nodes = append(nodes, collect(key)...)
+	}
+	if proof := collect(keys[0]); len(proof) != 3 || isBranch(proof[0]) {
+		t.Fatalf("expected the extension node, the branch and the leaf, got %d proof elements", len(proof))
+	}
+	account, _ := rlp.EncodeToBytes(state.Account{
+		Nonce:    1,
+		Balance:  big.NewInt(7),
+		Root:     storage.Hash(),
+		CodeHash: crypto.Keccak256(nil),
+	})
+	accountLeaf, _ := rlp.EncodeToBytes([][]byte{
+		trie.HexToCompact(trie.KeybytesToHex(crypto.Keccak256(addr.Bytes()))), account})
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), append(nodes, accountLeaf)...)
+
+	// The expected short extension node is above the branch of the two slots after the insertion:
+	if err := storage.TryUpdate(hashed(newKey), value); err != nil {
+		t.Fatal(err)
+	}
+	proof := collect(keys[0])
+	if len(proof) != 5 || isBranch(proof[2]) {
+		t.Fatalf("expected the new extension node, the branch, the short extension node, the branch and the leaf, got %d proof elements", len(proof))
+	}
+	shortExtNode := proof[2]
+
+	result, err := GetWitnessResult("", 1, []TrieModification{NewStorageChange(addr, newKey, common.HexToHash("0x17"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leaf *Node
+	for i := range result.Nodes {
+		if result.Nodes[i].Storage != nil {
+			leaf = &result.Nodes[i]
+		}
+	}
+	if leaf == nil {
+		t.Fatal("no storage leaf in the witness")
+	}
+	if _, ok := ModExtensionRows(*leaf); !ok {
+		t.Fatal("the storage leaf is not equipped with the modified extension node")
+	}
+	if got := leaf.KeccakData[len(leaf.KeccakData)-1]; !bytes.Equal(got, shortExtNode) {
+		t.Fatalf("wrong short extension node %x, expected %x", got, shortExtNode)
+	}
+}
@@ -0,0 +1,37 @@
+package witness
+
+import (
+	"main/gethutil/mpt/oracle"
+)
+
+// RecordFixture generates the witness of the modifications in the block (see GetWitnessResult) and
+// saves what the oracle served for it to the fixture at path. GetWitnessFromFixture replays it.
+func RecordFixture(path string, nodeUrl string, blockNum int, trieModifications []TrieModification, opts ...WitnessOption) ([]Node, error) {
+	recorder := oracle.StartRecording()
+	result, err := GetWitnessResult(nodeUrl, blockNum, trieModifications, opts...)
+	fixture := recorder.Stop(uint64(blockNum))
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Nodes, fixture.Save(path)
+}
+
+// GetWitnessFromFixture generates the witness of the modifications from the fixture saved by
+// RecordFixture, without network. The modifications need to be the recorded ones (or to need
+// no other trie nodes). The oracle provider is reset to the default one afterwards.
+func GetWitnessFromFixture(path string, trieModifications []TrieModification, opts ...WitnessOption) ([]Node, error) {
+	fixture, err := oracle.LoadFixture(path)
+	if err != nil {
+		return nil, err
+	}
+	oracle.SetProvider(fixture.Provider())
+	defer oracle.SetProvider(nil)
+
+	result, err := GetWitnessResult("", int(fixture.Block), trieModifications, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Nodes, nil
+}
@@ -0,0 +1,36 @@
+package witness
+
+import (
+	"path/filepath"
+	"testing"
+
+	"main/gethutil/mpt/oracle"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestRecordAndReplayFixture(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x17"))
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageLeaf)
+	trieModifications := []TrieModification{NewNonceChange(addr, 2)}
+
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	recorded, err := RecordFixture(path, "", 1, trieModifications)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The state is not served by the oracle any more (nor cached by it), only the fixture has it:
+	oracle.SetProvider(nil)
+	oracle.ResetCache()
+	replayed, err := GetWitnessFromFixture(path, trieModifications)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := DiffNodes(recorded, replayed); len(diffs) != 0 {
+		t.Fatalf("replayed witness differs from the recorded one: %v", diffs)
+	}
+}
@@ -0,0 +1,167 @@
+package witness
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// fuzzModLen is the length of one modification in the input of FuzzConvertProofToWitness.
+const fuzzModLen = 2 + common.HashLength
+
+// FuzzConvertProofToWitness generates the witnesses of random modifications of the example state
+// where the contract has the random number of slots (the storage trie of up to 255 slots has branches
+// at different depths and, now and then, extension nodes). Each modification is fuzzModLen bytes:
+// the operation, the value and the 32-byte key. The operation (modulo 4) is:
+//   - 0: the change of the slot at the key to the value (0 deletes the slot),
+//   - 1: the change of the slot set in the initial state (the last byte of the key picks it),
+//   - 2: the non-existence proof of the slot at the key (the change when the slot is set),
+//   - 3: the nonce (or, when the operation is at least 128, the balance) change of the account,
+//     the last byte of the key picks the contract or the externally owned account.
+//
+// No error is expected. The witnesses need to be chained and the storage root in the last account
+// leaf of the contract needs to be the root of the storage trie with the same modifications applied.
+// The seed corpus consists of the modifications of the example witnesses.
+func FuzzConvertProofToWitness(f *testing.F) {
+	for _, trieModifications := range exampleModifications() {
+		var mods []byte
+		for _, tMod := range trieModifications {
+			switch {
+			case tMod.Address != exampleContract && tMod.Address != exampleEOA:
+			case tMod.Type == StorageChanged:
+				mods = append(append(mods, 0, tMod.Value[31]), tMod.Key[:]...)
+			case tMod.Type == StorageDoesNotExist:
+				mods = append(append(mods, 2, 0), tMod.Key[:]...)
+			case tMod.Type == NonceChanged || tMod.Type == BalanceChanged:
+				op, value := byte(3), byte(tMod.Nonce)
+				if tMod.Type == BalanceChanged {
+					op, value = 131, byte(tMod.Balance.Uint64())
+				}
+				key := common.Hash{31: 1}
+				if tMod.Address == exampleEOA {
+					key[31] = 0
+				}
+				mods = append(append(mods, op, value), key[:]...)
+			}
+		}
+		if len(mods) != 0 {
+			f.Add(uint8(3), mods)
+		}
+	}
+	randomKey := crypto.Keccak256Hash([]byte("slot"))
+	f.Add(uint8(200), bytes.Join([][]byte{
+		{1, 0}, common.Hash{31: 7}.Bytes(),
+		{0, 5}, randomKey.Bytes(),
+		{2, 0}, common.Hash{0: 0xff}.Bytes(),
+		{3, 9}, common.Hash{31: 1}.Bytes(),
+		{0, 0}, randomKey.Bytes(),
+		{131, 100}, common.Hash{}.Bytes(),
+	}, nil))
+
+	f.Fuzz(func(t *testing.T, slots uint8, mods []byte) {
+		if len(mods) > fuzzModLen*16 {
+			mods = mods[:fuzzModLen*16]
+		}
+		root, nodes := exampleStateWithSlots(int(slots))
+		setMemoryState(t, root, nodes...)
+
+		// The storage trie of the contract, modified alongside the witness:
+		storage, err := trie.New(common.Hash{}, &trie.Database{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make(map[common.Hash]byte)
+		setSlot := func(slot common.Hash, value byte) {
+			key := crypto.Keccak256(slot.Bytes())
+			if value == 0 {
+				delete(values, slot)
+				check(storage.TryDelete(key))
+				return
+			}
+			values[slot] = value
+			v, _ := rlp.EncodeToBytes([]byte{value})
+			check(storage.TryUpdate(key, v))
+		}
+		for i := 1; i <= int(slots); i++ {
+			setSlot(common.BigToHash(big.NewInt(int64(i))), byte(i))
+		}
+
+		var trieModifications []TrieModification
+		for i := 0; i+fuzzModLen <= len(mods); i += fuzzModLen {
+			op, value, key := mods[i], mods[i+1], common.BytesToHash(mods[i+2:i+fuzzModLen])
+			switch op % 4 {
+			case 1:
+				if slots == 0 {
+					continue
+				}
+				key = common.BigToHash(big.NewInt(int64(key[31]%slots) + 1))
+			case 2:
+				if _, ok := values[key]; !ok {
+					trieModifications = append(trieModifications, NewStorageNonExistence(exampleContract, key))
+					continue
+				}
+			case 3:
+				addr := exampleContract
+				if key[31]%2 == 0 {
+					addr = exampleEOA
+				}
+				if op < 128 {
+					trieModifications = append(trieModifications, NewNonceChange(addr, uint64(value)))
+				} else {
+					trieModifications = append(trieModifications, NewBalanceChange(addr, big.NewInt(int64(value))))
+				}
+				continue
+			}
+			trieModifications = append(trieModifications, NewStorageChange(exampleContract, key, common.BigToHash(big.NewInt(int64(value)))))
+			setSlot(key, value)
+		}
+		if len(trieModifications) == 0 {
+			return
+		}
+
+		result, err := GetWitnessResult("", 1, trieModifications, AllowDuplicates())
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments, err := SplitByModification(result.Nodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != len(trieModifications) {
+			t.Fatalf("%d witnesses of %d modifications", len(segments), len(trieModifications))
+		}
+		var contract *AccountNode
+		for i, segment := range segments {
+			if i > 0 && !bytes.Equal(segment[0].Values[0][1:33], segments[i-1][0].Values[1][1:33]) {
+				t.Fatalf("modification %d does not start at the C root of the previous one", i)
+			}
+			if !bytes.Equal(segment[0].Values[1][1:33], result.IntermediateRoots[i].Bytes()) {
+				t.Fatalf("modification %d: the C root is not the state root after the modification", i)
+			}
+			var account *AccountNode
+			for _, node := range segment {
+				if node.Account != nil {
+					account = node.Account
+				}
+			}
+			if account == nil || account.Address != trieModifications[i].Address {
+				t.Fatalf("modification %d: no account leaf of %s", i, trieModifications[i].Address)
+			}
+			if account.Address == exampleContract {
+				contract = account
+			}
+		}
+		if contract != nil && contract.StorageRootC != storage.Hash() {
+			t.Fatalf("storage root %s, expected %s", contract.StorageRootC, storage.Hash())
+		}
+		if _, err := FlattenNodes(result.Nodes); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -1,14 +1,22 @@
 package witness
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"main/gethutil/mpt/oracle"
 	"main/gethutil/mpt/state"
+	"main/gethutil/mpt/trie"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 func TestUpdateOneLevel(t *testing.T) {
@@ -2334,3 +2342,803 @@ func TestStorageDoesNotExistOnlySProof(t *testing.T) {
 
 	prepareWitness("StorageDoesNotExistOnlySProof", trieModifications, statedb)
 }
+
+func TestDestructAccountClearsStorage(t *testing.T) {
+	blockNum := 13284469
+	blockNumberParent := big.NewInt(int64(blockNum))
+	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb.DisableLoadingRemoteAccounts()
+
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	// The account is created and gets the storage in the same batch in which it is destructed.
+	statedb.CreateAccount(addr)
+	statedb.SetState(addr, common.HexToHash("0x12"), common.BigToHash(big.NewInt(1)))
+	statedb.SetState(addr, common.HexToHash("0x21"), common.BigToHash(big.NewInt(2)))
+
+	trieModifications := []TrieModification{
+		{Type: AccountDestructed, Address: addr},
+		{Type: AccountCreate, Address: addr},
+	}
+
+	nodes := obtainTwoProofsAndConvertToWitness(trieModifications, statedb, 0)
+	segments, err := SplitByModification(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The account leaf of the AccountDestructed witness (not the one of the re-created account):
+	var leaf *AccountNode
+	for _, node := range segments[0] {
+		if node.Account != nil {
+			leaf = node.Account
+		}
+	}
+	if leaf == nil {
+		t.Fatal("no account leaf in the AccountDestructed witness")
+	}
+	// After SELFDESTRUCT the C leaf is the placeholder (the storage root is zero) or has the empty
+	// storage trie, the storage of the account is not kept:
+	if leaf.StorageRootC != (common.Hash{}) && leaf.StorageRootC != emptyStorageRoot {
+		t.Fatalf("storage root of the destructed account is not the empty trie hash: %s", leaf.StorageRootC)
+	}
+}
+
+func TestDestructAccountWithStorageMode(t *testing.T) {
+	blockNum := 13284469
+	blockNumberParent := big.NewInt(int64(blockNum))
+	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb.DisableLoadingRemoteAccounts()
+
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	slots := []common.Hash{common.HexToHash("0x12"), common.HexToHash("0x21")}
+	statedb.CreateAccount(addr)
+	for i, slot := range slots {
+		statedb.SetState(addr, slot, common.BigToHash(big.NewInt(int64(i+1))))
+	}
+
+	trieModifications := AccountDestructedWithStorage(addr, slots)
+	nodes := obtainTwoProofsAndConvertToWitness(trieModifications[:len(slots)], statedb, 0)
+
+	// After the last slot is cleared, the storage root in the C account leaf is the empty trie hash:
+	var leaf *Node
+	for i := range nodes {
+		if nodes[i].Account != nil {
+			leaf = &nodes[i]
+		}
+	}
+	if leaf == nil {
+		t.Fatal("no account leaf in the witness")
+	}
+	storageRootC := leaf.Values[AccountStorageC]
+	if common.BytesToHash(storageRootC[1:33]) != emptyStorageRoot {
+		t.Fatalf("storage trie is not emptied: %v", storageRootC)
+	}
+
+	prepareWitness("DestructAccountWithStorage", trieModifications[len(slots):], statedb)
+}
+
+func TestEstimateWitness(t *testing.T) {
+	blockNum := 14766377
+	addr := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
+	trieModifications := []TrieModification{
+		{Type: NonceChanged, Nonce: 33, Address: addr},
+		{Type: BalanceChanged, Balance: big.NewInt(439), Address: addr},
+	}
+
+	estimate, err := EstimateWitness(oracle.NodeUrl, blockNum, trieModifications)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := GetWitness(oracle.NodeUrl, blockNum, trieModifications)
+	b, err := json.Marshal(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if estimate.NodeCount != len(nodes) {
+		t.Errorf("estimated %d nodes, got %d", estimate.NodeCount, len(nodes))
+	}
+	tolerance := len(b) / 4
+	if estimate.ByteSize < len(b)-tolerance || estimate.ByteSize > len(b)+tolerance {
+		t.Errorf("estimated %d bytes, got %d", estimate.ByteSize, len(b))
+	}
+}
+
+// lastAccountNode returns the last account leaf node in the witness.
+func lastAccountNode(t *testing.T, nodes []Node) Node {
+	for i := len(nodes) - 1; i >= 0; i-- {
+		if nodes[i].Account != nil {
+			return nodes[i]
+		}
+	}
+	t.Fatal("no account leaf in the witness")
+	return Node{}
+}
+
+func TestCreateAccountOverPreexistingStorage(t *testing.T) {
+	blockNum := 13284469
+	blockNumberParent := big.NewInt(int64(blockNum))
+	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb.DisableLoadingRemoteAccounts()
+
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	oldKey := common.HexToHash("0x12")
+	// Storage of the contract that lived at the address before:
+	statedb.CreateAccount(addr)
+	statedb.SetState(addr, oldKey, common.BigToHash(big.NewInt(1)))
+	statedb.IntermediateRoot(false)
+	oldStorageRoot := statedb.StorageTrie(addr).Hash()
+
+	// The constructor of the redeployed contract sets a different slot:
+	keys := []common.Hash{common.HexToHash("0x21")}
+	values := []common.Hash{common.BigToHash(big.NewInt(2))}
+	trieModifications, err := AccountCreateWithStorage(addr, keys, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := obtainTwoProofsAndConvertToWitness(trieModifications, statedb, 0)
+
+	if statedb.GetState(addr, oldKey) != (common.Hash{}) {
+		t.Fatal("storage of the previous account should be dropped")
+	}
+	storageRoot := statedb.StorageTrie(addr).Hash()
+	if storageRoot == oldStorageRoot || storageRoot == emptyStorageRoot {
+		t.Fatalf("unexpected storage root %s", storageRoot)
+	}
+	storageRootC := lastAccountNode(t, nodes).Values[AccountStorageC]
+	if common.BytesToHash(storageRootC[1:33]) != storageRoot {
+		t.Fatalf("C account leaf does not carry the constructor-set storage root: %v", storageRootC)
+	}
+}
+
+func TestCreateAccountOverEmptyAccount(t *testing.T) {
+	blockNum := 13284469
+	blockNumberParent := big.NewInt(int64(blockNum))
+	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb.DisableLoadingRemoteAccounts()
+
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	// Funds sent to the address before the contract is deployed there:
+	statedb.SetBalance(addr, big.NewInt(7))
+	statedb.IntermediateRoot(false)
+
+	keys := []common.Hash{common.HexToHash("0x12")}
+	values := []common.Hash{common.BigToHash(big.NewInt(1))}
+	trieModifications, err := AccountCreateWithStorage(addr, keys, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := obtainTwoProofsAndConvertToWitness(trieModifications, statedb, 0)
+
+	if statedb.GetBalance(addr).Cmp(big.NewInt(7)) != 0 {
+		t.Fatal("balance should be carried over to the created account")
+	}
+	storageRootC := lastAccountNode(t, nodes).Values[AccountStorageC]
+	if common.BytesToHash(storageRootC[1:33]) != statedb.StorageTrie(addr).Hash() {
+		t.Fatalf("C account leaf does not carry the constructor-set storage root: %v", storageRootC)
+	}
+}
+
+func TestNonceUnchanged(t *testing.T) {
+	blockNum := 14766377
+	blockNumberParent := big.NewInt(int64(blockNum))
+	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	addr := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
+
+	trieMod := TrieModification{
+		Type:    NonceChanged,
+		Nonce:   statedb.GetNonce(addr),
+		Address: addr,
+	}
+	nodes := obtainTwoProofsAndConvertToWitness([]TrieModification{trieMod}, statedb, 0)
+
+	start := nodes[0]
+	if !start.Start.IsNoOp {
+		t.Fatal("setting the nonce to its current value should be flagged as no-op")
+	}
+	if !bytes.Equal(start.Values[0], start.Values[1]) {
+		t.Fatalf("S and C roots differ: %v %v", start.Values[0], start.Values[1])
+	}
+	leaf := lastAccountNode(t, nodes)
+	if !bytes.Equal(leaf.KeccakData[0], leaf.KeccakData[1]) {
+		t.Fatal("S and C account leaves differ")
+	}
+	for _, rows := range [][2]AccountRowType{
+		{AccountNonceS, AccountNonceC}, {AccountBalanceS, AccountBalanceC},
+		{AccountStorageS, AccountStorageC}, {AccountCodehashS, AccountCodehashC},
+	} {
+		if !bytes.Equal(leaf.Values[rows[0]], leaf.Values[rows[1]]) {
+			t.Fatalf("S and C rows differ: %v %v", leaf.Values[rows[0]], leaf.Values[rows[1]])
+		}
+	}
+}
+
+func TestStorageRootDelta(t *testing.T) {
+	blockNum := 13284469
+	blockNumberParent := big.NewInt(int64(blockNum))
+	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb.DisableLoadingRemoteAccounts()
+
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	// The two keys are in different branch children, the storage root is thus a branch.
+	ks := []common.Hash{common.HexToHash("0x12"), common.HexToHash("0x21")}
+	statedb.CreateAccount(addr)
+	for i, key := range ks {
+		statedb.SetState(addr, key, common.BigToHash(big.NewInt(int64(i+1))))
+	}
+
+	trieModifications := []TrieModification{{
+		Type:    StorageChanged,
+		Key:     ks[0],
+		Value:   common.BigToHash(big.NewInt(17)),
+		Address: addr,
+	}}
+	nodes := obtainTwoProofsAndConvertToWitness(trieModifications, statedb, 0)
+
+	accountIndex := -1
+	for i := range nodes {
+		if nodes[i].Account != nil {
+			accountIndex = i
+		}
+	}
+	if accountIndex == -1 || accountIndex+1 >= len(nodes) || nodes[accountIndex+1].ExtensionBranch == nil {
+		t.Fatal("account leaf is not followed by the storage root branch")
+	}
+	account := nodes[accountIndex].Account
+	storageRoot := nodes[accountIndex+1]
+
+	rootS := crypto.Keccak256Hash(storageRoot.KeccakData[0])
+	rootC := crypto.Keccak256Hash(storageRoot.KeccakData[1])
+	if account.StorageRootS != rootS {
+		t.Errorf("storage root S: got %x, want %x", account.StorageRootS, rootS)
+	}
+	if account.StorageRootC != rootC {
+		t.Errorf("storage root C: got %x, want %x", account.StorageRootC, rootC)
+	}
+	if account.StorageRootS == account.StorageRootC {
+		t.Error("storage root is not changed by the storage write")
+	}
+	if account.CodeHashS != account.CodeHashC {
+		t.Errorf("code hash changed: %x %x", account.CodeHashS, account.CodeHashC)
+	}
+}
+
+// The storage slot of an account that does not exist is proved not to exist by the account
+// non-existence proof.
+func TestNonExistingStorageOfNonExistingAccount(t *testing.T) {
+	blockNum := 13284469
+	blockNumberParent := big.NewInt(int64(blockNum))
+	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+
+	addr := common.HexToAddress("0x21")
+
+	trieMod := TrieModification{
+		Address: addr,
+		Key:     common.HexToHash("0x12"),
+		Type:    StorageDoesNotExist,
+	}
+	nodes := obtainTwoProofsAndConvertToWitness([]TrieModification{trieMod}, statedb, 0)
+
+	if nodes[0].Start == nil || nodes[0].Start.ProofType != "AccountDoesNotExist" {
+		t.Fatalf("expected account non-existence witness, got start node %+v", nodes[0].Start)
+	}
+	for _, node := range nodes {
+		if node.Storage != nil {
+			t.Fatal("witness for a non-existing account contains a storage leaf")
+		}
+	}
+}
+
+// witnessAccountKey reconstructs the (C proof) account key from the witness of a single
+// modification: extension nibbles and modified branch positions followed by the leaf key nibbles.
+func witnessAccountKey(t *testing.T, nodes []Node) []byte {
+	var nibbles []byte
+	for _, node := range nodes {
+		if node.ExtensionBranch != nil {
+			if node.ExtensionBranch.IsExtension {
+				nibbles = append(nibbles, getKeyRowNibbles(node.KeccakData[3])...)
+			}
+			nibbles = append(nibbles, byte(node.ExtensionBranch.Branch.ModifiedIndex))
+		}
+		if node.Account != nil {
+			return append(nibbles, getKeyRowNibbles(node.KeccakData[1])...)
+		}
+	}
+	t.Fatal("no account leaf in the witness")
+	return nil
+}
+
+// Two accounts with hashed addresses sharing the first six nibbles: the witness of each of them
+// goes through the branches (and extension nodes) of the common prefix and needs to reconstruct
+// the whole key.
+func TestAccountsSharingPrefix(t *testing.T) {
+	blockNum := 13284469
+	blockNumberParent := big.NewInt(int64(blockNum))
+	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+
+	// keccak256(addr1) = baff9b36..., keccak256(addr2) = baff9bf9...
+	addr1 := common.HexToAddress("0xaa00000000000000000000000000000000000ade")
+	addr2 := common.HexToAddress("0xaa00000000000000000000000000000000002a6b")
+	addrh1 := crypto.Keccak256(addr1.Bytes())
+	addrh2 := crypto.Keccak256(addr2.Bytes())
+	if !bytes.Equal(addrh1[:3], addrh2[:3]) {
+		t.Fatalf("hashed addresses do not share the prefix: %x %x", addrh1, addrh2)
+	}
+
+	// Adding the second account turns the leaf of the first one into a branch at the seventh nibble.
+	trieModifications := []TrieModification{
+		{Type: NonceChanged, Nonce: 1, Address: addr1},
+		{Type: NonceChanged, Nonce: 1, Address: addr2},
+	}
+	prepareWitness("AccountsSharingPrefix", trieModifications, statedb)
+
+	for _, addr := range []common.Address{addr1, addr2} {
+		trieMod := TrieModification{Type: BalanceChanged, Balance: big.NewInt(23), Address: addr}
+		nodes := obtainTwoProofsAndConvertToWitness([]TrieModification{trieMod}, statedb, 0)
+
+		key := trie.KeybytesToHex(crypto.Keccak256(addr.Bytes()))
+		key = key[:len(key)-1] // remove the terminator
+		if got := witnessAccountKey(t, nodes); !bytes.Equal(got, key) {
+			t.Fatalf("witness key of %s: got %v, want %v", addr, got, key)
+		}
+	}
+}
+
+func TestWitnessWithRawProofs(t *testing.T) {
+	blockNum := 14766377
+	addr := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
+	trieModifications := []TrieModification{
+		{Type: NonceChanged, Nonce: 33, Address: addr},
+		{Type: BalanceChanged, Balance: big.NewInt(439), Address: addr},
+	}
+
+	result, err := GetWitnessResult(oracle.NodeUrl, blockNum, trieModifications, WithRawProofs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.RawProofs) != len(trieModifications) {
+		t.Fatalf("got %d raw proofs, want %d", len(result.RawProofs), len(trieModifications))
+	}
+
+	var startNodes []Node
+	for _, node := range result.Nodes {
+		if node.Start != nil && node.Start.ProofType != "Disabled" {
+			startNodes = append(startNodes, node)
+		}
+	}
+	for i, rawProof := range result.RawProofs {
+		sRoot := common.BytesToHash(startNodes[i].Values[0][1:33])
+		cRoot := common.BytesToHash(startNodes[i].Values[1][1:33])
+		if h := crypto.Keccak256Hash(rawProof.AccountProofS[0]); h != sRoot {
+			t.Errorf("modification %d: S proof root %x, start node %x", i, h, sRoot)
+		}
+		if h := crypto.Keccak256Hash(rawProof.AccountProofC[0]); h != cRoot {
+			t.Errorf("modification %d: C proof root %x, start node %x", i, h, cRoot)
+		}
+	}
+
+	// Without the option the raw proofs are not attached:
+	result, err = GetWitnessResult(oracle.NodeUrl, blockNum, trieModifications)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RawProofs != nil {
+		t.Fatal("raw proofs attached without WithRawProofs")
+	}
+}
+
+func TestCustomModification(t *testing.T) {
+	blockNum := 14766377
+	blockNumberParent := big.NewInt(int64(blockNum))
+	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	addr := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
+
+	trieMod := CustomAccountModification(addr, NonceChanged, func(statedb *state.StateDB) error {
+		statedb.SetNonce(addr, statedb.GetNonce(addr)+1)
+		statedb.SetBalance(addr, big.NewInt(439))
+		return nil
+	})
+	nodes := obtainTwoProofsAndConvertToWitness([]TrieModification{trieMod}, statedb, 0)
+
+	if nodes[0].Start.IsNoOp {
+		t.Fatal("custom modification not applied")
+	}
+	leaf := lastAccountNode(t, nodes)
+	if bytes.Equal(leaf.Values[AccountNonceS], leaf.Values[AccountNonceC]) {
+		t.Fatal("nonce not changed")
+	}
+	if bytes.Equal(leaf.Values[AccountBalanceS], leaf.Values[AccountBalanceC]) {
+		t.Fatal("balance not changed")
+	}
+	if statedb.GetBalance(addr).Cmp(big.NewInt(439)) != 0 {
+		t.Fatalf("wrong balance after the modification: %v", statedb.GetBalance(addr))
+	}
+}
+
+func TestAccessListWitness(t *testing.T) {
+	blockNum := 14766377
+	slots := []common.Hash{common.HexToHash("0x0"), common.HexToHash("0x1")}
+	entries := []AccessListEntry{
+		{Address: common.HexToAddress("0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2"), StorageKeys: slots},
+		{Address: common.HexToAddress("0xdAC17F958D2ee523a2206206994597C13D831ec7"), StorageKeys: slots},
+	}
+
+	nodes, err := GetAccessListWitness(oracle.NodeUrl, blockNum, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	witnesses := 0
+	for _, node := range nodes {
+		if node.Start == nil || node.Start.ProofType == "Disabled" {
+			continue
+		}
+		witnesses++
+		if !bytes.Equal(node.Values[0], node.Values[1]) {
+			t.Fatalf("access list witness changes the state root: %v %v", node.Values[0], node.Values[1])
+		}
+	}
+	if witnesses != 4 {
+		t.Fatalf("got %d witnesses, want one per slot (4)", witnesses)
+	}
+}
+
+func TestStorageChangedToSameValue(t *testing.T) {
+	blockNum := 14766377
+	addr := common.HexToAddress("0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2")
+	trieMod := TrieModification{
+		Type:    StorageChanged,
+		Key:     common.HexToHash("0x12345"),
+		Value:   common.BigToHash(big.NewInt(5)),
+		Address: addr,
+	}
+	// The second modification writes the value that is already there:
+	trieModifications := []TrieModification{trieMod, trieMod}
+
+	result, err := GetWitnessResult(oracle.NodeUrl, blockNum, trieModifications, AllowDuplicates())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := firstNoOpStorageChange(result.Nodes, trieModifications); i != 1 {
+		t.Fatalf("the second modification should be read-only, got %d", i)
+	}
+
+	_, err = GetWitnessResult(oracle.NodeUrl, blockNum, trieModifications, AllowDuplicates(), RequireChange())
+	if !errors.Is(err, ErrNoChange) {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+}
+
+func TestGetWitnessResumable(t *testing.T) {
+	blockNum := 14766377
+	addr := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
+	trieModifications := []TrieModification{
+		{Type: NonceChanged, Nonce: 33, Address: addr},
+		{Type: BalanceChanged, Balance: big.NewInt(439), Address: addr},
+		{Type: NonceChanged, Nonce: 34, Address: addr},
+		{Type: BalanceChanged, Balance: big.NewInt(440), Address: addr},
+	}
+	expected, err := json.Marshal(GetWitness(oracle.NodeUrl, blockNum, trieModifications))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate the run that has been interrupted after two modifications:
+	blockHeaderParent := oracle.PrefetchBlock(big.NewInt(int64(blockNum)), true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	checkpointPath := filepath.Join(t.TempDir(), "witness.checkpoint")
+	err = saveCheckpoint(checkpointPath, checkpoint{
+		BlockNum:         blockNum,
+		NextModification: 2,
+		Nodes:            obtainTwoProofsAndConvertToWitness(trieModifications[:2], statedb, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := GetWitnessResumable(oracle.NodeUrl, blockNum, trieModifications, checkpointPath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := json.Marshal(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resumed, expected) {
+		t.Fatal("resumed witness differs from the witness generated in one run")
+	}
+	if _, err := os.Stat(checkpointPath); !os.IsNotExist(err) {
+		t.Fatal("checkpoint not removed after the witness is generated")
+	}
+}
+
+func TestWitnessWithTiming(t *testing.T) {
+	blockNum := 14766377
+	addr := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
+	trieModifications := []TrieModification{
+		NewNonceChange(addr, 33),
+		NewBalanceChange(addr, big.NewInt(439)),
+		NewNonceChange(addr, 34),
+	}
+
+	result, err := GetWitnessResult(oracle.NodeUrl, blockNum, trieModifications, AllowDuplicates(), WithTiming())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Timings) != len(trieModifications) {
+		t.Fatalf("got %d timings, want %d", len(result.Timings), len(trieModifications))
+	}
+	for i, timing := range result.Timings {
+		if timing.Index != i {
+			t.Fatalf("timing %d is for modification %d", i, timing.Index)
+		}
+		if timing.Fetch < 0 || timing.Conversion <= 0 {
+			t.Fatalf("modification %d: fetch %v, conversion %v", i, timing.Fetch, timing.Conversion)
+		}
+	}
+
+	// The timing does not change the witness:
+	plain, err := GetWitnessResult(oracle.NodeUrl, blockNum, trieModifications, AllowDuplicates())
+	if err != nil {
+		t.Fatal(err)
+	}
+	timed, _ := json.Marshal(result.Nodes)
+	expected, _ := json.Marshal(plain.Nodes)
+	if !bytes.Equal(timed, expected) {
+		t.Fatal("witness generated with timing differs")
+	}
+	if plain.Timings != nil {
+		t.Fatal("timings recorded without WithTiming")
+	}
+}
+
+func TestCodeHashReadEOA(t *testing.T) {
+	blockNum := 13284469
+	blockNumberParent := big.NewInt(int64(blockNum))
+	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb.DisableLoadingRemoteAccounts()
+
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	statedb.SetBalance(addr, big.NewInt(7))
+	statedb.IntermediateRoot(false)
+
+	nodes := obtainTwoProofsAndConvertToWitness([]TrieModification{NewCodeHashRead(addr)}, statedb, 0)
+
+	if !nodes[0].Start.IsNoOp {
+		t.Fatal("code hash read should not change the trie")
+	}
+	emptyCodeHash := common.BytesToHash(crypto.Keccak256(nil))
+	account := lastAccountNode(t, nodes).Account
+	if account.CodeHashS != emptyCodeHash || account.CodeHashC != emptyCodeHash {
+		t.Fatalf("code hash of EOA: got %x %x, want %x", account.CodeHashS, account.CodeHashC, emptyCodeHash)
+	}
+}
+
+// branchChildrenAt returns the non-empty children of the branch by their positions (the inlined
+// children as their RLP).
+func branchChildrenAt(t *testing.T, branch []byte) map[int][]byte {
+	elems, _, err := rlp.SplitList(branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children := make(map[int][]byte)
+	for i := 0; i < 16; i++ {
+		kind, content, rest, err := rlp.Split(elems)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind == rlp.List {
+			children[i] = elems[:len(elems)-len(rest)] // inlined node
+		} else if len(content) > 0 {
+			children[i] = content
+		}
+		elems = rest
+	}
+	return children
+}
+
+// leafValue returns the value (the second element) of the leaf.
+func leafValue(t *testing.T, leaf []byte) []byte {
+	elems, _, err := rlp.SplitList(leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, rest, err := rlp.Split(elems)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, value, _, err := rlp.Split(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// The account is created next to an existing account leaf: a branch with the two account leaves
+// appears. When the account is destructed, the branch collapses and the other account leaf moves up
+// (it drifts) into the position of the branch.
+func TestAccountDeleteTwoLeafBranchCollapse(t *testing.T) {
+	blockNum := 13284469
+	blockNumberParent := big.NewInt(int64(blockNum))
+	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+
+	addr := common.HexToAddress("0x21")
+	statedb.CreateAccount(addr)
+
+	trieModifications := []TrieModification{NewAccountDestruct(addr)}
+	var rawProofs []RawProof
+	nodes := obtainTwoProofsAndConvertToWitnessWithProofs(trieModifications, statedb, 0, &rawProofs, nil)
+
+	proofS, proofC := rawProofs[0].AccountProofS, rawProofs[0].AccountProofC
+	if len(proofS) != len(proofC)+1 {
+		t.Fatalf("S proof (%d) should have one more element than C proof (%d)", len(proofS), len(proofC))
+	}
+	children := branchChildrenAt(t, proofS[len(proofS)-2])
+	if len(children) != 2 {
+		t.Fatalf("the branch above the deleted account has %d children", len(children))
+	}
+
+	// The C proof (the shorter one) ends with the drifted leaf:
+	_, _, _, isLastLeaf, _, err := statedb.GetProof(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isLastLeaf {
+		t.Fatal("C proof should end with the drifted account leaf")
+	}
+
+	var placeholder *ExtensionBranchNode
+	for _, node := range nodes {
+		if node.ExtensionBranch != nil && node.ExtensionBranch.IsPlaceholder[1] {
+			placeholder = node.ExtensionBranch
+		}
+	}
+	if placeholder == nil {
+		t.Fatal("no C placeholder branch in the witness")
+	}
+	modified, drifted := placeholder.Branch.ModifiedIndex, placeholder.Branch.DriftedIndex
+	_, isModified := children[modified]
+	neighbour, isDrifted := children[drifted]
+	if modified == drifted || !isModified || !isDrifted {
+		t.Fatalf("modified index %d and drifted index %d, branch children at %v", modified, drifted, children)
+	}
+	if len(neighbour) == 32 {
+		neighbour, err = oracle.Preimage(common.BytesToHash(neighbour))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The drifted leaf (as it is in the branch) is the neighbour node of the account leaf:
+	account := lastAccountNode(t, nodes)
+	keyDrifted, _, _, _ := prepareStorageLeafInfo(neighbour, false, false)
+	if !bytes.Equal(account.Values[AccountDrifted], keyDrifted) {
+		t.Fatalf("drifted row %v, want the key of the drifted leaf %v", account.Values[AccountDrifted], keyDrifted)
+	}
+	if !bytes.Equal(account.KeccakData[len(account.KeccakData)-1], neighbour) {
+		t.Fatal("drifted leaf missing in the keccak data")
+	}
+	// Only the key of the drifted leaf changes when it moves up:
+	if !bytes.Equal(leafValue(t, neighbour), leafValue(t, proofC[len(proofC)-1])) {
+		t.Fatal("the last element of C proof is not the drifted leaf")
+	}
+}
+
+// beaconRootsAddress is the EIP-4788 contract storing the parent beacon block roots in a ring buffer
+// of historyBufferLength timestamps (slot timestamp % historyBufferLength) and roots (the slot
+// historyBufferLength further).
+var beaconRootsAddress = common.HexToAddress("0x000F3df6D732807Ef1319fB7B8bB8522d0Beac02")
+
+const historyBufferLength = 8191
+
+func TestBeaconRootsStorage(t *testing.T) {
+	blockNum := 19500000 // after Dencun
+	header := oracle.PrefetchBlock(big.NewInt(int64(blockNum)), true, nil)
+	timestampSlot := header.Time % historyBufferLength
+	rootSlot := common.BigToHash(new(big.Int).SetUint64(timestampSlot + historyBufferLength))
+
+	trieModifications := []TrieModification{
+		NewStorageChange(beaconRootsAddress, rootSlot, common.HexToHash("0xbeac02")),
+	}
+	result, err := GetWitnessResult(oracle.NodeUrl, blockNum, trieModifications)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := result.Nodes
+
+	start := nodes[0]
+	if start.Start.ProofType != "StorageChanged" || start.Start.IsNoOp {
+		t.Fatalf("wrong start node %+v", start.Start)
+	}
+	if !bytes.Equal(start.Values[0][1:33], header.Root.Bytes()) {
+		t.Fatal("S root is not the state root of the block")
+	}
+	account := lastAccountNode(t, nodes).Account
+	if account.Address != beaconRootsAddress || account.CodeHashS == (common.Hash{}) {
+		t.Fatalf("wrong account leaf %+v", account)
+	}
+	if nodes[len(nodes)-2].Storage == nil {
+		t.Fatal("storage leaf missing")
+	}
+}
+
+// A precompile has no code and no storage, its account exists only when it has received ether.
+func TestPrecompileNonce(t *testing.T) {
+	blockNum := 13284469
+	ecrecover := common.BytesToAddress([]byte{1})
+	trieModifications := []TrieModification{NewNonceChange(ecrecover, 1)}
+
+	result, err := GetWitnessResult(oracle.NodeUrl, blockNum, trieModifications)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := lastAccountNode(t, result.Nodes).Account
+	if account.Address != ecrecover || account.CodeHashS != common.BytesToHash(crypto.Keccak256(nil)) {
+		t.Fatalf("wrong account leaf %+v", account)
+	}
+}
+
+func TestAccountReadContract(t *testing.T) {
+	blockNum := 14766377
+	blockNumberParent := big.NewInt(int64(blockNum))
+	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
+	database := state.NewDatabase(blockHeaderParent)
+	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+
+	addr := common.HexToAddress("0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2")
+	nodes := obtainTwoProofsAndConvertToWitness([]TrieModification{NewAccountRead(addr)}, statedb, 0)
+
+	start := nodes[0].Start
+	if !start.IsNoOp || start.ProofType != "NonceChanged" {
+		t.Fatalf("wrong start node %+v", start)
+	}
+	leafNode := lastAccountNode(t, nodes)
+	if !bytes.Equal(leafNode.KeccakData[0], leafNode.KeccakData[1]) {
+		t.Fatal("S and C account leaves differ")
+	}
+	var account state.Account
+	if err := rlp.DecodeBytes(leafValue(t, leafNode.KeccakData[0]), &account); err != nil {
+		t.Fatal(err)
+	}
+	if account.Nonce != statedb.GetNonce(addr) || account.Balance.Cmp(statedb.GetBalance(addr)) != 0 {
+		t.Fatalf("wrong nonce or balance: %d %v", account.Nonce, account.Balance)
+	}
+	codeHash := statedb.GetCodeHash(addr)
+	if common.BytesToHash(account.CodeHash) != codeHash || leafNode.Account.CodeHashS != codeHash || codeHash == common.BytesToHash(crypto.Keccak256(nil)) {
+		t.Fatalf("wrong code hash %x", account.CodeHash)
+	}
+	if leafNode.Account.StorageRootS != account.Root || account.Root == emptyStorageRoot {
+		t.Fatalf("wrong storage root %x", leafNode.Account.StorageRootS)
+	}
+
+	_, err := GetWitnessResult(oracle.NodeUrl, blockNum, []TrieModification{NewAccountRead(common.HexToAddress("0x2fa8c7a7d0d1b2e3f4a5b6c7d8e9f0a1b2c3d4e5"))})
+	if !errors.Is(err, ErrProofConvert) {
+		t.Fatalf("AccountRead of a non-existing account: expected ErrProofConvert, got %v", err)
+	}
+}
@@ -481,6 +481,12 @@ func TestStorageInFirstLevelNonExistingLong(t *testing.T) {
 }
 
 func ExtNodeInserted(key1, key2, key3 common.Hash, testName string) {
+	StoreNodes(testName, extNodeInsertedNodes(key1, key2, key3))
+}
+
+// extNodeInsertedNodes returns the witness for the insertion of key3 into the storage trie
+// that contains key1 and key2.
+func extNodeInsertedNodes(key1, key2, key3 common.Hash) []Node {
 	oracle.NodeUrl = oracle.LocalUrl
 
 	blockNum := 0
@@ -512,9 +518,11 @@ func ExtNodeInserted(key1, key2, key3 common.Hash, testName string) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	prepareWitness(testName, trieModifications, statedb)
+	nodes := obtainTwoProofsAndConvertToWitness(trieModifications, statedb, 0)
 
 	oracle.PreventHashingInSecureTrie = false
+
+	return nodes
 }
 
 func ExtNodeDeleted(key1, key2, key3 common.Hash, testName string) {
@@ -922,3 +930,46 @@ func TestExtNodeDeletedExtShortIsBranchFirstLevel(t *testing.T) {
 
 	ExtNodeDeleted(key1, key2, key3, "ExtNodeDeletedExtShortIsBranchFirstLevel")
 }
+
+func TestModExtensionRows(t *testing.T) {
+	SkipIfNoGeth(t)
+	// The same trie as in TestExtNodeInsertedBefore6After1FirstLevel: the extension node with nibbles
+	// 1 2 3 4 5 6 is replaced by the extension node 1 2 3 4 (and the short extension node 6 below it).
+	key1 := common.HexToHash("0x1234561000000000000000000000000000000000000000000000000000000000")
+	key2 := common.HexToHash("0x1234563000000000000000000000000000000000000000000000000000000000")
+	key3 := common.HexToHash("0x1234400000000000000000000000000000000000000000000000000000000000")
+
+	nodes := extNodeInsertedNodes(key1, key2, key3)
+
+	var found bool
+	for _, node := range nodes {
+		rows, ok := ModExtensionRows(node)
+		if !ok {
+			continue
+		}
+		found = true
+		if node.Storage == nil {
+			t.Fatal("modified extension rows expected in the storage leaf")
+		}
+		if len(rows) != modifiedExtensionNodeRowLen {
+			t.Fatalf("got %d modified extension rows", len(rows))
+		}
+		l := len(node.Values)
+		for i, row := range rows {
+			if &row[0] != &node.Values[l-modifiedExtensionNodeRowLen+i][0] {
+				t.Fatalf("row %d is not the leaf row %d", i, l-modifiedExtensionNodeRowLen+i)
+			}
+		}
+		// The first row of the long extension node holds its key (nibbles 1 2 3 4 5 6):
+		if rows[0][0] == 0 {
+			t.Fatal("long extension node row is empty")
+		}
+	}
+	if !found {
+		t.Fatal("no modified extension rows in the witness")
+	}
+
+	if _, ok := ModExtensionRows(GetEndNode()); ok {
+		t.Fatal("end node has no modified extension rows")
+	}
+}
@@ -0,0 +1,142 @@
+package witness
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// JSONNaming is the naming convention of the field names in the witness JSON, see MarshalNodes.
+type JSONNaming int
+
+const (
+	// SnakeCase names the fields as the struct tags do (proof_type), it is the JSON of json.Marshal.
+	SnakeCase JSONNaming = iota
+	// CamelCase names the fields in lower camel case (proofType).
+	CamelCase
+)
+
+// MarshalNodes returns the JSON of the nodes with the field names in the naming convention.
+// The JSON is the same as the one of json.Marshal except for the field names (the field order
+// and the values are kept).
+func MarshalNodes(nodes []Node, naming JSONNaming) ([]byte, error) {
+	data, err := json.Marshal(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch naming {
+	case SnakeCase:
+		return data, nil
+	case CamelCase:
+		return renameJSONKeys(data, snakeToCamel)
+	}
+	return nil, fmt.Errorf("unknown JSON naming %d", naming)
+}
+
+// UnmarshalNodes reads the nodes from the JSON written by MarshalNodes with the naming convention.
+func UnmarshalNodes(data []byte, naming JSONNaming) ([]Node, error) {
+	switch naming {
+	case SnakeCase:
+	case CamelCase:
+		var err error
+		if data, err = renameJSONKeys(data, camelToSnake); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown JSON naming %d", naming)
+	}
+
+	var nodes []Node
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// renameJSONKeys returns the JSON with the object keys replaced by rename(key). The JSON is
+// rewritten token by token, so the order of the keys is kept (decoding into a map would sort them).
+func renameJSONKeys(data []byte, rename func(string) string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	// The open objects and arrays, n is the number of the tokens (keys and values) in them so far:
+	type container struct {
+		object bool
+		n      int
+	}
+	var stack []container
+	var buf bytes.Buffer
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			buf.WriteByte(byte(d))
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		isKey := false
+		if len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if top.object && top.n%2 == 1 {
+				buf.WriteByte(':')
+			} else if top.n > 0 {
+				buf.WriteByte(',')
+			}
+			isKey = top.object && top.n%2 == 0
+			top.n++
+		}
+
+		if d, ok := tok.(json.Delim); ok {
+			buf.WriteByte(byte(d))
+			stack = append(stack, container{object: d == '{'})
+			continue
+		}
+		if s, ok := tok.(string); ok && isKey {
+			tok = rename(s)
+		}
+		b, err := json.Marshal(tok)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// snakeToCamel returns the snake case name in lower camel case: code_hash_s is codeHashS.
+func snakeToCamel(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+
+	return strings.Join(parts, "")
+}
+
+// camelToSnake is the inverse of snakeToCamel: codeHashS is code_hash_s.
+func camelToSnake(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsUpper(r) {
+			b.WriteByte('_')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
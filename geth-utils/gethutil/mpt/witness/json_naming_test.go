@@ -0,0 +1,54 @@
+package witness
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// The witness JSON in both naming conventions reads back into the same nodes, the camel case JSON
+// differs from the snake case one only in the field names.
+func TestMarshalNodesNaming(t *testing.T) {
+	nodes := GenerateExampleWitnesses()[proofTypeNames[AccountAndStorageChange]]
+	snake, err := MarshalNodes(nodes, SnakeCase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	camel, err := MarshalNodes(nodes, CamelCase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(snake, []byte(`"proof_type"`)) || bytes.Contains(snake, []byte(`"proofType"`)) {
+		t.Fatal("expected snake case field names in the snake case JSON")
+	}
+	for _, name := range []string{"proofType", "extensionBranch", "codeHashS", "keccakData", "isNoOp"} {
+		if !bytes.Contains(camel, []byte(`"`+name+`"`)) {
+			t.Fatalf("no %s in the camel case JSON", name)
+		}
+	}
+	if bytes.Contains(camel, []byte(`_`)) {
+		t.Fatal("snake case field name in the camel case JSON")
+	}
+	if len(camel) != len(snake)-strings.Count(string(snake), "_") {
+		t.Fatal("camel case JSON differs from the snake case JSON in more than the field names")
+	}
+
+	for naming, data := range map[JSONNaming][]byte{SnakeCase: snake, CamelCase: camel} {
+		decoded, err := UnmarshalNodes(data, naming)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip, err := MarshalNodes(decoded, naming)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(roundTrip, data) {
+			t.Fatalf("naming %d: the JSON of the decoded nodes differs", naming)
+		}
+	}
+
+	if _, err := MarshalNodes(nodes, JSONNaming(2)); err == nil {
+		t.Fatal("expected an error for the unknown naming")
+	}
+}
@@ -1,11 +1,13 @@
 package witness
 
 import (
+	"fmt"
 	"math"
 
 	"main/gethutil/mpt/trie"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 func prepareEmptyNonExistingStorageRow() []byte {
@@ -52,6 +54,55 @@ func prepareNonExistingStorageRow(leafC, keyNibbles []byte) ([]byte, []byte) {
 	return wrongRlpBytes, nonExistingStorageRow
 }
 
+// AccountLayout is the RLP layout of the account (the value of the account leaf), it depends
+// on the fork.
+type AccountLayout int
+
+const (
+	// AccountLayoutCurrent is the layout of the forks so far: the list of the nonce, the balance,
+	// the storage root and the code hash.
+	AccountLayoutCurrent AccountLayout = iota
+	// AccountLayoutExtended is the current layout followed by the fields a future fork might add.
+	// The added fields are in the leaf RLP (and thus in its hash), but there are no rows for them:
+	// the circuit cannot verify such a witness. The layout is accepted only by ConvertProofs, for
+	// inspecting the proofs; the witness generation from the state (GetWitness) always uses
+	// AccountLayoutCurrent.
+	AccountLayoutExtended
+)
+
+// accountLayoutFields is the number of the account fields the rows are prepared for.
+const accountLayoutFields = 4
+
+// checkAccountLayout panics with ErrUnsupportedShape when the account in the leaf (side, "S" or "C",
+// is used in the message) is not of the layout: the current layout has exactly the four fields,
+// the extended layout has at least them. As in checkNodeRLP, the bytes after the leaf are not checked.
+func checkAccountLayout(leaf []byte, layout AccountLayout, side string) {
+	fields := 0
+	content, _, err := rlp.SplitList(leaf)
+	if err == nil {
+		// Skip the key:
+		_, content, err = rlp.SplitString(content)
+	}
+	var value []byte
+	if err == nil {
+		value, _, err = rlp.SplitString(content)
+	}
+	if err == nil {
+		value, _, err = rlp.SplitList(value)
+	}
+	if err == nil {
+		fields, err = rlp.CountValues(value)
+	}
+	if err != nil {
+		panic(fmt.Errorf("%w: %s account leaf value: %v", ErrMalformedNode, side, err))
+	}
+
+	if fields == accountLayoutFields || layout == AccountLayoutExtended && fields > accountLayoutFields {
+		return
+	}
+	panic(unsupportedShape("%s account of %d fields in the account layout %d", side, fields, layout))
+}
+
 func getNonceBalanceValue(leaf []byte, keyLen int) ([]byte, []byte, int) {
 	nonceStart := 3 + keyLen + 1 + 1 + 1 + 1
 
@@ -60,8 +111,9 @@ func getNonceBalanceValue(leaf []byte, keyLen int) ([]byte, []byte, int) {
 	var nonce []byte
 
 	// If the first nonce byte is > 128, it means it presents (nonce_len - 128),
-	// if the first nonce byte is <= 128, the actual nonce value is < 128 and is exactly this first byte
-	// (however, when nonce = 0, the actual value that is stored is 128)
+	// if the first nonce byte is < 128, the actual nonce value is < 128 and is exactly this first byte.
+	// When nonce = 0, the value is encoded as the empty string, that is a single byte 128 with
+	// no payload, it is taken as the one-byte nonce too.
 	if leaf[nonceStart] <= 128 {
 		// only one nonce byte
 		nonceRlpLen = 1
@@ -76,7 +128,7 @@ func getNonceBalanceValue(leaf []byte, keyLen int) ([]byte, []byte, int) {
 	var balanceRlpLen byte
 	var storageStart int
 	if leaf[balanceStart] <= 128 {
-		// only one balance byte
+		// only one balance byte (128 when the balance is 0, see the nonce case above)
 		balanceRlpLen = 1
 		storageStart = balanceStart + int(balanceRlpLen)
 	} else {
@@ -103,7 +155,7 @@ func getStorageRootCodeHashValue(leaf []byte, storageStart int) ([]byte, []byte)
 	codeHashValue := make([]byte, valueLen)
 	storageRlpLen := leaf[storageStart] - 128
 	if storageRlpLen != 32 {
-		panic("Account leaf RLP 3")
+		panic(unsupportedShape("Account leaf RLP 3"))
 	}
 	storage := leaf[storageStart : storageStart+32+1]
 	for i := 0; i < 33; i++ {
@@ -112,7 +164,7 @@ func getStorageRootCodeHashValue(leaf []byte, storageStart int) ([]byte, []byte)
 	codeHashStart := storageStart + int(storageRlpLen) + 1
 	codeHashRlpLen := leaf[codeHashStart] - 128
 	if codeHashRlpLen != 32 {
-		panic("Account leaf RLP 4")
+		panic(unsupportedShape("Account leaf RLP 4"))
 	}
 	codeHash := leaf[codeHashStart : codeHashStart+32+1]
 	for i := 0; i < 33; i++ {
@@ -122,11 +174,20 @@ func getStorageRootCodeHashValue(leaf []byte, storageStart int) ([]byte, []byte)
 	return storageRootValue, codeHashValue
 }
 
-func prepareAccountLeafNode(addr common.Address, addrh []byte, leafS, leafC, neighbourNode, addressNibbles []byte, isPlaceholder, isSModExtension, isCModExtension bool) Node {
+func prepareAccountLeafNode(addr common.Address, addrh []byte, leafS, leafC, neighbourNode, addressNibbles []byte, isPlaceholder, isSModExtension, isCModExtension bool, layout AccountLayout) Node {
 	// For non existing account proof there are two cases:
 	// 1. A leaf is returned that is not at the required address (wrong leaf).
 	// 2. A branch is returned as the last element of getProof and
 	//    there is nil object at address position. Placeholder account leaf is added in this case.
+	if !isPlaceholder {
+		checkNodeRLP(leafS, 2, "S account leaf")
+		checkNodeRLP(leafC, 2, "C account leaf")
+		checkAccountLayout(leafS, layout, "S")
+		checkAccountLayout(leafC, layout, "C")
+	}
+	if neighbourNode != nil {
+		checkNodeRLP(neighbourNode, 0, "drifted account node")
+	}
 	values := make([][]byte, 12)
 
 	keyLenS := int(leafS[2]) - 128
@@ -194,11 +255,11 @@ func prepareAccountLeafNode(addr common.Address, addrh []byte, leafS, leafC, nei
 
 	rlpStringSecondPartLenS := leafS[3+keyLenS] - 183
 	if rlpStringSecondPartLenS != 1 {
-		panic("Account leaf RLP at this position should be 1 (S)")
+		panic(unsupportedShape("Account leaf RLP at this position should be 1 (S)"))
 	}
 	rlpStringSecondPartLenC := leafC[3+keyLenC] - 183
 	if rlpStringSecondPartLenC != 1 {
-		panic("Account leaf RLP at this position should be 1 (C)")
+		panic(unsupportedShape("Account leaf RLP at this position should be 1 (C)"))
 	}
 	rlpStringLenS := leafS[3+keyLenS+1]
 	rlpStringLenC := leafC[3+keyLenC+1]
@@ -214,21 +275,21 @@ func prepareAccountLeafNode(addr common.Address, addrh []byte, leafS, leafC, nei
 
 	rlpListSecondPartLenS := leafS[3+keyLenS+1+1] - 247
 	if rlpListSecondPartLenS != 1 {
-		panic("Account leaf RLP 1 (S)")
+		panic(unsupportedShape("Account leaf RLP 1 (S)"))
 	}
 	rlpListSecondPartLenC := leafC[3+keyLenC+1+1] - 247
 	if rlpListSecondPartLenC != 1 {
-		panic("Account leaf RLP 1 (C)")
+		panic(unsupportedShape("Account leaf RLP 1 (C)"))
 	}
 
 	rlpListLenS := leafS[3+keyLenS+1+1+1]
 	if rlpStringLenS != rlpListLenS+2 {
-		panic("Account leaf RLP 2 (S)")
+		panic(unsupportedShape("Account leaf RLP 2 (S)"))
 	}
 
 	rlpListLenC := leafC[3+keyLenC+1+1+1]
 	if rlpStringLenC != rlpListLenC+2 {
-		panic("Account leaf RLP 2 (C)")
+		panic(unsupportedShape("Account leaf RLP 2 (C)"))
 	}
 
 	storageStartS := 0
@@ -258,9 +319,15 @@ func prepareAccountLeafNode(addr common.Address, addrh []byte, leafS, leafC, nei
 	storageRootValueC := make([]byte, valueLen)
 	codeHashValueS := make([]byte, valueLen)
 	codeHashValueC := make([]byte, valueLen)
+	var storageRootS, storageRootC, codeHashS, codeHashC common.Hash
 	if !isPlaceholder {
 		storageRootValueS, codeHashValueS = getStorageRootCodeHashValue(leafS, storageStartS)
 		storageRootValueC, codeHashValueC = getStorageRootCodeHashValue(leafC, storageStartC)
+		// The first byte of the value is the RLP length (160).
+		storageRootS = common.BytesToHash(storageRootValueS[1:33])
+		storageRootC = common.BytesToHash(storageRootValueC[1:33])
+		codeHashS = common.BytesToHash(codeHashValueS[1:33])
+		codeHashC = common.BytesToHash(codeHashValueC[1:33])
 	}
 
 	values[AccountKeyS] = keyRowS
@@ -292,6 +359,10 @@ func prepareAccountLeafNode(addr common.Address, addrh []byte, leafS, leafC, nei
 		DriftedRlpBytes:   driftedRlpBytes,
 		WrongRlpBytes:     wrongRlpBytes,
 		IsModExtension:    [2]bool{isSModExtension, isCModExtension},
+		StorageRootS:      storageRootS,
+		StorageRootC:      storageRootC,
+		CodeHashS:         codeHashS,
+		CodeHashC:         codeHashC,
 	}
 	keccakData := [][]byte{leafS, leafC, addr.Bytes()}
 	if neighbourNode != nil {
@@ -306,9 +377,20 @@ func prepareAccountLeafNode(addr common.Address, addrh []byte, leafS, leafC, nei
 	return node
 }
 
+// setAccountLeafSPlaceholder turns the S part of the account leaf node into a placeholder: the S
+// nonce, balance, storage root and code hash are cleared (the key and the RLP bytes are kept as
+// they are, the S leaf being a copy of the C leaf).
+func setAccountLeafSPlaceholder(node *Node) {
+	for _, ind := range []AccountRowType{AccountNonceS, AccountBalanceS, AccountStorageS, AccountCodehashS} {
+		node.Values[ind] = make([]byte, valueLen)
+	}
+	node.Account.StorageRootS = common.Hash{}
+	node.Account.CodeHashS = common.Hash{}
+}
+
 // prepareLeafAndPlaceholderNode prepares a leaf node and its placeholder counterpart
 // (used when one of the proofs does not have a leaf).
-func prepareLeafAndPlaceholderNode(addr common.Address, addrh []byte, proof1, proof2 [][]byte, storage_key common.Hash, key []byte, isAccountProof, isSModExtension, isCModExtension bool) Node {
+func prepareLeafAndPlaceholderNode(addr common.Address, addrh []byte, proof1, proof2 [][]byte, storage_key common.Hash, key []byte, isAccountProof, isSModExtension, isCModExtension bool, layout AccountLayout) Node {
 	len1 := len(proof1)
 	len2 := len(proof2)
 
@@ -327,7 +409,7 @@ func prepareLeafAndPlaceholderNode(addr common.Address, addrh []byte, proof1, pr
 
 		// When generating a proof that account doesn't exist, the length of both proofs is the same (doesn't reach
 		// this code).
-		return prepareAccountLeafNode(addr, addrh, leafS, leafC, nil, key, false, isSModExtension, isCModExtension)
+		return prepareAccountLeafNode(addr, addrh, leafS, leafC, nil, key, false, isSModExtension, isCModExtension, layout)
 	} else {
 		var leaf []byte
 		isSPlaceholder := false
@@ -387,7 +469,7 @@ func prepareAccountLeafPlaceholderNode(addr common.Address, addrh, key []byte, k
 		leaf[4+i] = remainingNibbles[2*i+offset]*16 + remainingNibbles[2*i+1+offset]
 	}
 
-	node := prepareAccountLeafNode(addr, addrh, leaf, leaf, nil, key, true, false, false)
+	node := prepareAccountLeafNode(addr, addrh, leaf, leaf, nil, key, true, false, false, AccountLayoutCurrent)
 
 	node.Account.ValueRlpBytes[0][0] = 184
 	node.Account.ValueRlpBytes[0][1] = 70
@@ -430,7 +512,7 @@ func prepareStorageLeafInfo(row []byte, valueIsZero, isPlaceholder bool) ([]byte
 		if !isPlaceholder {
 			valueRlp = row[keyLen+offset : keyLen+offset+1]
 			if !valueIsZero {
-				copy(value, row[keyLen+offset+1:])
+				value = leafValueRow(row[keyLen+offset+1:])
 			}
 		} else {
 			// If placeholder, we leave the value to be 0.
@@ -502,19 +584,37 @@ func prepareStorageLeafInfo(row []byte, valueIsZero, isPlaceholder bool) ([]byte
 	return key, value, keyRlp, valueRlp
 }
 
-func prepareStorageLeafNode(leafS, leafC, neighbourNode []byte, storage_key common.Hash, key []byte, nonExistingStorageProof, isSPlaceholder, isCPlaceholder, isSModExtension, isCModExtension bool) Node {
-	var rows [][]byte
+// leafValueRow returns the row holding the value bytes of a storage leaf (the RLP of the stored
+// value, without the string prefix of the leaf value). The row has valueLen bytes (the longest RLP
+// of a 32-byte value is 33 bytes), it is extended only when the value does not fit, so that
+// it is not truncated.
+func leafValueRow(value []byte) []byte {
+	n := valueLen
+	if len(value) > n {
+		n = len(value)
+	}
+	row := make([]byte, n)
+	copy(row, value)
 
-	keyS, valueS, listRlpBytes1, valueRlpBytes1 := prepareStorageLeafInfo(leafS, false, isSPlaceholder)
+	return row
+}
 
-	rows = append(rows, keyS)
-	rows = append(rows, valueS)
+func prepareStorageLeafNode(leafS, leafC, neighbourNode []byte, storage_key common.Hash, key []byte, nonExistingStorageProof, isSPlaceholder, isCPlaceholder, isSModExtension, isCModExtension bool) Node {
+	// The placeholder leaf is not necessarily a valid RLP (see prepareStorageLeafPlaceholderNode).
+	if !isSPlaceholder {
+		checkNodeRLP(leafS, 2, "S storage leaf")
+	}
+	if !isCPlaceholder {
+		checkNodeRLP(leafC, 2, "C storage leaf")
+	}
+	if neighbourNode != nil {
+		checkNodeRLP(neighbourNode, 0, "drifted storage node")
+	}
+	rows := make([][]byte, StorageWrong+1)
 
+	keyS, valueS, listRlpBytes1, valueRlpBytes1 := prepareStorageLeafInfo(leafS, false, isSPlaceholder)
 	keyC, valueC, listRlpBytes2, valueRlpBytes2 := prepareStorageLeafInfo(leafC, false, isCPlaceholder)
 
-	rows = append(rows, keyC)
-	rows = append(rows, valueC)
-
 	var listRlpBytes [2][]byte
 	listRlpBytes[0] = listRlpBytes1
 	listRlpBytes[1] = listRlpBytes2
@@ -528,8 +628,10 @@ func prepareStorageLeafNode(leafS, leafC, neighbourNode []byte, storage_key comm
 	if neighbourNode != nil {
 		keyDrifted, _, driftedRlpBytes, _ = prepareStorageLeafInfo(neighbourNode, false, false)
 	}
-	rows = append(rows, keyDrifted)
 
+	// For the non-existing storage proof with the wrong leaf, keyS (= keyC) is the key of the wrong leaf,
+	// the row StorageWrong holds the queried key. For the nil child, the leaf is the placeholder
+	// (see prepareStorageLeafPlaceholderNode) and the row is empty.
 	var nonExistingStorageRow []byte
 	var wrongRlpBytes []byte
 	if nonExistingStorageProof {
@@ -537,7 +639,13 @@ func prepareStorageLeafNode(leafS, leafC, neighbourNode []byte, storage_key comm
 	} else {
 		nonExistingStorageRow = prepareEmptyNonExistingStorageRow()
 	}
-	rows = append(rows, nonExistingStorageRow)
+
+	rows[StorageKeyS] = keyS
+	rows[StorageValueS] = valueS
+	rows[StorageKeyC] = keyC
+	rows[StorageValueC] = valueC
+	rows[StorageDrifted] = keyDrifted
+	rows[StorageWrong] = nonExistingStorageRow
 
 	// These rows are only used in the case of a modified extension node.
 	// These rows are actually set in equipLeafWithModExtensionNode function.
@@ -567,3 +675,32 @@ func prepareStorageLeafNode(leafS, leafC, neighbourNode []byte, storage_key comm
 
 	return node
 }
+
+// AccountAddressFromLeaf returns the hashed address of the account leaf: the nibbles of the path
+// to the leaf (the positions in the branches and the nibbles of the extension nodes above the leaf)
+// followed by the nibbles of the leaf key. It is used to check that the account witness is the witness
+// of the intended address. ErrMalformedNode is returned when leaf is not a leaf and an error when
+// the nibbles are not the 64 nibbles of a hashed address.
+func AccountAddressFromLeaf(leaf []byte, pathNibbles []byte) (common.Hash, error) {
+	var elems [][]byte
+	if err := rlp.DecodeBytes(leaf, &elems); err != nil || len(elems) != 2 || len(elems[0]) == 0 {
+		return common.Hash{}, fmt.Errorf("%w: not a leaf (%d bytes)", ErrMalformedNode, len(leaf))
+	}
+	compact := elems[0]
+	if compact[0]&0x20 == 0 {
+		return common.Hash{}, fmt.Errorf("%w: extension node instead of the leaf", ErrMalformedNode)
+	}
+
+	nibbles := common.CopyBytes(pathNibbles)
+	if compact[0]&0x10 != 0 { // odd number of nibbles
+		nibbles = append(nibbles, compact[0]&0x0f)
+	}
+	for _, b := range compact[1:] {
+		nibbles = append(nibbles, b/16, b%16)
+	}
+	if len(nibbles) != 64 {
+		return common.Hash{}, fmt.Errorf("%d path and %d leaf nibbles, expected 64 in total", len(pathNibbles), len(nibbles)-len(pathNibbles))
+	}
+
+	return common.BytesToHash(trie.HexToKeybytes(nibbles)), nil
+}
@@ -0,0 +1,271 @@
+package witness
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+
+	"main/gethutil/mpt/oracle"
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var emptyStorageRoot = common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+
+// makeAccountLeaf returns the RLP of an account leaf as it appears in GetProof when the leaf
+// is positioned after keyIndex nibbles of the hashed address.
+func makeAccountLeaf(t *testing.T, addrh []byte, keyIndex int, nonce uint64, balance *big.Int) []byte {
+	account := oracle.Account{
+		Nonce:    nonce,
+		Balance:  balance,
+		Root:     emptyStorageRoot,
+		CodeHash: crypto.Keccak256(nil),
+	}
+	accountRlp, err := rlp.EncodeToBytes(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactKey := trie.HexToCompact(trie.KeybytesToHex(addrh)[keyIndex:])
+	leaf, err := rlp.EncodeToBytes([][]byte{compactKey, accountRlp})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf
+}
+
+func assertValidLeafRlp(t *testing.T, leaf []byte) {
+	elems, rest, err := rlp.SplitList(leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("trailing bytes after leaf RLP: %v", rest)
+	}
+	if c, err := rlp.CountValues(elems); err != nil || c != 2 {
+		t.Fatalf("leaf should have two elements, got %d (%v)", c, err)
+	}
+}
+
+func accountTransitionTemplate(t *testing.T, nonceS, nonceC uint64, balanceS, balanceC *big.Int) Node {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	addrh := crypto.Keccak256(addr.Bytes())
+	keyIndex := 1
+
+	leafS := makeAccountLeaf(t, addrh, keyIndex, nonceS, balanceS)
+	leafC := makeAccountLeaf(t, addrh, keyIndex, nonceC, balanceC)
+	assertValidLeafRlp(t, leafS)
+	assertValidLeafRlp(t, leafC)
+
+	node := prepareAccountLeafNode(addr, addrh, leafS, leafC, nil, trie.KeybytesToHex(addrh), false, false, false, AccountLayoutCurrent)
+
+	for _, ind := range []AccountRowType{AccountStorageS, AccountStorageC} {
+		if node.Values[ind][0] != 160 || !bytes.Equal(node.Values[ind][1:33], emptyStorageRoot.Bytes()) {
+			t.Fatalf("storage root read from the wrong position: %v", node.Values[ind])
+		}
+	}
+	for _, ind := range []AccountRowType{AccountCodehashS, AccountCodehashC} {
+		if node.Values[ind][0] != 160 || !bytes.Equal(node.Values[ind][1:33], crypto.Keccak256(nil)) {
+			t.Fatalf("code hash read from the wrong position: %v", node.Values[ind])
+		}
+	}
+
+	return node
+}
+
+func TestAccountBalanceToZero(t *testing.T) {
+	node := accountTransitionTemplate(t, 1, 1, big.NewInt(1000000), big.NewInt(0))
+
+	if node.Values[AccountBalanceC][0] != 128 || node.Values[AccountBalanceC][1] != 0 {
+		t.Fatalf("zero balance should be encoded as a single 128 byte: %v", node.Values[AccountBalanceC])
+	}
+	if node.Values[AccountBalanceS][0] != 131 {
+		t.Fatalf("wrong S balance: %v", node.Values[AccountBalanceS])
+	}
+}
+
+func TestAccountNonceToZero(t *testing.T) {
+	node := accountTransitionTemplate(t, 300, 0, big.NewInt(5), big.NewInt(5))
+
+	if node.Values[AccountNonceC][0] != 128 || node.Values[AccountNonceC][1] != 0 {
+		t.Fatalf("zero nonce should be encoded as a single 128 byte: %v", node.Values[AccountNonceC])
+	}
+	if node.Values[AccountBalanceC][0] != 5 {
+		t.Fatalf("balance read from the wrong position: %v", node.Values[AccountBalanceC])
+	}
+}
+
+func TestAccountNonceAndBalanceToZero(t *testing.T) {
+	node := accountTransitionTemplate(t, 300, 0, big.NewInt(1000000), big.NewInt(0))
+
+	if node.Values[AccountNonceC][0] != 128 || node.Values[AccountBalanceC][0] != 128 {
+		t.Fatalf("wrong zero nonce / balance: %v %v", node.Values[AccountNonceC], node.Values[AccountBalanceC])
+	}
+	if node.Account.ListRlpBytes[0][1] == node.Account.ListRlpBytes[1][1] {
+		t.Fatalf("leaf length should change when the nonce drops to 0")
+	}
+}
+
+// makeStorageLeaf returns the RLP of the storage leaf (in the first trie level) with the RLP
+// of the value as it is stored in the trie.
+func makeStorageLeaf(t *testing.T, key common.Hash, valueRlp []byte) []byte {
+	compactKey := trie.HexToCompact(trie.KeybytesToHex(crypto.Keccak256(key.Bytes())))
+	leaf, err := rlp.EncodeToBytes([][]byte{compactKey, valueRlp})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf
+}
+
+func TestStorageLeafValueLength(t *testing.T) {
+	key := common.HexToHash("0x12")
+	hashedKey := trie.KeybytesToHex(crypto.Keccak256(key.Bytes()))
+	rlpValue := func(v common.Hash) []byte {
+		r, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(v.Bytes()))
+		return r
+	}
+	fullValue := common.HexToHash("0xff000000000000000000000000000000000000000000000000000000000001ff")
+	// The leading zero bytes are stripped: the RLP is 3 bytes long.
+	shortValue := common.HexToHash("0x01ff")
+	// Longer than any 32-byte value (the leaf is not valid in a storage trie, it must not be truncated).
+	longValueRlp, _ := rlp.EncodeToBytes(bytes.Repeat([]byte{0xab}, 40))
+
+	for _, valueRlp := range [][]byte{rlpValue(fullValue), rlpValue(shortValue), longValueRlp} {
+		leaf := makeStorageLeaf(t, key, valueRlp)
+		assertValidLeafRlp(t, leaf)
+		node := prepareStorageLeafNode(leaf, leaf, nil, key, hashedKey, false, false, false, false, false)
+
+		for _, valueRow := range [][]byte{node.Values[1], node.Values[3]} {
+			if len(valueRow) < valueLen {
+				t.Fatalf("value row shorter than %d bytes: %v", valueLen, valueRow)
+			}
+			if !bytes.Equal(valueRow[:len(valueRlp)], valueRlp) {
+				t.Fatalf("value %x stored as %x", valueRlp, valueRow)
+			}
+			if len(valueRlp) <= valueLen && (len(valueRow) != valueLen || !bytes.Equal(valueRow[len(valueRlp):], make([]byte, valueLen-len(valueRlp)))) {
+				t.Fatalf("value row not padded with zeros: %v", valueRow)
+			}
+		}
+		// The prefix of the value string in the leaf:
+		if !bytes.Equal(node.Storage.ValueRlpBytes[0], leaf[len(leaf)-len(valueRlp)-1:len(leaf)-len(valueRlp)]) {
+			t.Fatalf("wrong value RLP bytes %v", node.Storage.ValueRlpBytes[0])
+		}
+	}
+}
+
+// The storage trie is a branch with two leaves, the path of the queried key ends at the leaf
+// of another slot (the wrong leaf): the StorageWrong row holds the queried key in the shape
+// of the wrong leaf key.
+func TestStorageNonExistenceWrongLeaf(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	var leaves [][]byte
+	children := make(map[int]common.Hash)
+	for i := 0; len(leaves) < 2; i++ {
+		keyh := crypto.Keccak256(slotKey(i).Bytes())
+		if _, ok := children[int(keyh[0]/16)]; ok {
+			continue
+		}
+		value, _ := rlp.EncodeToBytes([]byte{byte(i + 1)})
+		leaf, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(trie.KeybytesToHex(keyh)[1:]), value})
+		leaves = append(leaves, leaf)
+		children[int(keyh[0]/16)] = crypto.Keccak256Hash(leaf)
+	}
+	// The key with the hash under one of the leaves:
+	var key common.Hash
+	for i := 1000; ; i++ {
+		if _, ok := children[int(crypto.Keccak256(slotKey(i).Bytes())[0]/16)]; ok {
+			key = slotKey(i)
+			break
+		}
+	}
+	keyh := crypto.Keccak256(key.Bytes())
+	wrongLeaf := leaves[0]
+	if crypto.Keccak256Hash(leaves[1]) == children[int(keyh[0]/16)] {
+		wrongLeaf = leaves[1]
+	}
+
+	storageRoot := makeBranch(t, children)
+	account, _ := rlp.EncodeToBytes(oracle.Account{
+		Nonce:    1,
+		Balance:  big.NewInt(7),
+		Root:     crypto.Keccak256Hash(storageRoot),
+		CodeHash: crypto.Keccak256(nil),
+	})
+	accountLeaf, _ := rlp.EncodeToBytes([][]byte{
+		trie.HexToCompact(trie.KeybytesToHex(crypto.Keccak256(addr.Bytes()))), account})
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageRoot, leaves[0], leaves[1])
+
+	result, err := GetWitnessResult("", 1, []TrieModification{NewStorageNonExistence(addr, key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := result.Nodes[len(result.Nodes)-2]
+	if leaf.Storage == nil || !bytes.Equal(leaf.KeccakData[1], wrongLeaf) {
+		t.Fatal("the witness does not end with the wrong leaf")
+	}
+	if len(leaf.Storage.WrongRlpBytes) == 0 {
+		t.Fatal("no RLP bytes of the wrong leaf")
+	}
+	// The leaf is in the first level, the row holds the 63 nibbles of the queried key that follow
+	// the branch (the odd first nibble with the hex-prefix flag):
+	wrong := leaf.Values[StorageWrong]
+	if wrong[0] != 128+32 || wrong[1] != keyh[0]%16+48 || !bytes.Equal(wrong[2:33], keyh[1:]) {
+		t.Fatalf("wrong StorageWrong row: %v", wrong)
+	}
+	if bytes.Equal(leaf.Values[StorageKeyC][:33], wrong[:33]) {
+		t.Fatal("the key row of the wrong leaf is the queried key")
+	}
+}
+
+// The proof that ends at the leaf of the queried key does not prove the non-existence.
+func TestStorageNonExistenceLeafOfKey(t *testing.T) {
+	storageValue := func(i int) []byte {
+		v, _ := rlp.EncodeToBytes([]byte{byte(i + 1)})
+		return v
+	}
+	input := makeConversionInput(t, 2,
+		func(i int) []byte { return crypto.Keccak256(slotKey(i).Bytes()) },
+		storageValue, storageValue(0))
+
+	err := func() (err error) {
+		defer recoverWitnessError(0, common.Address{}, &err)
+		convertProofToWitness(nil, common.Address{}, nil, input.proof1, input.proof2, input.extNibblesS, input.extNibblesC,
+			slotKey(0), input.key, nil, false, false, true, input.isLastLeaf, AccountLayoutCurrent)
+		return nil
+	}()
+	if !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("expected ErrKeyMismatch, got %v", err)
+	}
+}
+
+// The hashed address is the path to the leaf followed by the leaf key, for the even and the odd
+// number of the path nibbles.
+func TestAccountAddressFromLeaf(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	addrh := crypto.Keccak256(addr.Bytes())
+	path := trie.KeybytesToHex(addrh)
+	for _, keyIndex := range []int{0, 3, 4} {
+		leaf := makeAccountLeaf(t, addrh, keyIndex, 1, big.NewInt(7))
+		got, err := AccountAddressFromLeaf(leaf, path[:keyIndex])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != common.BytesToHash(addrh) {
+			t.Fatalf("key index %d: expected %x, got %x", keyIndex, addrh, got)
+		}
+	}
+
+	leaf := makeAccountLeaf(t, addrh, 3, 1, big.NewInt(7))
+	if _, err := AccountAddressFromLeaf(leaf, path[:2]); err == nil {
+		t.Fatal("expected an error for the path of the wrong length")
+	}
+	ext, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(path[:3]), common.HexToHash("0x12").Bytes()})
+	if _, err := AccountAddressFromLeaf(ext, nil); !errors.Is(err, ErrMalformedNode) {
+		t.Fatalf("expected ErrMalformedNode for the extension node, got %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package witness
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ErrRootMismatch is returned by MergeWitnesses when the witnesses do not chain.
+var ErrRootMismatch = errors.New("witnesses do not chain")
+
+// MergeWitnesses chains the witness b after the witness a, for example the witnesses of the consecutive
+// modifications generated separately. The S root of the first modification in b needs to be the C root
+// of the last modification in a. When any of the witnesses is generated with WithoutRedundantBoundaries,
+// the merged witness is trimmed too (the first start node of b might be omitted then).
+func MergeWitnesses(a, b []Node) ([]Node, error) {
+	expandedA, expandedB := ExpandBoundaries(a), ExpandBoundaries(b)
+	segmentsA, err := SplitByModification(expandedA)
+	if err != nil {
+		return nil, fmt.Errorf("first witness: %w", err)
+	}
+	segmentsB, err := SplitByModification(expandedB)
+	if err != nil {
+		return nil, fmt.Errorf("second witness: %w", err)
+	}
+
+	if len(segmentsA) != 0 && len(segmentsB) != 0 {
+		endRoot := segmentsA[len(segmentsA)-1][0].Values[1]
+		startRoot := segmentsB[0][0].Values[0]
+		if !bytes.Equal(endRoot, startRoot) {
+			return nil, fmt.Errorf("%w: end root %x, start root %x", ErrRootMismatch, endRoot, startRoot)
+		}
+	}
+
+	merged := make([]Node, 0, len(expandedA)+len(expandedB))
+	merged = append(merged, expandedA...)
+	merged = append(merged, expandedB...)
+	if len(expandedA) != len(a) || len(expandedB) != len(b) {
+		merged = trimRedundantBoundaries(merged)
+	}
+
+	return merged, nil
+}
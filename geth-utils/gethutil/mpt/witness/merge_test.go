@@ -0,0 +1,57 @@
+package witness
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestMergeWitnesses(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	addrh := crypto.Keccak256(addr.Bytes())
+	roots := []common.Hash{common.HexToHash("0x01"), common.HexToHash("0x02"), common.HexToHash("0x03"), common.HexToHash("0x04")}
+	// witness returns the witness of the nonce modifications from roots[from] to roots[to]:
+	witness := func(from, to int) []Node {
+		var nodes []Node
+		for i := from; i < to; i++ {
+			leafS := makeAccountLeaf(t, addrh, 0, uint64(i), big.NewInt(5))
+			leafC := makeAccountLeaf(t, addrh, 0, uint64(i+1), big.NewInt(5))
+			nodes = append(nodes,
+				GetStartNode("NonceChanged", roots[i], roots[i+1], 0),
+				prepareAccountLeafNode(addr, addrh, leafS, leafC, nil, trie.KeybytesToHex(addrh), false, false, false, AccountLayoutCurrent),
+				GetEndNode())
+		}
+		return nodes
+	}
+	whole := witness(0, 3)
+
+	merged, err := MergeWitnesses(witness(0, 1), witness(1, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := DiffNodes(merged, whole); len(diffs) != 0 {
+		t.Fatalf("merged witness differs from the witness of all modifications: %v", diffs)
+	}
+
+	// The trimmed witnesses are merged into the trimmed witness:
+	merged, err = MergeWitnesses(trimRedundantBoundaries(witness(0, 2)), witness(2, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := DiffNodes(merged, trimRedundantBoundaries(whole)); len(diffs) != 0 {
+		t.Fatalf("merged witness differs from the trimmed witness: %v", diffs)
+	}
+
+	// The witness from roots[2] does not follow the witness ending at roots[1]:
+	if _, err := MergeWitnesses(witness(0, 1), witness(2, 3)); !errors.Is(err, ErrRootMismatch) {
+		t.Fatalf("expected ErrRootMismatch, got %v", err)
+	}
+	if _, err := MergeWitnesses(witness(1, 3), witness(0, 1)); !errors.Is(err, ErrRootMismatch) {
+		t.Fatalf("expected ErrRootMismatch for the witnesses in the wrong order, got %v", err)
+	}
+}
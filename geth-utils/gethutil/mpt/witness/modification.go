@@ -0,0 +1,141 @@
+package witness
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// NewNonceChange returns the modification setting the nonce of the account.
+func NewNonceChange(addr common.Address, nonce uint64) TrieModification {
+	return TrieModification{Type: NonceChanged, Address: addr, Nonce: nonce}
+}
+
+// NewBalanceChange returns the modification setting the balance of the account.
+func NewBalanceChange(addr common.Address, balance *big.Int) TrieModification {
+	return TrieModification{Type: BalanceChanged, Address: addr, Balance: balance}
+}
+
+// NewCodeHashChange returns the modification setting the code hash of the account.
+func NewCodeHashChange(addr common.Address, codeHash common.Hash) TrieModification {
+	return TrieModification{Type: CodeHashChanged, Address: addr, CodeHash: codeHash.Bytes()}
+}
+
+// NewCodeHashRead returns the modification proving the current code hash of the account.
+func NewCodeHashRead(addr common.Address) TrieModification {
+	return TrieModification{Type: CodeHashRead, Address: addr}
+}
+
+// NewAccountRead returns the modification proving that the account exists (with its current fields).
+func NewAccountRead(addr common.Address) TrieModification {
+	return TrieModification{Type: AccountRead, Address: addr}
+}
+
+// NewAccountCreate returns the modification creating the account (an existing account is replaced).
+func NewAccountCreate(addr common.Address) TrieModification {
+	return TrieModification{Type: AccountCreate, Address: addr}
+}
+
+// NewAccountDestruct returns the modification deleting the account.
+func NewAccountDestruct(addr common.Address) TrieModification {
+	return TrieModification{Type: AccountDestructed, Address: addr}
+}
+
+// NewAccountNonExistence returns the modification proving that the account does not exist.
+func NewAccountNonExistence(addr common.Address) TrieModification {
+	return TrieModification{Type: AccountDoesNotExist, Address: addr}
+}
+
+// NewStorageChange returns the modification setting the storage slot key of the account to value.
+// The zero value is not stored in the trie: setting the slot to zero deletes it (the C proof is
+// the proof of the slot that does not exist), setting the slot that is not set to zero does not
+// change the trie. NewStorageNonExistence proves that the slot is not set.
+func NewStorageChange(addr common.Address, key, value common.Hash) TrieModification {
+	return TrieModification{Type: StorageChanged, Address: addr, Key: key, Value: value}
+}
+
+// StorageModificationFromPreimage returns the modification setting the storage slot keccak256(preimage)
+// of the account to value. The preimage is, for example, the key of a mapping concatenated with the slot
+// of the mapping (both padded to 32 bytes).
+func StorageModificationFromPreimage(addr common.Address, preimage []byte, value common.Hash) TrieModification {
+	return NewStorageChange(addr, crypto.Keccak256Hash(preimage), value)
+}
+
+// NewStorageNonExistence returns the modification proving that the storage slot key of the account
+// is not set.
+func NewStorageNonExistence(addr common.Address, key common.Hash) TrieModification {
+	return TrieModification{Type: StorageDoesNotExist, Address: addr, Key: key}
+}
+
+// NewAccountAndStorageChange returns the modification setting the nonce of the account (and its balance,
+// when balance is not nil) and then the storage slot key of the account to value.
+func NewAccountAndStorageChange(addr common.Address, nonce uint64, balance *big.Int, key, value common.Hash) TrieModification {
+	return TrieModification{Type: AccountAndStorageChange, Address: addr, Nonce: nonce, Balance: balance, Key: key, Value: value}
+}
+
+// Validate checks that the fields the proof type needs are set (and that HashedKey, when set,
+// is the hash of Key).
+func (tMod *TrieModification) Validate() error {
+	switch tMod.Type {
+	case NonceChanged, AccountCreate, AccountDestructed, AccountDoesNotExist, CodeHashRead, AccountRead:
+	case BalanceChanged:
+		if tMod.Balance == nil && tMod.Custom == nil {
+			return fmt.Errorf("balance not set for BalanceChanged modification of %s", tMod.Address)
+		}
+	case CodeHashChanged:
+		if len(tMod.CodeHash) != common.HashLength && tMod.Custom == nil {
+			return fmt.Errorf("code hash of %d bytes for CodeHashChanged modification of %s", len(tMod.CodeHash), tMod.Address)
+		}
+	case StorageChanged, StorageDoesNotExist, AccountAndStorageChange:
+		if tMod.Custom != nil {
+			return fmt.Errorf("custom modification of %s is not supported for storage proofs", tMod.Address)
+		}
+		if tMod.HashedKey != nil && !bytes.Equal(tMod.HashedKey.Bytes(), hashStorageKey(tMod.Key)) {
+			return fmt.Errorf("hashed key %x is not the hash of the storage key %x of %s", *tMod.HashedKey, tMod.Key, tMod.Address)
+		}
+	default:
+		return fmt.Errorf("unsupported proof type %d for modification of %s", tMod.Type, tMod.Address)
+	}
+
+	return nil
+}
+
+// SummarizeModifications returns the description of the modifications for the logs and the error
+// messages, a line per modification: the index, the proof type, the address and the fields used
+// by the proof type (the fields the proof type ignores are left out).
+func SummarizeModifications(mods []TrieModification) string {
+	lines := make([]string, len(mods))
+	for i, tMod := range mods {
+		line := fmt.Sprintf("%d: %s %s", i, tMod.Type, tMod.Address)
+		if tMod.Custom != nil {
+			line += " custom"
+		} else {
+			switch tMod.Type {
+			case NonceChanged:
+				line += fmt.Sprintf(" nonce=%d", tMod.Nonce)
+			case BalanceChanged:
+				line += fmt.Sprintf(" balance=%s", tMod.Balance)
+			case CodeHashChanged:
+				line += fmt.Sprintf(" codeHash=%#x", tMod.CodeHash)
+			case AccountAndStorageChange:
+				line += fmt.Sprintf(" nonce=%d", tMod.Nonce)
+				if tMod.Balance != nil {
+					line += fmt.Sprintf(" balance=%s", tMod.Balance)
+				}
+			}
+		}
+		switch tMod.Type {
+		case StorageChanged, AccountAndStorageChange:
+			line += fmt.Sprintf(" key=%s value=%s", tMod.Key, tMod.Value)
+		case StorageDoesNotExist:
+			line += fmt.Sprintf(" key=%s", tMod.Key)
+		}
+		lines[i] = line
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,209 @@
+package witness
+
+import (
+	"bytes"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestModificationConstructorsValidate(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	for _, tMod := range []TrieModification{
+		NewNonceChange(addr, 1),
+		NewBalanceChange(addr, big.NewInt(23)),
+		NewCodeHashChange(addr, common.HexToHash("0xc5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470")),
+		NewCodeHashRead(addr),
+		NewAccountRead(addr),
+		NewAccountCreate(addr),
+		NewAccountDestruct(addr),
+		NewAccountNonExistence(addr),
+		NewStorageChange(addr, key, common.HexToHash("0x1")),
+		NewStorageNonExistence(addr, key),
+		NewAccountAndStorageChange(addr, 2, big.NewInt(5), key, common.HexToHash("0x1")),
+	} {
+		if err := tMod.Validate(); err != nil {
+			t.Errorf("modification of type %d: %v", tMod.Type, err)
+		}
+	}
+}
+
+func TestValidateMissingFields(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	for _, tMod := range []TrieModification{
+		{Type: BalanceChanged, Address: addr},
+		{Type: CodeHashChanged, Address: addr, CodeHash: []byte{1}},
+		{Type: Disabled, Address: addr},
+		{Type: StorageChanged, Address: addr, Custom: &CustomModification{}},
+		{Type: AccountAndStorageChange, Address: addr, Custom: &CustomModification{}},
+	} {
+		if err := tMod.Validate(); err == nil {
+			t.Errorf("modification of type %d should not be valid", tMod.Type)
+		}
+	}
+}
+
+// The account is created before the slots are set, each key with its value; the keys and the values
+// need to be paired.
+func TestAccountCreateWithStorage(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	keys := []common.Hash{common.HexToHash("0x12"), common.HexToHash("0x21")}
+	values := []common.Hash{common.HexToHash("0x1"), common.HexToHash("0x2")}
+	mods, err := AccountCreateWithStorage(addr, keys, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mods) != 3 || mods[0].Type != AccountCreate {
+		t.Fatalf("expected the account creation and 2 storage changes, got %v", mods)
+	}
+	for i, tMod := range mods[1:] {
+		if tMod.Type != StorageChanged || tMod.Key != keys[i] || tMod.Value != values[i] || tMod.Address != addr {
+			t.Fatalf("modification %d: %+v", i+1, tMod)
+		}
+	}
+
+	if _, err := AccountCreateWithStorage(addr, keys, values[:1]); err == nil {
+		t.Fatal("expected an error for the key without a value")
+	}
+	if _, err := AccountCreateWithStorage(addr, keys[:1], values); err == nil {
+		t.Fatal("expected an error for the value without a key")
+	}
+}
+
+func TestStorageModificationFromPreimage(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	// balances[holder] of a mapping at slot 3:
+	holder := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
+	preimage := append(common.LeftPadBytes(holder.Bytes(), 32), common.LeftPadBytes([]byte{3}, 32)...)
+	slot := common.BytesToHash(crypto.Keccak256(preimage))
+	value := common.HexToHash("0x2a")
+
+	tMod := StorageModificationFromPreimage(addr, preimage, value)
+	if !reflect.DeepEqual(tMod, NewStorageChange(addr, slot, value)) {
+		t.Fatalf("wrong modification %+v", tMod)
+	}
+
+	accountLeaf, storageLeaf := singleSlotState(addr, slot, common.HexToHash("0x17"))
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageLeaf)
+	fromPreimage, err := GetWitnessResult("", 1, []TrieModification{tMod})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromSlot, err := GetWitnessResult("", 1, []TrieModification{NewStorageChange(addr, slot, value)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := DiffNodes(fromSlot.Nodes, fromPreimage.Nodes); diffs != nil {
+		t.Fatalf("witnesses differ: %v", diffs)
+	}
+}
+
+// The nonce bump and the storage write of a contract call: the account witness is followed
+// by the storage witness, the same as for the two separate modifications.
+func TestAccountAndStorageChange(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	value := common.HexToHash("0x2a")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x17"))
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageLeaf)
+
+	result, err := GetWitnessResult("", 1, []TrieModification{NewAccountAndStorageChange(addr, 2, nil, key, value)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := SplitByModification(result.Nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segments[0][0].Start.ProofType != "NonceChanged" || segments[1][0].Start.ProofType != "StorageChanged" {
+		t.Fatalf("expected the NonceChanged and the StorageChanged witness, got %d witnesses", len(segments))
+	}
+	if !bytes.Equal(segments[0][0].Values[1], segments[1][0].Values[0]) {
+		t.Fatalf("C root of the account witness %x is not the S root of the storage witness %x",
+			segments[0][0].Values[1], segments[1][0].Values[0])
+	}
+	if len(result.IntermediateRoots) != 1 || !bytes.Equal(result.IntermediateRoots[0].Bytes(), segments[1][0].Values[1][1:33]) {
+		t.Fatalf("wrong intermediate roots %v", result.IntermediateRoots)
+	}
+
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageLeaf)
+	separate, err := GetWitnessResult("", 1, []TrieModification{NewNonceChange(addr, 2), NewStorageChange(addr, key, value)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := DiffNodes(result.Nodes, separate.Nodes); diffs != nil {
+		t.Fatalf("witness differs from the witness of the separate modifications: %v", diffs)
+	}
+}
+
+// The precomputed hashed key gives the same witness as the key hashed by the witness generation,
+// Validate rejects the hashed key of another storage key.
+func TestHashedKey(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x17"))
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageLeaf)
+
+	tMod := NewStorageChange(addr, key, common.HexToHash("0x2a"))
+	expected, err := GetWitnessResult("", 1, []TrieModification{tMod})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashedKey := crypto.Keccak256Hash(key.Bytes())
+	tMod.HashedKey = &hashedKey
+	if err := tMod.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := GetWitnessResult("", 1, []TrieModification{tMod})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := DiffNodes(expected.Nodes, result.Nodes); len(diffs) != 0 {
+		t.Fatalf("the witness with the hashed key differs: %v", diffs)
+	}
+
+	wrong := crypto.Keccak256Hash(common.HexToHash("0x13").Bytes())
+	tMod.HashedKey = &wrong
+	if err := tMod.Validate(); err == nil {
+		t.Fatal("expected an error for the hashed key of another storage key")
+	}
+}
+
+func TestSummarizeModifications(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	value := common.HexToHash("0x2a")
+	nonce := NewNonceChange(addr, 3)
+	nonce.Key = key // ignored by the proof type
+	mods := []TrieModification{
+		nonce,
+		NewBalanceChange(addr, big.NewInt(23)),
+		NewStorageChange(addr, key, value),
+		NewStorageNonExistence(addr, key),
+		NewAccountAndStorageChange(addr, 2, nil, key, value),
+		NewAccountDestruct(addr),
+		{Type: Disabled, Address: addr},
+	}
+
+	expected := []string{
+		"0: NonceChanged " + addr.Hex() + " nonce=3",
+		"1: BalanceChanged " + addr.Hex() + " balance=23",
+		"2: StorageChanged " + addr.Hex() + " key=" + key.Hex() + " value=" + value.Hex(),
+		"3: StorageDoesNotExist " + addr.Hex() + " key=" + key.Hex(),
+		"4: AccountAndStorageChange " + addr.Hex() + " nonce=2 key=" + key.Hex() + " value=" + value.Hex(),
+		"5: AccountDestructed " + addr.Hex(),
+		"6: Disabled " + addr.Hex(),
+	}
+	if summary := SummarizeModifications(mods); summary != strings.Join(expected, "\n") {
+		t.Fatalf("wrong summary:\n%s", summary)
+	}
+	if ProofType(42).String() != "ProofType(42)" {
+		t.Fatalf("wrong name of the unknown proof type: %s", ProofType(42))
+	}
+}
@@ -43,9 +43,10 @@ func equipLeafWithModExtensionNode(statedb *state.StateDB, leafNode Node, addr c
 	ind := byte(keyIndex) + byte(numberOfNibbles) // where the old and new extension nodes start to be different
 	longExtNodeKey := make([]byte, len(key))
 	copy(longExtNodeKey, key)
-	// We would like to retrieve the shortened extension node from the trie via GetProof or
-	// GetStorageProof (depending whether it is an account proof or storage proof),
-	// the key where we find its underlying branch is `oldExtNodeKey`.
+	// We would like to retrieve the shortened extension node from the trie via GetProofByHash or
+	// GetStorageProofByHash (depending whether it is an account proof or storage proof),
+	// the key where we find its underlying branch is `oldExtNodeKey`. The key is the path
+	// in the trie (it is already hashed), neither the address nor the storage key.
 	for j := ind; int(j) < keyIndex+len(longNibbles); j++ {
 		// keyIndex is where the nibbles of the old and new extension node start
 		longExtNodeKey[j] = longNibbles[j-byte(keyIndex)]
@@ -56,9 +57,9 @@ func equipLeafWithModExtensionNode(statedb *state.StateDB, leafNode Node, addr c
 	var proof [][]byte
 	var err error
 	if isAccountProof {
-		proof, _, _, _, _, err = statedb.GetProof(addr)
+		proof, _, _, _, _, err = statedb.GetProofByHash(ky)
 	} else {
-		proof, _, _, _, _, err = statedb.GetStorageProof(addr, ky)
+		proof, _, _, _, _, err = statedb.GetStorageProofByHash(addr, ky)
 	}
 	check(err)
 
@@ -86,19 +87,7 @@ func equipLeafWithModExtensionNode(statedb *state.StateDB, leafNode Node, addr c
 				shortExtNode = proof[len(proof)-3]
 			}
 		} else {
-			shortNibbles := longNibbles[numberOfNibbles+1:]
-			compact := trie.HexToCompact(shortNibbles)
-			longStartBranch := 2 + (longExtNode[1] - 128) // cannot be "short" in terms of having the length at position 0; TODO: extension with length at position 2 not supported (the probability very small)
-
-			if len(shortNibbles) > 1 {
-				// add RLP2:
-				compact = append([]byte{128 + byte(len(compact))}, compact...)
-			}
-
-			shortExtNode = append(compact, longExtNode[longStartBranch:]...)
-
-			// add RLP1:
-			shortExtNode = append([]byte{192 + byte(len(shortExtNode))}, shortExtNode...)
+			shortExtNode = extensionNodeWithNibbles(longExtNode, longNibbles[numberOfNibbles+1:])
 		}
 
 		// Get the nibbles of the shortened extension node:
@@ -3,6 +3,7 @@ package witness
 import (
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 
 	"main/gethutil/mpt/oracle"
 
@@ -13,6 +14,9 @@ type BranchNode struct {
 	ModifiedIndex int
 	DriftedIndex  int
 	ListRlpBytes  [2][]byte
+	// ValueRlp is the RLP of the value slot (the 17th element) of the S and C branch,
+	// [128] when the slot is empty.
+	ValueRlp [2][]byte
 }
 
 func (n *BranchNode) MarshalJSON() ([]byte, error) {
@@ -20,14 +24,34 @@ func (n *BranchNode) MarshalJSON() ([]byte, error) {
 		ModifiedIndex int      `json:"modified_index"`
 		DriftedIndex  int      `json:"drifted_index"`
 		ListRlpBytes  []string `json:"list_rlp_bytes"`
+		ValueRlp      []string `json:"value_rlp"`
 	}{
 		ModifiedIndex: n.ModifiedIndex,
 		DriftedIndex:  n.DriftedIndex,
 		ListRlpBytes:  encodeArray(n.ListRlpBytes[:]),
+		ValueRlp:      encodeArray(n.ValueRlp[:]),
 	}
 	return json.Marshal(jsonData)
 }
 
+func (n *BranchNode) UnmarshalJSON(data []byte) error {
+	var jsonData struct {
+		ModifiedIndex int      `json:"modified_index"`
+		DriftedIndex  int      `json:"drifted_index"`
+		ListRlpBytes  []string `json:"list_rlp_bytes"`
+		ValueRlp      []string `json:"value_rlp"`
+	}
+	if err := json.Unmarshal(data, &jsonData); err != nil {
+		return err
+	}
+	var d hexDecoder
+	n.ModifiedIndex = jsonData.ModifiedIndex
+	n.DriftedIndex = jsonData.DriftedIndex
+	n.ListRlpBytes = d.pair(jsonData.ListRlpBytes)
+	n.ValueRlp = d.pair(jsonData.ValueRlp)
+	return d.err
+}
+
 type ExtensionNode struct {
 	ListRlpBytes []byte
 }
@@ -41,6 +65,18 @@ func (n *ExtensionNode) MarshalJSON() ([]byte, error) {
 	return json.Marshal(jsonData)
 }
 
+func (n *ExtensionNode) UnmarshalJSON(data []byte) error {
+	var jsonData struct {
+		ListRlpBytes string `json:"list_rlp_bytes"`
+	}
+	if err := json.Unmarshal(data, &jsonData); err != nil {
+		return err
+	}
+	var d hexDecoder
+	n.ListRlpBytes = d.bytes(jsonData.ListRlpBytes)
+	return d.err
+}
+
 // When marshalling, []byte encodes as a base64-encoded string.
 func base64ToString(bs []byte) string {
 	if bs == nil {
@@ -57,9 +93,51 @@ func encodeArray(arrayBytes [][]byte) []string {
 	return hexStrings
 }
 
+// hexDecoder decodes the hex strings produced by base64ToString and encodeArray, the first error
+// is kept in err.
+type hexDecoder struct {
+	err error
+}
+
+func (d *hexDecoder) bytes(s string) []byte {
+	bs, err := hex.DecodeString(s)
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	return bs
+}
+
+func (d *hexDecoder) array(hexStrings []string) [][]byte {
+	if hexStrings == nil {
+		return nil
+	}
+	arrayBytes := make([][]byte, len(hexStrings))
+	for i, s := range hexStrings {
+		arrayBytes[i] = d.bytes(s)
+	}
+	return arrayBytes
+}
+
+func (d *hexDecoder) pair(hexStrings []string) [2][]byte {
+	var pair [2][]byte
+	if len(hexStrings) == 0 { // not present in the JSON
+		return pair
+	}
+	if len(hexStrings) != 2 {
+		if d.err == nil {
+			d.err = fmt.Errorf("expected 2 elements, got %d", len(hexStrings))
+		}
+		return pair
+	}
+	pair[0], pair[1] = d.bytes(hexStrings[0]), d.bytes(hexStrings[1])
+	return pair
+}
+
 type StartNode struct {
 	DisablePreimageCheck bool   `json:"disable_preimage_check"`
 	ProofType            string `json:"proof_type"`
+	// IsNoOp is set when the modification does not change the trie (S and C proofs are the same).
+	IsNoOp bool `json:"is_no_op"`
 }
 
 type ExtensionBranchNode struct {
@@ -72,6 +150,9 @@ type ExtensionBranchNode struct {
 	IsPlaceholder  [2]bool       `json:"is_placeholder"`
 	Extension      ExtensionNode `json:"extension"`
 	Branch         BranchNode    `json:"branch"`
+	// IsShared is set (by WithSharedNodeDedup) when the S and C branch (and extension node) are
+	// the same and the C copies are omitted from the node, see ExpandSharedNodes.
+	IsShared bool `json:"is_shared,omitempty"`
 }
 
 type ModExtensionNode struct {
@@ -87,6 +168,18 @@ func (n *ModExtensionNode) MarshalJSON() ([]byte, error) {
 	return json.Marshal(jsonData)
 }
 
+func (n *ModExtensionNode) UnmarshalJSON(data []byte) error {
+	var jsonData struct {
+		ListRlpBytes []string `json:"list_rlp_bytes"`
+	}
+	if err := json.Unmarshal(data, &jsonData); err != nil {
+		return err
+	}
+	var d hexDecoder
+	n.ListRlpBytes = d.pair(jsonData.ListRlpBytes)
+	return d.err
+}
+
 type AccountNode struct {
 	Address           common.Address
 	Key               []byte
@@ -97,6 +190,12 @@ type AccountNode struct {
 	WrongRlpBytes     []byte
 	IsModExtension    [2]bool
 	ModListRlpBytes   [2][]byte
+	// StorageRootS and StorageRootC are the storage roots in the S and C account leaf, CodeHashS and
+	// CodeHashC the code hashes. They are zero when the leaf is a placeholder.
+	StorageRootS common.Hash
+	StorageRootC common.Hash
+	CodeHashS    common.Hash
+	CodeHashC    common.Hash
 }
 
 func (n *AccountNode) MarshalJSON() ([]byte, error) {
@@ -110,6 +209,10 @@ func (n *AccountNode) MarshalJSON() ([]byte, error) {
 		WrongRlpBytes     string   `json:"wrong_rlp_bytes"`
 		IsModExtension    [2]bool  `json:"is_mod_extension"`
 		ModListRlpBytes   []string `json:"mod_list_rlp_bytes"`
+		StorageRootS      string   `json:"storage_root_s"`
+		StorageRootC      string   `json:"storage_root_c"`
+		CodeHashS         string   `json:"code_hash_s"`
+		CodeHashC         string   `json:"code_hash_c"`
 	}{
 		Address:           base64ToString(n.Address.Bytes()),
 		Key:               base64ToString(n.Key),
@@ -120,10 +223,50 @@ func (n *AccountNode) MarshalJSON() ([]byte, error) {
 		WrongRlpBytes:     base64ToString(n.WrongRlpBytes),
 		IsModExtension:    n.IsModExtension,
 		ModListRlpBytes:   encodeArray(n.ModListRlpBytes[:]),
+		StorageRootS:      base64ToString(n.StorageRootS.Bytes()),
+		StorageRootC:      base64ToString(n.StorageRootC.Bytes()),
+		CodeHashS:         base64ToString(n.CodeHashS.Bytes()),
+		CodeHashC:         base64ToString(n.CodeHashC.Bytes()),
 	}
 	return json.Marshal(jsonData)
 }
 
+func (n *AccountNode) UnmarshalJSON(data []byte) error {
+	var jsonData struct {
+		Address           string   `json:"address"`
+		Key               string   `json:"key"`
+		ListRlpBytes      []string `json:"list_rlp_bytes"`
+		ValueRlpBytes     []string `json:"value_rlp_bytes"`
+		ValueListRlpBytes []string `json:"value_list_rlp_bytes"`
+		DriftedRlpBytes   string   `json:"drifted_rlp_bytes"`
+		WrongRlpBytes     string   `json:"wrong_rlp_bytes"`
+		IsModExtension    [2]bool  `json:"is_mod_extension"`
+		ModListRlpBytes   []string `json:"mod_list_rlp_bytes"`
+		StorageRootS      string   `json:"storage_root_s"`
+		StorageRootC      string   `json:"storage_root_c"`
+		CodeHashS         string   `json:"code_hash_s"`
+		CodeHashC         string   `json:"code_hash_c"`
+	}
+	if err := json.Unmarshal(data, &jsonData); err != nil {
+		return err
+	}
+	var d hexDecoder
+	n.Address = common.BytesToAddress(d.bytes(jsonData.Address))
+	n.Key = d.bytes(jsonData.Key)
+	n.ListRlpBytes = d.pair(jsonData.ListRlpBytes)
+	n.ValueRlpBytes = d.pair(jsonData.ValueRlpBytes)
+	n.ValueListRlpBytes = d.pair(jsonData.ValueListRlpBytes)
+	n.DriftedRlpBytes = d.bytes(jsonData.DriftedRlpBytes)
+	n.WrongRlpBytes = d.bytes(jsonData.WrongRlpBytes)
+	n.IsModExtension = jsonData.IsModExtension
+	n.ModListRlpBytes = d.pair(jsonData.ModListRlpBytes)
+	n.StorageRootS = common.BytesToHash(d.bytes(jsonData.StorageRootS))
+	n.StorageRootC = common.BytesToHash(d.bytes(jsonData.StorageRootC))
+	n.CodeHashS = common.BytesToHash(d.bytes(jsonData.CodeHashS))
+	n.CodeHashC = common.BytesToHash(d.bytes(jsonData.CodeHashC))
+	return d.err
+}
+
 type StorageNode struct {
 	Address         common.Hash
 	Key             []byte
@@ -158,12 +301,48 @@ func (n *StorageNode) MarshalJSON() ([]byte, error) {
 	return json.Marshal(jsonData)
 }
 
+func (n *StorageNode) UnmarshalJSON(data []byte) error {
+	var jsonData struct {
+		Address         string   `json:"address"`
+		Key             string   `json:"key"`
+		ListRlpBytes    []string `json:"list_rlp_bytes"`
+		ValueRlpBytes   []string `json:"value_rlp_bytes"`
+		DriftedRlpBytes string   `json:"drifted_rlp_bytes"`
+		WrongRlpBytes   string   `json:"wrong_rlp_bytes"`
+		IsModExtension  [2]bool  `json:"is_mod_extension"`
+		ModListRlpBytes []string `json:"mod_list_rlp_bytes"`
+	}
+	if err := json.Unmarshal(data, &jsonData); err != nil {
+		return err
+	}
+	var d hexDecoder
+	n.Address = common.BytesToHash(d.bytes(jsonData.Address))
+	n.Key = d.bytes(jsonData.Key)
+	n.ListRlpBytes = d.pair(jsonData.ListRlpBytes)
+	n.ValueRlpBytes = d.pair(jsonData.ValueRlpBytes)
+	n.DriftedRlpBytes = d.bytes(jsonData.DriftedRlpBytes)
+	n.WrongRlpBytes = d.bytes(jsonData.WrongRlpBytes)
+	n.IsModExtension = jsonData.IsModExtension
+	n.ModListRlpBytes = d.pair(jsonData.ModListRlpBytes)
+	return d.err
+}
+
 type JSONableValues [][]byte
 
 func (u JSONableValues) MarshalJSON() ([]byte, error) {
 	return json.Marshal(encodeArray(u))
 }
 
+func (u *JSONableValues) UnmarshalJSON(data []byte) error {
+	var hexStrings []string
+	if err := json.Unmarshal(data, &hexStrings); err != nil {
+		return err
+	}
+	var d hexDecoder
+	*u = d.array(hexStrings)
+	return d.err
+}
+
 /*
 Note: using pointers for fields to be null when not set (otherwise the field is set to default value
 when marshalling).
@@ -202,6 +381,13 @@ func GetStartNode(proofType string, sRoot, cRoot common.Hash, specialTest byte)
 	}
 }
 
+// isNoOp returns whether the modification of the proof type with the S and C roots does not change
+// the trie (the start node has IsNoOp set). The non-existence proofs are not modifications, they
+// are never no-ops.
+func isNoOp(proofType string, sRoot, cRoot common.Hash) bool {
+	return sRoot == cRoot && proofType != "AccountDoesNotExist" && proofType != "StorageDoesNotExist"
+}
+
 func GetEndNode() Node {
 	e := StartNode{
 		DisablePreimageCheck: false,
@@ -217,3 +403,136 @@ func GetEndNode() Node {
 		Values: endValues,
 	}
 }
+
+// Row is a single row of the witness, an element of Node.Values.
+type Row []byte
+
+// ModExtensionRows returns the rows of the modified extension node (set by equipLeafWithModExtensionNode)
+// when the leaf node is equipped with them: the first three rows are the long extension node
+// and the last three rows the short extension node (see IsModExtension for which of them
+// is before and which after the modification).
+// The returned rows share the memory with node.Values.
+func ModExtensionRows(node Node) ([]Row, bool) {
+	var isModExtension [2]bool
+	switch {
+	case node.Account != nil:
+		isModExtension = node.Account.IsModExtension
+	case node.Storage != nil:
+		isModExtension = node.Storage.IsModExtension
+	default:
+		return nil, false
+	}
+	if !isModExtension[0] && !isModExtension[1] || len(node.Values) < modifiedExtensionNodeRowLen {
+		return nil, false
+	}
+
+	rows := make([]Row, modifiedExtensionNodeRowLen)
+	l := len(node.Values)
+	for i := range rows {
+		rows[i] = node.Values[l-modifiedExtensionNodeRowLen+i]
+	}
+
+	return rows, true
+}
+
+// DriftedLeaf returns the drifted leaf of the account or storage leaf node: the leaf that is moved
+// into the branch added by the modification (or out of the branch removed by it), the AccountDrifted
+// row holds its key. The leaf is in KeccakData after the S and C leaf and the key, followed only by
+// the long and short extension node when the node is equipped with the modified extension node.
+func DriftedLeaf(node Node) ([]byte, bool) {
+	if node.Account == nil && node.Storage == nil {
+		return nil, false
+	}
+	switch len(node.KeccakData) {
+	case 4, 4 + 2:
+		return node.KeccakData[3], true
+	}
+
+	return nil, false
+}
+
+// IndexedRow is the row of the flattened witness: Index is the index of the row in the flattened
+// witness, Node the index of its node (in the witness with the shared nodes and the boundaries
+// expanded) and NodeRow the index of the row in Node.Values.
+type IndexedRow struct {
+	Index   int `json:"index"`
+	Node    int `json:"node"`
+	NodeRow int `json:"node_row"`
+	Row     Row `json:"row"`
+}
+
+// FlattenNodes returns the rows of the nodes in the order the circuit consumes them: the rows of
+// each node in turn. The nodes deduplicated by WithSharedNodeDedup and the start nodes omitted by
+// WithoutRedundantBoundaries are restored first. An error is returned for a node of an unknown type
+// or with an unexpected number of rows.
+func FlattenNodes(nodes []Node) ([]Row, error) {
+	indexed, err := flattenIndexed(nodes)
+	if err != nil {
+		return nil, err
+	}
+	var rows []Row
+	for _, row := range indexed {
+		rows = append(rows, row.Row)
+	}
+
+	return rows, nil
+}
+
+// flattenIndexed is FlattenNodes with each row annotated with its position.
+func flattenIndexed(nodes []Node) ([]IndexedRow, error) {
+	nodes = ExpandSharedNodes(ExpandBoundaries(nodes))
+	var rows []IndexedRow
+	for i, node := range nodes {
+		var rowLen int
+		switch {
+		case node.Start != nil:
+			rowLen = startNodeRows
+		case node.ExtensionBranch != nil:
+			rowLen = branchNodeRows
+		case node.Account != nil:
+			rowLen = accountLeafRows
+		case node.Storage != nil:
+			rowLen = storageLeafRows
+		default:
+			return nil, fmt.Errorf("node %d: unknown node type", i)
+		}
+		if len(node.Values) != rowLen {
+			return nil, fmt.Errorf("node %d: %d rows, expected %d", i, len(node.Values), rowLen)
+		}
+		for r, row := range node.Values {
+			rows = append(rows, IndexedRow{Index: len(rows), Node: i, NodeRow: r, Row: row})
+		}
+	}
+
+	return rows, nil
+}
+
+// SplitByModification splits the chained witness into the witnesses of the modifications: each
+// segment begins with a start node and ends with an end node. An error is returned when a node
+// is outside of a start/end pair or when a start node is not followed by an end node.
+func SplitByModification(nodes []Node) ([][]Node, error) {
+	var segments [][]Node
+	begin := -1
+	for i, node := range nodes {
+		switch {
+		case node.Start != nil && node.Start.ProofType != "Disabled":
+			if begin != -1 {
+				return nil, fmt.Errorf("start node at %d before the end node of the modification starting at %d", i, begin)
+			}
+			begin = i
+		case node.Start != nil:
+			if begin == -1 {
+				return nil, fmt.Errorf("end node at %d without a start node", i)
+			}
+			segments = append(segments, nodes[begin:i+1:i+1])
+			begin = -1
+		case begin == -1:
+			return nil, fmt.Errorf("node at %d outside of a modification", i)
+		}
+	}
+	if begin != -1 {
+		return nil, fmt.Errorf("no end node for the modification starting at %d", begin)
+	}
+
+	return segments, nil
+}
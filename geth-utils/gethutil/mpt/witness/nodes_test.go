@@ -0,0 +1,180 @@
+package witness
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"os"
+	"testing"
+
+	"main/gethutil/mpt/state"
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestSplitByModification(t *testing.T) {
+	branchS := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xaa"), 10: common.HexToHash("0xcc")})
+	branchC := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xbb"), 10: common.HexToHash("0xcc")})
+	branch := prepareBranchNode(branchS, branchC, nil, nil, nil, makeRows(4, 0), 3, 3, false, false, false)
+	root := func(i int) common.Hash { return common.BigToHash(big.NewInt(int64(i + 1))) }
+
+	var nodes []Node
+	for i, l := range []int{1, 2, 0} {
+		nodes = append(nodes, GetStartNode("NonceChanged", root(i), root(i+1), 0))
+		for j := 0; j < l; j++ {
+			nodes = append(nodes, branch)
+		}
+		nodes = append(nodes, GetEndNode())
+	}
+
+	segments, err := SplitByModification(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 {
+		t.Fatalf("expected 3 segments, got %d", len(segments))
+	}
+	for i, segment := range segments {
+		first, last := segment[0], segment[len(segment)-1]
+		if first.Start == nil || first.Start.ProofType != "NonceChanged" {
+			t.Fatalf("segment %d does not begin with the start node", i)
+		}
+		if last.Start == nil || last.Start.ProofType != "Disabled" {
+			t.Fatalf("segment %d does not end with the end node", i)
+		}
+		if !bytes.Equal(first.Values[0][1:33], root(i).Bytes()) || len(segment) != []int{3, 4, 2}[i] {
+			t.Fatalf("wrong segment %d", i)
+		}
+	}
+
+	for name, unbalanced := range map[string][]Node{
+		"no end":         nodes[:len(nodes)-1],
+		"no start":       nodes[1:],
+		"start in start": append(append([]Node{}, nodes[:2]...), nodes...),
+		"node outside":   append([]Node{branch}, nodes...),
+		"two end nodes":  append(append([]Node{}, nodes...), GetEndNode()),
+	} {
+		if _, err := SplitByModification(unbalanced); err == nil {
+			t.Fatalf("%s: unbalanced witness accepted", name)
+		}
+	}
+}
+
+func TestFlattenNodes(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	addrh := crypto.Keccak256(addr.Bytes())
+	branchS := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xaa"), 10: common.HexToHash("0xcc")})
+	branchC := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xbb"), 10: common.HexToHash("0xcc")})
+	leafS := makeAccountLeaf(t, addrh, 1, 1, big.NewInt(5))
+	leafC := makeAccountLeaf(t, addrh, 1, 2, big.NewInt(5))
+	nodes := []Node{
+		GetStartNode("NonceChanged", common.HexToHash("0x01"), common.HexToHash("0x02"), 0),
+		prepareBranchNode(branchS, branchC, nil, nil, nil, makeRows(4, 0), 3, 3, false, false, false),
+		prepareAccountLeafNode(addr, addrh, leafS, leafC, nil, trie.KeybytesToHex(addrh), false, false, false, AccountLayoutCurrent),
+		GetEndNode(),
+	}
+
+	rows, err := FlattenNodes(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The start node, the branch (the modified child, 16 children, 4 extension node rows), the account
+	// leaf (AccountRowType rows and the modified extension node rows) and the end node:
+	if len(rows) != 2+21+18+2 {
+		t.Fatalf("expected 43 rows, got %d", len(rows))
+	}
+	if !bytes.Equal(rows[2+21+int(AccountNonceC)], nodes[2].Values[AccountNonceC]) {
+		t.Fatal("wrong nonce row")
+	}
+
+	// The row sequence of the nonce change (the same witness as in TestDumpNodesNonceChanged):
+	var buf bytes.Buffer
+	for i, row := range rows {
+		fmt.Fprintf(&buf, "%d %x\n", i, []byte(row))
+	}
+	golden := "testdata/flatten_nonce_changed.golden"
+	if *updateGolden {
+		if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	goldenRows, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), goldenRows) {
+		t.Fatalf("rows differ from %s:\n%s", golden, buf.String())
+	}
+
+	// The shared branch is expanded:
+	shared := append([]Node(nil), nodes...)
+	shared[1] = prepareBranchNode(branchC, branchC, nil, nil, nil, makeRows(4, 0), 3, 3, false, false, false)
+	expected, _ := FlattenNodes(shared)
+	dedupSharedNodes(shared)
+	if got, err := FlattenNodes(shared); err != nil || len(got) != len(expected) {
+		t.Fatalf("deduplicated witness: %d rows, expected %d (%v)", len(got), len(expected), err)
+	}
+
+	nodes[1].Values = nodes[1].Values[1:]
+	if _, err := FlattenNodes(nodes); err == nil {
+		t.Fatal("expected an error for the branch with a missing row")
+	}
+	if _, err := FlattenNodes([]Node{{}}); err == nil {
+		t.Fatal("expected an error for the node of unknown type")
+	}
+}
+
+// The slot is inserted into the trie with a single leaf: the leaf drifts into the new branch.
+func TestDriftedLeaf(t *testing.T) {
+	keys := [][]byte{
+		common.RightPadBytes([]byte{0x30}, 32),
+		common.RightPadBytes([]byte{0x10}, 32),
+	}
+	value, _ := rlp.EncodeToBytes([]byte{2})
+	newValue, _ := rlp.EncodeToBytes([]byte{17})
+	tr, err := trie.New(common.Hash{}, &trie.Database{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Update(keys[1], value)
+
+	var proof1, proof2, driftedProof testProofList
+	_, extNibblesS, isLastLeaf, _, err := tr.Prove(keys[0], 0, &proof1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Update(keys[0], newValue)
+	_, extNibblesC, _, _, err := tr.Prove(keys[0], 0, &proof2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The drifted leaf is at its new position in the branch:
+	if _, _, _, _, err := tr.Prove(keys[1], 0, &driftedProof); err != nil {
+		t.Fatal(err)
+	}
+	drifted := driftedProof[len(driftedProof)-1]
+
+	var statedb *state.StateDB // not needed when there is no modified extension node
+	nodes := convertProofToWitness(statedb, common.Address{}, nil, proof1, proof2, extNibblesS, extNibblesC,
+		common.BytesToHash(keys[0]), trie.KeybytesToHex(keys[0]), drifted, false, false, false, isLastLeaf, AccountLayoutCurrent)
+	leaf := nodes[len(nodes)-1]
+	if leaf.Storage == nil {
+		t.Fatal("the last node is not the storage leaf")
+	}
+	if got, ok := DriftedLeaf(leaf); !ok || !bytes.Equal(got, drifted) {
+		t.Fatalf("drifted leaf %x (%v), want %x", got, ok, drifted)
+	}
+
+	for _, node := range nodes[:len(nodes)-1] {
+		if _, ok := DriftedLeaf(node); ok {
+			t.Fatal("drifted leaf of the branch")
+		}
+	}
+	noDrift := prepareStorageLeafNode(proof2[len(proof2)-1], proof2[len(proof2)-1], nil, common.BytesToHash(keys[0]), trie.KeybytesToHex(keys[0]), false, false, false, false, false)
+	if _, ok := DriftedLeaf(noDrift); ok {
+		t.Fatal("drifted leaf of the leaf without the neighbour node")
+	}
+}
@@ -0,0 +1,18 @@
+package witness
+
+// omitLeaves omits the last leaf node of each modification (the node before the end node when it is
+// an account or storage leaf node), the witness then proves only the path down to the last branch
+// (or extension node). The account leaf of a storage modification is kept: it is above the storage
+// trie and holds the storage root.
+func omitLeaves(nodes []Node) []Node {
+	omitted := make([]Node, 0, len(nodes))
+	for _, node := range nodes {
+		last := len(omitted) - 1
+		if isEndNode(node) && last >= 0 && (omitted[last].Account != nil || omitted[last].Storage != nil) {
+			omitted = omitted[:last]
+		}
+		omitted = append(omitted, node)
+	}
+
+	return omitted
+}
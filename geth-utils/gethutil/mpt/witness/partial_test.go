@@ -0,0 +1,45 @@
+package witness
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestWithoutLeaf(t *testing.T) {
+	root, nodes := exampleState()
+	setMemoryState(t, root, nodes...)
+
+	for _, tc := range []struct {
+		name string
+		mod  TrieModification
+	}{
+		{"account", NewNonceChange(exampleEOA, 2)},
+		{"storage", NewStorageChange(exampleContract, common.BigToHash(big.NewInt(1)), common.HexToHash("0x2a"))},
+	} {
+		full, err := GetWitnessResult("", 1, []TrieModification{tc.mod})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := GetWitnessResult("", 1, []TrieModification{tc.mod}, WithoutLeaf())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Nodes) != len(full.Nodes)-1 {
+			t.Fatalf("%s: expected %d nodes, got %d", tc.name, len(full.Nodes)-1, len(result.Nodes))
+		}
+		l := len(result.Nodes)
+		if !isEndNode(result.Nodes[l-1]) || result.Nodes[l-2].ExtensionBranch == nil {
+			t.Fatalf("%s: the witness does not end with a branch and the end node", tc.name)
+		}
+		for i, node := range result.Nodes {
+			if node.Storage != nil || node.Account != nil && tc.mod.Type != StorageChanged {
+				t.Fatalf("%s: leaf node at %d", tc.name, i)
+			}
+		}
+		if tc.mod.Type == StorageChanged && len(DiffNodes(result.Nodes[:l-1], full.Nodes[:l-1])) != 0 {
+			t.Fatalf("%s: the nodes above the storage leaf differ", tc.name)
+		}
+	}
+}
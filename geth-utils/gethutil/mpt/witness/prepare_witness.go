@@ -1,14 +1,17 @@
 package witness
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/big"
+	"time"
 
 	"main/gethutil/mpt/oracle"
 	"main/gethutil/mpt/state"
-	"main/gethutil/mpt/trie"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/crypto"
 )
 
 const valueLen = 34
@@ -31,6 +34,23 @@ const (
 	AccountWrong
 )
 
+// StorageRowType is the row of the storage leaf node (see prepareStorageLeafNode), the rows
+// of the modified extension node follow.
+type StorageRowType int64
+
+const (
+	StorageKeyS StorageRowType = iota
+	StorageValueS
+	StorageKeyC
+	StorageValueC
+	StorageDrifted
+	// StorageWrong holds the queried key in the shape of the key of the wrong leaf: the storage
+	// non-existence is proven either with a nil child of the last branch (the placeholder leaf
+	// follows the branch, the row is empty) or with the leaf of another slot at the position
+	// of the queried key (the wrong leaf), the same as AccountWrong for the accounts.
+	StorageWrong
+)
+
 type ProofType int64
 
 const (
@@ -41,10 +61,34 @@ const (
 	AccountDestructed
 	AccountDoesNotExist
 	StorageChanged
+	// StorageDoesNotExist proves that the storage slot is not set. When the account itself does not exist,
+	// the slot non-existence follows from the account non-existence and an AccountDoesNotExist witness
+	// is generated instead.
 	StorageDoesNotExist
 	AccountCreate
+	// CodeHashRead does not change the account, the witness proves its current code hash
+	// (for example, that the account has no code: the code hash is keccak256 of the empty code).
+	CodeHashRead
+	// AccountRead does not change the account, the witness proves that the account exists and
+	// its nonce, balance, storage root and code hash (all in the account leaf).
+	AccountRead
+	// AccountAndStorageChange sets the nonce (and the balance, when set) of the account and then
+	// the storage slot, as a contract call that writes storage does. The witness is the NonceChanged
+	// witness followed by the StorageChanged witness (the C root of the first is the S root of the second).
+	AccountAndStorageChange
 )
 
+// String returns the name of the proof type (as in proofTypeNames).
+func (t ProofType) String() string {
+	if name, ok := proofTypeNames[t]; ok {
+		return name
+	}
+	if t == Disabled {
+		return "Disabled"
+	}
+	return fmt.Sprintf("ProofType(%d)", int64(t))
+}
+
 type TrieModification struct {
 	Type     ProofType
 	Key      common.Hash
@@ -53,6 +97,474 @@ type TrieModification struct {
 	Nonce    uint64
 	Balance  *big.Int
 	CodeHash []byte
+	// Custom, when set, replaces the account change given by Type (Type is then used only as
+	// the proof type of the witness). It is not supported for the storage modifications.
+	Custom *CustomModification `json:"-"`
+	// HashedKey, when set, is the path of Key in the storage trie (see hashStorageKey) known
+	// by the caller, the witness generation uses it instead of hashing Key. Validate checks
+	// that it is consistent with Key.
+	HashedKey *common.Hash
+}
+
+// CustomModification is an arbitrary change of the account state. The witness proves the account
+// before and after Apply has been called.
+type CustomModification struct {
+	Apply func(statedb *state.StateDB) error
+}
+
+// CustomAccountModification returns the modification that changes the account at addr by calling
+// apply; the witness is labelled with proofType.
+func CustomAccountModification(addr common.Address, proofType ProofType, apply func(statedb *state.StateDB) error) TrieModification {
+	return TrieModification{
+		Type:    proofType,
+		Address: addr,
+		Custom:  &CustomModification{Apply: apply},
+	}
+}
+
+// splitAccountAndStorageChange returns the account and the storage modification of
+// the AccountAndStorageChange modification.
+func splitAccountAndStorageChange(tMod TrieModification) []TrieModification {
+	accountMod := CustomAccountModification(tMod.Address, NonceChanged, func(statedb *state.StateDB) error {
+		statedb.SetNonce(tMod.Address, tMod.Nonce)
+		if tMod.Balance != nil {
+			statedb.SetBalance(tMod.Address, tMod.Balance)
+		}
+		return nil
+	})
+
+	storageMod := NewStorageChange(tMod.Address, tMod.Key, tMod.Value)
+	storageMod.HashedKey = tMod.HashedKey
+
+	return []TrieModification{accountMod, storageMod}
+}
+
+// AccountDestructedWithStorage returns the modifications for SELFDESTRUCT when the witness
+// needs to show the storage being wiped too: each of the given slots is first set to 0
+// (one storage witness per slot, the last one showing the storage trie emptied) and then
+// the account is deleted.
+func AccountDestructedWithStorage(addr common.Address, slots []common.Hash) []TrieModification {
+	var trieModifications []TrieModification
+	for _, slot := range slots {
+		trieModifications = append(trieModifications, TrieModification{
+			Type:    StorageChanged,
+			Key:     slot,
+			Value:   common.Hash{},
+			Address: addr,
+		})
+	}
+	trieModifications = append(trieModifications, TrieModification{
+		Type:    AccountDestructed,
+		Address: addr,
+	})
+
+	return trieModifications
+}
+
+// AccountCreateWithStorage returns the modifications for a contract creation where the constructor
+// sets the storage: the account is (re)created - any storage the address had before is dropped
+// (for example, CREATE2 redeploy after SELFDESTRUCT) - and then the slots are set one by one.
+// The account leaf in the C proof of the last modification carries the storage root of
+// the constructor-set storage. values[i] is the value of keys[i], an error is returned when
+// the numbers of the keys and the values differ.
+func AccountCreateWithStorage(addr common.Address, keys, values []common.Hash) ([]TrieModification, error) {
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("%d storage keys and %d values", len(keys), len(values))
+	}
+	trieModifications := []TrieModification{{
+		Type:    AccountCreate,
+		Address: addr,
+	}}
+	for i := 0; i < len(keys); i++ {
+		trieModifications = append(trieModifications, TrieModification{
+			Type:    StorageChanged,
+			Key:     keys[i],
+			Value:   values[i],
+			Address: addr,
+		})
+	}
+
+	return trieModifications, nil
+}
+
+// RawProof holds the GetProof proofs before (S) and after (C) a modification from which
+// the witness of the modification has been converted. The storage proofs are set only for
+// storage modifications.
+type RawProof struct {
+	Address       common.Address
+	Key           common.Hash
+	AccountProofS [][]byte
+	AccountProofC [][]byte
+	StorageProofS [][]byte
+	StorageProofC [][]byte
+}
+
+func (p *RawProof) MarshalJSON() ([]byte, error) {
+	jsonData := struct {
+		Address       string   `json:"address"`
+		Key           string   `json:"key"`
+		AccountProofS []string `json:"account_proof_s"`
+		AccountProofC []string `json:"account_proof_c"`
+		StorageProofS []string `json:"storage_proof_s"`
+		StorageProofC []string `json:"storage_proof_c"`
+	}{
+		Address:       base64ToString(p.Address.Bytes()),
+		Key:           base64ToString(p.Key.Bytes()),
+		AccountProofS: encodeArray(p.AccountProofS),
+		AccountProofC: encodeArray(p.AccountProofC),
+		StorageProofS: encodeArray(p.StorageProofS),
+		StorageProofC: encodeArray(p.StorageProofC),
+	}
+	return json.Marshal(jsonData)
+}
+
+// WitnessResult is the witness together with the optional data requested by WitnessOption.
+type WitnessResult struct {
+	Nodes []Node `json:"nodes"`
+	// RawProofs has one element per modification, set only when WithRawProofs is given.
+	RawProofs []RawProof `json:"raw_proofs,omitempty"`
+	// Timings has one element per modification, set only when WithTiming is given.
+	Timings []ModificationTiming `json:"timings,omitempty"`
+	// IntermediateRoots has one element per modification: the state root after the modification
+	// (the C root of its witness and the S root of the next one).
+	IntermediateRoots []common.Hash `json:"intermediate_roots"`
+	// Rows is the flattened witness (see FlattenNodes) with the row indices, set only when
+	// WithRowIndices is given.
+	Rows []IndexedRow `json:"rows,omitempty"`
+	// StorageRootChanges has one element per storage witness, set only when WithStorageRootChanges
+	// is given.
+	StorageRootChanges []StorageRootChange `json:"storage_root_changes,omitempty"`
+	// COnly has one element per witness of a modification, set only when WithCOnly is given
+	// (Nodes is not set then).
+	COnly []COnlyProof `json:"c_only,omitempty"`
+}
+
+// ModificationTiming is the wall-clock time spent on a modification. Fetch is the time spent
+// waiting for the node (the proofs and preimages not in the oracle cache), Conversion is the rest:
+// applying the modification and converting the proofs into the witness.
+type ModificationTiming struct {
+	Index      int           `json:"index"`
+	Fetch      time.Duration `json:"fetch"`
+	Conversion time.Duration `json:"conversion"`
+}
+
+// ErrNoChange is returned (with the RequireChange option) when a StorageChanged modification sets
+// the storage slot to the value it already has.
+var ErrNoChange = errors.New("storage modification does not change the value")
+
+// ErrDuplicateModification is returned (unless the AllowDuplicates option is given) when two
+// modifications have the same type, address and storage key.
+var ErrDuplicateModification = errors.New("duplicate modification")
+
+// ErrIncompatibleOptions is returned when the options passed to GetWitnessResult cannot be
+// combined, for example WithCOnly and an option operating on the witness nodes.
+var ErrIncompatibleOptions = errors.New("incompatible witness options")
+
+// ErrHeaderRootMismatch is returned (with the WithHeaderRootCheck option) when the witness does not
+// start from the state root of the block header.
+var ErrHeaderRootMismatch = errors.New("witness does not start from the header state root")
+
+type witnessConfig struct {
+	rawProofs     bool
+	requireChange bool
+	timing        bool
+	dedup         bool
+	trimBoundary  bool
+	allowDups     bool
+	headerRoot    bool
+	rowIndices    bool
+	maxCalls      int
+	withoutLeaf   bool
+	storageRoots  bool
+	cOnly         bool
+}
+
+// WitnessOption configures GetWitnessResult.
+type WitnessOption func(*witnessConfig)
+
+// WithRawProofs attaches the S and C proofs of each modification to WitnessResult, so that
+// the witness can be verified independently. The proofs are not included by default as they
+// about double the size of the output.
+func WithRawProofs() WitnessOption {
+	return func(c *witnessConfig) {
+		c.rawProofs = true
+	}
+}
+
+// RequireChange makes GetWitnessResult return ErrNoChange when a StorageChanged modification
+// does not change the storage. Without this option, such modification is turned into a read-only
+// witness: S and C proofs are the same and the start node has IsNoOp set.
+func RequireChange() WitnessOption {
+	return func(c *witnessConfig) {
+		c.requireChange = true
+	}
+}
+
+// WithTiming records the time spent on each of the modifications in WitnessResult.
+func WithTiming() WitnessOption {
+	return func(c *witnessConfig) {
+		c.timing = true
+	}
+}
+
+// WithSharedNodeDedup omits the C copy of the branches that are the same in S and C (see
+// ExpandSharedNodes for the reconstruction).
+func WithSharedNodeDedup() WitnessOption {
+	return func(c *witnessConfig) {
+		c.dedup = true
+	}
+}
+
+// WithoutRedundantBoundaries omits the start node of a modification when it has the same proof
+// type as the previous modification and its start root is the end root of the previous modification.
+// The roots are kept in the end node of the previous modification (see ExpandBoundaries for
+// the reconstruction).
+func WithoutRedundantBoundaries() WitnessOption {
+	return func(c *witnessConfig) {
+		c.trimBoundary = true
+	}
+}
+
+// AllowDuplicates disables the check for the modifications of the same type, address and storage
+// key. Such modifications are chained like any other: each one is applied to the state after
+// the previous one, so the later one overwrites the earlier one.
+func AllowDuplicates() WitnessOption {
+	return func(c *witnessConfig) {
+		c.allowDups = true
+	}
+}
+
+// WithRowIndices attaches the flattened witness to WitnessResult, each row annotated with its index
+// in the flattened witness and its node, to correlate the circuit assignment errors with the witness.
+func WithRowIndices() WitnessOption {
+	return func(c *witnessConfig) {
+		c.rowIndices = true
+	}
+}
+
+// WithoutLeaf omits the leaf node of each modification (the account leaf of the account modifications,
+// the storage leaf of the storage modifications), the witness then proves only the path down to
+// the last branch, for example to prove the root of a subtree.
+func WithoutLeaf() WitnessOption {
+	return func(c *witnessConfig) {
+		c.withoutLeaf = true
+	}
+}
+
+// WithMaxOracleCalls makes GetWitnessResult return ErrOracleBudgetExceeded when the witness
+// generation needs more than n oracle calls (the prefetches and the preimage lookups, see
+// oracle.ProviderCalls), to bound the requests sent to a metered node. n <= 0 means no limit.
+func WithMaxOracleCalls(n int) WitnessOption {
+	return func(c *witnessConfig) {
+		c.maxCalls = n
+	}
+}
+
+// WithHeaderRootCheck makes GetWitnessResult return ErrHeaderRootMismatch when the S root of the first
+// modification is not the state root of the block header the state is opened at (as obtained by
+// oracle.PrefetchBlock). The roots differ when the state served by the oracle is not the state of
+// the header, for example when the node returns the accounts of another block.
+func WithHeaderRootCheck() WitnessOption {
+	return func(c *witnessConfig) {
+		c.headerRoot = true
+	}
+}
+
+// WithStorageRootChanges attaches the change of the storage root field of the account leaf to
+// WitnessResult for each storage witness: the account part of the storage witness shows the account
+// leaf before and after the storage modification, only its storage root changes. The storage roots
+// are checked to be the roots of the storage proofs (ErrStorageRootMismatch otherwise).
+func WithStorageRootChanges() WitnessOption {
+	return func(c *witnessConfig) {
+		c.storageRoots = true
+	}
+}
+
+// WithCOnly replaces the witness nodes with the C proofs of each modification (see COnlyProof),
+// for the consumers that have the state before the modifications and need only the state after
+// them. The S and C roots of each modification still bound the change. The options operating
+// on the witness nodes (WithoutLeaf, WithSharedNodeDedup, WithoutRedundantBoundaries and
+// WithRowIndices) are rejected with ErrIncompatibleOptions alongside it.
+func WithCOnly() WitnessOption {
+	return func(c *witnessConfig) {
+		c.cOnly = true
+	}
+}
+
+// GetWitnessResult is like GetWitness, but returns WitnessResult which can be extended by
+// the options. The failures are returned as *WitnessError (see ErrProofFetch, ErrProofConvert,
+// ErrUnsupportedShape and ErrInternal). The modifications of the same type, address and storage key are
+// rejected with ErrDuplicateModification, see AllowDuplicates. An empty nodeUrl keeps
+// oracle.NodeUrl (the state is then usually served by the provider set with oracle.SetProvider).
+func GetWitnessResult(nodeUrl string, blockNum int, trieModifications []TrieModification, opts ...WitnessOption) (WitnessResult, error) {
+	var config witnessConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.cOnly && (config.withoutLeaf || config.dedup || config.trimBoundary || config.rowIndices) {
+		return WitnessResult{}, fmt.Errorf("%w: WithCOnly replaces the witness nodes, the options operating on them do not apply", ErrIncompatibleOptions)
+	}
+	if !config.allowDups {
+		if i, j := duplicateModification(trieModifications); j != -1 {
+			return WitnessResult{}, fmt.Errorf("modifications %d and %d: %w", i, j, ErrDuplicateModification)
+		}
+	}
+
+	if nodeUrl != "" {
+		oracle.NodeUrl = nodeUrl
+	}
+	if config.maxCalls > 0 {
+		oracle.SetCallBudget(config.maxCalls)
+		defer oracle.SetCallBudget(0)
+	}
+	statedb, err := openStateDB(blockNum)
+	if err != nil {
+		return WitnessResult{}, err
+	}
+
+	var result WitnessResult
+	var rawProofs *[]RawProof
+	if config.rawProofs || config.storageRoots || config.cOnly {
+		rawProofs = &result.RawProofs
+	}
+	keys := newKeyCache()
+	for i, tMod := range trieModifications {
+		start := time.Now()
+		fetchStart := oracle.FetchTime()
+		proofsStart := len(result.RawProofs)
+		nodes, err := witnessOfModification(i, tMod, statedb, rawProofs, keys)
+		if err != nil {
+			return WitnessResult{}, err
+		}
+		if config.storageRoots {
+			changes, err := storageRootChanges(i, nodes, result.RawProofs[proofsStart:])
+			if err != nil {
+				return WitnessResult{}, err
+			}
+			result.StorageRootChanges = append(result.StorageRootChanges, changes...)
+		}
+		if config.cOnly {
+			cOnly, err := cOnlyProofs(i, nodes, result.RawProofs[proofsStart:])
+			if err != nil {
+				return WitnessResult{}, err
+			}
+			result.COnly = append(result.COnly, cOnly...)
+		}
+		result.Nodes = append(result.Nodes, nodes...)
+		// The modification has been committed by statedb.IntermediateRoot:
+		result.IntermediateRoots = append(result.IntermediateRoots, statedb.GetTrie().Hash())
+		if config.timing {
+			total := time.Since(start)
+			fetch := oracle.FetchTime() - fetchStart
+			result.Timings = append(result.Timings, ModificationTiming{
+				Index:      i,
+				Fetch:      fetch,
+				Conversion: total - fetch,
+			})
+		}
+	}
+
+	if !config.rawProofs {
+		// Collected only for the storage root changes or the C proofs:
+		result.RawProofs = nil
+	}
+	if config.headerRoot {
+		if err := checkHeaderRoot(result.Nodes, statedb.Db.StateRoot); err != nil {
+			return WitnessResult{}, err
+		}
+	}
+	if config.requireChange {
+		if i := firstNoOpStorageChange(result.Nodes, trieModifications); i != -1 {
+			return WitnessResult{}, fmt.Errorf("modification %d: %w", i, ErrNoChange)
+		}
+	}
+	if config.cOnly {
+		result.Nodes = nil
+	}
+	if config.withoutLeaf {
+		result.Nodes = omitLeaves(result.Nodes)
+	}
+	if config.dedup {
+		dedupSharedNodes(result.Nodes)
+	}
+	if config.trimBoundary {
+		result.Nodes = trimRedundantBoundaries(result.Nodes)
+	}
+	if config.rowIndices {
+		if result.Rows, err = flattenIndexed(result.Nodes); err != nil {
+			return WitnessResult{}, err
+		}
+	}
+
+	return result, nil
+}
+
+// checkHeaderRoot returns ErrHeaderRootMismatch when the S root of the first start node is not root.
+func checkHeaderRoot(nodes []Node, root common.Hash) error {
+	for _, node := range nodes {
+		if node.Start == nil || isEndNode(node) {
+			continue
+		}
+		if sRoot := common.BytesToHash(node.Values[0][1:33]); sRoot != root {
+			return fmt.Errorf("%w: S root %x, header root %x", ErrHeaderRootMismatch, sRoot, root)
+		}
+		break
+	}
+
+	return nil
+}
+
+// duplicateModification returns the indices of the first pair of modifications with the same
+// type, address and key (-1, -1 if there is none). The custom modifications are not compared,
+// their type is only the label of the witness.
+func duplicateModification(trieModifications []TrieModification) (int, int) {
+	type modKey struct {
+		typ  ProofType
+		addr common.Address
+		key  common.Hash
+	}
+	seen := make(map[modKey]int)
+	for j, tMod := range trieModifications {
+		if tMod.Custom != nil {
+			continue
+		}
+		k := modKey{tMod.Type, tMod.Address, tMod.Key}
+		if i, ok := seen[k]; ok {
+			return i, j
+		}
+		seen[k] = j
+	}
+
+	return -1, -1
+}
+
+// firstNoOpStorageChange returns the index of the first StorageChanged (or AccountAndStorageChange)
+// modification that did not change the storage (-1 if there is none). Each modification has a start node
+// in the witness, AccountAndStorageChange has two (the account one is not checked).
+func firstNoOpStorageChange(nodes []Node, trieModifications []TrieModification) int {
+	var mods []int // the index of the modification of each start node, -1 when not checked
+	for i, tMod := range trieModifications {
+		if tMod.Type == AccountAndStorageChange {
+			mods = append(mods, -1)
+		}
+		if tMod.Type == StorageChanged || tMod.Type == AccountAndStorageChange {
+			mods = append(mods, i)
+		} else {
+			mods = append(mods, -1)
+		}
+	}
+	j := 0
+	for _, node := range nodes {
+		if node.Start == nil || node.Start.ProofType == "Disabled" {
+			continue
+		}
+		if node.Start.IsNoOp && mods[j] != -1 {
+			return mods[j]
+		}
+		j++
+	}
+
+	return -1
 }
 
 // GetWitness is to be used by external programs to generate the witness.
@@ -65,28 +577,64 @@ func GetWitness(nodeUrl string, blockNum int, trieModifications []TrieModificati
 	return obtainTwoProofsAndConvertToWitness(trieModifications, statedb, 0)
 }
 
-func obtainAccountProofAndConvertToWitness(i int, tMod TrieModification, tModsLen int, statedb *state.StateDB, specialTest byte) []Node {
-	statedb.IntermediateRoot(false)
+// GetWitnessByTag is like GetWitness, but the block is given by a tag ("latest", "pending",
+// "finalized") instead of by a number. The tag is resolved to a concrete block number which is
+// returned alongside the witness so that the caller can record it.
+func GetWitnessByTag(nodeUrl string, tag string, trieModifications []TrieModification) ([]Node, int, error) {
+	oracle.NodeUrl = nodeUrl
+	blockNumber, err := oracle.ResolveBlockTag(tag)
+	if err != nil {
+		return nil, 0, err
+	}
+	blockNum := int(blockNumber.Int64())
 
-	addr := tMod.Address
-	addrh := crypto.Keccak256(addr.Bytes())
-	accountAddr := trie.KeybytesToHex(addrh)
+	return GetWitness(nodeUrl, blockNum, trieModifications), blockNum, nil
+}
 
-	// This needs to be called before oracle.PrefetchAccount, otherwise oracle.PrefetchAccount
-	// will cache the proof and won't return it.
-	// Calling oracle.PrefetchAccount after statedb.SetStateObjectIfExists is needed only
-	// for cases when statedb.loadRemoteAccountsIntoStateObjects = false.
-	statedb.SetStateObjectIfExists(tMod.Address)
+// preimage returns the node with the given hash, it is replaced in tests to observe the lookups.
+var preimage = oracle.Preimage
 
-	oracle.PrefetchAccount(statedb.Db.BlockNumber, tMod.Address, nil)
-	accountProof, aNeighbourNode1, aExtNibbles1, isLastLeaf1, aIsNeighbourNodeHashed1, err := statedb.GetProof(addr)
-	check(err)
+// resolveNeighbourNode returns the neighbour node as returned by GetProof / GetStorageProof with
+// the hash reference replaced by the node itself. A node shorter than 32 bytes is not referenced
+// by its hash but inlined in its parent - its RLP (a list) is then the node and no preimage
+// is looked up, even when isHashed is set.
+func resolveNeighbourNode(node []byte, isHashed bool) []byte {
+	if !isHashed || len(node) != 33 || node[0] != 160 {
+		return node
+	}
+	// The error is not handled here, because it is ok to continue when the preimage is not found
+	// for the cases when neighbour node is not needed.
+	n, _ := preimage(common.BytesToHash(node[1:]))
 
-	var nodes []Node
+	return n
+}
 
-	sRoot := statedb.GetTrie().Hash()
+// neededNeighbourNode returns the resolved neighbour node (see resolveNeighbourNode) when the S and C
+// proofs differ in length, nil otherwise. Only the branch added or deleted by the modification needs
+// the neighbour node, its preimage is thus not looked up for the plain updates.
+func neededNeighbourNode(proofS, proofC [][]byte, node []byte, isHashed bool) []byte {
+	if len(proofS) == len(proofC) {
+		return nil
+	}
+
+	return resolveNeighbourNode(node, isHashed)
+}
 
-	if tMod.Type == NonceChanged {
+// isAccountFieldChange returns whether the modification sets the nonce, the balance or the code hash
+// of the account (the changes that can leave the account empty in the sense of EIP-158).
+func isAccountFieldChange(tMod TrieModification) bool {
+	return tMod.Custom == nil && (tMod.Type == NonceChanged || tMod.Type == BalanceChanged || tMod.Type == CodeHashChanged)
+}
+
+// applyAccountModification applies the account modification to the state, it returns whether the
+// account has been emptied (and thus deleted, see EIP-158) by the change of its nonce, balance or code hash.
+func applyAccountModification(statedb *state.StateDB, tMod TrieModification) bool {
+	addr := tMod.Address
+	existed := statedb.Exist(addr)
+
+	if tMod.Custom != nil {
+		check(tMod.Custom.Apply(statedb))
+	} else if tMod.Type == NonceChanged {
 		statedb.SetNonce(addr, tMod.Nonce)
 	} else if tMod.Type == BalanceChanged {
 		statedb.SetBalance(addr, tMod.Balance)
@@ -94,11 +642,46 @@ func obtainAccountProofAndConvertToWitness(i int, tMod TrieModification, tModsLe
 		statedb.SetCodeHash(addr, tMod.CodeHash)
 	} else if tMod.Type == AccountCreate {
 		statedb.CreateAccount(tMod.Address)
+		// The account re-created after its destruction is not marked dirty by CreateAccount,
+		// touch it so that it is written to the trie:
+		statedb.AddBalance(tMod.Address, common.Big0)
 	} else if tMod.Type == AccountDestructed {
 		statedb.DeleteAccount(tMod.Address)
 	}
-	// No statedb change in case of AccountDoesNotExist.
+	// No statedb change in case of AccountDoesNotExist, CodeHashRead and AccountRead.
+	emptied := existed && isAccountFieldChange(tMod) && statedb.Empty(addr)
+	if emptied {
+		// EIP-158: the account with zero nonce, zero balance and no code does not exist,
+		// the change is proven as the deletion of the account.
+		statedb.DeleteAccount(addr)
+	}
+	if tMod.Type == AccountRead && !statedb.Exist(addr) {
+		panic(fmt.Errorf("AccountRead of the account %s that does not exist", addr))
+	}
+
+	return emptied
+}
+
+func obtainAccountProofAndConvertToWitness(i int, tMod TrieModification, tModsLen int, statedb *state.StateDB, specialTest byte, rawProofs *[]RawProof, keys *keyCache) []Node {
+	statedb.IntermediateRoot(false)
+
+	addr := tMod.Address
+	addrh, accountAddr := keys.addressKey(addr)
+
+	// This needs to be called before oracle.PrefetchAccount, otherwise oracle.PrefetchAccount
+	// will cache the proof and won't return it.
+	// Calling oracle.PrefetchAccount after statedb.SetStateObjectIfExists is needed only
+	// for cases when statedb.loadRemoteAccountsIntoStateObjects = false.
+	statedb.SetStateObjectIfExists(tMod.Address)
+
+	keys.prefetchAccount(statedb, tMod.Address)
+	accountProof, aNeighbourNode1, aExtNibbles1, isLastLeaf1, aIsNeighbourNodeHashed1, err := statedb.GetProof(addr)
+	check(err)
 
+	var nodes []Node
+
+	sRoot := statedb.GetTrie().Hash()
+	emptied := applyAccountModification(statedb, tMod)
 	statedb.IntermediateRoot(false)
 
 	cRoot := statedb.GetTrie().Hash()
@@ -106,6 +689,27 @@ func obtainAccountProofAndConvertToWitness(i int, tMod TrieModification, tModsLe
 	accountProof1, aNeighbourNode2, aExtNibbles2, isLastLeaf2, aIsNeighbourNodeHashed2, err := statedb.GetProof(addr)
 	check(err)
 
+	// AccountRead is NonceChanged with the same S and C proofs (the start node has IsNoOp set).
+	proofType := "NonceChanged"
+	if tMod.Type == BalanceChanged {
+		proofType = "BalanceChanged"
+	} else if tMod.Type == AccountDestructed || emptied {
+		proofType = "AccountDestructed"
+	} else if tMod.Type == AccountDoesNotExist {
+		proofType = "AccountDoesNotExist"
+	} else if tMod.Type == CodeHashChanged || tMod.Type == CodeHashRead {
+		// CodeHashRead is CodeHashChanged with the same S and C proofs (the start node has IsNoOp set).
+		proofType = "CodeHashChanged"
+	}
+
+	// The modification might not change anything (for example, the nonce is set to its current value),
+	// in this case the witness proves the current value with the same S and C proofs.
+	noOp := isNoOp(proofType, sRoot, cRoot)
+	if noOp {
+		accountProof1 = accountProof
+		aExtNibbles2 = aExtNibbles1
+	}
+
 	if tMod.Type == AccountDoesNotExist && len(accountProof) == 0 {
 		// If there is only one account in the state trie and we want to prove for some
 		// other account that it doesn't exist.
@@ -120,6 +724,13 @@ func obtainAccountProofAndConvertToWitness(i int, tMod TrieModification, tModsLe
 	}
 
 	addrh, accountAddr, accountProof, accountProof1, sRoot, cRoot = modifyAccountProofSpecialTests(addrh, accountAddr, sRoot, cRoot, accountProof, accountProof1, aNeighbourNode2, specialTest)
+	if rawProofs != nil {
+		*rawProofs = append(*rawProofs, RawProof{
+			Address:       addr,
+			AccountProofS: accountProof,
+			AccountProofC: accountProof1,
+		})
+	}
 	aNode := aNeighbourNode2
 	isShorterProofLastLeaf := isLastLeaf1
 	aIsNeighbourNodeHashed := aIsNeighbourNodeHashed2
@@ -130,25 +741,19 @@ func obtainAccountProofAndConvertToWitness(i int, tMod TrieModification, tModsLe
 		aIsNeighbourNodeHashed = aIsNeighbourNodeHashed1
 	}
 
-	if aIsNeighbourNodeHashed {
-		aNode, _ = oracle.Preimage(common.BytesToHash(aNode[1:]))
-	}
-
-	proofType := "NonceChanged"
-	if tMod.Type == BalanceChanged {
-		proofType = "BalanceChanged"
-	} else if tMod.Type == AccountDestructed {
-		proofType = "AccountDestructed"
-	} else if tMod.Type == AccountDoesNotExist {
-		proofType = "AccountDoesNotExist"
-	} else if tMod.Type == CodeHashChanged {
-		proofType = "CodeHashChanged"
-	}
+	aNode = neededNeighbourNode(accountProof, accountProof1, aNode, aIsNeighbourNodeHashed)
 
-	nodes = append(nodes, GetStartNode(proofType, sRoot, cRoot, specialTest))
+	startNode := GetStartNode(proofType, sRoot, cRoot, specialTest)
+	startNode.Start.IsNoOp = noOp
+	nodes = append(nodes, startNode)
 
 	nodesAccount :=
-		convertProofToWitness(statedb, addr, addrh, accountProof, accountProof1, aExtNibbles1, aExtNibbles2, tMod.Key, accountAddr, aNode, true, tMod.Type == AccountDoesNotExist, false, isShorterProofLastLeaf)
+		convertProofToWitness(statedb, addr, addrh, accountProof, accountProof1, aExtNibbles1, aExtNibbles2, tMod.Key, accountAddr, aNode, true, tMod.Type == AccountDoesNotExist, false, isShorterProofLastLeaf, AccountLayoutCurrent)
+	if tMod.Type == AccountCreate && len(accountProof) == 0 && len(accountProof1) == 1 {
+		// The first account in the empty trie: the C proof is the leaf only and there is nothing
+		// in the S proof, the S leaf is a placeholder.
+		setAccountLeafSPlaceholder(&nodesAccount[len(nodesAccount)-1])
+	}
 	nodes = append(nodes, nodesAccount...)
 	nodes = append(nodes, GetEndNode())
 
@@ -160,25 +765,31 @@ func obtainAccountProofAndConvertToWitness(i int, tMod TrieModification, tModsLe
 // prepared for each of the modifications and the witnesses are chained together - the final root of
 // the previous witness is the same as the start root of the current witness.
 func obtainTwoProofsAndConvertToWitness(trieModifications []TrieModification, statedb *state.StateDB, specialTest byte) []Node {
+	return obtainTwoProofsAndConvertToWitnessWithProofs(trieModifications, statedb, specialTest, nil, newKeyCache())
+}
+
+// obtainTwoProofsAndConvertToWitnessWithProofs is obtainTwoProofsAndConvertToWitness which also appends
+// the S and C proofs of each modification to rawProofs (when rawProofs is not nil).
+func obtainTwoProofsAndConvertToWitnessWithProofs(trieModifications []TrieModification, statedb *state.StateDB, specialTest byte, rawProofs *[]RawProof, keys *keyCache) []Node {
 	statedb.IntermediateRoot(false)
 	var nodes []Node
 
 	for i := 0; i < len(trieModifications); i++ {
 		tMod := trieModifications[i]
 
+		if tMod.Type == AccountAndStorageChange {
+			nodes = append(nodes, obtainTwoProofsAndConvertToWitnessWithProofs(splitAccountAndStorageChange(tMod), statedb, specialTest, rawProofs, keys)...)
+			continue
+		}
+
 		if tMod.Type == StorageChanged || tMod.Type == StorageDoesNotExist {
-			kh := crypto.Keccak256(tMod.Key.Bytes())
-			if oracle.PreventHashingInSecureTrie {
-				kh = tMod.Key.Bytes()
-			}
-			keyHashed := trie.KeybytesToHex(kh)
+			keyHashed := keys.modificationStorageKey(tMod)
 
 			addr := tMod.Address
-			addrh := crypto.Keccak256(addr.Bytes())
-			accountAddr := trie.KeybytesToHex(addrh)
+			addrh, accountAddr := keys.addressKey(addr)
 
-			oracle.PrefetchAccount(statedb.Db.BlockNumber, tMod.Address, nil)
-			oracle.PrefetchStorage(statedb.Db.BlockNumber, addr, tMod.Key, nil)
+			keys.prefetchAccount(statedb, tMod.Address)
+			keys.prefetchStorage(statedb, addr, tMod.Key)
 
 			if specialTest == 1 {
 				statedb.CreateAccount(addr)
@@ -191,11 +802,22 @@ func obtainTwoProofsAndConvertToWitness(trieModifications []TrieModification, st
 			// account - because the first part of the address is the same and
 			// the queried address doesn't have the account yet.
 			if !statedb.Exist(addr) {
+				if tMod.Type == StorageDoesNotExist {
+					// An account that does not exist has no storage, the storage non-existence thus follows
+					// from the account non-existence proof (there is no storage proof in the witness).
+					accountMod := TrieModification{Type: AccountDoesNotExist, Address: addr, Key: tMod.Key}
+					accountNodes := obtainAccountProofAndConvertToWitness(i, accountMod, len(trieModifications), statedb, specialTest, rawProofs, keys)
+					nodes = append(nodes, accountNodes...)
+					continue
+				}
 				// Note: the storage modification should not be the first modification for the account that does
 				// not exist yet.
 				panic("The account should exist at this point - created by SetNonce, SetBalance, or SetCodehash")
 			}
 
+			// The storage root in the account leaf is always the hash of the root node (the root is not
+			// inlined even when it is shorter than 32 bytes), the proof of a single slot storage trie is
+			// thus the leaf only.
 			storageProof, neighbourNode1, extNibbles1, isLastLeaf1, isNeighbourNodeHashed1, err := statedb.GetStorageProof(addr, tMod.Key)
 			check(err)
 
@@ -219,6 +841,15 @@ func obtainTwoProofsAndConvertToWitness(trieModifications []TrieModification, st
 			storageProof1, neighbourNode2, extNibbles2, isLastLeaf2, isNeighbourNodeHashed2, err := statedb.GetStorageProof(addr, tMod.Key)
 			check(err)
 
+			// The value might be set to the value that is already stored, S and C proofs are the same then.
+			noOp := isNoOp(proofType, sRoot, cRoot)
+			if noOp {
+				accountProof1 = accountProof
+				aExtNibbles2 = aExtNibbles1
+				storageProof1 = storageProof
+				extNibbles2 = extNibbles1
+			}
+
 			aNode := aNeighbourNode2
 			aIsLastLeaf := aIsLastLeaf1
 			aIsNeighbourNodeHashed := aIsNeighbourNodeHashed2
@@ -229,14 +860,6 @@ func obtainTwoProofsAndConvertToWitness(trieModifications []TrieModification, st
 				aIsNeighbourNodeHashed = aIsNeighbourNodeHashed1
 			}
 
-			// Note: oracle.Preimage is called here and not in Proof function because the preimage
-			// is not available yet there (GetProof / GetStorageProof fetch the preimages).
-			if aIsNeighbourNodeHashed {
-				// The error is not handled here, because it is ok to continue when the preimage is not found
-				// for the cases when neighbour node is not needed.
-				aNode, _ = oracle.Preimage(common.BytesToHash(aNode[1:]))
-			}
-
 			node := neighbourNode2
 			isLastLeaf := isLastLeaf1
 			isNeighbourNodeHashed := isNeighbourNodeHashed2
@@ -247,10 +870,15 @@ func obtainTwoProofsAndConvertToWitness(trieModifications []TrieModification, st
 				isNeighbourNodeHashed = isNeighbourNodeHashed1
 			}
 
-			if isNeighbourNodeHashed {
-				// The error is not handled here, because it is ok to continue when the preimage is not found
-				// for the cases when neighbour node is not needed.
-				node, _ = oracle.Preimage(common.BytesToHash(node[1:]))
+			// Note: the preimage is retrieved here and not in Proof function because the preimage
+			// is not available yet there (GetProof / GetStorageProof fetch the preimages).
+			node = neededNeighbourNode(storageProof, storageProof1, node, isNeighbourNodeHashed)
+
+			// The special test creates the account in the statedb and replaces the account proofs,
+			// the storage roots in its account leaves are thus not the roots of the storage proofs.
+			if specialTest == 0 {
+				checkStorageRoot(accountProof, storageProof, "S")
+				checkStorageRoot(accountProof1, storageProof1, "C")
 			}
 
 			if specialTest == 1 {
@@ -259,22 +887,36 @@ func obtainTwoProofsAndConvertToWitness(trieModifications []TrieModification, st
 				}
 				accountProof, accountProof1, sRoot, cRoot = modifyAccountSpecialEmptyTrie(addrh, accountProof1[len(accountProof1)-1])
 			}
+			aNode = neededNeighbourNode(accountProof, accountProof1, aNode, aIsNeighbourNodeHashed)
+
+			if rawProofs != nil {
+				*rawProofs = append(*rawProofs, RawProof{
+					Address:       addr,
+					Key:           tMod.Key,
+					AccountProofS: accountProof,
+					AccountProofC: accountProof1,
+					StorageProofS: storageProof,
+					StorageProofC: storageProof1,
+				})
+			}
 
 			// Needs to be after `specialTest == 1` preparation:
-			nodes = append(nodes, GetStartNode(proofType, sRoot, cRoot, specialTest))
+			startNode := GetStartNode(proofType, sRoot, cRoot, specialTest)
+			startNode.Start.IsNoOp = noOp
+			nodes = append(nodes, startNode)
 
 			// In convertProofToWitness, we can't use account address in its original form (non-hashed), because
 			// of the "special" test for which we manually manipulate the "hashed" address and we don't have a preimage.
 			// TODO: addr is used for calling GetProof for modified extension node only, might be done in a different way
 			nodesAccount :=
-				convertProofToWitness(statedb, addr, addrh, accountProof, accountProof1, aExtNibbles1, aExtNibbles2, tMod.Key, accountAddr, aNode, true, tMod.Type == AccountDoesNotExist, false, aIsLastLeaf)
+				convertProofToWitness(statedb, addr, addrh, accountProof, accountProof1, aExtNibbles1, aExtNibbles2, tMod.Key, accountAddr, aNode, true, tMod.Type == AccountDoesNotExist, false, aIsLastLeaf, AccountLayoutCurrent)
 			nodes = append(nodes, nodesAccount...)
 			nodesStorage :=
-				convertProofToWitness(statedb, addr, addrh, storageProof, storageProof1, extNibbles1, extNibbles2, tMod.Key, keyHashed, node, false, false, tMod.Type == StorageDoesNotExist, isLastLeaf)
+				convertProofToWitness(statedb, addr, addrh, storageProof, storageProof1, extNibbles1, extNibbles2, tMod.Key, keyHashed, node, false, false, tMod.Type == StorageDoesNotExist, isLastLeaf, AccountLayoutCurrent)
 			nodes = append(nodes, nodesStorage...)
 			nodes = append(nodes, GetEndNode())
 		} else {
-			accountNodes := obtainAccountProofAndConvertToWitness(i, tMod, len(trieModifications), statedb, specialTest)
+			accountNodes := obtainAccountProofAndConvertToWitness(i, tMod, len(trieModifications), statedb, specialTest, rawProofs, keys)
 			nodes = append(nodes, accountNodes...)
 		}
 	}
@@ -324,9 +966,10 @@ func updateStateAndPrepareWitness(testName string, keys, values []common.Hash, a
 
 // convertProofToWitness takes two GetProof proofs (before and after a single modification) and prepares
 // a witness for the MPT circuit. Alongside, it prepares the byte streams that need to be hashed
-// and inserted into the Keccak lookup table.
+// and inserted into the Keccak lookup table. statedb is used only to obtain the proof of a modified
+// extension node, it is nil when the proofs are not from a state (see ConvertProofs).
 func convertProofToWitness(statedb *state.StateDB, addr common.Address, addrh []byte, proof1, proof2, extNibblesS, extNibblesC [][]byte, storage_key common.Hash, key []byte, neighbourNode []byte,
-	isAccountProof, nonExistingAccountProof, nonExistingStorageProof, isShorterProofLastLeaf bool) []Node {
+	isAccountProof, nonExistingAccountProof, nonExistingStorageProof, isShorterProofLastLeaf bool, layout AccountLayout) []Node {
 	toBeHashed := make([][]byte, 0)
 
 	minLen := len(proof1)
@@ -361,14 +1004,19 @@ func convertProofToWitness(statedb *state.StateDB, addr common.Address, addrh []
 
 	var isExtension bool
 	extensionNodeInd := 0
+	// The extension node above the current branch. It is kept explicitly (instead of taking the
+	// previous proof element) as the extension node can be the first proof element (the root).
+	var extNode1, extNode2 []byte
 
 	var extListRlpBytes []byte
-	var extValues [][]byte
-	for i := 0; i < 4; i++ {
-		extValues = append(extValues, make([]byte, valueLen))
-	}
+	extValues := makeRows(4, 0)
 
-	var nodes []Node
+	// There is at most one node per proof element of the longer proof, plus the placeholder leaf.
+	maxLen := len1
+	if len2 > maxLen {
+		maxLen = len2
+	}
+	nodes := make([]Node, 0, maxLen+1)
 
 	for i := 0; i < upTo; i++ {
 		if !isBranch(proof1[i]) {
@@ -381,31 +1029,59 @@ func convertProofToWitness(statedb *state.StateDB, addr common.Address, addrh []
 			// nil in the underlying branch). For the non-existing proof with the wrong leaf
 			// (non-existing proofs can be with a nil leaf or with a wrong leaf),
 			// we don't need to worry because it appears in i = upTo-1).
-			if (i != upTo-1) || (areThereNibbles && isNonExistingProof) { // extension node
+			if (i != upTo-1) || (areThereNibbles && isNonExistingProof && !isLeafNode(proof1[i])) { // extension node
 				var numberOfNibbles byte
 				isExtension = true
+				if extensionNodeInd >= len(extNibblesS) {
+					panic(fmt.Errorf("%w: no nibbles for the extension node %d", ErrKeyMismatch, extensionNodeInd))
+				}
 				numberOfNibbles, extListRlpBytes, extValues = prepareExtensions(extNibblesS, extensionNodeInd, proof1[i], proof2[i])
+				extNode1, extNode2 = proof1[i], proof2[i]
+				if i == upTo-1 {
+					// The non-existing proof ends with the extension node: its nibbles diverge from the key
+					// (otherwise the branch below it would be in the proof).
+					checkKeyDiverges(key, keyIndex, extNibblesS[extensionNodeInd], "extension node")
+				} else {
+					checkKeyNibbles(key, keyIndex, extNibblesS[extensionNodeInd], int(numberOfNibbles), "extension node")
+				}
 
 				keyIndex += int(numberOfNibbles)
 				extensionNodeInd++
 				continue
 			}
 
+			if isExtension {
+				// The witness has no rows for an extension node followed by a leaf (in a trie built by
+				// the hashing rules the extension node is always followed by a branch), the proof is
+				// rejected instead of dropping the extension node.
+				panic(unsupportedShape("extension node followed by the leaf at position %d", i))
+			}
 			l := len(proof1)
+			leafNibbles := getKeyRowNibbles(proof2[l-1])
+			// Writing zero into the slot that does not exist does not change the trie: the S and C
+			// proofs are the same and end with the leaf of another key, as the non-existing proof.
+			// The leaf is converted as the wrong leaf of the non-existing proof (the row StorageWrong
+			// holds the queried key), it is not the leaf of the queried key.
+			isUnchangedWrongLeaf := !isAccountProof && len1 == len2 && bytes.Equal(proof1[l-1], proof2[l-1]) &&
+				!hasKeyNibbles(key[:len(key)-1], keyIndex, leafNibbles, len(key)-1-keyIndex)
+			if !isNonExistingProof && !isUnchangedWrongLeaf {
+				// The leaf holds the rest of the key (the key without the terminator nibble):
+				checkKeyNibbles(key[:len(key)-1], keyIndex, leafNibbles, len(key)-1-keyIndex, "leaf")
+			} else {
+				// The non-existing proof ends with the wrong leaf, the leaf of another key:
+				checkKeyDiverges(key[:len(key)-1], keyIndex, leafNibbles, "wrong leaf")
+			}
 			var node Node
 			if isAccountProof {
-				node = prepareAccountLeafNode(addr, addrh, proof1[l-1], proof2[l-1], nil, key, false, false, false)
+				node = prepareAccountLeafNode(addr, addrh, proof1[l-1], proof2[l-1], nil, key, false, false, false, layout)
 			} else {
-				node = prepareStorageLeafNode(proof1[l-1], proof2[l-1], nil, storage_key, key, nonExistingStorageProof, false, false, false, false)
+				node = prepareStorageLeafNode(proof1[l-1], proof2[l-1], nil, storage_key, key, nonExistingStorageProof || isUnchangedWrongLeaf, false, false, false, false)
 			}
 
 			nodes = append(nodes, node)
 		} else {
-			var extNode1 []byte = nil
-			var extNode2 []byte = nil
-			if isExtension {
-				extNode1 = proof1[i-1]
-				extNode2 = proof2[i-1]
+			if !isExtension {
+				extNode1, extNode2 = nil, nil
 			}
 
 			bNode := prepareBranchNode(proof1[i], proof2[i], extNode1, extNode2, extListRlpBytes, extValues,
@@ -420,6 +1096,11 @@ func convertProofToWitness(statedb *state.StateDB, addr common.Address, addrh []
 
 	if len1 != len2 {
 		if additionalBranch {
+			// The neighbour node drifts into (or out of) the added (deleted) branch. It is nil when
+			// the branch holds its hash and the preimage has not been found (see resolveNeighbourNode).
+			if len(neighbourNode) == 0 {
+				panic(fmt.Errorf("%w: key %x", ErrMissingNeighbourPreimage, key))
+			}
 			leafRow0 := proof1[len1-1] // To compute the drifted position.
 			if len1 > len2 {
 				leafRow0 = proof2[len2-1]
@@ -436,7 +1117,7 @@ func convertProofToWitness(statedb *state.StateDB, addr common.Address, addrh []
 			if isAccountProof {
 				// Add account leaf after branch placeholder:
 				if !isModifiedExtNode {
-					leafNode = prepareAccountLeafNode(addr, addrh, proof1[len1-1], proof2[len2-1], neighbourNode, key, false, false, false)
+					leafNode = prepareAccountLeafNode(addr, addrh, proof1[len1-1], proof2[len2-1], neighbourNode, key, false, false, false, layout)
 				} else {
 					isSModExtension := false
 					isCModExtension := false
@@ -445,7 +1126,7 @@ func convertProofToWitness(statedb *state.StateDB, addr common.Address, addrh []
 					} else {
 						isCModExtension = true
 					}
-					leafNode = prepareLeafAndPlaceholderNode(addr, addrh, proof1, proof2, storage_key, key, isAccountProof, isSModExtension, isCModExtension)
+					leafNode = prepareLeafAndPlaceholderNode(addr, addrh, proof1, proof2, storage_key, key, isAccountProof, isSModExtension, isCModExtension, layout)
 				}
 			} else {
 				// Add storage leaf after branch placeholder
@@ -459,7 +1140,7 @@ func convertProofToWitness(statedb *state.StateDB, addr common.Address, addrh []
 					} else {
 						isCModExtension = true
 					}
-					leafNode = prepareLeafAndPlaceholderNode(addr, addrh, proof1, proof2, storage_key, key, isAccountProof, isSModExtension, isCModExtension)
+					leafNode = prepareLeafAndPlaceholderNode(addr, addrh, proof1, proof2, storage_key, key, isAccountProof, isSModExtension, isCModExtension, layout)
 				}
 			}
 
@@ -467,16 +1148,27 @@ func convertProofToWitness(statedb *state.StateDB, addr common.Address, addrh []
 			// of the existing extension node), additional rows are added (extension node before and after
 			// modification).
 			if isModifiedExtNode {
+				if statedb == nil {
+					panic(unsupportedShape("modified extension node needs the state (key %x)", key))
+				}
 				leafNode = equipLeafWithModExtensionNode(statedb, leafNode, addr, proof1, proof2, extNibblesS, extNibblesC, key, neighbourNode,
 					keyIndex, extensionNodeInd, numberOfNibbles, additionalBranch,
 					isAccountProof, nonExistingAccountProof, isShorterProofLastLeaf, &toBeHashed)
 			}
 			nodes = append(nodes, leafNode)
 		} else {
-			node := prepareLeafAndPlaceholderNode(addr, addrh, proof1, proof2, storage_key, key, isAccountProof, false, false)
+			node := prepareLeafAndPlaceholderNode(addr, addrh, proof1, proof2, storage_key, key, isAccountProof, false, false, layout)
 			nodes = append(nodes, node)
 		}
-	} else if (len1 == 0 && len2 == 0) || isBranch(proof2[len(proof2)-1]) {
+	} else if isExtension || (len1 == 0 && len2 == 0) || isBranch(proof2[len(proof2)-1]) {
+		if isExtension {
+			// The non-existing proof ends with the extension node that diverges from the key, there is
+			// no branch below it in the proof. The extension node is put above the placeholder branch
+			// (in S and C) so that the witness has its nibbles, the placeholder leaf follows.
+			bNode := prepareBranchNode(emptyBranch, emptyBranch, extNode1, extNode2, extListRlpBytes, extValues,
+				key[keyIndex], key[keyIndex], true, true, isExtension)
+			nodes = append(nodes, bNode)
+		}
 		// Account proof has drifted leaf as the last row, storage proof has non-existing-storage row
 		// as the last row.
 		// When non existing proof and only the branches are returned, we add a placeholder leaf.
@@ -0,0 +1,1118 @@
+package witness
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+
+	"main/gethutil/mpt/oracle"
+	"main/gethutil/mpt/state"
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// conversionInput holds the S and C proofs of an update of the key in an in-memory trie.
+type conversionInput struct {
+	proof1, proof2           [][]byte
+	extNibblesS, extNibblesC [][]byte
+	key                      []byte
+	isLastLeaf               bool
+}
+
+// makeConversionInput fills an in-memory trie with n keys (value(i) as the value for the i-th key)
+// and returns the proofs before and after the value of the first key is set to newValue.
+func makeConversionInput(tb testing.TB, n int, hashedKey func(i int) []byte, value func(i int) []byte, newValue []byte) conversionInput {
+	tr, err := trie.New(common.Hash{}, &trie.Database{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		tr.Update(hashedKey(i), value(i))
+	}
+
+	var input conversionInput
+	key := hashedKey(0)
+	var proof1, proof2 testProofList
+	_, input.extNibblesS, input.isLastLeaf, _, err = tr.Prove(key, 0, &proof1)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tr.Update(key, newValue)
+	_, input.extNibblesC, _, _, err = tr.Prove(key, 0, &proof2)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	input.proof1, input.proof2 = proof1, proof2
+	input.key = trie.KeybytesToHex(key)
+
+	return input
+}
+
+func slotKey(i int) common.Hash {
+	var slot common.Hash
+	binary.BigEndian.PutUint64(slot[24:], uint64(i))
+	return slot
+}
+
+func BenchmarkConvertStorageProof(b *testing.B) {
+	storageValue := func(i int) []byte {
+		v, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(common.BigToHash(big.NewInt(int64(i + 1))).Bytes()))
+		return v
+	}
+	input := makeConversionInput(b, 10000,
+		func(i int) []byte { return crypto.Keccak256(slotKey(i).Bytes()) },
+		storageValue, storageValue(17))
+	var statedb *state.StateDB // not needed when there is no modified extension node
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		convertProofToWitness(statedb, common.Address{}, nil, input.proof1, input.proof2, input.extNibblesS, input.extNibblesC,
+			slotKey(0), input.key, nil, false, false, false, input.isLastLeaf, AccountLayoutCurrent)
+	}
+}
+
+func BenchmarkConvertAccountProof(b *testing.B) {
+	address := func(i int) common.Address {
+		return common.BigToAddress(big.NewInt(int64(i + 1)))
+	}
+	account := func(nonce uint64) []byte {
+		v, _ := rlp.EncodeToBytes(state.Account{
+			Nonce:    nonce,
+			Balance:  big.NewInt(1000000000000000000),
+			Root:     emptyStorageRoot,
+			CodeHash: crypto.Keccak256(nil),
+		})
+		return v
+	}
+	input := makeConversionInput(b, 10000,
+		func(i int) []byte { return crypto.Keccak256(address(i).Bytes()) },
+		func(i int) []byte { return account(1) }, account(2))
+	addr := address(0)
+	addrh := crypto.Keccak256(addr.Bytes())
+	var statedb *state.StateDB // not needed when there is no modified extension node
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		convertProofToWitness(statedb, addr, addrh, input.proof1, input.proof2, input.extNibblesS, input.extNibblesC,
+			common.Hash{}, input.key, nil, true, false, false, input.isLastLeaf, AccountLayoutCurrent)
+	}
+}
+
+// The root of the trie is an extension node: the first proof element is the extension node,
+// the branch below it is the second one.
+func TestConvertProofRootExtension(t *testing.T) {
+	keys := [][]byte{
+		common.RightPadBytes([]byte{0xab, 0x12}, 32),
+		common.RightPadBytes([]byte{0xab, 0x13}, 32),
+	}
+	value := func(i int) []byte {
+		v, _ := rlp.EncodeToBytes([]byte{byte(i + 1)})
+		return v
+	}
+	newValue, _ := rlp.EncodeToBytes([]byte{17})
+	input := makeConversionInput(t, len(keys), func(i int) []byte { return keys[i] }, value, newValue)
+	if len(input.proof1) != 3 || isBranch(input.proof1[0]) || !isBranch(input.proof1[1]) {
+		t.Fatalf("expected extension, branch and leaf: %v", input.proof1)
+	}
+
+	var statedb *state.StateDB // not needed when there is no modified extension node
+	nodes := convertProofToWitness(statedb, common.Address{}, nil, input.proof1, input.proof2, input.extNibblesS, input.extNibblesC,
+		common.BytesToHash(keys[0]), input.key, nil, false, false, false, input.isLastLeaf, AccountLayoutCurrent)
+
+	if len(nodes) != 2 || nodes[0].ExtensionBranch == nil || nodes[1].Storage == nil {
+		t.Fatalf("expected extension branch node and storage leaf, got %d nodes", len(nodes))
+	}
+	extensionBranch := nodes[0].ExtensionBranch
+	if !extensionBranch.IsExtension {
+		t.Fatal("branch under the root extension node is not marked as extension")
+	}
+	if !bytes.Equal(nodes[0].KeccakData[2], input.proof1[0]) || !bytes.Equal(nodes[0].KeccakData[3], input.proof2[0]) {
+		t.Fatal("root extension node missing in the keccak data")
+	}
+	// Extension nibbles a b 1, the key continues with nibble 2 in the branch:
+	if extensionBranch.Branch.ModifiedIndex != 2 {
+		t.Fatalf("wrong modified index %d", extensionBranch.Branch.ModifiedIndex)
+	}
+}
+
+// The account does not exist and its path ends in the root extension node: the key diverges
+// from the extension nibbles (a b 1) before the branch below it is reached.
+func TestConvertProofNonExistingExtension(t *testing.T) {
+	tr, err := trie.New(common.Hash{}, &trie.Database{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []byte{0x12, 0x13} {
+		v, _ := rlp.EncodeToBytes([]byte{b})
+		tr.Update(common.RightPadBytes([]byte{0xab, b}, 32), v)
+	}
+	extNibbles := [][]byte{{0xa, 0xb, 0x1}}
+
+	// The key diverges at the first and at the second nibble of the extension node:
+	for _, addrh := range [][]byte{common.RightPadBytes([]byte{0xcd}, 32), common.RightPadBytes([]byte{0xa5}, 32)} {
+		var proof testProofList
+		_, proofExtNibbles, isLastLeaf, _, err := tr.Prove(addrh, 0, &proof)
+		if err != nil || len(proof) != 1 || isBranch(proof[0]) {
+			t.Fatalf("expected the extension node only, got %d proof elements (%v)", len(proof), err)
+		}
+		if len(proofExtNibbles) != 1 || !bytes.Equal(proofExtNibbles[0], extNibbles[0]) {
+			t.Fatalf("wrong extension nibbles %v", proofExtNibbles)
+		}
+
+		var statedb *state.StateDB // not needed when there is no modified extension node
+		nodes := convertProofToWitness(statedb, common.Address{}, addrh, proof, proof, extNibbles, extNibbles,
+			common.Hash{}, trie.KeybytesToHex(addrh), nil, true, true, false, isLastLeaf, AccountLayoutCurrent)
+		if len(nodes) != 2 || nodes[0].ExtensionBranch == nil || nodes[1].Account == nil {
+			t.Fatalf("expected extension branch node and account leaf, got %d nodes", len(nodes))
+		}
+		extensionBranch := nodes[0].ExtensionBranch
+		if !extensionBranch.IsExtension || extensionBranch.IsPlaceholder != [2]bool{true, true} {
+			t.Fatalf("expected the extension node above the placeholder branch, got %+v", extensionBranch)
+		}
+		if !bytes.Equal(nodes[0].KeccakData[2], proof[0]) || !bytes.Equal(nodes[0].KeccakData[3], proof[0]) {
+			t.Fatal("extension node missing in the keccak data")
+		}
+		// The nibbles of the extension node are in the witness:
+		_, _, extValues := prepareExtensions(extNibbles, 0, proof[0], proof[0])
+		for j, row := range extValues {
+			if !bytes.Equal(nodes[0].Values[17+j], row) {
+				t.Fatalf("extension node row %d: got %v, want %v", j, nodes[0].Values[17+j], row)
+			}
+		}
+	}
+
+	// The proof of the key which is not diverging from the extension node is not accepted:
+	var proof testProofList
+	if _, _, _, _, err := tr.Prove(common.RightPadBytes([]byte{0xcd}, 32), 0, &proof); err != nil {
+		t.Fatal(err)
+	}
+	addrh := common.RightPadBytes([]byte{0xab, 0x12}, 32)
+	defer func() {
+		err, _ := recover().(error)
+		if !errors.Is(err, ErrKeyMismatch) {
+			t.Fatalf("expected ErrKeyMismatch, got %v", err)
+		}
+	}()
+	var statedb *state.StateDB
+	convertProofToWitness(statedb, common.Address{}, addrh, proof, proof, extNibbles, extNibbles,
+		common.Hash{}, trie.KeybytesToHex(addrh), nil, true, true, false, false, AccountLayoutCurrent)
+	t.Fatal("extension node matching the key of the non-existing proof not detected")
+}
+
+// The leaf is added into an empty slot of the existing branch: the C proof only appends the leaf
+// to the S proof. There is no placeholder branch, only the S leaf is a placeholder.
+func TestConvertProofLeafAppended(t *testing.T) {
+	keys := [][]byte{
+		common.RightPadBytes([]byte{0x30}, 32),
+		common.RightPadBytes([]byte{0x10}, 32),
+		common.RightPadBytes([]byte{0x20}, 32),
+	}
+	value := func(i int) []byte {
+		if i == 0 {
+			return nil // the key is not in the trie before the modification
+		}
+		v, _ := rlp.EncodeToBytes([]byte{byte(i + 1)})
+		return v
+	}
+	newValue, _ := rlp.EncodeToBytes([]byte{17})
+	input := makeConversionInput(t, len(keys), func(i int) []byte { return keys[i] }, value, newValue)
+	if len(input.proof1) != 1 || len(input.proof2) != 2 || !isBranch(input.proof1[0]) {
+		t.Fatalf("expected the branch in S and the branch and leaf in C: %d, %d", len(input.proof1), len(input.proof2))
+	}
+
+	var statedb *state.StateDB // not needed when there is no modified extension node
+	nodes := convertProofToWitness(statedb, common.Address{}, nil, input.proof1, input.proof2, input.extNibblesS, input.extNibblesC,
+		common.BytesToHash(keys[0]), input.key, nil, false, false, false, input.isLastLeaf, AccountLayoutCurrent)
+
+	if len(nodes) != 2 || nodes[0].ExtensionBranch == nil || nodes[1].Storage == nil {
+		t.Fatalf("expected branch and storage leaf, got %d nodes", len(nodes))
+	}
+	if nodes[0].ExtensionBranch.IsPlaceholder != [2]bool{false, false} || nodes[0].ExtensionBranch.Branch.ModifiedIndex != 3 {
+		t.Fatalf("unexpected branch %+v", nodes[0].ExtensionBranch)
+	}
+	if !bytes.Equal(nodes[1].KeccakData[1], input.proof2[1]) {
+		t.Fatal("C leaf missing in the keccak data")
+	}
+}
+
+// The nibbles of the root extension node do not match the key: the mismatch is detected
+// when the extension node is converted.
+func TestConvertProofExtensionKeyMismatch(t *testing.T) {
+	keys := [][]byte{
+		common.RightPadBytes([]byte{0xab, 0x12}, 32),
+		common.RightPadBytes([]byte{0xab, 0x13}, 32),
+	}
+	value := func(i int) []byte {
+		v, _ := rlp.EncodeToBytes([]byte{byte(i + 1)})
+		return v
+	}
+	newValue, _ := rlp.EncodeToBytes([]byte{17})
+	input := makeConversionInput(t, len(keys), func(i int) []byte { return keys[i] }, value, newValue)
+	// Extension nibbles a b 1:
+	input.extNibblesS[0][1] = 0xc
+
+	defer func() {
+		err, _ := recover().(error)
+		if !errors.Is(err, ErrKeyMismatch) || !errors.Is(err, ErrProofConvert) {
+			t.Fatalf("expected ErrKeyMismatch, got %v", err)
+		}
+	}()
+	var statedb *state.StateDB // not needed when there is no modified extension node
+	convertProofToWitness(statedb, common.Address{}, nil, input.proof1, input.proof2, input.extNibblesS, input.extNibblesC,
+		common.BytesToHash(keys[0]), input.key, nil, false, false, false, input.isLastLeaf, AccountLayoutCurrent)
+	t.Fatal("corrupted extension nibbles not detected")
+}
+
+// The leaves are shorter than 32 bytes and are thus inlined in the branch: the neighbour node is
+// the leaf itself, not a hash reference, and no preimage is to be looked up.
+func TestInlinedNeighbourNode(t *testing.T) {
+	tr, err := trie.New(common.Hash{}, &trie.Database{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Update([]byte{0x12, 0x34}, []byte{1})
+	tr.Update([]byte{0x12, 0x35}, []byte{2})
+
+	var proof testProofList
+	neighbourNode, _, _, isNeighbourNodeHashed, err := tr.Prove([]byte{0x12, 0x34}, 0, &proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isNeighbourNodeHashed {
+		t.Fatal("inlined neighbour node marked as hashed")
+	}
+	// The leaf at position 5 of the branch: the key has only the terminator nibble left.
+	inlinedLeaf := []byte{0xc2, 0x20, 0x02}
+	if !bytes.Equal(neighbourNode, inlinedLeaf) {
+		t.Fatalf("neighbour node: got %x, want %x", neighbourNode, inlinedLeaf)
+	}
+
+	lookups := 0
+	preimage = func(hash common.Hash) ([]byte, error) {
+		lookups++
+		return nil, nil
+	}
+	defer func() { preimage = oracle.Preimage }()
+
+	for _, isHashed := range []bool{false, true} {
+		if node := resolveNeighbourNode(neighbourNode, isHashed); !bytes.Equal(node, inlinedLeaf) {
+			t.Fatalf("inlined neighbour node changed: %x", node)
+		}
+	}
+	if lookups != 0 {
+		t.Fatalf("%d preimage lookups for an inlined node", lookups)
+	}
+
+	hashRef, _ := rlp.EncodeToBytes(crypto.Keccak256(inlinedLeaf))
+	resolveNeighbourNode(hashRef, true)
+	if lookups != 1 {
+		t.Fatalf("hash reference not resolved, %d lookups", lookups)
+	}
+}
+
+// Deleting the slot turns the branch with two leaves into the other leaf, the other leaf (the neighbour)
+// is needed in the witness.
+func TestMissingNeighbourPreimage(t *testing.T) {
+	storageValue := func(i int) []byte {
+		v, _ := rlp.EncodeToBytes([]byte{byte(i + 1)})
+		return v
+	}
+	input := makeConversionInput(t, 2,
+		func(i int) []byte { return crypto.Keccak256(slotKey(i).Bytes()) },
+		storageValue, nil)
+	if len(input.proof1) <= len(input.proof2) {
+		t.Fatalf("expected the deletion to shorten the proof: %d, %d", len(input.proof1), len(input.proof2))
+	}
+
+	preimage = func(hash common.Hash) ([]byte, error) {
+		return nil, errors.New("preimage not found")
+	}
+	defer func() { preimage = oracle.Preimage }()
+	hashRef, _ := rlp.EncodeToBytes(crypto.Keccak256(input.proof2[len(input.proof2)-1]))
+	neighbourNode := resolveNeighbourNode(hashRef, true)
+
+	err := func() (err error) {
+		defer recoverWitnessError(0, common.Address{}, &err)
+		var statedb *state.StateDB // not needed when there is no modified extension node
+		convertProofToWitness(statedb, common.Address{}, nil, input.proof1, input.proof2, input.extNibblesS, input.extNibblesC,
+			slotKey(0), input.key, neighbourNode, false, false, false, input.isLastLeaf, AccountLayoutCurrent)
+		return nil
+	}()
+	if !errors.Is(err, ErrMissingNeighbourPreimage) || !errors.Is(err, ErrProofConvert) {
+		t.Fatalf("expected ErrMissingNeighbourPreimage, got %v", err)
+	}
+}
+
+// singleSlotState returns the account leaf and the storage leaf of the state with a single account
+// (at addr) that has a single storage slot (key set to value), both leaves are the roots of their tries.
+func singleSlotState(addr common.Address, key, value common.Hash) (accountLeaf, storageLeaf []byte) {
+	shortLeaf := func(hashedKey, value []byte) []byte {
+		leaf, _ := rlp.EncodeToBytes([][]byte{append([]byte{0x20}, hashedKey...), value})
+		return leaf
+	}
+	storageValue, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(value.Bytes()))
+	storageLeaf = shortLeaf(crypto.Keccak256(key.Bytes()), storageValue)
+	account, _ := rlp.EncodeToBytes(state.Account{
+		Nonce:    1,
+		Balance:  big.NewInt(7),
+		Root:     crypto.Keccak256Hash(storageLeaf),
+		CodeHash: crypto.Keccak256(nil),
+	})
+
+	return shortLeaf(crypto.Keccak256(addr.Bytes()), account), storageLeaf
+}
+
+// setMemoryState makes the oracle serve the state with the given root (and trie nodes) in block 1
+// until the end of the test. The preimages of the next block are prefetched too, its state is the same.
+func setMemoryState(tb testing.TB, root common.Hash, nodes ...[]byte) {
+	provider := oracle.NewMemoryProvider()
+	provider.AddNodes(nodes...)
+	for n := int64(1); n <= 2; n++ {
+		provider.AddHeader(types.Header{Number: big.NewInt(n), Root: root, Difficulty: big.NewInt(0)})
+	}
+	oracle.SetProvider(provider)
+	tb.Cleanup(func() { oracle.SetProvider(nil) })
+}
+
+// The witness of a storage change is generated from the state served by an in-memory oracle
+// provider: both the state trie and the storage trie consist of a single leaf.
+func TestGetWitnessMemoryProvider(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x17"))
+	stateRoot := crypto.Keccak256Hash(accountLeaf)
+	setMemoryState(t, stateRoot, accountLeaf, storageLeaf)
+
+	newValue := common.HexToHash("0x2a")
+	result, err := GetWitnessResult("", 1, []TrieModification{NewStorageChange(addr, key, newValue)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := result.Nodes
+
+	if len(nodes) != 4 || nodes[0].Start == nil || nodes[1].Account == nil || nodes[2].Storage == nil {
+		t.Fatalf("expected start node, account leaf, storage leaf and end node, got %d nodes", len(nodes))
+	}
+	if nodes[0].Start.ProofType != "StorageChanged" || nodes[3].Start.ProofType != "Disabled" {
+		t.Fatalf("wrong proof types %s, %s", nodes[0].Start.ProofType, nodes[3].Start.ProofType)
+	}
+	newAccountLeaf, _ := singleSlotState(addr, key, newValue)
+	newStateRoot := crypto.Keccak256Hash(newAccountLeaf)
+	if !bytes.Equal(nodes[0].Values[0][1:33], stateRoot.Bytes()) || !bytes.Equal(nodes[0].Values[1][1:33], newStateRoot.Bytes()) {
+		t.Fatalf("wrong roots %x, %x", nodes[0].Values[0][1:33], nodes[0].Values[1][1:33])
+	}
+}
+
+// The storage trie with a single slot is the leaf only. The storage root in the account leaf is
+// the hash of the leaf (the root is never inlined, even when shorter than 32 bytes).
+func TestStorageSingleSlotTrie(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x01"))
+
+	for _, value := range []common.Hash{common.HexToHash("0x02"), {}} {
+		setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageLeaf)
+		result, err := GetWitnessResult("", 1, []TrieModification{NewStorageChange(addr, key, value)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes := result.Nodes
+
+		if len(nodes) != 4 || nodes[1].Account == nil || nodes[2].Storage == nil {
+			t.Fatalf("expected start node, account leaf, storage leaf and end node, got %d nodes", len(nodes))
+		}
+		if nodes[1].Account.StorageRootS != crypto.Keccak256Hash(storageLeaf) || !bytes.Equal(nodes[2].KeccakData[0], storageLeaf) {
+			t.Fatalf("storage root %x is not the hash of the storage leaf", nodes[1].Account.StorageRootS)
+		}
+		_, newStorageLeaf := singleSlotState(addr, key, value)
+		newStorageRoot := crypto.Keccak256Hash(newStorageLeaf)
+		if value == (common.Hash{}) {
+			// The slot is cleared, the storage trie is empty:
+			newStorageRoot = types.EmptyRootHash
+		}
+		if nodes[1].Account.StorageRootC != newStorageRoot {
+			t.Fatalf("storage root %x, expected %x", nodes[1].Account.StorageRootC, newStorageRoot)
+		}
+	}
+}
+
+// sameSlotModifications returns n modifications of the same storage slot in the state set by setMemoryState.
+func sameSlotModifications(tb testing.TB, n int) []TrieModification {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x17"))
+	setMemoryState(tb, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageLeaf)
+
+	trieModifications := make([]TrieModification, n)
+	for i := range trieModifications {
+		trieModifications[i] = NewStorageChange(addr, key, common.BigToHash(big.NewInt(int64(i+1))))
+	}
+
+	return trieModifications
+}
+
+// Two writes to the same slot are rejected unless AllowDuplicates is given, the second write is
+// then applied to the state after the first one.
+func TestDuplicateModification(t *testing.T) {
+	trieModifications := sameSlotModifications(t, 2)
+
+	_, err := GetWitnessResult("", 1, trieModifications)
+	if !errors.Is(err, ErrDuplicateModification) {
+		t.Fatalf("expected ErrDuplicateModification, got %v", err)
+	}
+	if _, err := GetWitnessResult("", 1, trieModifications[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := GetWitnessResult("", 1, trieModifications, AllowDuplicates())
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := SplitByModification(result.Nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("expected the witness of 2 modifications, got %d", len(segments))
+	}
+	if !bytes.Equal(segments[1][0].Values[0], segments[0][0].Values[1]) {
+		t.Fatal("the second write does not start from the state after the first one")
+	}
+}
+
+func TestIntermediateRoots(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x17"))
+	stateRoot := crypto.Keccak256Hash(accountLeaf)
+	setMemoryState(t, stateRoot, accountLeaf, storageLeaf)
+
+	trieModifications := []TrieModification{
+		NewNonceChange(addr, 2),
+		NewBalanceChange(addr, big.NewInt(9)),
+		NewStorageChange(addr, key, common.HexToHash("0x2a")),
+	}
+	result, err := GetWitnessResult("", 1, trieModifications)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.IntermediateRoots) != len(trieModifications) {
+		t.Fatalf("expected %d intermediate roots, got %d", len(trieModifications), len(result.IntermediateRoots))
+	}
+
+	segments, err := SplitByModification(result.Nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each root is the C root of the modification and the S root of the next one:
+	prev := stateRoot
+	for i, root := range result.IntermediateRoots {
+		start := segments[i][0]
+		if !bytes.Equal(start.Values[0][1:33], prev.Bytes()) || !bytes.Equal(start.Values[1][1:33], root.Bytes()) {
+			t.Fatalf("modification %d: roots %x, %x do not chain from %x to %x", i, start.Values[0][1:33], start.Values[1][1:33], prev, root)
+		}
+		if root == prev {
+			t.Fatalf("modification %d does not change the root", i)
+		}
+		prev = root
+	}
+}
+
+func TestWithHeaderRootCheck(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x17"))
+	stateRoot := crypto.Keccak256Hash(accountLeaf)
+	setMemoryState(t, stateRoot, accountLeaf, storageLeaf)
+
+	result, err := GetWitnessResult("", 1, []TrieModification{NewStorageChange(addr, key, common.HexToHash("0x2a"))}, WithHeaderRootCheck())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The header of the state the witness does not start from:
+	otherLeaf, _ := singleSlotState(addr, key, common.HexToHash("0x18"))
+	if err := checkHeaderRoot(result.Nodes, crypto.Keccak256Hash(otherLeaf)); !errors.Is(err, ErrHeaderRootMismatch) {
+		t.Fatalf("expected ErrHeaderRootMismatch, got %v", err)
+	}
+	if err := checkHeaderRoot(result.Nodes, stateRoot); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The rows of the chained witness (with the trimmed boundary) are indexed contiguously,
+// the node indices do not decrease and the row of each node starts at 0.
+func TestWithRowIndices(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x17"))
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageLeaf)
+
+	result, err := GetWitnessResult("", 1, []TrieModification{
+		NewStorageChange(addr, key, common.HexToHash("0x2a")),
+		NewStorageChange(addr, key, common.HexToHash("0x2b")),
+		NewNonceChange(addr, 2),
+	}, WithRowIndices(), WithoutRedundantBoundaries(), AllowDuplicates())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := FlattenNodes(result.Nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rows) != len(rows) {
+		t.Fatalf("%d indexed rows, %d rows", len(result.Rows), len(rows))
+	}
+	for i, row := range result.Rows {
+		if row.Index != i || !bytes.Equal(row.Row, rows[i]) {
+			t.Fatalf("row %d has index %d: %x", i, row.Index, row.Row)
+		}
+		if i == 0 {
+			if row.Node != 0 || row.NodeRow != 0 {
+				t.Fatalf("first row at node %d, row %d", row.Node, row.NodeRow)
+			}
+			continue
+		}
+		prev := result.Rows[i-1]
+		sameNode := row.Node == prev.Node && row.NodeRow == prev.NodeRow+1
+		nextNode := row.Node == prev.Node+1 && row.NodeRow == 0
+		if !sameNode && !nextNode {
+			t.Fatalf("row %d at node %d, row %d follows node %d, row %d", i, row.Node, row.NodeRow, prev.Node, prev.NodeRow)
+		}
+	}
+
+	result, err = GetWitnessResult("", 1, []TrieModification{NewNonceChange(addr, 3)})
+	if err != nil || result.Rows != nil {
+		t.Fatalf("rows without WithRowIndices: %d (%v)", len(result.Rows), err)
+	}
+}
+
+// countKeccak counts the key derivations (the keccak calls hashing an address or a storage key,
+// not the ones hashing the proof nodes) until the test ends.
+func countKeccak(tb testing.TB) *int {
+	calls := 0
+	SetKeccak(func(data []byte) []byte {
+		if len(data) == common.AddressLength || len(data) == common.HashLength {
+			calls++
+		}
+		return crypto.Keccak256(data)
+	})
+	tb.Cleanup(func() { SetKeccak(nil) })
+
+	return &calls
+}
+
+// The address and the storage key are hashed only once for all the modifications of the call.
+func TestKeyCache(t *testing.T) {
+	trieModifications := sameSlotModifications(t, 10)
+	calls := countKeccak(t)
+
+	if _, err := GetWitnessResult("", 1, trieModifications, AllowDuplicates()); err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 2 {
+		t.Fatalf("expected 2 keccak calls (the address and the storage key), got %d", *calls)
+	}
+}
+
+func BenchmarkSameSlotModifications(b *testing.B) {
+	trieModifications := sameSlotModifications(b, 100)
+	calls := countKeccak(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := GetWitnessResult("", 1, trieModifications, AllowDuplicates()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(*calls)/float64(b.N), "keccak/op")
+}
+
+// The first account is created in the empty state trie: the S leaf is a placeholder, the C leaf
+// is the root of the trie.
+func TestAccountCreateEmptyTrie(t *testing.T) {
+	setMemoryState(t, types.EmptyRootHash)
+
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	result, err := GetWitnessResult("", 1, []TrieModification{NewAccountCreate(addr)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := result.Nodes
+	if len(nodes) != 3 || nodes[1].Account == nil {
+		t.Fatalf("expected start node, account leaf and end node, got %d nodes", len(nodes))
+	}
+	if !bytes.Equal(nodes[0].Values[0][1:33], types.EmptyRootHash.Bytes()) {
+		t.Fatalf("S root is not the empty trie root: %x", nodes[0].Values[0][1:33])
+	}
+	cRoot := nodes[0].Values[1][1:33]
+	leaf := nodes[1]
+	if !bytes.Equal(crypto.Keccak256(leaf.KeccakData[1]), cRoot) {
+		t.Fatal("C leaf is not the root of the C trie")
+	}
+
+	account := leaf.Account
+	if account.StorageRootS != (common.Hash{}) || account.CodeHashS != (common.Hash{}) {
+		t.Fatalf("S placeholder leaf has storage root %x, code hash %x", account.StorageRootS, account.CodeHashS)
+	}
+	for _, ind := range []AccountRowType{AccountNonceS, AccountBalanceS, AccountStorageS, AccountCodehashS} {
+		if !bytes.Equal(leaf.Values[ind], make([]byte, valueLen)) {
+			t.Fatalf("S placeholder row %d not empty: %v", ind, leaf.Values[ind])
+		}
+	}
+	if account.StorageRootC != types.EmptyRootHash || account.CodeHashC != common.BytesToHash(crypto.Keccak256(nil)) {
+		t.Fatalf("C leaf has storage root %x, code hash %x", account.StorageRootC, account.CodeHashC)
+	}
+}
+
+// The account is created fresh in the state trie with other accounts, and re-created at the address
+// of the destructed account with storage and code: in both cases the C leaf is the empty account.
+func TestAccountCreateEmptyStorageAndCode(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	// The addresses with the distinct first nibble of the hashed address, all leaves are in the root branch:
+	addresses := []common.Address{addr}
+	used := map[byte]bool{crypto.Keccak256(addr.Bytes())[0] / 16: true}
+	for i := int64(1); len(addresses) < 4; i++ {
+		a := common.BigToAddress(big.NewInt(i))
+		if nibble := crypto.Keccak256(a.Bytes())[0] / 16; !used[nibble] {
+			used[nibble] = true
+			addresses = append(addresses, a)
+		}
+	}
+	fresh := addresses[3]
+
+	// The accounts (with storage and code) at the first three addresses:
+	children := make(map[int]common.Hash)
+	var leaves [][]byte
+	for _, a := range addresses[:3] {
+		addrh := crypto.Keccak256(a.Bytes())
+		account, _ := rlp.EncodeToBytes(state.Account{
+			Nonce:    3,
+			Balance:  big.NewInt(7),
+			Root:     common.HexToHash("0x5555"),
+			CodeHash: crypto.Keccak256([]byte("code")),
+		})
+		leaf, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(trie.KeybytesToHex(addrh)[1:]), account})
+		leaves = append(leaves, leaf)
+		children[int(addrh[0]/16)] = crypto.Keccak256Hash(leaf)
+	}
+	root := makeBranch(t, children)
+
+	checkEmptyAccount := func(nodes []Node) {
+		leaf := lastAccountNode(t, nodes)
+		if leaf.Account.StorageRootC != types.EmptyRootHash || leaf.Account.CodeHashC != crypto.Keccak256Hash(nil) {
+			t.Fatalf("C leaf has storage root %x, code hash %x", leaf.Account.StorageRootC, leaf.Account.CodeHashC)
+		}
+		if !bytes.Equal(leaf.Values[AccountStorageC][1:33], types.EmptyRootHash.Bytes()) ||
+			!bytes.Equal(leaf.Values[AccountCodehashC][1:33], crypto.Keccak256(nil)) {
+			t.Fatal("C storage root and code hash rows are not the empty trie root and the empty code hash")
+		}
+		var elems [][]byte
+		if err := rlp.DecodeBytes(leaf.KeccakData[1], &elems); err != nil || len(elems) != 2 {
+			t.Fatalf("C leaf is not a leaf: %v", err)
+		}
+		var account state.Account
+		if err := rlp.DecodeBytes(elems[1], &account); err != nil {
+			t.Fatal(err)
+		}
+		if account.Nonce != 0 || account.Balance.Sign() != 0 {
+			t.Fatalf("C leaf has nonce %d, balance %s", account.Nonce, account.Balance)
+		}
+	}
+
+	for _, trieModifications := range [][]TrieModification{
+		{NewAccountCreate(fresh)},
+		{NewAccountDestruct(addr), NewAccountCreate(addr)},
+	} {
+		setMemoryState(t, crypto.Keccak256Hash(root), append([][]byte{root}, leaves...)...)
+		result, err := GetWitnessResult("", 1, trieModifications)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkEmptyAccount(result.Nodes)
+	}
+}
+
+// The storage trie is a branch with two leaves: the neighbour of the updated leaf is needed only
+// when the slot is deleted (the branch turns into the other leaf), its preimage is not looked up
+// for the plain update.
+func TestNeighbourPreimageSkippedForUpdate(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	var keys []common.Hash
+	var leaves [][]byte
+	children := make(map[int]common.Hash)
+	for i := 0; len(keys) < 2; i++ {
+		keyh := crypto.Keccak256(slotKey(i).Bytes())
+		if _, ok := children[int(keyh[0]/16)]; ok {
+			continue
+		}
+		value, _ := rlp.EncodeToBytes([]byte{byte(i + 1)})
+		leaf, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(trie.KeybytesToHex(keyh)[1:]), value})
+		keys = append(keys, slotKey(i))
+		leaves = append(leaves, leaf)
+		children[int(keyh[0]/16)] = crypto.Keccak256Hash(leaf)
+	}
+	storageRoot := makeBranch(t, children)
+	account, _ := rlp.EncodeToBytes(state.Account{
+		Nonce:    1,
+		Balance:  big.NewInt(7),
+		Root:     crypto.Keccak256Hash(storageRoot),
+		CodeHash: crypto.Keccak256(nil),
+	})
+	accountLeaf, _ := rlp.EncodeToBytes([][]byte{
+		trie.HexToCompact(trie.KeybytesToHex(crypto.Keccak256(addr.Bytes()))), account})
+
+	neighbour := crypto.Keccak256Hash(leaves[1])
+	lookups := 0
+	preimage = func(hash common.Hash) ([]byte, error) {
+		if hash == neighbour {
+			lookups++
+		}
+		return oracle.Preimage(hash)
+	}
+	defer func() { preimage = oracle.Preimage }()
+
+	for _, tc := range []struct {
+		value   common.Hash
+		lookups int
+	}{
+		{common.HexToHash("0x2a"), 0},
+		{common.Hash{}, 1},
+	} {
+		lookups = 0
+		setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageRoot, leaves[0], leaves[1])
+		if _, err := GetWitnessResult("", 1, []TrieModification{NewStorageChange(addr, keys[0], tc.value)}); err != nil {
+			t.Fatal(err)
+		}
+		if lookups != tc.lookups {
+			t.Fatalf("value %x: %d neighbour preimage lookups, expected %d", tc.value, lookups, tc.lookups)
+		}
+	}
+}
+
+// The build is aborted once it needs more oracle calls than the budget, the budget of the calls
+// an unlimited build needs is enough.
+func TestWithMaxOracleCalls(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x17"))
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageLeaf)
+	trieModifications := []TrieModification{NewStorageChange(addr, key, common.HexToHash("0x2a"))}
+
+	calls := oracle.ProviderCalls()
+	if _, err := GetWitnessResult("", 1, trieModifications); err != nil {
+		t.Fatal(err)
+	}
+	calls = oracle.ProviderCalls() - calls
+	if calls < 2 {
+		t.Fatalf("expected at least 2 oracle calls, got %d", calls)
+	}
+
+	_, err := GetWitnessResult("", 1, trieModifications, WithMaxOracleCalls(1))
+	var witnessErr *WitnessError
+	if !errors.Is(err, ErrOracleBudgetExceeded) || !errors.As(err, &witnessErr) || witnessErr.Kind != ErrOracleBudgetExceeded {
+		t.Fatalf("expected ErrOracleBudgetExceeded, got %v", err)
+	}
+
+	if _, err := GetWitnessResult("", 1, trieModifications, WithMaxOracleCalls(calls)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// EIP-158: the nonce change that leaves the account with zero nonce, zero balance and no code
+// deletes the account. The state root branch of two accounts collapses into the leaf of the other
+// account, as for AccountDestructed.
+func TestEmptiedAccountDeleted(t *testing.T) {
+	var addrs []common.Address
+	var accounts, leaves [][]byte
+	children := make(map[int]common.Hash)
+	for i := int64(1); len(addrs) < 2; i++ {
+		addr := common.BigToAddress(big.NewInt(i))
+		addrh := crypto.Keccak256(addr.Bytes())
+		if _, ok := children[int(addrh[0]/16)]; ok {
+			continue
+		}
+		// The first account has only the nonce set, the second one has the balance too:
+		account, _ := rlp.EncodeToBytes(state.Account{
+			Nonce:    1,
+			Balance:  big.NewInt(7 * int64(len(addrs))),
+			Root:     common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421"),
+			CodeHash: crypto.Keccak256(nil),
+		})
+		leaf, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(trie.KeybytesToHex(addrh)[1:]), account})
+		addrs = append(addrs, addr)
+		accounts = append(accounts, account)
+		leaves = append(leaves, leaf)
+		children[int(addrh[0]/16)] = crypto.Keccak256Hash(leaf)
+	}
+	stateRoot := makeBranch(t, children)
+	setMemoryState(t, crypto.Keccak256Hash(stateRoot), stateRoot, leaves[0], leaves[1])
+
+	result, err := GetWitnessResult("", 1, []TrieModification{NewNonceChange(addrs[0], 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Nodes[0].Start.ProofType != "AccountDestructed" {
+		t.Fatalf("expected AccountDestructed witness, got %s", result.Nodes[0].Start.ProofType)
+	}
+
+	// The remaining account is the only leaf of the state trie (with the full key):
+	addrh := crypto.Keccak256(addrs[1].Bytes())
+	collapsed, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(trie.KeybytesToHex(addrh)), accounts[1]})
+	if result.IntermediateRoots[0] != crypto.Keccak256Hash(collapsed) {
+		t.Fatalf("expected the collapsed state root %x, got %x", crypto.Keccak256Hash(collapsed), result.IntermediateRoots[0])
+	}
+	branch := result.Nodes[1].ExtensionBranch.Branch
+	if branch.ModifiedIndex != int(crypto.Keccak256(addrs[0].Bytes())[0]/16) || branch.DriftedIndex != int(addrh[0]/16) {
+		t.Fatalf("wrong placeholder branch positions: modified %d, drifted %d", branch.ModifiedIndex, branch.DriftedIndex)
+	}
+}
+
+// The deletion of one of the two accounts below the extension node at the root: the extension node
+// and the branch collapse, the remaining account leaf (with the full key) is the root of the state trie.
+// The witness has the placeholder C branch (with the extension node) and the C root is the hash
+// of the remaining leaf.
+func TestAccountDeletedLeafBecomesRoot(t *testing.T) {
+	// The addresses with the same first two nibbles of the hashed address:
+	addrs := []common.Address{common.BigToAddress(big.NewInt(1))}
+	first := crypto.Keccak256(addrs[0].Bytes())[0]
+	for i := int64(2); len(addrs) < 2; i++ {
+		addr := common.BigToAddress(big.NewInt(i))
+		if crypto.Keccak256(addr.Bytes())[0] == first {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	tr, err := trie.New(common.Hash{}, &trie.Database{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accounts [][]byte
+	for i, addr := range addrs {
+		account, _ := rlp.EncodeToBytes(state.Account{
+			Nonce:    1,
+			Balance:  big.NewInt(int64(7 + i)),
+			Root:     types.EmptyRootHash,
+			CodeHash: crypto.Keccak256(nil),
+		})
+		accounts = append(accounts, account)
+		if err := tr.TryUpdate(crypto.Keccak256(addr.Bytes()), account); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var nodes [][]byte
+	for _, addr := range addrs {
+		err := tr.ProveEach(crypto.Keccak256(addr.Bytes()), func(level int, proofEl []byte) error {
+			nodes = append(nodes, common.CopyBytes(proofEl))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setMemoryState(t, tr.Hash(), nodes...)
+
+	result, err := GetWitnessResult("", 1, []TrieModification{NewAccountDestruct(addrs[0])}, WithRawProofs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := result.RawProofs[0]
+	if len(proof.AccountProofS) != 3 || len(proof.AccountProofC) != 1 {
+		t.Fatalf("expected the S proof of the extension node, branch and leaf and the C proof of the root leaf, got %d and %d elements",
+			len(proof.AccountProofS), len(proof.AccountProofC))
+	}
+
+	addrh := crypto.Keccak256(addrs[1].Bytes())
+	collapsed, _ := rlp.EncodeToBytes([][]byte{trie.HexToCompact(trie.KeybytesToHex(addrh)), accounts[1]})
+	if !bytes.Equal(proof.AccountProofC[0], collapsed) {
+		t.Fatalf("C proof is not the remaining leaf with the full key: %x", proof.AccountProofC[0])
+	}
+	cRoot := crypto.Keccak256Hash(collapsed)
+	if result.IntermediateRoots[0] != cRoot || !bytes.Equal(result.Nodes[0].Values[1][1:33], cRoot.Bytes()) {
+		t.Fatalf("expected the C root %s, got %s (start node %x)", cRoot, result.IntermediateRoots[0], result.Nodes[0].Values[1][1:33])
+	}
+
+	eb := result.Nodes[1].ExtensionBranch
+	if eb == nil || !eb.IsExtension || !eb.IsPlaceholder[1] {
+		t.Fatalf("expected the placeholder C branch with the extension node, got %+v", eb)
+	}
+	if eb.Branch.ModifiedIndex != int(crypto.Keccak256(addrs[0].Bytes())[1]/16) || eb.Branch.DriftedIndex != int(addrh[1]/16) {
+		t.Fatalf("wrong placeholder branch positions: modified %d, drifted %d", eb.Branch.ModifiedIndex, eb.Branch.DriftedIndex)
+	}
+	if len(result.Nodes) != 4 || result.Nodes[2].Account == nil {
+		t.Fatalf("expected start node, branch, account leaf and end node, got %d nodes", len(result.Nodes))
+	}
+	if _, err := FlattenNodes(result.Nodes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingProvider counts the account and storage prefetches served by the wrapped provider.
+type countingProvider struct {
+	oracle.Provider
+	accounts map[common.Address]int
+	slots    map[common.Hash]int
+}
+
+func (p *countingProvider) PrefetchAccount(blockNumber *big.Int, addr common.Address, postProcess func(map[common.Hash][]byte)) []string {
+	p.accounts[addr]++
+	return p.Provider.PrefetchAccount(blockNumber, addr, postProcess)
+}
+
+func (p *countingProvider) PrefetchStorage(blockNumber *big.Int, addr common.Address, skey common.Hash, postProcess func(map[common.Hash][]byte)) []string {
+	p.slots[skey]++
+	return p.Provider.PrefetchStorage(blockNumber, addr, skey, postProcess)
+}
+
+// The modifications of the same account are applied to the same state one after another: the witnesses
+// chain and the account (and each slot) is prefetched only once by the witness generation (the state
+// prefetches the account too when it loads it), a further storage modification of the account does
+// not prefetch the account again.
+func TestSameAccountRunPrefetchedOnce(t *testing.T) {
+	root, nodes := exampleState()
+	memory := oracle.NewMemoryProvider()
+	memory.AddNodes(nodes...)
+	for n := int64(1); n <= 2; n++ {
+		memory.AddHeader(types.Header{Number: big.NewInt(n), Root: root, Difficulty: big.NewInt(0)})
+	}
+	t.Cleanup(func() { oracle.SetProvider(nil) })
+	run := func(trieModifications []TrieModification) (WitnessResult, *countingProvider) {
+		provider := &countingProvider{Provider: memory, accounts: make(map[common.Address]int), slots: make(map[common.Hash]int)}
+		oracle.SetProvider(provider)
+		result, err := GetWitnessResult("", 1, trieModifications)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result, provider
+	}
+
+	key1, key2 := common.HexToHash("0x11"), common.HexToHash("0x12")
+	trieModifications := []TrieModification{
+		NewAccountCreate(exampleAbsent),
+		NewNonceChange(exampleAbsent, 1),
+		NewStorageChange(exampleAbsent, key1, common.HexToHash("0x2a")),
+		NewStorageChange(exampleAbsent, key2, common.HexToHash("0x2b")),
+	}
+	result, provider := run(trieModifications)
+
+	segments, err := SplitByModification(result.Nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != len(trieModifications) {
+		t.Fatalf("expected %d modifications, got %d", len(trieModifications), len(segments))
+	}
+	prev := root
+	for i, segment := range segments {
+		start := segment[0]
+		if !bytes.Equal(start.Values[0][1:33], prev.Bytes()) || !bytes.Equal(start.Values[1][1:33], result.IntermediateRoots[i].Bytes()) {
+			t.Fatalf("modification %d: roots %x, %x do not chain from %x to %x", i, start.Values[0][1:33], start.Values[1][1:33], prev, result.IntermediateRoots[i])
+		}
+		prev = result.IntermediateRoots[i]
+	}
+
+	_, shorter := run(trieModifications[:3])
+	if provider.accounts[exampleAbsent] != shorter.accounts[exampleAbsent] {
+		t.Fatalf("the second storage modification prefetched the account again: %d prefetches, %d without it",
+			provider.accounts[exampleAbsent], shorter.accounts[exampleAbsent])
+	}
+	if provider.slots[key2] != shorter.slots[key1] {
+		t.Fatalf("the slots are prefetched %d and %d times", shorter.slots[key1], provider.slots[key2])
+	}
+}
+
+// Setting the slot to zero deletes it from the storage trie, the C proof does not reach the leaf.
+// The slot that has never been written is proven by the non-existence witness, both proofs are
+// the same - as they are when zero is written to it.
+func TestStorageZeroValue(t *testing.T) {
+	root, nodes := exampleState()
+	setMemoryState(t, root, nodes...)
+	slot := func(i int64) common.Hash { return common.BigToHash(big.NewInt(i)) }
+
+	result, err := GetWitnessResult("", 1, []TrieModification{
+		NewStorageChange(exampleContract, slot(3), common.Hash{}),
+		NewStorageNonExistence(exampleContract, slot(4)),
+		NewStorageChange(exampleContract, slot(4), common.Hash{}),
+	}, WithRawProofs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := SplitByModification(result.Nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, deletedProof := segments[0][0].Start, result.RawProofs[0]
+	if deleted.ProofType != "StorageChanged" || deleted.IsNoOp {
+		t.Fatalf("expected the storage change, got %+v", deleted)
+	}
+	if len(deletedProof.StorageProofC) >= len(deletedProof.StorageProofS) ||
+		!isLeafNode(deletedProof.StorageProofS[len(deletedProof.StorageProofS)-1]) {
+		t.Fatalf("the slot has not been deleted: %d S and %d C storage proof elements",
+			len(deletedProof.StorageProofS), len(deletedProof.StorageProofC))
+	}
+
+	for i, proofType := range []string{"StorageDoesNotExist", "StorageChanged"} {
+		start, proof := segments[i+1][0].Start, result.RawProofs[i+1]
+		if start.ProofType != proofType {
+			t.Fatalf("modification %d: expected %s, got %s", i+1, proofType, start.ProofType)
+		}
+		if len(proof.StorageProofS) != len(proof.StorageProofC) ||
+			!bytes.Equal(segments[i+1][0].Values[0][1:33], segments[i+1][0].Values[1][1:33]) {
+			t.Fatalf("modification %d: the trie of the slot that is not set has changed", i+1)
+		}
+	}
+	if !segments[2][0].Start.IsNoOp {
+		t.Fatal("writing zero to the slot that is not set is not a no-op")
+	}
+}
+
+// Writing zero into the slot that does not exist leaves the storage trie unchanged, the S and C
+// proofs end with the leaf of another slot (as the non-existence proof of the slot does). The leaf
+// is converted as the wrong leaf: the row StorageWrong holds the queried key, as in the
+// non-existence proof.
+func TestStorageZeroWriteToUnsetSlot(t *testing.T) {
+	root, nodes := exampleState()
+	slot := common.BigToHash(big.NewInt(49))
+	leafOf := func(tMod TrieModification) Node {
+		setMemoryState(t, root, nodes...)
+		result, err := GetWitnessResult("", 1, []TrieModification{tMod})
+		if err != nil {
+			t.Fatalf("%s of value %s: %v", proofTypeNames[tMod.Type], tMod.Value, err)
+		}
+		leaf := result.Nodes[len(result.Nodes)-2]
+		if leaf.Storage == nil {
+			t.Fatalf("%s of value %s: no storage leaf before the end node", proofTypeNames[tMod.Type], tMod.Value)
+		}
+		return leaf
+	}
+
+	nonExisting := leafOf(NewStorageNonExistence(exampleContract, slot))
+	zeroWrite := leafOf(NewStorageChange(exampleContract, slot, common.Hash{}))
+	if bytes.Equal(nonExisting.Values[StorageWrong], prepareEmptyNonExistingStorageRow()) {
+		t.Fatal("the non-existence proof has no StorageWrong row")
+	}
+	for _, row := range []StorageRowType{StorageKeyS, StorageKeyC, StorageWrong} {
+		if !bytes.Equal(zeroWrite.Values[row], nonExisting.Values[row]) {
+			t.Fatalf("row %d: %x, the non-existence proof has %x", row, zeroWrite.Values[row], nonExisting.Values[row])
+		}
+	}
+	if !bytes.Equal(zeroWrite.Storage.WrongRlpBytes, nonExisting.Storage.WrongRlpBytes) {
+		t.Fatalf("wrong leaf RLP bytes %x, the non-existence proof has %x", zeroWrite.Storage.WrongRlpBytes, nonExisting.Storage.WrongRlpBytes)
+	}
+
+	// Writing the value creates the leaf of the slot, there is no wrong leaf:
+	set := leafOf(NewStorageChange(exampleContract, slot, common.HexToHash("0x2a")))
+	if !bytes.Equal(set.Values[StorageWrong], prepareEmptyNonExistingStorageRow()) || set.Storage.WrongRlpBytes != nil {
+		t.Fatalf("unexpected wrong leaf row %x", set.Values[StorageWrong])
+	}
+}
@@ -0,0 +1,57 @@
+package witness
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// StorageRootChange is the change of the storage root field of the account leaf by a storage
+// modification (see WithStorageRootChanges): S and C are the storage roots in the S and C account
+// leaf of the witness, which are the roots of the S and C storage proofs.
+type StorageRootChange struct {
+	Index   int            `json:"index"`
+	Address common.Address `json:"address"`
+	Key     common.Hash    `json:"key"`
+	S       common.Hash    `json:"s"`
+	C       common.Hash    `json:"c"`
+}
+
+// storageRootChanges returns the storage root changes of the storage witnesses among the witnesses
+// of the modification index (nodes), proofs are the raw proofs of the witnesses (one per witness).
+// ErrStorageRootMismatch is returned when the storage roots in the account leaf are not the roots
+// of the storage proofs.
+func storageRootChanges(index int, nodes []Node, proofs []RawProof) ([]StorageRootChange, error) {
+	segments, err := SplitByModification(nodes)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) != len(proofs) {
+		return nil, fmt.Errorf("modification %d: %d witnesses and %d proofs", index, len(segments), len(proofs))
+	}
+
+	var changes []StorageRootChange
+	for i, segment := range segments {
+		if proofType := segment[0].Start.ProofType; proofType != "StorageChanged" && proofType != "StorageDoesNotExist" {
+			continue
+		}
+		var account *AccountNode
+		for _, node := range segment {
+			if node.Account != nil {
+				account = node.Account
+			}
+		}
+		if account == nil {
+			return nil, fmt.Errorf("modification %d: no account leaf in the storage witness", index)
+		}
+
+		change := StorageRootChange{Index: index, Address: proofs[i].Address, Key: proofs[i].Key, S: account.StorageRootS, C: account.StorageRootC}
+		if s, c := proofRoot(proofs[i].StorageProofS), proofRoot(proofs[i].StorageProofC); s != change.S || c != change.C {
+			return nil, fmt.Errorf("%w: modification %d: storage proof roots %s, %s, account storage roots %s, %s",
+				ErrStorageRootMismatch, index, s, c, change.S, change.C)
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
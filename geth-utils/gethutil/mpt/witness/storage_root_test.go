@@ -0,0 +1,74 @@
+package witness
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// The storage root field of the account leaf changes from the root of the storage trie before
+// the storage modification to the root after it.
+func TestWithStorageRootChanges(t *testing.T) {
+	root, nodes := exampleState()
+	setMemoryState(t, root, nodes...)
+	slot := func(i int64) common.Hash { return common.BigToHash(big.NewInt(i)) }
+
+	// The storage trie of the example contract, updated alongside the witness:
+	storage, err := trie.New(common.Hash{}, &trie.Database{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setSlot := func(i, v int64) common.Hash {
+		value, _ := rlp.EncodeToBytes(big.NewInt(v))
+		if err := storage.TryUpdate(crypto.Keccak256(slot(i).Bytes()), value); err != nil {
+			t.Fatal(err)
+		}
+		return storage.Hash()
+	}
+	for i := int64(1); i <= 3; i++ {
+		setSlot(i, i)
+	}
+	expected := []StorageRootChange{
+		{Index: 0, Address: exampleContract, Key: slot(1), S: storage.Hash(), C: setSlot(1, 0x2a)},
+	}
+	expected = append(expected, StorageRootChange{Index: 2, Address: exampleContract, Key: slot(2), S: expected[0].C, C: setSlot(2, 0x2b)})
+
+	result, err := GetWitnessResult("", 1, []TrieModification{
+		NewStorageChange(exampleContract, slot(1), common.HexToHash("0x2a")),
+		NewNonceChange(exampleEOA, 5),
+		NewAccountAndStorageChange(exampleContract, 2, nil, slot(2), common.HexToHash("0x2b")),
+	}, WithStorageRootChanges())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.StorageRootChanges) != len(expected) {
+		t.Fatalf("got %d storage root changes, want %d", len(result.StorageRootChanges), len(expected))
+	}
+	for i, change := range result.StorageRootChanges {
+		if change != expected[i] {
+			t.Fatalf("storage root change %d: got %+v, want %+v", i, change, expected[i])
+		}
+	}
+	if result.RawProofs != nil {
+		t.Fatal("raw proofs attached without WithRawProofs")
+	}
+
+	// The storage proof that is not the proof of the account storage trie:
+	result, err = GetWitnessResult("", 1, []TrieModification{
+		NewStorageChange(exampleContract, slot(1), common.HexToHash("0x2a")),
+	}, WithRawProofs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := result.RawProofs[0]
+	proof.StorageProofC = proof.StorageProofS
+	if _, err := storageRootChanges(0, result.Nodes, []RawProof{proof}); !errors.Is(err, ErrStorageRootMismatch) {
+		t.Fatalf("expected ErrStorageRootMismatch, got %v", err)
+	}
+}
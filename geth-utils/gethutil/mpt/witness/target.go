@@ -0,0 +1,69 @@
+package witness
+
+import (
+	"errors"
+	"fmt"
+)
+
+// WitnessTarget is the trie the witness is generated for, see GenerateWitnessFor.
+type WitnessTarget int
+
+const (
+	// TargetState is the state trie: the account modifications.
+	TargetState WitnessTarget = iota
+	// TargetStorage is the storage tries of the accounts: the storage modifications (the witness
+	// proves the account too).
+	TargetStorage
+	// TargetTransaction is the transaction trie of the block.
+	TargetTransaction
+	// TargetReceipt is the receipt trie of the block.
+	TargetReceipt
+	// TargetWithdrawal is the withdrawal trie of the block.
+	TargetWithdrawal
+)
+
+func (t WitnessTarget) String() string {
+	switch t {
+	case TargetState:
+		return "state"
+	case TargetStorage:
+		return "storage"
+	case TargetTransaction:
+		return "transaction"
+	case TargetReceipt:
+		return "receipt"
+	case TargetWithdrawal:
+		return "withdrawal"
+	}
+	return fmt.Sprintf("WitnessTarget(%d)", int(t))
+}
+
+// ErrUnsupportedTarget is returned by GenerateWitnessFor for the tries there is no witness builder for.
+var ErrUnsupportedTarget = errors.New("no witness builder for the trie")
+
+// GenerateWitnessFor generates the witness of the modifications of the target trie in the block,
+// the modifications need to be of the target trie. The state and storage witnesses are generated
+// by GetWitnessResult (with the options). The transaction, receipt and withdrawal tries have no
+// witness builder yet, ErrUnsupportedTarget is returned for them: their leaves are keyed by the RLP
+// of the index and hold values longer than 32 bytes, which the leaf rows cannot represent. The raw
+// proof of a withdrawal is returned by GetWithdrawalProof.
+func GenerateWitnessFor(target WitnessTarget, nodeUrl string, blockNum int, trieModifications []TrieModification, opts ...WitnessOption) ([]Node, error) {
+	switch target {
+	case TargetState, TargetStorage:
+		for i, tMod := range trieModifications {
+			isStorage := tMod.Type == StorageChanged || tMod.Type == StorageDoesNotExist || tMod.Type == AccountAndStorageChange
+			if isStorage != (target == TargetStorage) {
+				return nil, fmt.Errorf("modification %d (type %d) is not a %s modification", i, tMod.Type, target)
+			}
+		}
+		result, err := GetWitnessResult(nodeUrl, blockNum, trieModifications, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return result.Nodes, nil
+	case TargetWithdrawal:
+		return nil, fmt.Errorf("%w: %s (see GetWithdrawalProof for the raw proof)", ErrUnsupportedTarget, target)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedTarget, target)
+	}
+}
@@ -0,0 +1,44 @@
+package witness
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestGenerateWitnessFor(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	key := common.HexToHash("0x12")
+	accountLeaf, storageLeaf := singleSlotState(addr, key, common.HexToHash("0x17"))
+	setMemoryState(t, crypto.Keccak256Hash(accountLeaf), accountLeaf, storageLeaf)
+
+	tests := []struct {
+		target    WitnessTarget
+		tMod      TrieModification
+		proofType string
+	}{
+		{TargetState, NewAccountRead(addr), "NonceChanged"},
+		{TargetStorage, NewStorageChange(addr, key, common.HexToHash("0x2a")), "StorageChanged"},
+	}
+	for _, test := range tests {
+		nodes, err := GenerateWitnessFor(test.target, "", 1, []TrieModification{test.tMod})
+		if err != nil {
+			t.Fatalf("%s: %v", test.target, err)
+		}
+		if len(nodes) == 0 || nodes[0].Start == nil || nodes[0].Start.ProofType != test.proofType {
+			t.Fatalf("%s: expected %s witness", test.target, test.proofType)
+		}
+	}
+
+	// The modification of another trie:
+	if _, err := GenerateWitnessFor(TargetState, "", 1, []TrieModification{tests[1].tMod}); err == nil {
+		t.Fatal("expected an error for the storage modification with the state target")
+	}
+	for _, target := range []WitnessTarget{TargetTransaction, TargetReceipt, TargetWithdrawal, WitnessTarget(5)} {
+		if _, err := GenerateWitnessFor(target, "", 1, nil); !errors.Is(err, ErrUnsupportedTarget) {
+			t.Fatalf("%s: expected ErrUnsupportedTarget, got %v", target, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package witness
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AccountState is the state of an account as given by the execution trace.
+type AccountState struct {
+	Nonce    uint64
+	Balance  *big.Int
+	CodeHash common.Hash
+	Storage  map[common.Hash]common.Hash
+}
+
+// AccountDiff is the change of an account in a block. Before is nil for the account created
+// in the block, After is nil for the account destructed in the block. A storage slot that is set
+// in Before, but not in After, is cleared.
+type AccountDiff struct {
+	Address common.Address
+	Before  *AccountState
+	After   *AccountState
+}
+
+// StateDiff lists the accounts touched by a block (as given by debug_traceBlock with
+// the prestate tracer in the diff mode).
+type StateDiff []AccountDiff
+
+// GetWitnessFromTrace returns the chained witness of all the changes in the state diff
+// applied to the state after block blockNum.
+func GetWitnessFromTrace(nodeUrl string, blockNum int, trace StateDiff) ([]Node, error) {
+	result, err := GetWitnessResult(nodeUrl, blockNum, stateDiffModifications(trace))
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Nodes, nil
+}
+
+// stateDiffModifications translates the state diff into the modifications. The accounts are
+// created first (the storage modifications require the account to exist), then the account fields
+// and the storage slots (ordered by the key) are set and the destructed accounts are deleted.
+func stateDiffModifications(trace StateDiff) []TrieModification {
+	var trieModifications []TrieModification
+	for _, diff := range trace {
+		if diff.Before == nil && diff.After != nil {
+			trieModifications = append(trieModifications, NewAccountCreate(diff.Address))
+		}
+	}
+
+	var destructs []TrieModification
+	for _, diff := range trace {
+		if diff.After == nil {
+			if diff.Before != nil {
+				destructs = append(destructs, NewAccountDestruct(diff.Address))
+			}
+			continue
+		}
+		before := diff.Before
+		if before == nil {
+			before = &AccountState{}
+		}
+		after := diff.After
+
+		if after.Nonce != before.Nonce {
+			trieModifications = append(trieModifications, NewNonceChange(diff.Address, after.Nonce))
+		}
+		if after.Balance != nil && (before.Balance == nil || after.Balance.Cmp(before.Balance) != 0) {
+			trieModifications = append(trieModifications, NewBalanceChange(diff.Address, after.Balance))
+		}
+		if after.CodeHash != (common.Hash{}) && after.CodeHash != before.CodeHash {
+			trieModifications = append(trieModifications, NewCodeHashChange(diff.Address, after.CodeHash))
+		}
+
+		var keys []common.Hash
+		for key, value := range after.Storage {
+			if value != before.Storage[key] {
+				keys = append(keys, key)
+			}
+		}
+		for key := range before.Storage {
+			if _, ok := after.Storage[key]; !ok && before.Storage[key] != (common.Hash{}) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return bytes.Compare(keys[i].Bytes(), keys[j].Bytes()) < 0
+		})
+		for _, key := range keys {
+			trieModifications = append(trieModifications, NewStorageChange(diff.Address, key, after.Storage[key]))
+		}
+	}
+
+	return append(trieModifications, destructs...)
+}
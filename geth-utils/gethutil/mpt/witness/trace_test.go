@@ -0,0 +1,64 @@
+package witness
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestStateDiffModifications(t *testing.T) {
+	existing := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	created := common.HexToAddress("0xbbbccf12580138bc2bbceeeaa111df4e42ab81ff")
+	codeHash := common.HexToHash("0x0102")
+	trace := StateDiff{
+		{
+			Address: existing,
+			Before: &AccountState{
+				Nonce:   3,
+				Balance: big.NewInt(100),
+				Storage: map[common.Hash]common.Hash{
+					common.HexToHash("0x2"): common.HexToHash("0x5"),
+					common.HexToHash("0x1"): common.HexToHash("0x7"),
+				},
+			},
+			After: &AccountState{
+				Nonce:   4,
+				Balance: big.NewInt(100),
+				Storage: map[common.Hash]common.Hash{
+					common.HexToHash("0x2"): common.HexToHash("0x6"),
+				},
+			},
+		},
+		{
+			Address: created,
+			After: &AccountState{
+				Balance:  big.NewInt(1),
+				CodeHash: codeHash,
+				Storage: map[common.Hash]common.Hash{
+					common.HexToHash("0x3"): common.HexToHash("0x9"),
+				},
+			},
+		},
+	}
+
+	expected := []TrieModification{
+		NewAccountCreate(created),
+		NewNonceChange(existing, 4),
+		// The slot 0x1 is cleared:
+		NewStorageChange(existing, common.HexToHash("0x1"), common.Hash{}),
+		NewStorageChange(existing, common.HexToHash("0x2"), common.HexToHash("0x6")),
+		NewBalanceChange(created, big.NewInt(1)),
+		NewCodeHashChange(created, codeHash),
+		NewStorageChange(created, common.HexToHash("0x3"), common.HexToHash("0x9")),
+	}
+	if got := stateDiffModifications(trace); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got modifications\n%+v\nwant\n%+v", got, expected)
+	}
+
+	destructed := StateDiff{{Address: existing, Before: &AccountState{Nonce: 1}}}
+	if got := stateDiffModifications(destructed); !reflect.DeepEqual(got, []TrieModification{NewAccountDestruct(existing)}) {
+		t.Fatalf("got modifications %+v", got)
+	}
+}
@@ -1,37 +1,318 @@
 package witness
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"main/gethutil/mpt/oracle"
+	"main/gethutil/mpt/state"
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
+// check panics with err (when not nil) classified as ErrProofConvert, so that recoverWitnessError
+// reports it as *WitnessError. The classification of err (for example ErrUnsupportedShape or
+// oracle.FetchError) is kept.
 func check(err error) {
 	if err != nil {
-		log.Fatal(err)
+		panic(fmt.Errorf("%w: %w", ErrProofConvert, err))
+	}
+}
+
+// keccak is the hash function the witness code uses to derive the trie keys (hashed addresses and
+// storage keys), see SetKeccak.
+var keccak = defaultKeccak
+
+func defaultKeccak(data []byte) []byte {
+	return crypto.Keccak256(data)
+}
+
+// SetKeccak replaces the keccak256 implementation used by the witness generation (for example with
+// a hardware-accelerated or an instrumented one); nil restores the default crypto.Keccak256.
+// The implementation needs to give the same hashes as crypto.Keccak256, otherwise the keys do not
+// match the ones in the trie - use CheckKeccak to verify it.
+func SetKeccak(f func([]byte) []byte) {
+	if f == nil {
+		f = defaultKeccak
+	}
+	keccak = f
+}
+
+// CheckKeccak compares f against crypto.Keccak256 on inputs of different lengths (covering
+// the empty input and inputs around the keccak256 rate of 136 bytes).
+func CheckKeccak(f func([]byte) []byte) error {
+	for _, n := range []int{0, 1, 20, 32, 135, 136, 137, 300} {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		if !bytes.Equal(f(data), defaultKeccak(data)) {
+			return fmt.Errorf("keccak of %d bytes differs from crypto.Keccak256", n)
+		}
+	}
+
+	return nil
+}
+
+// hashStorageKey returns the path of the storage key in the storage trie. It needs to be the same
+// as the key derivation of the secure trie (keccak256 of the key) - unless hashing is disabled
+// for the special tests by oracle.PreventHashingInSecureTrie.
+func hashStorageKey(key common.Hash) []byte {
+	if oracle.PreventHashingInSecureTrie {
+		return key.Bytes()
+	}
+	return keccak(key.Bytes())
+}
+
+// keyCache memoizes the trie keys of a witness generation, a batch often modifies the same account
+// (or the same storage slot) many times. The keys depend on SetKeccak and oracle.PreventHashingInSecureTrie,
+// so the cache is not shared between the calls. A nil *keyCache computes the keys each time.
+// It also records the accounts and storage slots that have been prefetched in the witness generation,
+// see prefetchAccount.
+type keyCache struct {
+	addresses   map[common.Address][2][]byte
+	storageKeys map[common.Hash][]byte
+	accounts    map[common.Address]bool
+	slots       map[[2]common.Hash]bool
+}
+
+func newKeyCache() *keyCache {
+	return &keyCache{
+		addresses:   make(map[common.Address][2][]byte),
+		storageKeys: make(map[common.Hash][]byte),
+		accounts:    make(map[common.Address]bool),
+		slots:       make(map[[2]common.Hash]bool),
+	}
+}
+
+// prefetchAccount prefetches the account proof unless it has already been prefetched in the witness
+// generation: the proof is the proof of the block the state is opened at, the modifications applied
+// to the state since do not change it. The runs of modifications of the same account thus fetch
+// the account only once.
+func (c *keyCache) prefetchAccount(statedb *state.StateDB, addr common.Address) {
+	if c != nil {
+		if c.accounts[addr] {
+			return
+		}
+		c.accounts[addr] = true
+	}
+	oracle.PrefetchAccount(statedb.Db.BlockNumber, addr, nil)
+}
+
+// prefetchStorage prefetches the storage proof unless it has already been prefetched in the witness
+// generation (see prefetchAccount).
+func (c *keyCache) prefetchStorage(statedb *state.StateDB, addr common.Address, key common.Hash) {
+	if c != nil {
+		slot := [2]common.Hash{common.BytesToHash(addr.Bytes()), key}
+		if c.slots[slot] {
+			return
+		}
+		c.slots[slot] = true
+	}
+	oracle.PrefetchStorage(statedb.Db.BlockNumber, addr, key, nil)
+}
+
+// addressKey returns the hashed address and its nibbles (the path of the account in the state trie).
+// The returned slices are shared, they must not be modified.
+func (c *keyCache) addressKey(addr common.Address) (addrh, nibbles []byte) {
+	if c != nil {
+		if k, ok := c.addresses[addr]; ok {
+			return k[0], k[1]
+		}
+	}
+	addrh = keccak(addr.Bytes())
+	nibbles = trie.KeybytesToHex(addrh)
+	if c != nil {
+		c.addresses[addr] = [2][]byte{addrh, nibbles}
+	}
+
+	return addrh, nibbles
+}
+
+// storageKey returns the nibbles of the path of the storage key in the storage trie (see hashStorageKey).
+// The returned slice is shared, it must not be modified.
+func (c *keyCache) storageKey(key common.Hash) []byte {
+	if c != nil {
+		if nibbles, ok := c.storageKeys[key]; ok {
+			return nibbles
+		}
+	}
+	nibbles := trie.KeybytesToHex(hashStorageKey(key))
+	if c != nil {
+		c.storageKeys[key] = nibbles
+	}
+
+	return nibbles
+}
+
+// modificationStorageKey returns the nibbles of the path of the modified storage key: the nibbles of
+// HashedKey when the caller has set it, storageKey otherwise.
+func (c *keyCache) modificationStorageKey(tMod TrieModification) []byte {
+	if tMod.HashedKey != nil {
+		return trie.KeybytesToHex(tMod.HashedKey.Bytes())
+	}
+
+	return c.storageKey(tMod.Key)
+}
+
+// WitnessVersion is the version of the Node format, it is written to the witness files alongside
+// the nodes (see WitnessEnvelope). It needs to be increased when the format changes in a way
+// the consumers of the files need to know about.
+const WitnessVersion = 1
+
+// WitnessEnvelope is the content of the witness files: the nodes and the version of their format.
+type WitnessEnvelope struct {
+	Version int    `json:"version"`
+	Nodes   []Node `json:"nodes"`
+}
+
+// ErrUnknownWitnessVersion is returned when the witness file is not of WitnessVersion, for example
+// when it has been written by a newer witness generator.
+var ErrUnknownWitnessVersion = errors.New("unknown witness version")
+
+// decodeWitness reads the witness envelope and returns its nodes, ErrUnknownWitnessVersion is
+// returned when the envelope is not of WitnessVersion.
+func decodeWitness(r io.Reader) ([]Node, error) {
+	var envelope WitnessEnvelope
+	if err := json.NewDecoder(r).Decode(&envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Version != WitnessVersion {
+		return nil, fmt.Errorf("%w %d, expected %d", ErrUnknownWitnessVersion, envelope.Version, WitnessVersion)
+	}
+
+	return envelope.Nodes, nil
+}
+
+// CompressedWitnessExt is the file extension of the gzip-compressed witness JSON.
+const CompressedWitnessExt = ".json.gz"
+
+// StoreNodesCompressed writes the nodes as gzip-compressed JSON (the same JSON as StoreNodes writes)
+// to path, which needs to have the CompressedWitnessExt extension.
+func StoreNodesCompressed(path string, nodes []Node) error {
+	if !strings.HasSuffix(path, CompressedWitnessExt) {
+		return fmt.Errorf("compressed witness file %s needs to have %s extension", path, CompressedWitnessExt)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	zw.Name = strings.TrimSuffix(filepath.Base(path), ".gz")
+	if err := json.NewEncoder(zw).Encode(WitnessEnvelope{Version: WitnessVersion, Nodes: nodes}); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// LoadNodesCompressed reads the nodes written by StoreNodesCompressed, ErrUnknownWitnessVersion is
+// returned for the file of another version.
+func LoadNodesCompressed(path string) ([]Node, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
 	}
+	defer zr.Close()
+
+	return decodeWitness(zr)
 }
 
+// makeRows returns n zeroed rows of valueLen bytes. The rows share one backing array (a single
+// allocation instead of n), each row is capped to its length so appending to it does not overwrite
+// the next row. The returned slice has room for extra more rows to be appended.
+func makeRows(n, extra int) [][]byte {
+	buf := make([]byte, n*valueLen)
+	rows := make([][]byte, n, n+extra)
+	for i := range rows {
+		rows[i] = buf[i*valueLen : (i+1)*valueLen : (i+1)*valueLen]
+	}
+
+	return rows
+}
+
+// defaultWitnessesDir is where StoreNodes puts the witnesses (relative to the witness package,
+// the circuit tests read them from there).
+const defaultWitnessesDir = "../generated_witnesses"
+
+// StoreNodes writes the nodes into the witnesses directory of the circuit tests, see StoreNodesTo.
+// It panics with the error of StoreNodesTo (not classified as a witness generation failure).
 func StoreNodes(testName string, nodes []Node) {
-	name := testName + ".json"
-	path := "../generated_witnesses/" + name
+	if _, err := StoreNodesTo(defaultWitnessesDir, testName, nodes); err != nil {
+		panic(err)
+	}
+}
+
+// ErrUnsafeTestName is returned by StoreNodesTo when the test name is not a plain file name:
+// it is empty, contains a path separator or is "." or "..".
+var ErrUnsafeTestName = errors.New("test name is not a plain file name")
+
+// checkTestName returns ErrUnsafeTestName when the file named after the test would not be
+// directly in the witnesses directory.
+func checkTestName(testName string) error {
+	if testName == "" || testName == "." || testName == ".." || strings.ContainsAny(testName, `/\`) ||
+		!filepath.IsLocal(testName+".json") {
+		return fmt.Errorf("%w: %q", ErrUnsafeTestName, testName)
+	}
+
+	return nil
+}
+
+// StoreNodesTo writes the nodes as JSON (in WitnessEnvelope of WitnessVersion) to the file
+// testName.json in dir (the directory is created if it does not exist yet). It returns the path
+// of the written file. The test name needs to be a plain file name (see ErrUnsafeTestName).
+func StoreNodesTo(dir, testName string, nodes []Node) (string, error) {
+	if err := checkTestName(testName); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, testName+".json")
 
 	// Create the directories if they do not exist yet
-	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	b, err := json.MarshalIndent(WitnessEnvelope{Version: WitnessVersion, Nodes: nodes}, "", "    ")
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
-	f, err := os.Create(path)
-	check(err)
-	defer f.Close()
-	b, err := json.MarshalIndent(nodes, "", "    ")
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// LoadNodes reads the nodes written by StoreNodesTo, ErrUnknownWitnessVersion is returned for
+// the file of another version.
+func LoadNodes(path string) ([]Node, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
+	defer f.Close()
 
-	_, err = f.WriteString(string(b))
-	check(err)
+	return decodeWitness(f)
 }
@@ -0,0 +1,223 @@
+package witness
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"main/gethutil/mpt/oracle"
+	"main/gethutil/mpt/trie"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestHashStorageKey(t *testing.T) {
+	// Secure trie keys of the first storage slots as derived by go-ethereum (keccak256 of the
+	// 32-byte slot):
+	slots := map[common.Hash]common.Hash{
+		common.HexToHash("0x0"): common.HexToHash("0x290decd9548b62a8d60345a988386fc84ba6bc95484008f6362f93160ef3e563"),
+		common.HexToHash("0x1"): common.HexToHash("0xb10e2d527612073b26eecdfd717e6a320cf44b4afac2b0732d9fcbe2b7fa0cf6"),
+		common.HexToHash("0x2"): common.HexToHash("0x405787fa12a823e0f2b7631cc41b3ba8828b3321ca811111fa75cd3aa3bb5ace"),
+	}
+	for slot, expected := range slots {
+		if !bytes.Equal(hashStorageKey(slot), expected.Bytes()) {
+			t.Fatalf("wrong secure trie key for slot %s: %x", slot, hashStorageKey(slot))
+		}
+	}
+}
+
+func TestHashStorageKeyPreventHashing(t *testing.T) {
+	oracle.PreventHashingInSecureTrie = true
+	defer func() { oracle.PreventHashingInSecureTrie = false }()
+
+	slot := common.HexToHash("0x12")
+	if !bytes.Equal(hashStorageKey(slot), slot.Bytes()) {
+		t.Fatalf("key should not be hashed: %x", hashStorageKey(slot))
+	}
+}
+
+func TestSetKeccak(t *testing.T) {
+	calls := 0
+	counting := func(data []byte) []byte {
+		calls++
+		return crypto.Keccak256(data)
+	}
+	if err := CheckKeccak(counting); err != nil {
+		t.Fatal(err)
+	}
+	SetKeccak(counting)
+	defer SetKeccak(nil)
+
+	calls = 0
+	slot := common.HexToHash("0x0")
+	expected := common.HexToHash("0x290decd9548b62a8d60345a988386fc84ba6bc95484008f6362f93160ef3e563")
+	if !bytes.Equal(hashStorageKey(slot), expected.Bytes()) {
+		t.Fatalf("wrong secure trie key: %x", hashStorageKey(slot))
+	}
+	if calls != 1 {
+		t.Fatalf("injected keccak called %d times, want 1", calls)
+	}
+
+	wrong := func(data []byte) []byte {
+		h := sha256.Sum256(data)
+		return h[:]
+	}
+	if err := CheckKeccak(wrong); err == nil {
+		t.Fatal("sha256 should not pass as keccak256")
+	}
+}
+
+func TestStoreNodesTo(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "witnesses")
+	sRoot := common.HexToHash("0x1")
+	cRoot := common.HexToHash("0x2")
+	nodes := []Node{GetStartNode("StorageChanged", sRoot, cRoot, 0), GetEndNode()}
+
+	path, err := StoreNodesTo(dir, "StoreNodesTo", nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "StoreNodesTo.json") {
+		t.Fatalf("unexpected path: %s", path)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored struct {
+		Version int `json:"version"`
+		Nodes   []struct {
+			Start *StartNode `json:"start"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal(b, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != WitnessVersion {
+		t.Fatalf("got version %d, want %d", stored.Version, WitnessVersion)
+	}
+	if len(stored.Nodes) != len(nodes) {
+		t.Fatalf("got %d nodes, want %d", len(stored.Nodes), len(nodes))
+	}
+	if stored.Nodes[0].Start == nil || stored.Nodes[0].Start.ProofType != "StorageChanged" {
+		t.Fatalf("start node not stored: %+v", stored.Nodes[0].Start)
+	}
+}
+
+// LoadNodes reads the file of the current version, the files of an older or a newer version
+// are rejected.
+func TestLoadNodesVersion(t *testing.T) {
+	dir := t.TempDir()
+	nodes := []Node{GetStartNode("StorageChanged", common.HexToHash("0x1"), common.HexToHash("0x2"), 0), GetEndNode()}
+	path, err := StoreNodesTo(dir, "LoadNodesVersion", nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadNodes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(nodes) || loaded[0].Start == nil || loaded[0].Start.ProofType != "StorageChanged" {
+		t.Fatalf("wrong nodes loaded: %+v", loaded)
+	}
+
+	for _, version := range []int{WitnessVersion - 1, WitnessVersion + 1} {
+		b, err := json.Marshal(WitnessEnvelope{Version: version, Nodes: nodes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "other.json")
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadNodes(path); !errors.Is(err, ErrUnknownWitnessVersion) {
+			t.Fatalf("version %d: expected ErrUnknownWitnessVersion, got %v", version, err)
+		}
+	}
+}
+
+func TestMakeRows(t *testing.T) {
+	rows := makeRows(3, 2)
+	if len(rows) != 3 || cap(rows) != 5 {
+		t.Fatalf("wrong number of rows: len %d, cap %d", len(rows), cap(rows))
+	}
+	// Appending to a row must not overwrite the next one:
+	rows[0] = append(rows[0], 7)
+	if len(rows[1]) != valueLen || rows[1][0] != 0 {
+		t.Fatalf("row 1 modified: %v", rows[1])
+	}
+}
+
+func TestStoreNodesCompressedRoundTrip(t *testing.T) {
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+	addrh := crypto.Keccak256(addr.Bytes())
+	branchS := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xaa"), 10: common.HexToHash("0xcc")})
+	branchC := makeBranch(t, map[int]common.Hash{3: common.HexToHash("0xbb"), 10: common.HexToHash("0xcc")})
+	leafS := makeAccountLeaf(t, addrh, 1, 1, big.NewInt(5))
+	leafC := makeAccountLeaf(t, addrh, 1, 2, big.NewInt(5))
+	nodes := []Node{
+		GetStartNode("NonceChanged", common.HexToHash("0x01"), common.HexToHash("0x02"), 0),
+		prepareBranchNode(branchS, branchC, nil, nil, nil, makeRows(4, 0), 3, 3, false, false, false),
+		prepareAccountLeafNode(addr, addrh, leafS, leafC, nil, trie.KeybytesToHex(addrh), false, false, false, AccountLayoutCurrent),
+		GetEndNode(),
+	}
+
+	path := filepath.Join(t.TempDir(), "witness"+CompressedWitnessExt)
+	if err := StoreNodesCompressed(path, nodes); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadNodesCompressed(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := json.Marshal(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("loaded nodes differ:\n%s\n%s", got, expected)
+	}
+
+	if err := StoreNodesCompressed(filepath.Join(t.TempDir(), "witness.json"), nodes); err == nil {
+		t.Fatal("expected error for a file without the compressed witness extension")
+	}
+}
+
+func TestStoreNodesToUnsafeName(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "witnesses")
+	nodes := []Node{GetStartNode("StorageChanged", common.HexToHash("0x1"), common.HexToHash("0x2"), 0), GetEndNode()}
+	for _, name := range []string{"../evil", "..", "", "a/b", `a\b`, "/tmp/evil"} {
+		if _, err := StoreNodesTo(dir, name, nodes); !errors.Is(err, ErrUnsafeTestName) {
+			t.Fatalf("%q: expected ErrUnsafeTestName, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "..", "evil.json")); !os.IsNotExist(err) {
+		t.Fatalf("the file outside of the directory has been written: %v", err)
+	}
+}
+
+// The file system errors are returned as they are, they are not witness generation failures.
+func TestStoreNodesToFileSystemError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "witnesses")
+	if err := os.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	nodes := []Node{GetStartNode("StorageChanged", common.HexToHash("0x1"), common.HexToHash("0x2"), 0), GetEndNode()}
+	_, err := StoreNodesTo(dir, "FileSystemError", nodes)
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || errors.Is(err, ErrProofConvert) {
+		t.Fatalf("expected the unclassified path error, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package witness
+
+import (
+	"bytes"
+	"fmt"
+
+	"main/gethutil/mpt/trie"
+	"main/gethutil/mpt/types"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// GetWithdrawalProof returns the root of the trie of the withdrawals (as computed by types.DeriveSha,
+// the withdrawals root of the block header) and the proof of the withdrawal at index. The key of
+// the withdrawal is the RLP of its index, see types.IndexKey.
+// The proof is not converted into the witness nodes: the leaf rows of the witness hold the 32-byte
+// keys (hashed addresses and storage keys) and the values of up to 32 bytes.
+func GetWithdrawalProof(withdrawals types.DerivableList, index int) (common.Hash, [][]byte, error) {
+	if index < 0 || index >= withdrawals.Len() {
+		return common.Hash{}, nil, fmt.Errorf("withdrawal index %d out of range [0, %d)", index, withdrawals.Len())
+	}
+
+	tr, err := trie.New(common.Hash{}, &trie.Database{})
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+	var buf bytes.Buffer
+	for _, i := range types.DeriveOrder(withdrawals.Len()) {
+		if err := tr.TryUpdate(types.IndexKey(i), types.EncodeForDerive(withdrawals, i, &buf)); err != nil {
+			return common.Hash{}, nil, err
+		}
+	}
+
+	var proof [][]byte
+	err = tr.ProveEach(types.IndexKey(index), func(level int, proofEl []byte) error {
+		proof = append(proof, common.CopyBytes(proofEl))
+		return nil
+	})
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+
+	return tr.Hash(), proof, nil
+}
@@ -0,0 +1,60 @@
+package witness
+
+import (
+	"bytes"
+	"testing"
+
+	"main/gethutil/mpt/trie"
+	"main/gethutil/mpt/types"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// testWithdrawals is the list of n withdrawals, each encoded as the RLP of its index and amount.
+type testWithdrawals int
+
+func (w testWithdrawals) Len() int { return int(w) }
+
+func (w testWithdrawals) EncodeIndex(i int, buf *bytes.Buffer) {
+	rlp.Encode(buf, []uint64{uint64(i), uint64(1000 + i)})
+}
+
+// The key of the withdrawal is the RLP of the index, the proof under that key gives the withdrawal
+// (at the boundaries of the single-byte encoding too).
+func TestGetWithdrawalProof(t *testing.T) {
+	withdrawals := testWithdrawals(130)
+	expectedRoot := types.DeriveSha(withdrawals, trie.NewStackTrie(nil))
+
+	for index, key := range map[int][]byte{0: {0x80}, 1: {0x01}, 127: {0x7f}, 128: {0x81, 0x80}} {
+		if !bytes.Equal(types.IndexKey(index), key) {
+			t.Fatalf("index %d: key %x, want %x", index, types.IndexKey(index), key)
+		}
+		root, proof, err := GetWithdrawalProof(withdrawals, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root != expectedRoot {
+			t.Fatalf("index %d: root %s, DeriveSha %s", index, root, expectedRoot)
+		}
+
+		proofDb := memorydb.New()
+		for _, proofEl := range proof {
+			proofDb.Put(crypto.Keccak256(proofEl), proofEl)
+		}
+		value, err := trie.VerifyProof(root, key, proofDb)
+		if err != nil {
+			t.Fatalf("index %d: %v", index, err)
+		}
+		var expected bytes.Buffer
+		withdrawals.EncodeIndex(index, &expected)
+		if !bytes.Equal(value, expected.Bytes()) {
+			t.Fatalf("index %d: proven value %x, want %x", index, value, expected.Bytes())
+		}
+	}
+
+	if _, _, err := GetWithdrawalProof(withdrawals, 130); err == nil {
+		t.Fatal("expected error for the index out of range")
+	}
+}
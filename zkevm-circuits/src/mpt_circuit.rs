@@ -10,6 +10,7 @@ use halo2_proofs::{
     poly::Rotation,
 };
 
+use serde::Deserialize;
 use std::{convert::TryInto, env::var, io::Read, marker::PhantomData};
 
 mod account_leaf;
@@ -733,9 +734,41 @@ impl<F: Field> Circuit<F> for MPTCircuit<F> {
     }
 }
 
-/// Loads an MPT proof from reader
+/// The version of the witness files written by the witness generator (`WitnessVersion` in
+/// geth-utils).
+pub const WITNESS_VERSION: u64 = 1;
+
+/// The versioned witness file: the nodes with the version of their format.
+#[derive(Deserialize)]
+struct WitnessEnvelope {
+    version: u64,
+    nodes: Vec<Node>,
+}
+
+/// Loads an MPT proof from reader, the proof of an unknown witness version is rejected.
+/// The witness file is either the envelope with the version (a JSON object) or the nodes only
+/// (a JSON array, as returned by the witness generator and as in the files written before the
+/// version was added). The top-level JSON type picks the format, so that the errors in the nodes
+/// are reported as such.
 pub fn load_proof<R: Read>(reader: R) -> Result<Vec<Node>, serde_json::Error> {
-    let mut nodes: Vec<Node> = serde_json::from_reader(reader)?;
+    let mut nodes = match serde_json::from_reader::<_, serde_json::Value>(reader)? {
+        value @ serde_json::Value::Object(_) => {
+            let envelope: WitnessEnvelope = serde_json::from_value(value)?;
+            if envelope.version != WITNESS_VERSION {
+                return Err(serde::de::Error::custom(format!(
+                    "unknown witness version {}, expected {}",
+                    envelope.version, WITNESS_VERSION
+                )));
+            }
+            envelope.nodes
+        }
+        value @ serde_json::Value::Array(_) => serde_json::from_value(value)?,
+        _ => {
+            return Err(serde::de::Error::custom(
+                "expected the witness envelope (an object) or the nodes (an array)",
+            ))
+        }
+    };
 
     // Add the address and the key to the list of values in the Account and Storage nodes
     for node in nodes.iter_mut() {
@@ -783,6 +816,22 @@ mod tests {
             });
     }
 
+    #[test]
+    fn load_proof_errors() {
+        let err = load_proof(r#"{"version": 999, "nodes": []}"#.as_bytes()).unwrap_err();
+        assert!(err.to_string().contains("unknown witness version 999"));
+        // The error in the nodes is reported, not the mismatch of the formats:
+        for json in [
+            r#"{"version": 1, "nodes": [{"values": 7}]}"#,
+            r#"[{"values": 7}]"#,
+        ] {
+            let err = load_proof(json.as_bytes()).unwrap_err().to_string();
+            assert!(!err.contains("did not match any variant"), "{}", err);
+        }
+        assert!(load_proof("7".as_bytes()).is_err());
+        assert!(load_proof("[]".as_bytes()).unwrap().is_empty());
+    }
+
     #[test]
     fn variadic_size_check() {
         let mut circuits = get_witnesses();